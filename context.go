@@ -1,8 +1,20 @@
 package modulir
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,27 +34,71 @@ import (
 
 // Args are the set of arguments accepted by NewContext.
 type Args struct {
-	Concurrency int
-	Log         LoggerInterface
-	LogColor    bool
-	Pool        *Pool
-	Port        int
-	SourceDir   string
-	TargetDir   string
-	Watcher     *fsnotify.Watcher
-	Websocket   bool
+	BuildCache   *BuildCache
+	Concurrency  int
+	Draft        bool
+	FS           fs.FS
+	Gzip         bool
+	HashContent  bool
+	Log          LoggerInterface
+	LogColor     bool
+	Pool         *Pool
+	Pools        map[string]*Pool
+	Port         int
+	Production   bool
+	SourceDir    string
+	TargetDir    string
+	TraceChanges bool
+	WatchIgnore  []string
+	Watcher      *fsnotify.Watcher
+	Websocket    bool
 }
 
+// RenderFunc renders a single source file and returns its output. See
+// Context.RegisterRenderer.
+type RenderFunc func(c *Context, source string) ([]byte, error)
+
 // Context contains useful state that can be used by a user-provided build
 // function.
 type Context struct {
+	// BuildCache is a manifest of built targets and the contents of the
+	// sources they were built from that's persisted between runs. When set,
+	// ChangedTarget consults it so that targets whose sources are unchanged
+	// aren't rebuilt on a cold start. See BuildCache for details.
+	//
+	// Defaults to nil, which disables the cache. It's set by Build and
+	// BuildLoop if Config.BuildCachePath is.
+	BuildCache *BuildCache
+
 	// Concurrency is the number of concurrent workers to run during the build
 	// step.
 	Concurrency int
 
+	// Draft indicates that a fast, lower-fidelity build is wanted, like for
+	// a quick preview. Expensive steps that don't change a site's content are
+	// skipped:
+	//
+	//   - CreateTarget doesn't write gzipped siblings even if Gzip is set.
+	//   - mimage doesn't pass resized images through optimizers like mozjpeg
+	//     or pngquant, and doesn't write markers so that images are fully
+	//     processed by the next non-draft build.
+	//   - mmarkdownext doesn't give images a Retina srcset. It doesn't have
+	//     access to the context, so set its RenderOptions.Draft from this.
+	//
+	// Defaults to false.
+	Draft bool
+
 	// FirstRun indicates whether this is the first run of the build loop.
 	FirstRun bool
 
+	// FS is a filesystem from which source content is read by helpers like
+	// ReadFile and ReadDir (and modules that use them). It allows content to
+	// be embedded in a binary or kept in memory for testing. Paths are
+	// interpreted relative to the root of the filesystem.
+	//
+	// Defaults to nil, which reads from the operating system's filesystem.
+	FS fs.FS
+
 	// Forced causes the Changed function to always return true regardless of
 	// the path it's invoked on, thereby prompting all jobs that use it to
 	// execute.
@@ -50,6 +106,23 @@ type Context struct {
 	// Make sure to unset it after your build run is finished.
 	Forced bool
 
+	// Gzip causes files created with CreateTarget (and modules that use it,
+	// like mace.RenderFile, mmarkdown.RenderFile, and mfile.CopyFile) to also
+	// be written as a gzipped sibling with a ".gz" suffix, which is useful for
+	// hosts that can serve precompressed content.
+	//
+	// Defaults to false.
+	Gzip bool
+
+	// HashContent causes Changed to compare a SHA-256 hash of a file's
+	// contents when its modified time has changed before declaring it changed.
+	// This avoids false rebuilds when tools like Git or rsync rewrite files
+	// with identical content, but is more expensive because changed files
+	// have to be read.
+	//
+	// Defaults to false, which compares modified times only.
+	HashContent bool
+
 	// Jobs is a channel over which jobs to be done are transmitted.
 	Jobs chan *Job
 
@@ -61,12 +134,24 @@ type Context struct {
 	LogColor bool
 
 	// Pool is the job pool used to build the static site.
+	//
+	// Additional named pools with their own concurrency may be managed by the
+	// context as well. See AddPool and PoolFor.
 	Pool *Pool
 
 	// Port specifies the port on which to serve content from TargetDir over
 	// HTTP.
 	Port int
 
+	// Production indicates that the build is one for production rather than
+	// for previewing in development. Content helpers like
+	// mcontent.FilterDrafts use it to exclude drafts from production builds
+	// while still including them in development so that they can be
+	// previewed.
+	//
+	// Defaults to false.
+	Production bool
+
 	// QuickPaths are a set of paths for which Changed will return true when
 	// the context is in "quick rebuild mode". During this time all the normal
 	// file system checks that Changed makes will be bypassed to enable a
@@ -89,6 +174,23 @@ type Context struct {
 	// TargetDir is the directory where the site will be built to.
 	TargetDir string
 
+	// TraceChanges causes every decision made by Changed to be logged at
+	// informational level along with the reason for it (e.g. a new file, an
+	// advanced modified time, or unchanged contents), which helps track down
+	// files that are rebuilt when they shouldn't be or vice versa.
+	//
+	// Defaults to false.
+	TraceChanges bool
+
+	// WatchIgnore is a set of glob patterns (as used by filepath.Match) for
+	// paths whose changes shouldn't trigger a rebuild. Patterns are matched
+	// against every element of a path relative to SourceDir (so that a
+	// pattern like `node_modules` ignores everything beneath it), and patterns
+	// containing a slash against the relative path itself. Patterns from a
+	// `.gitignore` in SourceDir are included automatically, and changes
+	// within TargetDir are always ignored.
+	WatchIgnore []string
+
 	// Watcher is a file system watcher that picks up changes to source files
 	// and restarts the build loop.
 	Watcher *fsnotify.Watcher
@@ -99,40 +201,105 @@ type Context struct {
 	// Defaults to false.
 	Websocket bool
 
+	// buildCompleteEvent is the type of websocket event sent to clients when
+	// a build completes (see websocketEvent). It's set by the build loop just
+	// before it broadcasts on its build complete condition variable, and is
+	// guarded by that variable's lock.
+	buildCompleteEvent string
+
 	// Helper for producing rich colors and styles to the log.
 	colorizer *colorizer
 
+	// dependencies is the graph of outputs and the inputs they're built from
+	// as declared with DependsOn. It's shared with sub-contexts.
+	dependencies *dependencyGraph
+
 	// fileModTimeCache remembers the last modified times of files.
 	fileModTimeCache *fileModTimeCache
 
+	// pools are named job pools in addition to the main Pool. Their rounds
+	// are started and waited on alongside the main pool's.
+	pools map[string]*Pool
+
+	// poolsMu synchronizes concurrent access to pools. It's a pointer so that
+	// it can be shared with sub-contexts.
+	poolsMu *sync.RWMutex
+
+	// rebuildPauser tracks whether rebuilds triggered by the watcher are
+	// paused. It's shared between the HTTP server, which pauses and resumes
+	// rebuilds, and the loop watching for changes.
+	rebuildPauser *rebuildPauser
+
+	// round holds the context of the current round, which is canceled when
+	// the next round starts or the build loop is torn down. It's shared with
+	// sub-contexts.
+	round *contextRound
+
+	// renderers are functions registered with RegisterRenderer to render
+	// source files, keyed by file extension.
+	renderers map[string]RenderFunc
+
+	// renderersMu synchronizes concurrent access to renderers. It's a pointer
+	// so that it can be shared with sub-contexts.
+	renderersMu *sync.RWMutex
+
+	// watchEventSubscribers are channels returned by WatchEvents that are sent
+	// changes detected by the watcher. It's shared with sub-contexts.
+	watchEventSubscribers *watchEventSubscribers
+
 	// watchedPaths are the set of paths that we're currently watching. This
 	// information is tracked internally by fsnotify as well, but we track it here
 	// as well to help with debugging (for "too many open files" problems and the
 	// like).
 	watchedPaths map[string]struct{}
 
-	// watchedPathsMu synchronizes concurrent access to watchedPaths.
-	watchedPathsMu sync.RWMutex
+	// watchedRecursiveRoots are the absolute paths of directories passed to
+	// WatchRecursive, beneath which newly created directories are watched.
+	// It's guarded by watchedPathsMu.
+	watchedRecursiveRoots map[string]struct{}
+
+	// watchedPathsMu synchronizes concurrent access to watchedPaths. It's a
+	// pointer so that it can be shared with sub-contexts.
+	watchedPathsMu *sync.RWMutex
 }
 
 // NewContext initializes and returns a new Context.
 func NewContext(args *Args) *Context {
 	c := &Context{
-		Concurrency: args.Concurrency,
-		FirstRun:    true,
-		Log:         args.Log,
-		LogColor:    args.LogColor,
-		Pool:        args.Pool,
-		Port:        args.Port,
-		SourceDir:   args.SourceDir,
-		Stats:       &Stats{},
-		TargetDir:   args.TargetDir,
-		Watcher:     args.Watcher,
-		Websocket:   args.Websocket,
+		BuildCache:   args.BuildCache,
+		Concurrency:  args.Concurrency,
+		Draft:        args.Draft,
+		FS:           args.FS,
+		FirstRun:     true,
+		Gzip:         args.Gzip,
+		HashContent:  args.HashContent,
+		Log:          args.Log,
+		LogColor:     args.LogColor,
+		Pool:         args.Pool,
+		Port:         args.Port,
+		Production:   args.Production,
+		SourceDir:    args.SourceDir,
+		Stats:        &Stats{},
+		TargetDir:    args.TargetDir,
+		TraceChanges: args.TraceChanges,
+		WatchIgnore:  args.WatchIgnore,
+		Watcher:      args.Watcher,
+		Websocket:    args.Websocket,
 
 		colorizer:        &colorizer{LogColor: args.LogColor},
+		dependencies:     newDependencyGraph(),
 		fileModTimeCache: newFileModTimeCache(args.Log),
+		pools:            make(map[string]*Pool),
+		poolsMu:          &sync.RWMutex{},
+		rebuildPauser:    newRebuildPauser(),
+		renderers:        make(map[string]RenderFunc),
+		round:            &contextRound{},
+		renderersMu:      &sync.RWMutex{},
 		watchedPaths:     make(map[string]struct{}),
+		watchedPathsMu:   &sync.RWMutex{},
+
+		watchEventSubscribers: &watchEventSubscribers{},
+		watchedRecursiveRoots: make(map[string]struct{}),
 	}
 
 	if args.Pool != nil {
@@ -140,12 +307,113 @@ func NewContext(args *Args) *Context {
 		c.Jobs = args.Pool.Jobs
 	}
 
+	for name, pool := range args.Pools {
+		pool.colorizer = c.colorizer
+		c.pools[name] = pool
+	}
+
 	return c
 }
 
 // AddJob is a shortcut for adding a new job to the Jobs channel.
 func (c *Context) AddJob(name string, f func() (bool, error)) {
-	c.Jobs <- NewJob(name, f)
+	// Go through the pool rather than c.Jobs so that sub-contexts, whose Jobs
+	// aren't updated when a parent starts a new round, always enqueue to the
+	// current round.
+	c.Pool.Jobs <- NewJob(name, f)
+}
+
+// AddAlwaysJob adds a new job that runs on every build regardless of whether
+// anything has changed, like one that writes a build timestamp. It's passed a
+// copy of the context with Forced set, so change detection helpers like
+// Changed and ChangedTarget (and modules that use them) always report changes
+// within it. Like any other job, it should return true to signal that it did
+// work, and it participates in the pool's statistics and error handling.
+func (c *Context) AddAlwaysJob(name string, f func(c *Context) (bool, error)) {
+	forced := c.Sub("", "")
+	forced.Forced = true
+
+	c.AddJob(name, func() (bool, error) {
+		return f(forced)
+	})
+}
+
+// AddCommandJob is a shortcut for adding a new job that runs an external
+// command (like esbuild or sass), but only if any of changedPaths have changed
+// (see ChangedAny) or the context is forced. Note that this means that a job
+// with no changedPaths only runs when forced.
+//
+// The command's combined standard output and error are included in the job's
+// error if it fails.
+func (c *Context) AddCommandJob(name string, changedPaths []string, cmd string, args ...string) {
+	c.AddJob(name, func() (bool, error) {
+		if !c.ChangedAny(changedPaths...) {
+			return false, nil
+		}
+
+		var out bytes.Buffer
+		command := exec.Command(cmd, args...)
+		command.Stdout = &out
+		command.Stderr = &out
+
+		if err := command.Run(); err != nil {
+			return true, xerrors.Errorf("error running command '%s': %w; output: %s",
+				strings.Join(append([]string{cmd}, args...), " "), err,
+				strings.TrimSpace(out.String()))
+		}
+
+		c.Log.Debugf("Ran command '%s': %s", cmd, strings.TrimSpace(out.String()))
+		return true, nil
+	})
+}
+
+// AddPool adds a named job pool running at the given concurrency, which can be
+// retrieved afterwards with PoolFor. Named pools are useful for separating
+// workloads that have different optimal concurrency, like CPU-bound rendering
+// and IO-bound fetching.
+//
+// The pool's rounds are started and waited on along with the context's main
+// Pool. If the main pool already has a round in progress, the new pool starts
+// its round immediately so that it can accept jobs right away.
+//
+// Panics if a pool with the same name was already added.
+func (c *Context) AddPool(name string, concurrency int) *Pool {
+	pool := NewPool(c.Log, concurrency)
+	pool.colorizer = c.colorizer
+
+	c.poolsMu.Lock()
+	defer c.poolsMu.Unlock()
+
+	if _, ok := c.pools[name]; ok {
+		panic(xerrors.Errorf("pool already added: %s", name))
+	}
+
+	if c.Pool != nil && c.Pool.roundStarted {
+		pool.StartRound(c.Pool.roundNum)
+	}
+
+	c.pools[name] = pool
+	return pool
+}
+
+// PoolFor returns the named job pool previously added with AddPool, or the
+// main Pool if name is empty.
+//
+// Panics if no pool with the given name exists.
+func (c *Context) PoolFor(name string) *Pool {
+	if name == "" {
+		return c.Pool
+	}
+
+	c.poolsMu.RLock()
+	pool, ok := c.pools[name]
+	c.poolsMu.RUnlock()
+
+	if !ok {
+		panic(xerrors.Errorf("no pool named: %s", name))
+	}
+
+	return pool
 }
 
 // AllowError is a helper that's useful for when an error coming back from a
@@ -165,9 +433,12 @@ func (c *Context) AllowError(executed bool, err error) bool {
 // many times for every single job in a build loop. It needs to be optimized
 // fairly carefully for both speed and lack of contention when running
 // concurrently with other jobs.
+//
+// If TraceChanges is set, each decision is logged along with its reason.
 func (c *Context) Changed(path string) bool {
 	// Always return immediately if the context has been forced.
 	if c.Forced {
+		c.traceChanged(path, true, changeReasonForced)
 		return true
 	}
 
@@ -181,6 +452,11 @@ func (c *Context) Changed(path string) bool {
 	// Short circuit quickly if the context is in "quick rebuild mode".
 	if c.QuickPaths != nil {
 		_, ok := c.QuickPaths[path]
+		if ok {
+			c.traceChanged(path, true, changeReasonQuickPath)
+		} else {
+			c.traceChanged(path, false, changeReasonNotQuickPath)
+		}
 		return ok
 	}
 
@@ -189,10 +465,12 @@ func (c *Context) Changed(path string) bool {
 		if !os.IsNotExist(err) {
 			c.Log.Errorf("Path passed to Changed doesn't exist: %s", path)
 		}
+		c.traceChanged(path, true, changeReasonMissing)
 		return true
 	}
 
-	changed, ok := c.fileModTimeCache.isFileUpdated(fileInfo, path)
+	changed, ok, reason := c.fileModTimeCache.isFileUpdated(fileInfo, path, c.HashContent)
+	c.traceChanged(path, changed, reason)
 
 	// If we got ok back, then we know the file was in the cache and also
 	// therefore would've been already watched. Return as early as possible.
@@ -211,7 +489,9 @@ func (c *Context) Changed(path string) bool {
 		}
 	}
 
-	return true
+	// Usually true, but may be false for files whose records were loaded from
+	// disk and that are unchanged since.
+	return changed
 }
 
 // ChangedAny is the same as Changed except it returns true if any of the given
@@ -231,6 +511,191 @@ func (c *Context) ChangedAny(paths ...string) bool {
 	return changed
 }
 
+// ChangedTarget is the same as ChangedAny on the given sources, except that it
+// also returns true if the target path doesn't exist, regardless of whether
+// any sources changed. Use it to guard jobs that render or copy sources to a
+// target so that a target that was deleted (e.g. from TargetDir) is
+// regenerated without having to touch its sources.
+//
+// If BuildCache is set, a target whose sources appear to have changed is
+// still considered unchanged if it exists and the contents of its sources are
+// the same as when it was last written with CreateTarget, even by a previous
+// run of the program.
+func (c *Context) ChangedTarget(target string, sources ...string) bool {
+	// Sources are always checked, even if the target is missing, so that
+	// they're added to the file mod time cache and watched.
+	changed := c.ChangedAny(sources...)
+
+	_, err := os.Stat(target)
+	if err != nil && !os.IsNotExist(err) {
+		c.Log.Errorf("Error checking target: %v", err)
+	}
+	targetExists := err == nil
+
+	if !changed && targetExists {
+		return false
+	}
+
+	// Consulting the build cache requires hashing every source, so it's only
+	// done once a cheaper check has come up positive. This also stages the
+	// sources' hashes to be recorded once the target is written.
+	if c.BuildCache != nil && !c.Forced && len(sources) > 0 {
+		if c.BuildCache.check(target, sources) && targetExists {
+			c.Log.Debugf("Target up to date according to build cache: %s", target)
+			return false
+		}
+	}
+
+	return true
+}
+
+// CreateTarget creates (or truncates) the named target file and returns a
+// writer to it. If Gzip is set (and Draft isn't), everything written is also
+// compressed into a sibling file with a ".gz" suffix.
+//
+// Once the target's been written in full, Commit should be called to close it.
+// Because that flushes any compressed data, its error should be checked. If
+// BuildCache is set, the target is recorded in it only once it's committed, so
+// a target that was only partly written isn't considered up to date by a
+// future run. Close can be deferred to clean up on error paths.
+func (c *Context) CreateTarget(name string) (*TargetFile, error) {
+	writer, err := c.createTarget(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TargetFile{
+		buildCache: c.BuildCache,
+		target:     name,
+		writer:     writer,
+	}, nil
+}
+
+// TargetFile is a target file created by CreateTarget.
+type TargetFile struct {
+	buildCache *BuildCache
+	closed     bool
+	failed     bool
+	target     string
+	writer     io.WriteCloser
+}
+
+// Close closes the target without marking it as written in full, so it's not
+// recorded in the build cache. It does nothing if the target has already been
+// closed or committed, so it's safe to defer.
+func (f *TargetFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	return f.writer.Close()
+}
+
+// Commit closes the target and, as long as no write to it failed, records it
+// in the build cache (if there is one). It should be called once the target
+// has been written in full.
+func (f *TargetFile) Commit() error {
+	if f.closed {
+		return xerrors.Errorf("target already closed: %s", f.target)
+	}
+	f.closed = true
+
+	if err := f.writer.Close(); err != nil {
+		return err
+	}
+
+	if f.buildCache != nil && !f.failed {
+		f.buildCache.record(f.target)
+	}
+	return nil
+}
+
+// Write writes data to the target. If it fails, the target won't be recorded
+// in the build cache when it's committed.
+func (f *TargetFile) Write(data []byte) (int, error) {
+	n, err := f.writer.Write(data)
+	if err != nil {
+		f.failed = true
+	}
+	return n, err
+}
+
+// Dependents returns the outputs that depend on any of the given inputs
+// according to dependencies declared with DependsOn, sorted by path. Outputs
+// that depend on the given inputs indirectly (i.e. through another output
+// that's also declared as an input) are included, so after an input changes,
+// these are all the outputs that need to be rebuilt.
+func (c *Context) Dependents(inputs ...string) []string {
+	return c.dependencies.dependents(inputs)
+}
+
+// DependsOn declares that the given output (usually a target path) is built
+// from the given inputs (usually source paths), like the layouts and partials
+// that a page is rendered with. Declared dependencies can be queried with
+// Dependents so that a change to an input can trigger rebuilds of just the
+// outputs that it affects.
+//
+// Dependencies accumulate, so it's safe to call DependsOn multiple times for
+// the same output, including on every build loop. Paths are normalized with
+// filepath.Clean.
+func (c *Context) DependsOn(output string, inputs ...string) {
+	c.dependencies.add(output, inputs)
+}
+
+// ReadDir reads the named directory from FS, or from the operating system's
+// filesystem if FS isn't set.
+func (c *Context) ReadDir(name string) ([]fs.DirEntry, error) {
+	if c.FS != nil {
+		return fs.ReadDir(c.FS, fsPath(name))
+	}
+
+	return os.ReadDir(name)
+}
+
+// ReadFile reads the named file from FS, or from the operating system's
+// filesystem if FS isn't set.
+func (c *Context) ReadFile(name string) ([]byte, error) {
+	if c.FS != nil {
+		return fs.ReadFile(c.FS, fsPath(name))
+	}
+
+	return os.ReadFile(name)
+}
+
+// RegisterRenderer registers a function that renders source files with the
+// given extension (like ".md"), which is used by RenderOne. Registering a
+// renderer for an extension that already has one replaces it.
+func (c *Context) RegisterRenderer(ext string, f RenderFunc) {
+	c.renderersMu.Lock()
+	defer c.renderersMu.Unlock()
+
+	c.renderers[strings.ToLower(ext)] = f
+}
+
+// RenderOne renders a single source file with the renderer registered for its
+// extension and returns the output without writing it anywhere. It's intended
+// as a debugging aid for isolating the output of one file without running a
+// full build.
+func (c *Context) RenderOne(source string) ([]byte, error) {
+	ext := strings.ToLower(filepath.Ext(source))
+
+	c.renderersMu.RLock()
+	f, ok := c.renderers[ext]
+	c.renderersMu.RUnlock()
+
+	if !ok {
+		return nil, xerrors.Errorf("no renderer registered for extension '%s' (source: '%s')", ext, source)
+	}
+
+	data, err := f(c, source)
+	if err != nil {
+		return nil, xerrors.Errorf("error rendering '%s': %w", source, err)
+	}
+
+	return data, nil
+}
+
 // ResetBuild signals to the Context to do the bookkeeping it needs to do for
 // the next build round.
 func (c *Context) ResetBuild() {
@@ -239,8 +704,80 @@ func (c *Context) ResetBuild() {
 	c.fileModTimeCache.promote()
 }
 
+// SourcePath joins any number of path elements onto SourceDir.
+func (c *Context) SourcePath(elem ...string) string {
+	return filepath.Join(append([]string{c.SourceDir}, elem...)...)
+}
+
+// Sub returns a sub-context whose SourceDir and TargetDir are rebased onto the
+// given subdirectories of the current context's, which is useful for building
+// a section of a site into its own output subtree. Either subdirectory may be
+// empty to leave the corresponding directory unchanged.
+//
+// The sub-context shares its job pools, statistics, build cache, dependency
+// graph, file modification time cache, and watcher (along with the set of
+// watched paths) with its parent. Other state like Forced and QuickPaths is
+// copied, so create sub-contexts from within the build function on each loop
+// rather than holding onto them across loops. Rounds should be managed (i.e.
+// StartRound and Wait) through the parent context.
+func (c *Context) Sub(sourceSubdir, targetSubdir string) *Context {
+	return &Context{
+		BuildCache:   c.BuildCache,
+		Concurrency:  c.Concurrency,
+		Draft:        c.Draft,
+		FS:           c.FS,
+		FirstRun:     c.FirstRun,
+		Forced:       c.Forced,
+		Gzip:         c.Gzip,
+		HashContent:  c.HashContent,
+		Jobs:         c.Jobs,
+		Log:          c.Log,
+		LogColor:     c.LogColor,
+		Pool:         c.Pool,
+		Port:         c.Port,
+		Production:   c.Production,
+		QuickPaths:   c.QuickPaths,
+		SourceDir:    filepath.Join(c.SourceDir, sourceSubdir),
+		Stats:        c.Stats,
+		TargetDir:    filepath.Join(c.TargetDir, targetSubdir),
+		TraceChanges: c.TraceChanges,
+		WatchIgnore:  c.WatchIgnore,
+		Watcher:      c.Watcher,
+		Websocket:    c.Websocket,
+
+		colorizer:        c.colorizer,
+		dependencies:     c.dependencies,
+		fileModTimeCache: c.fileModTimeCache,
+		pools:            c.pools,
+		poolsMu:          c.poolsMu,
+		rebuildPauser:    c.rebuildPauser,
+		renderers:        c.renderers,
+		round:            c.round,
+		renderersMu:      c.renderersMu,
+		watchedPaths:     c.watchedPaths,
+		watchedPathsMu:   c.watchedPathsMu,
+
+		watchEventSubscribers: c.watchEventSubscribers,
+		watchedRecursiveRoots: c.watchedRecursiveRoots,
+	}
+}
+
+// TargetPath joins any number of path elements onto TargetDir.
+func (c *Context) TargetPath(elem ...string) string {
+	return filepath.Join(append([]string{c.TargetDir}, elem...)...)
+}
+
+// RoundContext returns the context of the current round. It's canceled when
+// the next round starts or the build loop is torn down (like when the process
+// is about to re-exec itself), so long-running work in jobs should watch it
+// and return early. Jobs created with NewJobWithContext receive it
+// automatically.
+func (c *Context) RoundContext() context.Context {
+	return c.round.context()
+}
+
 // StartRound starts a new round for the context, also starting it on its
-// attached job pool.
+// attached job pool. The previous round's context is canceled.
 func (c *Context) StartRound() {
 	c.Log.Debugf("Context StartRound()")
 
@@ -249,9 +786,13 @@ func (c *Context) StartRound() {
 
 	c.Stats.NumRounds++
 
-	// Then start the pool again, which also has the side effect of
+	ctx := c.round.start()
+
+	// Then start the pools again, which also has the side effect of
 	// reinitializing anything that needs to be reinitialized.
-	c.Pool.StartRound(roundNum)
+	for _, pool := range c.allPools() {
+		pool.StartRoundWithContext(ctx, roundNum)
+	}
 
 	// This channel is reinitialized, so make sure to pull in the new one.
 	c.Jobs = c.Pool.Jobs
@@ -265,7 +806,7 @@ func (c *Context) StartRound() {
 // Returns nil if the round of jobs executed successfully, and a set of errors
 // that occurred otherwise.
 func (c *Context) Wait() []error {
-	c.Log.Debugf("Context Wait(); jobs queued: %v", len(c.Pool.Jobs))
+	c.Log.Debugf("Context Wait(); jobs queued: %v", c.numJobsQueued())
 
 	c.Stats.LoopDuration += time.Since(c.Stats.lastLoopStart)
 
@@ -274,16 +815,19 @@ func (c *Context) Wait() []error {
 		c.Stats.lastLoopStart = time.Now()
 	}()
 
-	// Wait for work to finish.
-	c.Pool.Wait()
+	// Wait for work to finish. Pools run concurrently, so it doesn't matter
+	// which order they're waited on.
+	c.waitPools()
 
-	// Note use of append even though we always expect the current set to be
-	// empty so that the slice is duplicated and not affected by its source
-	// being reset by `StartRound` below.
-	c.Stats.JobsErrored = append(c.Stats.JobsErrored, c.Pool.JobsErrored...)
+	for _, pool := range c.allPools() {
+		// Note use of append even though we always expect the current set to
+		// be empty so that the slice is duplicated and not affected by its
+		// source being reset by `StartRound` below.
+		c.Stats.JobsErrored = append(c.Stats.JobsErrored, pool.JobsErrored...)
 
-	c.Stats.JobsExecuted = append(c.Stats.JobsExecuted, c.Pool.JobsExecuted...)
-	c.Stats.NumJobs += len(c.Pool.JobsAll)
+		c.Stats.JobsExecuted = append(c.Stats.JobsExecuted, pool.JobsExecuted...)
+		c.Stats.NumJobs += len(pool.JobsAll)
+	}
 
 	c.StartRound()
 
@@ -301,6 +845,105 @@ func (c *Context) Wait() []error {
 	return errors
 }
 
+// WatchEvents returns a new channel over which changes to files detected by
+// the watcher are sent, which is useful for things like expiring caches. Each
+// call subscribes a new channel, and nothing is sent until the first call, so
+// contexts that don't subscribe pay nothing.
+//
+// Events are sent without blocking, so a subscriber that falls behind by more
+// than a buffer of events misses some. Channels are never closed.
+func (c *Context) WatchEvents() <-chan WatchEvent {
+	return c.watchEventSubscribers.subscribe()
+}
+
+// WatchRecursive watches root and every directory beneath it for changes.
+// Directories created beneath root afterwards are watched as they appear.
+// Directories ignored by the watcher (see WatchIgnore) are skipped.
+//
+// Changed only watches the parent directory of each path it's given, so this
+// is useful for deep content trees where a change in a directory that hasn't
+// been checked yet would otherwise go unnoticed.
+//
+// Does nothing if the context has no watcher.
+func (c *Context) WatchRecursive(root string) error {
+	if c.Watcher == nil {
+		return nil
+	}
+
+	root = absPath(root)
+
+	c.watchedPathsMu.Lock()
+	c.watchedRecursiveRoots[root] = struct{}{}
+	c.watchedPathsMu.Unlock()
+
+	return c.addWatchedRecursive(root)
+}
+
+// Returns the main pool followed by any named pools, sorted by name for
+// stable ordering.
+func (c *Context) allPools() []*Pool {
+	c.poolsMu.RLock()
+	defer c.poolsMu.RUnlock()
+
+	names := make([]string, 0, len(c.pools))
+	for name := range c.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pools := make([]*Pool, 0, len(c.pools)+1)
+	pools = append(pools, c.Pool)
+	for _, name := range names {
+		pools = append(pools, c.pools[name])
+	}
+	return pools
+}
+
+// Returns the total number of jobs queued but not yet fed to workers across
+// all pools.
+func (c *Context) numJobsQueued() int {
+	var numJobs int
+	for _, pool := range c.allPools() {
+		numJobs += len(pool.Jobs)
+	}
+	return numJobs
+}
+
+// Waits on the current round of every pool.
+func (c *Context) waitPools() {
+	for _, pool := range c.allPools() {
+		pool.Wait()
+	}
+}
+
+// Creates a target file for CreateTarget, also writing a gzipped sibling if
+// Gzip is set (and Draft isn't).
+func (c *Context) createTarget(name string) (io.WriteCloser, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, xerrors.Errorf("error creating target file: %w", err)
+	}
+
+	if !c.Gzip || c.Draft {
+		return file, nil
+	}
+
+	gzipFile, err := os.Create(name + ".gz")
+	if err != nil {
+		file.Close()
+		return nil, xerrors.Errorf("error creating gzip target file: %w", err)
+	}
+
+	gzipWriter := gzip.NewWriter(gzipFile)
+
+	return &gzipTargetFile{
+		Writer:     io.MultiWriter(file, gzipWriter),
+		file:       file,
+		gzipFile:   gzipFile,
+		gzipWriter: gzipWriter,
+	}, nil
+}
+
 func (c *Context) addWatched(fileInfo os.FileInfo, absolutePath string) error {
 	// Watch the parent directory unless the file is a directory itself. This
 	// will hopefully mean fewer individual entries in the notifier.
@@ -329,6 +972,71 @@ func (c *Context) addWatched(fileInfo os.FileInfo, absolutePath string) error {
 	return nil
 }
 
+// Watches the given directory and every directory beneath it, skipping any
+// that the watcher ignores.
+func (c *Context) addWatchedRecursive(root string) error {
+	ignorer, err := newWatchIgnorer(c)
+	if err != nil {
+		c.Log.Errorf("Error reading watch ignore patterns: %v", err)
+	}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if path != root && ignorer.ignored(path) {
+			return filepath.SkipDir
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return xerrors.Errorf("error getting directory info: %w", err)
+		}
+
+		return c.addWatched(info, path)
+	})
+	if err != nil {
+		return xerrors.Errorf("error watching directory recursively: %w", err)
+	}
+
+	return nil
+}
+
+// Watches a directory that was just created (along with any directories that
+// were moved in with it) if it's beneath a root passed to WatchRecursive.
+// Does nothing for anything else.
+func (c *Context) watchCreatedDir(path string) {
+	path = absPath(path)
+
+	c.watchedPathsMu.RLock()
+	underRoot := false
+	for root := range c.watchedRecursiveRoots {
+		if strings.HasPrefix(path, root+string(filepath.Separator)) {
+			underRoot = true
+			break
+		}
+	}
+	c.watchedPathsMu.RUnlock()
+
+	if !underRoot {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return
+	}
+
+	if err := c.addWatchedRecursive(path); err != nil {
+		c.Log.Errorf("Error watching created directory: %v", err)
+	}
+}
+
 // Stats tracks various statistics about the build process.
 type Stats struct {
 	// JobsErrored is a slice of jobs that errored on the last run.
@@ -373,6 +1081,140 @@ func (s *Stats) Reset() {
 	s.lastLoopStart = time.Now()
 }
 
+// BuildCache is a manifest of targets written by a build along with hashes of
+// the sources they were built from. It's meant to be persisted between runs of
+// a program (see Config.BuildCachePath) so that targets whose sources are
+// unchanged don't have to be rebuilt on a cold start, even if the sources'
+// modified times changed (say after a fresh checkout) or were never recorded.
+//
+// It's populated and consulted by Context. ChangedTarget hashes the sources of
+// a target that appears to need rebuilding and compares them to the ones
+// recorded for it, and the new hashes are recorded once the target has been
+// written and committed with a target file from CreateTarget. A target is only
+// considered up to date if it exists and was recorded with exactly the same
+// set of sources.
+type BuildCache struct {
+	mu sync.Mutex
+
+	// pending are source hashes staged by check, keyed by target, that are
+	// moved to records once the target is written.
+	pending map[string]map[string][]byte
+
+	// records are the hashes of the sources that each target was last
+	// written from, keyed by target and then by source.
+	records map[string]map[string][]byte
+}
+
+// NewBuildCache returns a new empty BuildCache.
+func NewBuildCache() *BuildCache {
+	return &BuildCache{
+		pending: make(map[string]map[string][]byte),
+		records: make(map[string]map[string][]byte),
+	}
+}
+
+// Load reads records previously written by Save from the given path into the
+// cache. A file that doesn't exist is not an error, and leaves the cache as
+// it is.
+func (c *BuildCache) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("error reading build cache: %w", err)
+	}
+
+	var records map[string]map[string][]byte
+	if err := json.Unmarshal(data, &records); err != nil {
+		return xerrors.Errorf("error decoding build cache: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for target, hashes := range records {
+		c.records[target] = hashes
+	}
+
+	return nil
+}
+
+// Save writes the cache's records to the given path so that they can be
+// loaded by a future process with Load.
+func (c *BuildCache) Save(path string) error {
+	c.mu.Lock()
+	data, err := json.Marshal(c.records)
+	c.mu.Unlock()
+	if err != nil {
+		return xerrors.Errorf("error encoding build cache: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return xerrors.Errorf("error writing build cache: %w", err)
+	}
+
+	return nil
+}
+
+// Returns whether the target was recorded with exactly the given sources and
+// their current contents. Either way, the sources' current hashes are staged
+// to be recorded for the target if it's written.
+func (c *BuildCache) check(target string, sources []string) bool {
+	target = filepath.Clean(target)
+
+	hashes := make(map[string][]byte, len(sources))
+	for _, source := range sources {
+		hash, err := hashFile(source)
+		if err != nil {
+			// A source that can't be hashed (say because it's a directory)
+			// can't be compared, so the target is never recorded.
+			c.mu.Lock()
+			delete(c.pending, target)
+			c.mu.Unlock()
+			return false
+		}
+		hashes[filepath.Clean(source)] = hash
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[target] = hashes
+
+	recorded, ok := c.records[target]
+	if !ok || len(recorded) != len(hashes) {
+		return false
+	}
+
+	for source, hash := range hashes {
+		if !bytes.Equal(recorded[source], hash) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Records the source hashes staged for the target by check. If none were
+// staged, the target was written from unknown sources, so any existing record
+// for it is forgotten instead.
+func (c *BuildCache) record(target string) {
+	target = filepath.Clean(target)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hashes, ok := c.pending[target]
+	if !ok {
+		delete(c.records, target)
+		return
+	}
+
+	c.records[target] = hashes
+	delete(c.pending, target)
+}
+
 //////////////////////////////////////////////////////////////////////////////
 //
 //
@@ -383,46 +1225,279 @@ func (s *Stats) Reset() {
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// changeReason is the reason for a decision made by Context.Changed, which is
+// logged if Context.TraceChanges is set.
+type changeReason string
+
+// The possible values of changeReason.
+const (
+	changeReasonContentsChanged   changeReason = "modified time advanced and contents changed"
+	changeReasonContentsUnchanged changeReason = "modified time advanced but contents unchanged"
+	changeReasonForced            changeReason = "context forced"
+	changeReasonMissing           changeReason = "file doesn't exist"
+	changeReasonModTimeAdvanced   changeReason = "modified time advanced"
+	changeReasonNew               changeReason = "new file"
+	changeReasonNotQuickPath      changeReason = "not in quick paths"
+	changeReasonQuickPath         changeReason = "in quick paths"
+	changeReasonUnchanged         changeReason = "modified time unchanged"
+)
+
+// Logs a decision made by Changed and its reason if TraceChanges is set.
+func (c *Context) traceChanged(path string, changed bool, reason changeReason) {
+	if !c.TraceChanges {
+		return
+	}
+
+	decision := "unchanged"
+	if changed {
+		decision = "changed"
+	}
+
+	c.Log.Infof("Trace: %s: %s (%s)", path, decision, reason)
+}
+
+// dependencyGraph tracks the inputs that outputs are built from as declared
+// with Context.DependsOn. It's safe for concurrent use.
+type dependencyGraph struct {
+	mu sync.RWMutex
+
+	// outputs are the outputs that depend on each input, keyed by input.
+	outputs map[string]map[string]struct{}
+}
+
+// newDependencyGraph returns a new empty dependencyGraph.
+func newDependencyGraph() *dependencyGraph {
+	return &dependencyGraph{
+		outputs: make(map[string]map[string]struct{}),
+	}
+}
+
+// Records that output depends on each of inputs.
+func (g *dependencyGraph) add(output string, inputs []string) {
+	output = filepath.Clean(output)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, input := range inputs {
+		input = filepath.Clean(input)
+
+		outputs, ok := g.outputs[input]
+		if !ok {
+			outputs = make(map[string]struct{})
+			g.outputs[input] = outputs
+		}
+		outputs[output] = struct{}{}
+	}
+}
+
+// Returns the sorted outputs that depend on any of inputs, directly or
+// transitively.
+func (g *dependencyGraph) dependents(inputs []string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	seen := make(map[string]struct{})
+
+	queue := make([]string, len(inputs))
+	for i, input := range inputs {
+		queue[i] = filepath.Clean(input)
+	}
+
+	for len(queue) > 0 {
+		input := queue[0]
+		queue = queue[1:]
+
+		for output := range g.outputs[input] {
+			if _, ok := seen[output]; ok {
+				continue
+			}
+
+			seen[output] = struct{}{}
+			queue = append(queue, output)
+		}
+	}
+
+	dependents := make([]string, 0, len(seen))
+	for output := range seen {
+		dependents = append(dependents, output)
+	}
+	sort.Strings(dependents)
+
+	return dependents
+}
+
+// contextRound tracks the context of a Context's current round so that it can
+// be canceled when the next round starts or when the build loop is torn down.
+type contextRound struct {
+	cancel   context.CancelFunc
+	canceled bool
+	ctx      context.Context
+	mu       sync.Mutex
+}
+
+// cancelAll cancels the current round along with any started after it, so
+// that their jobs are skipped.
+func (r *contextRound) cancelAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.canceled = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// context returns the current round's context, or a background context if no
+// round has been started.
+func (r *contextRound) context() context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// isCanceled returns whether cancelAll has been called.
+func (r *contextRound) isCanceled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.canceled
+}
+
+// start cancels the previous round's context and returns a new one for the
+// next round, which is already canceled if cancelAll has been called.
+func (r *contextRound) start() context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel != nil {
+		r.cancel()
+	}
+
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	if r.canceled {
+		r.cancel()
+	}
+
+	return r.ctx
+}
+
 // FileModTimeCache tracks the last modified time of files seen so a
 // determination can be made as to whether they need to be recompiled.
 type fileModTimeCache struct {
 	log                 LoggerInterface
 	mu                  sync.Mutex
-	pathToModTimeMap    map[string]time.Time
-	pathToModTimeMapNew map[string]time.Time
+	pathToModTimeMap    map[string]fileModTimeCacheEntry
+	pathToModTimeMapNew map[string]fileModTimeCacheEntry
+}
+
+// fileModTimeCacheEntry is the information tracked for a single file in
+// fileModTimeCache.
+type fileModTimeCacheEntry struct {
+	// hash is a SHA-256 hash of the file's contents. It's only set if the
+	// file was checked with hashing enabled.
+	hash []byte
+
+	// loaded indicates that the entry was loaded from disk (see load) and
+	// that the file hasn't been checked by this process yet, so it's not
+	// necessarily being watched.
+	loaded bool
+
+	// modTime is the file's last modified time.
+	modTime time.Time
+}
+
+// fileModTimeCacheRecord is the serialized form of a fileModTimeCacheEntry
+// that's written to disk by fileModTimeCache.save.
+type fileModTimeCacheRecord struct {
+	Hash    []byte    `json:"hash,omitempty"`
+	ModTime time.Time `json:"mod_time"`
 }
 
 // newFileModTimeCache returns a new fileModTimeCache.
 func newFileModTimeCache(log LoggerInterface) *fileModTimeCache {
 	return &fileModTimeCache{
 		log:                 log,
-		pathToModTimeMap:    make(map[string]time.Time),
-		pathToModTimeMapNew: make(map[string]time.Time),
+		pathToModTimeMap:    make(map[string]fileModTimeCacheEntry),
+		pathToModTimeMapNew: make(map[string]fileModTimeCacheEntry),
 	}
 }
 
 // changed returns whether the target path's modified time has changed since
 // the last time it was checked. It also saves the last modified time for
 // future checks. The second return value is whether or not the record was
-// already in the cache.
-func (c *fileModTimeCache) isFileUpdated(fileInfo os.FileInfo, absolutePath string) (bool, bool) {
+// already in the cache, and is always false for records loaded from disk that
+// haven't been checked yet so that the caller knows to watch them. The third
+// is the reason for the decision.
+//
+// If hashContent is set and the modified time has changed, the file's
+// contents are hashed and it's only considered changed if the hash differs
+// from the one stored on the last check.
+func (c *fileModTimeCache) isFileUpdated(fileInfo os.FileInfo, absolutePath string,
+	hashContent bool,
+) (bool, bool, changeReason) {
 	modTime := fileInfo.ModTime()
 
-	lastModTime, ok := c.pathToModTimeMap[absolutePath]
+	lastEntry, ok := c.pathToModTimeMap[absolutePath]
+
+	// Entries loaded from disk are reported as uncached on every path so
+	// that the caller starts watching their files.
+	cached := ok && !lastEntry.loaded
 
 	if ok {
-		changed := lastModTime.Before(modTime)
+		changed := lastEntry.modTime.Before(modTime)
 		if !changed {
-			return false, ok
+			if lastEntry.loaded {
+				// Store a copy that isn't marked as loaded so the file is
+				// only reported as uncached once.
+				lastEntry.loaded = false
+				c.mu.Lock()
+				c.pathToModTimeMapNew[absolutePath] = lastEntry
+				c.mu.Unlock()
+			}
+
+			return false, cached, changeReasonUnchanged
+		}
+	}
+
+	entry := fileModTimeCacheEntry{modTime: modTime}
+
+	if hashContent {
+		hash, err := hashFile(absolutePath)
+		if err != nil {
+			// Fall back to treating the file as changed.
+			c.log.Errorf("Error hashing file: %v", err)
 		}
+		entry.hash = hash
 	}
 
-	// Store to the new map for eventual promotion.
+	// Store to the new map for eventual promotion. This happens even if the
+	// contents turn out to be unchanged so that the new modified time is used
+	// on the next check and the file doesn't have to be hashed again.
 	c.mu.Lock()
-	c.pathToModTimeMapNew[absolutePath] = modTime
+	c.pathToModTimeMapNew[absolutePath] = entry
 	c.mu.Unlock()
 
-	return true, ok
+	var reason changeReason
+	switch {
+	case !ok:
+		reason = changeReasonNew
+	case entry.hash == nil || lastEntry.hash == nil:
+		reason = changeReasonModTimeAdvanced
+	case bytes.Equal(entry.hash, lastEntry.hash):
+		return false, cached, changeReasonContentsUnchanged
+	default:
+		reason = changeReasonContentsChanged
+	}
+
+	// Debug level only because this happens for every file on a full build.
+	c.log.Debugf("File did change: %s (%s)", absolutePath, reason)
+
+	return true, cached, reason
 }
 
 // promote takes all the new modification times collected during this round
@@ -433,10 +1508,112 @@ func (c *fileModTimeCache) promote() {
 	defer c.mu.Unlock()
 
 	// Promote all new values to the current map.
-	for path, modTime := range c.pathToModTimeMapNew {
-		c.pathToModTimeMap[path] = modTime
+	for path, entry := range c.pathToModTimeMapNew {
+		c.pathToModTimeMap[path] = entry
 	}
 
 	// Clear the new map for the next round.
-	c.pathToModTimeMapNew = make(map[string]time.Time)
+	c.pathToModTimeMapNew = make(map[string]fileModTimeCacheEntry)
+}
+
+// load reads records previously written by save from the given path into the
+// cache. A file that doesn't exist is not an error, and leaves the cache as
+// it is.
+func (c *fileModTimeCache) load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("error reading mod time cache: %w", err)
+	}
+
+	var records map[string]fileModTimeCacheRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return xerrors.Errorf("error decoding mod time cache: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for path, record := range records {
+		c.pathToModTimeMap[path] = fileModTimeCacheEntry{
+			hash:    record.Hash,
+			loaded:  true,
+			modTime: record.ModTime,
+		}
+	}
+
+	c.log.Debugf("Loaded %v mod time cache record(s) from: %s", len(records), path)
+	return nil
+}
+
+// save writes the cache's records to the given path so that they can be
+// loaded by a future process with load. Only promoted records are included.
+// Those collected since the last promotion may belong to jobs that haven't
+// finished, and saving them would have a future process skip their files.
+func (c *fileModTimeCache) save(path string) error {
+	c.mu.Lock()
+	records := make(map[string]fileModTimeCacheRecord, len(c.pathToModTimeMap))
+	for path, entry := range c.pathToModTimeMap {
+		records[path] = fileModTimeCacheRecord{Hash: entry.hash, ModTime: entry.modTime}
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return xerrors.Errorf("error encoding mod time cache: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return xerrors.Errorf("error writing mod time cache: %w", err)
+	}
+
+	c.log.Debugf("Saved %v mod time cache record(s) to: %s", len(records), path)
+	return nil
+}
+
+// Produces a SHA-256 hash of the contents of the file at the given path.
+func hashFile(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("error opening file to hash: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, xerrors.Errorf("error hashing file: %w", err)
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// Converts a path as it'd be used with the operating system's filesystem
+// (like a path built from SourceDir) to one suitable for use with fs.FS, which
+// requires slash-separated paths without a leading `./`.
+func fsPath(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// A target file created by CreateTarget that's also being written to a gzipped
+// sibling.
+type gzipTargetFile struct {
+	io.Writer
+
+	file       *os.File
+	gzipFile   *os.File
+	gzipWriter *gzip.Writer
+}
+
+// Close flushes compressed data and closes both files, returning the first
+// error encountered. Every file is closed even if an earlier one errors.
+func (f *gzipTargetFile) Close() error {
+	var firstErr error
+	for _, closer := range []io.Closer{f.gzipWriter, f.gzipFile, f.file} {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
@@ -1 +1,617 @@
 package modulir
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestContextPools(t *testing.T) {
+	log := &Logger{Level: LevelInfo}
+	c := NewContext(&Args{
+		Log:   log,
+		Pool:  NewPool(log, 2),
+		Pools: map[string]*Pool{"fetch": NewPool(log, 20)},
+	})
+
+	c.StartRound()
+
+	// Pools can also be added after a round has already started.
+	render := c.AddPool("render", 4)
+
+	assert.Equal(t, c.Pool, c.PoolFor(""))
+	assert.Equal(t, render, c.PoolFor("render"))
+	assert.Equal(t, 20, c.PoolFor("fetch").concurrency)
+	assert.Panics(t, func() { c.PoolFor("unknown") })
+	assert.Panics(t, func() { c.AddPool("render", 4) })
+
+	c.AddJob("main", func() (bool, error) { return true, nil })
+	c.PoolFor("fetch").Jobs <- NewJob("fetch 0", func() (bool, error) { return true, nil })
+	c.PoolFor("fetch").Jobs <- NewJob("fetch 1", func() (bool, error) { return false, nil })
+	render.Jobs <- NewJob("render", func() (bool, error) { return true, xerrors.Errorf("error") })
+
+	errs := c.Wait()
+	assert.Equal(t, []string{"error"}, errorStrings(errs))
+
+	assert.Equal(t, 4, c.Stats.NumJobs)
+	assert.Equal(t, 3, len(c.Stats.JobsExecuted))
+	assert.Equal(t, 1, len(c.Stats.JobsErrored))
+
+	// Wait restarts all pools, so shut them back down.
+	c.waitPools()
+}
+
+func TestContextRoundContext(t *testing.T) {
+	log := &Logger{Level: LevelInfo}
+	c := NewContext(&Args{
+		Log:  log,
+		Pool: NewPool(log, 2),
+	})
+
+	c.StartRound()
+	roundCtx := c.RoundContext()
+	assert.NoError(t, roundCtx.Err())
+
+	var jobCtx context.Context
+	c.Jobs <- NewJobWithContext("job", func(ctx context.Context) (bool, error) {
+		jobCtx = ctx
+		return true, ctx.Err()
+	})
+	assert.Nil(t, c.Wait())
+
+	// Starting a new round (which Wait does) cancels the last one.
+	assert.ErrorIs(t, roundCtx.Err(), context.Canceled)
+	assert.ErrorIs(t, jobCtx.Err(), context.Canceled)
+	assert.NoError(t, c.RoundContext().Err())
+
+	// Tearing down cancels the current round along with any started after it,
+	// and their jobs are skipped.
+	c.round.cancelAll()
+	assert.ErrorIs(t, c.RoundContext().Err(), context.Canceled)
+
+	c.waitPools()
+	c.ResetBuild()
+	c.StartRound()
+	assert.ErrorIs(t, c.RoundContext().Err(), context.Canceled)
+
+	c.AddJob("skipped", func() (bool, error) { return true, nil })
+	c.Wait()
+	assert.Equal(t, 0, len(c.Stats.JobsExecuted))
+
+	c.waitPools()
+}
+
+func TestContextAddAlwaysJob(t *testing.T) {
+	log := &Logger{Level: LevelInfo}
+	c := NewContext(&Args{
+		Log:  log,
+		Pool: NewPool(log, 2),
+	})
+
+	path := filepath.Join(t.TempDir(), "source.md")
+	assert.NoError(t, os.WriteFile(path, []byte("source"), 0o600))
+
+	addJobs := func() {
+		c.AddJob("changed", func() (bool, error) {
+			return c.Changed(path), nil
+		})
+		c.AddAlwaysJob("always", func(c *Context) (bool, error) {
+			return c.Changed(path), nil
+		})
+	}
+
+	c.StartRound()
+	addJobs()
+	assert.Nil(t, c.Wait())
+	assert.Equal(t, 2, len(c.Stats.JobsExecuted))
+
+	// Nothing has changed, but the always-run job still executes.
+	c.waitPools()
+	c.ResetBuild()
+	c.StartRound()
+	addJobs()
+	assert.Nil(t, c.Wait())
+	assert.Equal(t, 1, len(c.Stats.JobsExecuted))
+	assert.Equal(t, "always", c.Stats.JobsExecuted[0].Name)
+
+	// The parent context isn't forced.
+	assert.False(t, c.Forced)
+
+	c.waitPools()
+}
+
+func TestContextAddCommandJob(t *testing.T) {
+	log := &Logger{Level: LevelInfo}
+	c := NewContext(&Args{
+		Log:  log,
+		Pool: NewPool(log, 2),
+	})
+
+	path := filepath.Join(t.TempDir(), "source.css")
+	assert.NoError(t, os.WriteFile(path, []byte("source"), 0o600))
+
+	c.StartRound()
+	c.AddCommandJob("succeeds", []string{path}, "true")
+	c.AddCommandJob("fails", []string{path}, "sh", "-c", "echo oops; exit 1")
+	errs := c.Wait()
+
+	assert.Equal(t, 1, len(errs))
+	assert.Contains(t, errs[0].Error(), "error running command 'sh -c echo oops; exit 1'")
+	assert.Contains(t, errs[0].Error(), "output: oops")
+	assert.Equal(t, 2, len(c.Stats.JobsExecuted))
+
+	// Commands don't run again if their paths haven't changed. Wait restarts
+	// rounds, so shut them down first like the build loop does.
+	c.waitPools()
+	c.ResetBuild()
+	c.StartRound()
+	c.AddCommandJob("fails", []string{path}, "sh", "-c", "echo oops; exit 1")
+	assert.Nil(t, c.Wait())
+	assert.Equal(t, 0, len(c.Stats.JobsExecuted))
+
+	c.waitPools()
+}
+
+func TestContextSub(t *testing.T) {
+	log := &Logger{Level: LevelInfo}
+	c := NewContext(&Args{
+		Log:       log,
+		Pool:      NewPool(log, 2),
+		SourceDir: "./content",
+		TargetDir: "./public",
+	})
+
+	sub := c.Sub("fragments", "fragments")
+	assert.Equal(t, "content/fragments", sub.SourceDir)
+	assert.Equal(t, "public/fragments", sub.TargetDir)
+	assert.Equal(t, "content/fragments/hello.md", sub.SourcePath("hello.md"))
+	assert.Equal(t, "public/fragments/hello/index.html", sub.TargetPath("hello", "index.html"))
+
+	// Subdirectories may be left empty, and sub-contexts can be nested.
+	subSub := sub.Sub("", "2023")
+	assert.Equal(t, "content/fragments", subSub.SourceDir)
+	assert.Equal(t, "public/fragments/2023", subSub.TargetDir)
+
+	// State is shared with the parent.
+	assert.Same(t, c.Stats, sub.Stats)
+	assert.Same(t, c.dependencies, sub.dependencies)
+	assert.Same(t, c.fileModTimeCache, sub.fileModTimeCache)
+	assert.Same(t, c.watchedPathsMu, sub.watchedPathsMu)
+
+	sub.watchedPathsMu.Lock()
+	sub.watchedPaths["content/fragments"] = struct{}{}
+	sub.watchedPathsMu.Unlock()
+	assert.Contains(t, c.watchedPaths, "content/fragments")
+
+	// Jobs added to the sub-context go to the parent's current round, even
+	// when it was started after the sub-context was created.
+	c.StartRound()
+	sub.AddJob("sub job", func() (bool, error) { return true, nil })
+	assert.Nil(t, c.Wait())
+	assert.Equal(t, 1, c.Stats.NumJobs)
+	c.waitPools()
+}
+
+func TestContextWatchRecursive(t *testing.T) {
+	watcher, err := fsnotify.NewWatcher()
+	assert.NoError(t, err)
+	defer watcher.Close()
+
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "content", "2023", "01"), 0o755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "content", "node_modules", "pkg"), 0o755))
+
+	c := NewContext(&Args{
+		Log:         &Logger{Level: LevelInfo},
+		SourceDir:   dir,
+		WatchIgnore: []string{"node_modules"},
+		Watcher:     watcher,
+	})
+
+	assert.NoError(t, c.WatchRecursive(filepath.Join(dir, "content")))
+	assert.Contains(t, c.watchedPaths, filepath.Join(dir, "content"))
+	assert.Contains(t, c.watchedPaths, filepath.Join(dir, "content", "2023"))
+	assert.Contains(t, c.watchedPaths, filepath.Join(dir, "content", "2023", "01"))
+	assert.NotContains(t, c.watchedPaths, filepath.Join(dir, "content", "node_modules"))
+
+	// Directories created beneath the root are watched along with their
+	// subdirectories, but not those created elsewhere.
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "content", "2024", "02"), 0o755))
+	c.watchCreatedDir(filepath.Join(dir, "content", "2024"))
+	assert.Contains(t, c.watchedPaths, filepath.Join(dir, "content", "2024"))
+	assert.Contains(t, c.watchedPaths, filepath.Join(dir, "content", "2024", "02"))
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "other"), 0o755))
+	c.watchCreatedDir(filepath.Join(dir, "other"))
+	assert.NotContains(t, c.watchedPaths, filepath.Join(dir, "other"))
+
+	// Without a watcher, it does nothing.
+	c = NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+	assert.NoError(t, c.WatchRecursive(filepath.Join(dir, "content")))
+	assert.Empty(t, c.watchedPaths)
+}
+
+func TestContextChangedHashContent(t *testing.T) {
+	c := NewContext(&Args{HashContent: true, Log: &Logger{Level: LevelInfo}})
+
+	path := filepath.Join(t.TempDir(), "source.md")
+	assert.NoError(t, os.WriteFile(path, []byte("source"), 0o600))
+
+	assert.True(t, c.Changed(path))
+	c.fileModTimeCache.promote()
+	assert.False(t, c.Changed(path))
+
+	// Rewritten with identical contents and a newer modified time.
+	touch := func(data string) {
+		assert.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+		modTime := time.Now().Add(time.Minute)
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+		c.fileModTimeCache.promote()
+	}
+
+	touch("source")
+	assert.False(t, c.Changed(path))
+
+	touch("changed source")
+	assert.True(t, c.Changed(path))
+
+	// Without hashing, only the modified time is considered.
+	c.HashContent = false
+	c.fileModTimeCache.promote()
+	touch("changed source")
+	assert.True(t, c.Changed(path))
+}
+
+func TestContextChangedPersistedCache(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "cache.json")
+	path := filepath.Join(dir, "source.md")
+	assert.NoError(t, os.WriteFile(path, []byte("source"), 0o600))
+
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+	assert.True(t, c.Changed(path))
+
+	// Records from the current round aren't saved until they're promoted
+	// because their jobs may not have finished.
+	assert.NoError(t, c.fileModTimeCache.save(cachePath))
+	{
+		c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+		assert.NoError(t, c.fileModTimeCache.load(cachePath))
+		assert.True(t, c.Changed(path))
+	}
+
+	c.fileModTimeCache.promote()
+	assert.NoError(t, c.fileModTimeCache.save(cachePath))
+
+	// A new context (i.e. process) with the loaded cache sees the file as
+	// unchanged.
+	c = NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+	assert.NoError(t, c.fileModTimeCache.load(cachePath))
+	assert.False(t, c.Changed(path))
+
+	c.fileModTimeCache.promote()
+	assert.False(t, c.Changed(path))
+
+	// But still sees it as changed when it's modified.
+	modTime := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	assert.True(t, c.Changed(path))
+
+	// A missing cache file isn't an error.
+	c = NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+	assert.NoError(t, c.fileModTimeCache.load(filepath.Join(dir, "missing.json")))
+	assert.True(t, c.Changed(path))
+}
+
+func TestContextChangedPersistedCacheWatched(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "cache.json")
+	sourceDir := filepath.Join(dir, "content")
+	path := filepath.Join(sourceDir, "source.md")
+	assert.NoError(t, os.MkdirAll(sourceDir, 0o755))
+	assert.NoError(t, os.WriteFile(path, []byte("source"), 0o600))
+
+	c := NewContext(&Args{HashContent: true, Log: &Logger{Level: LevelInfo}})
+	assert.True(t, c.Changed(path))
+	c.fileModTimeCache.promote()
+	assert.NoError(t, c.fileModTimeCache.save(cachePath))
+
+	// The file is modified while no process is running.
+	modTime := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	for _, hashContent := range []bool{false, true} {
+		watcher, err := fsnotify.NewWatcher()
+		assert.NoError(t, err)
+		defer watcher.Close()
+
+		// A new process with the loaded cache sees the file as changed (or
+		// unchanged if its contents are hashed), and still watches it.
+		c = NewContext(&Args{HashContent: hashContent, Log: &Logger{Level: LevelInfo}, Watcher: watcher})
+		assert.NoError(t, c.fileModTimeCache.load(cachePath))
+		assert.Equal(t, !hashContent, c.Changed(path))
+		assert.Contains(t, c.watchedPaths, sourceDir)
+	}
+}
+
+func TestContextChangedTarget(t *testing.T) {
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.md")
+	target := filepath.Join(dir, "target.html")
+
+	assert.NoError(t, os.WriteFile(source, []byte("source"), 0o600))
+
+	// Missing target, and the source hasn't been seen before.
+	assert.True(t, c.ChangedTarget(target, source))
+
+	assert.NoError(t, os.WriteFile(target, []byte("target"), 0o600))
+	c.fileModTimeCache.promote()
+
+	// Target exists and the source is unchanged.
+	assert.False(t, c.ChangedTarget(target, source))
+
+	// Target was deleted, so it needs to be regenerated even though the
+	// source is unchanged.
+	assert.NoError(t, os.Remove(target))
+	c.fileModTimeCache.promote()
+	assert.True(t, c.ChangedTarget(target, source))
+}
+
+func TestContextChangedTargetBuildCache(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "build_cache.json")
+
+	sources := []string{filepath.Join(dir, "a.md"), filepath.Join(dir, "b.md")}
+	for _, source := range sources {
+		assert.NoError(t, os.WriteFile(source, []byte(source), 0o600))
+	}
+
+	// Simulates a cold build in a new process, returning the number of
+	// targets that were rebuilt.
+	build := func(forced bool) int {
+		c := NewContext(&Args{BuildCache: NewBuildCache(), Log: &Logger{Level: LevelInfo}})
+		c.Forced = forced
+		assert.NoError(t, c.BuildCache.Load(cachePath))
+
+		numRebuilt := 0
+		for _, source := range sources {
+			target := strings.TrimSuffix(source, ".md") + ".html"
+			if !c.ChangedTarget(target, source) {
+				continue
+			}
+
+			file, err := c.CreateTarget(target)
+			assert.NoError(t, err)
+			_, err = file.Write([]byte("rendered"))
+			assert.NoError(t, err)
+			assert.NoError(t, file.Commit())
+
+			numRebuilt++
+		}
+
+		assert.NoError(t, c.BuildCache.Save(cachePath))
+		return numRebuilt
+	}
+
+	assert.Equal(t, 2, build(false))
+
+	// Nothing has changed, so a second cold build does no work.
+	assert.Equal(t, 0, build(false))
+
+	// A newer modified time with the same contents isn't a change.
+	modTime := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(sources[0], modTime, modTime))
+	assert.Equal(t, 0, build(false))
+
+	// Only the target of a source whose contents changed is rebuilt.
+	assert.NoError(t, os.WriteFile(sources[0], []byte("changed"), 0o600))
+	assert.Equal(t, 1, build(false))
+	assert.Equal(t, 0, build(false))
+
+	// A deleted target is rebuilt.
+	assert.NoError(t, os.Remove(filepath.Join(dir, "b.html")))
+	assert.Equal(t, 1, build(false))
+
+	// Forced builds ignore the cache.
+	assert.Equal(t, 2, build(true))
+}
+
+func TestContextCreateTargetBuildCache(t *testing.T) {
+	dir := t.TempDir()
+	cachePath := filepath.Join(dir, "build_cache.json")
+	source := filepath.Join(dir, "source.md")
+	target := filepath.Join(dir, "source.html")
+	assert.NoError(t, os.WriteFile(source, []byte("source"), 0o600))
+
+	// Writes the target in a new process, returning whether a cold build
+	// afterwards considers it up to date.
+	build := func(write func(file *TargetFile)) bool {
+		c := NewContext(&Args{BuildCache: NewBuildCache(), Log: &Logger{Level: LevelInfo}})
+		assert.NoError(t, c.BuildCache.Load(cachePath))
+		assert.True(t, c.ChangedTarget(target, source))
+
+		file, err := c.CreateTarget(target)
+		assert.NoError(t, err)
+		defer file.Close()
+		write(file)
+
+		assert.NoError(t, c.BuildCache.Save(cachePath))
+
+		c = NewContext(&Args{BuildCache: NewBuildCache(), Log: &Logger{Level: LevelInfo}})
+		assert.NoError(t, c.BuildCache.Load(cachePath))
+		return !c.ChangedTarget(target, source)
+	}
+
+	// A target that's abandoned partway through (closed but not committed)
+	// isn't recorded.
+	assert.False(t, build(func(file *TargetFile) {
+		_, err := file.Write([]byte("partial"))
+		assert.NoError(t, err)
+	}))
+
+	// Nor is one with a failed write, even if it's committed.
+	assert.False(t, build(func(file *TargetFile) {
+		file.writer = &failingWriteCloser{file.writer}
+		_, err := file.Write([]byte("rendered"))
+		assert.Error(t, err)
+		assert.NoError(t, file.Commit())
+	}))
+
+	assert.True(t, build(func(file *TargetFile) {
+		_, err := file.Write([]byte("rendered"))
+		assert.NoError(t, err)
+		assert.NoError(t, file.Commit())
+
+		// Closing after committing does nothing.
+		assert.NoError(t, file.Close())
+	}))
+}
+
+// A writer whose writes always fail, but which closes the writer it wraps.
+type failingWriteCloser struct {
+	io.WriteCloser
+}
+
+func (w *failingWriteCloser) Write(data []byte) (int, error) {
+	return 0, xerrors.Errorf("write failed")
+}
+
+func TestContextChangedLogging(t *testing.T) {
+	var out bytes.Buffer
+	logger := &Logger{Level: LevelInfo, stdoutOverride: &out}
+	c := NewContext(&Args{Log: logger})
+
+	path := filepath.Join(t.TempDir(), "source.md")
+	assert.NoError(t, os.WriteFile(path, []byte("source"), 0o600))
+
+	// Changes aren't logged at the info level so that builds aren't noisy.
+	assert.True(t, c.Changed(path))
+	c.fileModTimeCache.promote()
+	assert.Equal(t, "", out.String())
+
+	modTime := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	// But are at the debug level.
+	logger.Level = LevelDebug
+	assert.True(t, c.Changed(path))
+	assert.Equal(t, "[DEBUG] File did change: "+path+" (modified time advanced)\n", out.String())
+}
+
+func TestContextChangedTraceChanges(t *testing.T) {
+	var out bytes.Buffer
+	c := NewContext(&Args{
+		HashContent: true,
+		Log:         &Logger{Level: LevelInfo, stdoutOverride: &out},
+	})
+
+	path := filepath.Join(t.TempDir(), "source.md")
+	assert.NoError(t, os.WriteFile(path, []byte("source"), 0o600))
+
+	touch := func(data string) {
+		assert.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+		modTime := time.Now().Add(time.Minute)
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	// Nothing is logged without trace mode.
+	assert.True(t, c.Changed(path))
+	c.fileModTimeCache.promote()
+	assert.Equal(t, "", out.String())
+
+	c.TraceChanges = true
+
+	assert.False(t, c.Changed(path))
+	c.fileModTimeCache.promote()
+
+	touch("source")
+	assert.False(t, c.Changed(path))
+	c.fileModTimeCache.promote()
+
+	touch("changed source")
+	assert.True(t, c.Changed(path))
+	c.fileModTimeCache.promote()
+
+	assert.NoError(t, os.WriteFile(path+".new", []byte("new"), 0o600))
+	assert.True(t, c.Changed(path+".new"))
+
+	assert.True(t, c.Changed(path+".missing"))
+
+	c.Forced = true
+	assert.True(t, c.Changed(path))
+
+	assert.Equal(t, strings.Join([]string{
+		"[INFO] Trace: " + path + ": unchanged (modified time unchanged)",
+		"[INFO] Trace: " + path + ": unchanged (modified time advanced but contents unchanged)",
+		"[INFO] Trace: " + path + ": changed (modified time advanced and contents changed)",
+		"[INFO] Trace: " + path + ".new: changed (new file)",
+		"[INFO] Trace: " + path + ".missing: changed (file doesn't exist)",
+		"[INFO] Trace: " + path + ": changed (context forced)",
+	}, "\n")+"\n", out.String())
+}
+
+func TestContextDependsOn(t *testing.T) {
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+
+	c.DependsOn("public/about/index.html", "content/about.md", "layouts/main.ace")
+	c.DependsOn("public/index.html", "content/index.md", "layouts/main.ace")
+	c.DependsOn("layouts/main.ace", "./views/_nav.ace")
+
+	// Declaring the same dependency again has no effect.
+	c.DependsOn("public/index.html", "content/index.md")
+
+	assert.Equal(t, []string{"public/about/index.html"}, c.Dependents("content/about.md"))
+	assert.Equal(t, []string{"public/about/index.html", "public/index.html"},
+		c.Dependents("content/about.md", "content/index.md"))
+
+	// Outputs that depend on an input transitively are included.
+	assert.Equal(t, []string{"layouts/main.ace", "public/about/index.html", "public/index.html"},
+		c.Dependents("views/_nav.ace"))
+
+	assert.Equal(t, []string{}, c.Dependents("content/unknown.md"))
+
+	// Cycles don't cause an infinite loop.
+	c.DependsOn("a", "b")
+	c.DependsOn("b", "a")
+	assert.Equal(t, []string{"a", "b"}, c.Dependents("a"))
+}
+
+func TestContextReadFS(t *testing.T) {
+	c := NewContext(&Args{
+		FS: fstest.MapFS{
+			"content/a.md": &fstest.MapFile{Data: []byte("a")},
+			"content/b.md": &fstest.MapFile{Data: []byte("b")},
+		},
+		Log: &Logger{Level: LevelInfo},
+	})
+
+	data, err := c.ReadFile("./content/a.md")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), data)
+
+	entries, err := c.ReadDir(c.SourcePath("content"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "b.md", entries[1].Name())
+
+	_, err = c.ReadFile("content/missing.md")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Sub-contexts read from the same filesystem.
+	data, err = c.Sub("content", "").ReadFile(c.Sub("content", "").SourcePath("b.md"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), data)
+}
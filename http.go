@@ -3,15 +3,26 @@ package modulir
 //go:generate go run scripts/embed_js/main.go
 
 import (
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/sys/unix"
 	"golang.org/x/xerrors"
 )
 
@@ -27,28 +38,72 @@ import (
 
 // Starts serving the built site over HTTP on the configured port. A server
 // instance is returned so that it can be shut down gracefully.
-func startServingTargetDirHTTP(c *Context, buildComplete *sync.Cond) *http.Server {
-	c.Log.Infof("Serving '%s' to: http://localhost:%v/", path.Clean(c.TargetDir), c.Port)
+//
+// Content is compressed according to the client's Accept-Encoding. See
+// getCompressedFileHandler.
+//
+// If both a TLS certificate and key are configured, content is served over
+// HTTPS instead.
+//
+// If PortAutoIncrement is configured and the port is already in use, the next
+// few ports are tried in turn.
+//
+// If a Listener is configured, it's served on instead. Either way, the
+// returned server's Addr is that of the listener, so a port of 0 can be used
+// to listen on a port chosen by the system.
+//
+// If basic auth credentials are configured, all requests must present them.
+func startServingTargetDirHTTP(c *Context, config *Config, buildComplete *sync.Cond) *http.Server {
+	useTLS := config.TLSCertFile != "" && config.TLSKeyFile != ""
 
-	mux := http.NewServeMux()
-	mux.Handle("/", http.FileServer(http.Dir(c.TargetDir)))
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
 
-	if c.Websocket {
-		mux.HandleFunc("/websocket.js", getWebsocketJSHandler(c))
-		mux.HandleFunc("/websocket", getWebsocketHandler(c, buildComplete))
+	listener := config.Listener
+	if listener == nil {
+		var err error
+		listener, _, err = listenOnPort(c, c.Port, config.PortAutoIncrement)
+		if err != nil {
+			exitWithError(xerrors.Errorf("error starting HTTP server: %w", err))
+		}
+	}
+
+	// The port that's actually bound, which may differ from the configured
+	// one if it was auto-incremented, zero, or a listener was injected.
+	port := c.Port
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+
+	c.Log.Infof("Serving '%s' to: %s://localhost:%v/", path.Clean(c.TargetDir), scheme, port)
+
+	if config.MaintenancePage != "" {
+		c.Log.Infof("Serving maintenance page '%s' for all content", config.MaintenancePage)
+	}
+
+	var handler http.Handler = newServeMux(c, config, port, buildComplete)
+	if basicAuthEnabled(config) {
+		handler = getBasicAuthHandler(config, handler)
 	}
 
 	server := &http.Server{
-		Addr:              fmt.Sprintf(":%v", c.Port),
-		Handler:           mux,
+		Addr:              listener.Addr().String(),
+		Handler:           handler,
 		ReadHeaderTimeout: 5 * time.Second, // protect against Slowloris attack
 	}
 
 	go func() {
-		err := server.ListenAndServe()
+		var err error
+		if useTLS {
+			err = server.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+		} else {
+			err = server.Serve(listener)
+		}
 
-		// ListenAndServe always returns a non-nil error (but if started
-		// successfully, it'll block for a long time).
+		// Serve always returns a non-nil error (but if started successfully,
+		// it'll block for a long time).
 		if !errors.Is(err, http.ErrServerClosed) {
 			exitWithError(xerrors.Errorf("error starting HTTP server: %w", err))
 		}
@@ -73,6 +128,17 @@ type websocketEvent struct {
 	Type string `json:"type"`
 }
 
+// Types of websocketEvent.
+const (
+	// Sent when a build completes, prompting clients to reload the page.
+	websocketEventBuildComplete = "build_complete"
+
+	// Sent instead of websocketEventBuildComplete when a build was triggered
+	// by changes to only stylesheets, prompting clients to reload their
+	// stylesheets in place.
+	websocketEventCSSReload = "css_reload"
+)
+
 const (
 	// Maximum message size allowed from peer.
 	websocketMaxMessageSize = 512
@@ -107,8 +173,609 @@ var websocketUpgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-func getWebsocketHandler(c *Context, buildComplete *sync.Cond) func(w http.ResponseWriter, r *http.Request) {
+// Returns whether basic auth credentials are configured.
+func basicAuthEnabled(config *Config) bool {
+	return config.BasicAuthUser != "" || config.BasicAuthPassword != ""
+}
+
+// Checks whether the request carries the configured basic auth credentials.
+// Credentials are hashed so that they're compared in constant time regardless
+// of their length.
+func checkBasicAuth(config *Config, r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	userSum := sha256.Sum256([]byte(user))
+	expectedUserSum := sha256.Sum256([]byte(config.BasicAuthUser))
+	passwordSum := sha256.Sum256([]byte(password))
+	expectedPasswordSum := sha256.Sum256([]byte(config.BasicAuthPassword))
+
+	// Both comparisons are always made so that timing doesn't reveal which of
+	// them failed.
+	userMatch := subtle.ConstantTimeCompare(userSum[:], expectedUserSum[:])
+	passwordMatch := subtle.ConstantTimeCompare(passwordSum[:], expectedPasswordSum[:])
+	return userMatch&passwordMatch == 1
+}
+
+// Responds with a 401 that prompts clients for basic auth credentials.
+func challengeBasicAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Modulir", charset="UTF-8"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// Requires that requests carry the configured basic auth credentials before
+// passing them through to next.
+func getBasicAuthHandler(config *Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkBasicAuth(config, r) {
+			challengeBasicAuth(w)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Extensions of files that are already compressed and which aren't worth
+// compressing again.
+var incompressibleExts = map[string]struct{}{
+	".avif":  {},
+	".br":    {},
+	".gif":   {},
+	".gz":    {},
+	".jpeg":  {},
+	".jpg":   {},
+	".mp3":   {},
+	".mp4":   {},
+	".pdf":   {},
+	".png":   {},
+	".webm":  {},
+	".webp":  {},
+	".woff":  {},
+	".woff2": {},
+	".zip":   {},
+}
+
+// Returns whether the request's Accept-Encoding header allows the given
+// encoding. An encoding given a quality of zero is considered refused.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+				continue
+			}
+
+			quality := 1.0
+			if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+					quality = q
+				}
+			}
+			return quality > 0
+		}
+	}
+
+	return false
+}
+
+// Serves files from the given directory like http.FileServer, but compressed
+// with an encoding negotiated with the client. Brotli is preferred when the
+// client accepts it and there's either an up-to-date precompressed ".br"
+// sibling of the requested file or brotliEncoder is set to encode on the fly.
+// Otherwise gzip is used, again preferring an up-to-date ".gz" sibling (like
+// those written by Context.Gzip) and falling back to encoding on the fly.
+//
+// Compressed responses aren't byte for byte the same as the file that any
+// ETag was derived from, so a strong ETag on them is made weak.
+//
+// Files that are already compressed (like images and fonts) are served as is.
+func getCompressedFileHandler(dir string, brotliEncoder func(io.Writer) io.WriteCloser) http.Handler {
+	fileServer := http.FileServer(http.Dir(dir))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if strings.HasSuffix(name, "/") {
+			name += "index.html"
+		}
+
+		if _, ok := incompressibleExts[strings.ToLower(path.Ext(name))]; ok {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if acceptsEncoding(r, "br") {
+			if servePrecompressed(w, r, dir, name, ".br", "br") {
+				return
+			}
+
+			if brotliEncoder != nil {
+				serveEncoded(w, r, fileServer, "br", brotliEncoder)
+				return
+			}
+		}
+
+		if acceptsEncoding(r, "gzip") {
+			if servePrecompressed(w, r, dir, name, ".gz", "gzip") {
+				return
+			}
+
+			serveEncoded(w, r, fileServer, "gzip", func(w io.Writer) io.WriteCloser {
+				return gzip.NewWriter(w)
+			})
+			return
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// Sets a weak ETag derived from the requested file's modification time and
+// size along with Last-Modified, and responds with a 304 when the request's
+// If-None-Match or If-Modified-Since header shows that the client's copy is
+// current. Requests that don't resolve to a regular file in dir are passed
+// through to next untouched.
+//
+// If contentETag is set, the ETag is instead a strong one derived from a hash
+// of the file's contents, so that it stays the same across builds that
+// rewrite a file without changing it. It's made weak by
+// getCompressedFileHandler when the response is compressed.
+func getETagHandler(dir string, contentETag bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name := r.URL.Path
+
+		// http.FileServer redirects these to the directory, which shouldn't be
+		// preempted by a 304.
+		if strings.HasSuffix(name, "/index.html") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasSuffix(name, "/") {
+			name += "index.html"
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+
+		info, err := os.Stat(target)
+		if err != nil || !info.Mode().IsRegular() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		etag := fmt.Sprintf(`W/"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+		if contentETag {
+			etag, err = contentHashETag(target)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+
+		if notModified(r, etag, info.ModTime()) {
+			// Per RFC 7232, these shouldn't be sent with a 304.
+			w.Header().Del("Content-Length")
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns a strong ETag derived from a SHA-256 hash of the file at the given
+// path.
+func contentHashETag(target string) (string, error) {
+	f, err := os.Open(target)
+	if err != nil {
+		return "", xerrors.Errorf("error opening file: %w", err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", xerrors.Errorf("error hashing file: %w", err)
+	}
+
+	return fmt.Sprintf(`"%x"`, hash.Sum(nil)), nil
+}
+
+// Returns whether the request's conditional headers show that the client's
+// copy of a resource with the given ETag and modification time is current.
+// If-None-Match takes precedence over If-Modified-Since when both are present,
+// and ETags are compared weakly.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, candidate := range strings.Split(header, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if header := r.Header.Get("If-Modified-Since"); header != "" {
+		since, err := http.ParseTime(header)
+		if err != nil {
+			return false
+		}
+
+		// HTTP dates have only second precision.
+		return !modTime.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// Serves a precompressed sibling of the requested file if there is one that's
+// at least as new as the file itself and the file's content type can be
+// determined from its extension. Returns false if nothing was served.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, dir, name, ext, encoding string) bool {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		return false
+	}
+
+	filePath := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+
+	info, err := os.Stat(filePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	f, err := os.Open(filePath + ext)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	compressedInfo, err := f.Stat()
+	if err != nil || !compressedInfo.Mode().IsRegular() || compressedInfo.ModTime().Before(info.ModTime()) {
+		return false
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Set("Content-Type", contentType)
+	weakenETag(w.Header())
+	http.ServeContent(w, r, name, info.ModTime(), f)
+	return true
+}
+
+// Serves a request through the given handler while compressing successful
+// responses with the given encoder.
+func serveEncoded(w http.ResponseWriter, r *http.Request, handler http.Handler,
+	encoding string, newEncoder func(io.Writer) io.WriteCloser,
+) {
+	// Ranges can't be served for content that's being encoded on the fly, so
+	// always serve the full response.
+	r = r.Clone(r.Context())
+	r.Header.Del("Range")
+
+	ew := &encodingResponseWriter{
+		ResponseWriter: w,
+		encoding:       encoding,
+		newEncoder:     newEncoder,
+	}
+	defer ew.Close()
+
+	handler.ServeHTTP(ew, r)
+}
+
+// An http.ResponseWriter that compresses the body of successful responses.
+// Other responses (like redirects, errors, or 304s) are passed through as is.
+type encodingResponseWriter struct {
+	http.ResponseWriter
+
+	encoder     io.WriteCloser
+	encoding    string
+	newEncoder  func(io.Writer) io.WriteCloser
+	wroteHeader bool
+}
+
+func (w *encodingResponseWriter) Close() error {
+	if w.encoder == nil {
+		return nil
+	}
+	return w.encoder.Close()
+}
+
+func (w *encodingResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *encodingResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if statusCode == http.StatusOK {
+		w.Header().Del("Accept-Ranges")
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", w.encoding)
+		weakenETag(w.Header())
+		w.encoder = w.newEncoder(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Marks a strong ETag set in the given headers as weak. Weak ETags are left as
+// they are.
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// The number of ports tried after the configured one when PortAutoIncrement is
+// enabled and the configured port is in use.
+const portAutoIncrementAttempts = 10
+
+// Listens on the given port. If autoIncrement is set and the port is already in
+// use, the next few ports are tried in turn. Returns the listener along with
+// the port that it's bound to.
+func listenOnPort(c *Context, port int, autoIncrement bool) (net.Listener, int, error) {
+	for attempt := 0; ; attempt++ {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+		if err == nil {
+			return listener, port, nil
+		}
+
+		if !autoIncrement || attempt >= portAutoIncrementAttempts || !errors.Is(err, unix.EADDRINUSE) {
+			return nil, 0, xerrors.Errorf("error listening on port %v: %w", port, err)
+		}
+
+		c.Log.Infof("Port %v is in use; trying port %v", port, port+1)
+		port++
+	}
+}
+
+// Builds the mux that routes requests to the HTTP server's handlers. The port
+// is the one the server is bound to, which the websocket JavaScript connects
+// back to.
+func newServeMux(c *Context, config *Config, port int, buildComplete *sync.Cond) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	var fileHandler http.Handler = getETagHandler(c.TargetDir, config.ContentETag,
+		getCompressedFileHandler(c.TargetDir, config.BrotliEncoder))
+	if config.NotFoundPath != "" {
+		fileHandler = getNotFoundHandler(c.TargetDir, config.NotFoundPath, fileHandler)
+	}
+
+	switch {
+	case config.MaintenancePage != "":
+		mux.Handle("/", getMaintenanceHandler(c, config.MaintenancePage))
+	case config.SPAFallback != "":
+		mux.Handle("/", getSPAFallbackHandler(c.TargetDir, config.SPAFallback, fileHandler))
+	default:
+		mux.Handle("/", fileHandler)
+	}
+
+	for pattern, newHandler := range config.Handlers {
+		mux.Handle(pattern, newHandler(c))
+	}
+
+	mux.HandleFunc("/_modulir/pause", getPauseHandler(c))
+	mux.HandleFunc("/_modulir/resume", getResumeHandler(c))
+
+	if c.Websocket {
+		mux.HandleFunc("/websocket.js", getWebsocketJSHandler(c, port))
+		mux.HandleFunc("/websocket", getWebsocketHandler(c, config, buildComplete))
+	}
+
+	return mux
+}
+
+// Responds to every request with the given maintenance page and a 503. The
+// page is read on each request so that changes to it show up right away.
+func getMaintenanceHandler(c *Context, page string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile(page)
+		if err != nil {
+			c.Log.Errorf("Error reading maintenance page: %v", err)
+			http.Error(w, "Error reading maintenance page", http.StatusInternalServerError)
+			return
+		}
+
+		contentType := mime.TypeByExtension(filepath.Ext(page))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		if _, err := w.Write(data); err != nil {
+			c.Log.Errorf("Error writing maintenance page: %v", err)
+		}
+	})
+}
+
+// Serves the given fallback file in dir with a 200 for requests that don't
+// resolve to an existing file or directory, so that a single-page app can
+// handle client-side routes like `/about`. Requests with a file extension are
+// assumed to be for assets and never fall back, so a missing asset is still a
+// 404. Everything else is passed through to next.
+func getSPAFallbackHandler(dir, fallback string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+
+		if path.Ext(name) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+fallback))))
+		if err != nil {
+			http.Error(w, "Error opening SPA fallback", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.Error(w, "Error opening SPA fallback", http.StatusInternalServerError)
+			return
+		}
+
+		http.ServeContent(w, r, fallback, info.ModTime(), f)
+	})
+}
+
+// Intercepts 404s from next and responds with the contents of the given
+// not found page in dir instead (still with a 404), like a deployed host would.
+// If the page itself is missing, next's response is passed through unchanged.
+func getNotFoundHandler(dir, notFoundPath string, next http.Handler) http.Handler {
+	pagePath := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+notFoundPath)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&notFoundResponseWriter{
+			ResponseWriter: w,
+			pagePath:       pagePath,
+			request:        r,
+		}, r)
+	})
+}
+
+// An http.ResponseWriter that replaces the body of 404 responses with the
+// contents of a not found page. See getNotFoundHandler.
+type notFoundResponseWriter struct {
+	http.ResponseWriter
+
+	intercepted bool
+	pagePath    string
+	request     *http.Request
+	wroteHeader bool
+}
+
+func (w *notFoundResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	// The original body is discarded in favor of the not found page.
+	if w.intercepted {
+		return len(data), nil
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *notFoundResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if statusCode != http.StatusNotFound {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	data, err := os.ReadFile(w.pagePath)
+	if err != nil {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	w.intercepted = true
+
+	contentType := mime.TypeByExtension(filepath.Ext(w.pagePath))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Del("X-Content-Type-Options")
+	w.Header().Set("Content-Type", contentType)
+	w.ResponseWriter.WriteHeader(statusCode)
+
+	if w.request.Method != http.MethodHead {
+		// Errors writing to the client aren't actionable, and the original
+		// handler's writes after this are discarded anyway.
+		_, _ = w.ResponseWriter.Write(data)
+	}
+}
+
+// Pauses rebuilds so that changes detected by the watcher are accumulated
+// instead of acted on until rebuilds are resumed.
+func getPauseHandler(c *Context) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if c.rebuildPauser.pause() {
+			c.Log.Infof("Rebuilds paused; changes will be accumulated until resumed")
+		}
+
+		fmt.Fprintln(w, "paused")
+	}
+}
+
+// Resumes rebuilds, triggering a single rebuild for any changes that were
+// accumulated while they were paused.
+func getResumeHandler(c *Context) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if c.rebuildPauser.resume() {
+			c.Log.Infof("Rebuilds resumed")
+		}
+
+		fmt.Fprintln(w, "resumed")
+	}
+}
+
+func getWebsocketHandler(c *Context, config *Config,
+	buildComplete *sync.Cond,
+) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The whole server is normally wrapped in basic auth, but check here
+		// as well so that a connection can never be upgraded without it.
+		if basicAuthEnabled(config) && !checkBasicAuth(config, r) {
+			challengeBasicAuth(w)
+			return
+		}
+
 		conn, err := websocketUpgrader.Upgrade(w, r, nil)
 		if err != nil {
 			c.Log.Errorf("Error upgrading websocket connection: %v", err)
@@ -123,11 +790,11 @@ func getWebsocketHandler(c *Context, buildComplete *sync.Cond) func(w http.Respo
 	}
 }
 
-func getWebsocketJSHandler(c *Context) func(w http.ResponseWriter, r *http.Request) {
+func getWebsocketJSHandler(c *Context, port int) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/javascript")
 		err := websocketJSTemplate.Execute(w, map[string]interface{}{
-			"Port": c.Port,
+			"Port": port,
 		})
 		if err != nil {
 			c.Log.Errorf("Error executing template/writing websocket.js: %v", err)
@@ -201,14 +868,15 @@ func websocketWritePump(c *Context, conn *websocket.Conn,
 	// This is a hack because of course there's no way to select on a
 	// conditional variable. Instead, we have a separate Goroutine wait on the
 	// conditional variable and signal the main select below through a channel.
-	buildCompleteChan := make(chan struct{}, 1)
+	buildCompleteChan := make(chan string, 1)
 	go func() {
 		for {
 			buildComplete.L.Lock()
 			buildComplete.Wait()
+			eventType := c.buildCompleteEvent
 			buildComplete.L.Unlock()
 
-			buildCompleteChan <- struct{}{}
+			buildCompleteChan <- eventType
 
 			// Break out of the Goroutine when we can to prevent a Goroutine
 			// leak.
@@ -237,12 +905,12 @@ func websocketWritePump(c *Context, conn *websocket.Conn,
 
 	for {
 		select {
-		case <-buildCompleteChan:
+		case eventType := <-buildCompleteChan:
 			if err := conn.SetWriteDeadline(time.Now().Add(websocketWriteWait)); err != nil {
 				c.Log.Errorf(logPrefix(c, conn)+"Couldn't set WebSocket read deadline: %v",
 					err)
 			}
-			writeErr = conn.WriteJSON(websocketEvent{Type: "build_complete"})
+			writeErr = conn.WriteJSON(websocketEvent{Type: eventType})
 
 			// Send shouldn't strictly need to be non-blocking, but we do one
 			// anyway just to hedge against future or unexpected problems so as
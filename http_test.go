@@ -1 +1,460 @@
 package modulir
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                 false,
+		"gzip":             true,
+		"deflate, gzip":    true,
+		"GZIP":             true,
+		"gzip;q=0.5":       true,
+		"gzip;q=0":         false,
+		"gzip; q=0.0, br":  false,
+		"deflate, br;q=1":  false,
+		"x-gzip, identity": false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", header)
+		assert.Equal(t, expected, acceptsEncoding(r, "gzip"), "header: %q", header)
+	}
+}
+
+func TestGetBasicAuthHandler(t *testing.T) {
+	config := &Config{BasicAuthUser: "user", BasicAuthPassword: "password"}
+	handler := getBasicAuthHandler(config, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	serve := func(user, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if user != "" || password != "" {
+			r.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("user", "password")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+
+	for _, creds := range [][2]string{{"", ""}, {"user", "wrong"}, {"wrong", "password"}, {"user", ""}} {
+		w := serve(creds[0], creds[1])
+		assert.Equal(t, http.StatusUnauthorized, w.Code, creds)
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+	}
+
+	// The websocket refuses unauthenticated upgrades on its own.
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+	w = httptest.NewRecorder()
+	getWebsocketHandler(c, config, nil)(w, httptest.NewRequest(http.MethodGet, "/websocket", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestGetCompressedFileHandler(t *testing.T) {
+	dir := t.TempDir()
+
+	html := strings.Repeat("<p>Hello, world.</p>", 100)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte(html), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "image.png"), []byte("png"), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "style.css"), []byte("body {}"), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "style.css.br"), []byte("brotli"), 0o600))
+
+	serve := func(handler http.Handler, path, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	handler := getCompressedFileHandler(dir, nil)
+
+	// Compressed with gzip on the fly.
+	{
+		w := serve(handler, "/", "gzip, br")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		assert.Equal(t, "", w.Header().Get("Content-Length"))
+
+		reader, err := gzip.NewReader(w.Body)
+		assert.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, html, string(data))
+	}
+
+	// Uncompressed for clients that don't accept an encoding.
+	{
+		w := serve(handler, "/", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, html, w.Body.String())
+	}
+
+	// Already compressed types are served as is.
+	{
+		w := serve(handler, "/image.png", "gzip")
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "png", w.Body.String())
+	}
+
+	// A precompressed Brotli sibling is preferred.
+	{
+		w := serve(handler, "/style.css", "gzip, br")
+		assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "text/css; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Equal(t, "brotli", w.Body.String())
+	}
+
+	// Errors aren't compressed.
+	{
+		w := serve(handler, "/missing.html", "gzip")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	}
+
+	// Brotli is encoded on the fly with an encoder.
+	{
+		handler := getCompressedFileHandler(dir, func(w io.Writer) io.WriteCloser {
+			return &upperCaseEncoder{w}
+		})
+
+		w := serve(handler, "/", "gzip, br")
+		assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, strings.ToUpper(html), w.Body.String())
+	}
+}
+
+// A stand-in for a Brotli encoder that upper cases everything written to it.
+type upperCaseEncoder struct {
+	w io.Writer
+}
+
+func (e *upperCaseEncoder) Close() error { return nil }
+
+func (e *upperCaseEncoder) Write(data []byte) (int, error) {
+	return e.w.Write(bytes.ToUpper(data))
+}
+
+func TestNewServeMuxMaintenancePage(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("index"), 0o600))
+
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	assert.NoError(t, os.WriteFile(page, []byte("Down for maintenance"), 0o600))
+
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}, TargetDir: dir})
+	mux := newServeMux(c, &Config{MaintenancePage: page}, c.Port, nil)
+
+	for _, path := range []string{"/", "/index.html", "/missing", "/nested/page/"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, path)
+		assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"), path)
+		assert.Equal(t, "Down for maintenance", w.Body.String(), path)
+	}
+
+	// Content is served normally without a maintenance page.
+	mux = newServeMux(c, &Config{}, c.Port, nil)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "index", w.Body.String())
+}
+
+func TestNewServeMuxHandlers(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("index"), 0o600))
+
+	log := &Logger{Level: LevelInfo}
+	c := NewContext(&Args{Log: log, Pool: NewPool(log, 4), TargetDir: dir})
+
+	// A stand-in for mmetrics, whose handler needs the context's pool.
+	mux := newServeMux(c, &Config{
+		Handlers: map[string]func(c *Context) http.Handler{
+			"/metrics": func(c *Context) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, "modulir_pool_concurrency %d\n", c.Pool.concurrency)
+				})
+			},
+		},
+	}, c.Port, nil)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := serve("/metrics")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "modulir_pool_concurrency 4\n", w.Body.String())
+
+	// Content is still served.
+	w = serve("/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "index", w.Body.String())
+}
+
+func TestNewServeMuxSPAFallback(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("app"), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "robots.txt"), []byte("robots"), 0o600))
+
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}, TargetDir: dir, Websocket: true})
+	mux := newServeMux(c, &Config{SPAFallback: "index.html"}, c.Port, nil)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	// Client-side routes get the fallback.
+	for _, path := range []string{"/about", "/posts/123/"} {
+		w := serve(path)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"), path)
+		assert.Equal(t, "app", w.Body.String(), path)
+	}
+
+	// Existing files are served as usual.
+	w := serve("/robots.txt")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "robots", w.Body.String())
+
+	// Missing assets don't fall back.
+	w = serve("/missing.js")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Websocket routes take precedence.
+	w = serve("/websocket.js")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/javascript", w.Header().Get("Content-Type"))
+}
+
+func TestListenOnPort(t *testing.T) {
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+
+	// Occupy a port chosen by the system.
+	busy, err := net.Listen("tcp", ":0")
+	assert.NoError(t, err)
+	defer busy.Close()
+
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+
+	_, _, err = listenOnPort(c, busyPort, false)
+	assert.ErrorIs(t, err, unix.EADDRINUSE)
+
+	listener, port, err := listenOnPort(c, busyPort, true)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	assert.Greater(t, port, busyPort)
+	assert.LessOrEqual(t, port, busyPort+portAutoIncrementAttempts)
+	assert.Equal(t, port, listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestNewServeMuxNotFoundPath(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("index"), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "404.html"), []byte("Not found!"), 0o600))
+
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}, TargetDir: dir})
+	mux := newServeMux(c, &Config{NotFoundPath: "404.html"}, c.Port, nil)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w := serve("/missing.html")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "Not found!", w.Body.String())
+
+	// Found files are unaffected.
+	w = serve("/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "index", w.Body.String())
+
+	// Falls back to the default response if the page is missing.
+	mux = newServeMux(c, &Config{NotFoundPath: "missing-404.html"}, c.Port, nil)
+	w = serve("/missing.html")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "404 page not found\n", w.Body.String())
+}
+
+func TestGetETagHandler(t *testing.T) {
+	dir := t.TempDir()
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("index"), 0o600))
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "index.html"), modTime, modTime))
+
+	handler := getETagHandler(dir, false, http.FileServer(http.Dir(dir)))
+
+	serve := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve("/", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "index", w.Body.String())
+	assert.Equal(t, modTime.Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+
+	etag := w.Header().Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`), "etag: %s", etag)
+
+	w = serve("/", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, "", w.Body.String())
+
+	w = serve("/", map[string]string{"If-None-Match": `W/"other", ` + etag})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = serve("/", map[string]string{"If-None-Match": `W/"other"`})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// If-None-Match takes precedence over If-Modified-Since.
+	w = serve("/", map[string]string{
+		"If-None-Match":     `W/"other"`,
+		"If-Modified-Since": modTime.Format(http.TimeFormat),
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serve("/", map[string]string{"If-Modified-Since": modTime.Format(http.TimeFormat)})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = serve("/", map[string]string{"If-Modified-Since": modTime.Add(-time.Second).Format(http.TimeFormat)})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Missing files are passed through without validators.
+	w = serve("/missing.html", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "", w.Header().Get("ETag"))
+}
+
+func TestGetETagHandler_ContentETag(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "index.html")
+
+	handler := getETagHandler(dir, true, http.FileServer(http.Dir(dir)))
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.NoError(t, os.WriteFile(target, []byte("index"), 0o600))
+
+	w := serve(nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, fmt.Sprintf(`"%x"`, sha256.Sum256([]byte("index"))), etag)
+
+	// Rewriting the file with the same contents and a new modification time
+	// leaves the ETag as it was.
+	modTime := time.Now().Add(time.Hour)
+	assert.NoError(t, os.WriteFile(target, []byte("index"), 0o600))
+	assert.NoError(t, os.Chtimes(target, modTime, modTime))
+
+	w = serve(map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, "", w.Body.String())
+
+	// Changing the contents changes the ETag.
+	assert.NoError(t, os.WriteFile(target, []byte("changed"), 0o600))
+
+	w = serve(map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "changed", w.Body.String())
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	// Compressed responses get a weak version of the ETag, which still
+	// validates the client's copy.
+	handler = getETagHandler(dir, true, getCompressedFileHandler(dir, nil))
+	etag = fmt.Sprintf(`"%x"`, sha256.Sum256([]byte("changed")))
+
+	w = serve(map[string]string{"Accept-Encoding": "gzip"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "W/"+etag, w.Header().Get("ETag"))
+
+	w = serve(map[string]string{"Accept-Encoding": "gzip", "If-None-Match": "W/" + etag})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// Uncompressed responses keep the strong ETag.
+	w = serve(nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+}
+
+func TestStartServingTargetDirHTTP_Listener(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("index"), 0o600))
+
+	c := NewContext(&Args{Log: &Logger{Level: LevelWarn}, TargetDir: dir})
+
+	// Listen on an ephemeral port to avoid conflicts.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server := startServingTargetDirHTTP(c, &Config{Listener: listener}, nil)
+	defer server.Close()
+
+	assert.Equal(t, listener.Addr().String(), server.Addr)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet,
+		"http://"+server.Addr+"/index.html", nil)
+	assert.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "index", string(body))
+}
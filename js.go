@@ -9,7 +9,9 @@ package modulir
 
 // Source: websocket.js
 const websocketJS = "function connect() {\n" +
-	"  var url = \"ws://localhost:{{.Port}}/websocket\";\n" +
+	"  // Pages served over TLS can only connect to secure websockets.\n" +
+	"  var scheme = location.protocol === \"https:\" ? \"wss\" : \"ws\";\n" +
+	"  var url = `${scheme}://localhost:{{.Port}}/websocket`;\n" +
 	"\n" +
 	"  console.log(`Connecting to Modulir: ${url}`);\n" +
 	"  var socket = new WebSocket(url);\n" +
@@ -43,6 +45,20 @@ const websocketJS = "function connect() {\n" +
 	"\n" +
 	"        break;\n" +
 	"\n" +
+	"      case \"css_reload\":\n" +
+	"        // Only stylesheets changed, so reload them in place by busting their\n" +
+	"        // cache with a query string instead of reloading the page. This keeps\n" +
+	"        // scroll position and form state.\n" +
+	"        console.log(\"Reloading stylesheets after receiving css_reload\");\n" +
+	"\n" +
+	"        document.querySelectorAll(\"link[rel=stylesheet]\").forEach(function(link) {\n" +
+	"          var url = new URL(link.href);\n" +
+	"          url.searchParams.set(\"modulir_reload\", Date.now());\n" +
+	"          link.href = url.toString();\n" +
+	"        });\n" +
+	"\n" +
+	"        break;\n" +
+	"\n" +
 	"      default:\n" +
 	"        console.log(`Don't know how to handle type '${data.type}'`);\n" +
 	"    }\n" +
@@ -1,5 +1,7 @@
 function connect() {
-  var url = "ws://localhost:{{.Port}}/websocket";
+  // Pages served over TLS can only connect to secure websockets.
+  var scheme = location.protocol === "https:" ? "wss" : "ws";
+  var url = `${scheme}://localhost:{{.Port}}/websocket`;
 
   console.log(`Connecting to Modulir: ${url}`);
   var socket = new WebSocket(url);
@@ -33,6 +35,20 @@ function connect() {
 
         break;
 
+      case "css_reload":
+        // Only stylesheets changed, so reload them in place by busting their
+        // cache with a query string instead of reloading the page. This keeps
+        // scroll position and form state.
+        console.log("Reloading stylesheets after receiving css_reload");
+
+        document.querySelectorAll("link[rel=stylesheet]").forEach(function(link) {
+          var url = new URL(link.href);
+          url.searchParams.set("modulir_reload", Date.now());
+          link.href = url.toString();
+        });
+
+        break;
+
       default:
         console.log(`Don't know how to handle type '${data.type}'`);
     }
@@ -1,11 +1,21 @@
 package mace
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"html/template"
 	"io"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template/parse"
+	"time"
 
 	"github.com/yosssi/ace"
 	"golang.org/x/xerrors"
@@ -13,7 +23,42 @@ import (
 	"github.com/brandur/modulir"
 )
 
+// AssetFS produces a function suitable for use as ace.Options.Asset that reads
+// templates from the given filesystem instead of from disk. This allows
+// templates to be bundled into a binary with `go:embed`:
+//
+//	//go:embed layouts views
+//	var templatesFS embed.FS
+//
+//	mace.Render(c, "layouts/main.ace", "views/index.ace", w,
+//	    &ace.Options{Asset: mace.AssetFS(templatesFS)}, locals)
+//
+// Template paths are interpreted relative to the root of the filesystem.
+func AssetFS(fsys fs.FS) func(name string) ([]byte, error) {
+	return func(name string) ([]byte, error) {
+		// Ace builds names with filepath.Join, but io/fs paths are always
+		// slash-separated and unrooted.
+		name = strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, xerrors.Errorf("error reading template '%s' from filesystem: %w", name, err)
+		}
+
+		return data, nil
+	}
+}
+
+// PageKey is the key in locals under which a page passed with
+// RenderOptions.Page is made available to templates (i.e. as `.Page`).
+const PageKey = "Page"
+
 // Load loads an Ace template.
+//
+// Templates are validated against the helpers in opts.FuncMap as they're
+// loaded, so a reference to a helper that doesn't exist (say because of a
+// typo) fails here rather than partway through a build. The returned error
+// lists every undefined helper referenced by the template.
 func Load(c *modulir.Context, basePath, innerPath string, opts *ace.Options) (*template.Template, error) {
 	if opts == nil {
 		opts = &ace.Options{}
@@ -37,6 +82,11 @@ func Load(c *modulir.Context, basePath, innerPath string, opts *ace.Options) (*t
 	// didn't set DynamicReload.
 	template, err := ace.Load(extlessBasePath, extlessInnerPath, opts)
 	if err != nil {
+		if undefined := undefinedFuncs(extlessBasePath, extlessInnerPath, opts, err); len(undefined) > 0 {
+			return nil, xerrors.Errorf("error loading Ace template '%s': undefined function(s): %s",
+				extlessInnerPath, strings.Join(undefined, ", "))
+		}
+
 		return nil, xerrors.Errorf("error loading Ace template '%s': %w", extlessInnerPath, err)
 	}
 
@@ -51,13 +101,133 @@ func Load(c *modulir.Context, basePath, innerPath string, opts *ace.Options) (*t
 func Render(c *modulir.Context, basePath, innerPath string, writer io.Writer,
 	opts *ace.Options, locals map[string]interface{},
 ) error {
+	return RenderWithOptions(c, basePath, innerPath, writer, opts, locals, nil)
+}
+
+// RenderOptions are options for RenderWithOptions.
+type RenderOptions struct {
+	// Page is a struct (or pointer to one) made available to templates under
+	// PageKey alongside locals. Unlike locals, its fields are checked by the
+	// compiler, so it's a good home for metadata common to every page like a
+	// title or publish date.
+	//
+	// Before rendering, any of its fields tagged with `mace:"required"` that
+	// have a zero value cause rendering to fail:
+	//
+	//	type Page struct {
+	//	    Title string `mace:"required"`
+	//	}
+	Page interface{}
+
+	// Strict causes rendering to fail if the template references a key that
+	// wasn't provided in locals. Keys provided in locals that the template
+	// never references are logged as warnings.
+	//
+	// Strict templates are always loaded fresh instead of coming from Ace's
+	// cache (because the missing key option would otherwise leak into
+	// non-strict renders of the same template), so this mode is somewhat
+	// slower and intended mainly for development.
+	Strict bool
+
+	// Timeout is the maximum amount of time that a template is given to
+	// execute, after which rendering fails with an error naming the view that
+	// wraps context.DeadlineExceeded. This protects the build from templates
+	// that hang (say because of a slow helper or a runaway loop).
+	//
+	// Go's templates can't be cancelled, so a template that times out is
+	// abandoned to finish executing in the background. Its output is buffered
+	// and discarded so that nothing is written after rendering has failed.
+	//
+	// Defaults to zero, which means no timeout.
+	Timeout time.Duration
+}
+
+// Site describes the build that a template is being rendered in. It's made
+// available to templates under SiteKey so that they can branch on it (e.g.
+// `{{if .Site.Production}}` to only include analytics in production) without
+// having the build's flags threaded through every set of locals.
+type Site struct {
+	// Draft is the rendering context's Draft.
+	Draft bool
+
+	// Production is the rendering context's Production.
+	Production bool
+}
+
+// SiteKey is the key in locals under which a Site is made available to
+// templates (i.e. as `.Site`) by every render function. It's not added if
+// locals already has a value for the key so that existing uses of it aren't
+// clobbered.
+const SiteKey = "Site"
+
+// RenderWithOptions is a shortcut for loading an Ace template and rendering it
+// to a target file.
+//
+// Unlike Render, its behavior can be tweaked.
+func RenderWithOptions(c *modulir.Context, basePath, innerPath string, writer io.Writer,
+	opts *ace.Options, locals map[string]interface{}, renderOpts *RenderOptions,
+) error {
+	strict := renderOpts != nil && renderOpts.Strict
+
+	if renderOpts != nil && renderOpts.Page != nil {
+		if err := validatePage(renderOpts.Page); err != nil {
+			return xerrors.Errorf("error validating page for view '%s': %w", innerPath, err)
+		}
+
+		if _, ok := locals[PageKey]; ok {
+			return xerrors.Errorf("local '%s' conflicts with page", PageKey)
+		}
+
+		locals = withLocal(locals, PageKey, renderOpts.Page)
+	}
+
+	_, hasSite := locals[SiteKey]
+	if !hasSite {
+		locals = withLocal(locals, SiteKey, &Site{
+			Draft:      c.Draft,
+			Production: c.Production,
+		})
+	}
+
+	if strict {
+		var strictOpts ace.Options
+		if opts != nil {
+			strictOpts = *opts
+		}
+		strictOpts.DynamicReload = true
+		opts = &strictOpts
+	}
+
 	template, err := Load(c, basePath, innerPath, opts)
 	if err != nil {
 		return xerrors.Errorf("error loading template: %w", err)
 	}
 
-	err = template.Execute(writer, locals)
+	if strict {
+		template.Option("missingkey=error")
+
+		for _, key := range unusedLocals(template, locals) {
+			// The site is added to every render, so it's fine not to use it.
+			if key == SiteKey && !hasSite {
+				continue
+			}
+
+			c.Log.Warnf("mace: Local '%s' passed to view '%s' but never referenced",
+				key, innerPath)
+		}
+	}
+
+	var timeout time.Duration
+	if renderOpts != nil {
+		timeout = renderOpts.Timeout
+	}
+
+	err = executeWithTimeout(template, writer, locals, timeout)
 	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return xerrors.Errorf("error rendering view '%s': timed out after %v: %w",
+				innerPath, timeout, err)
+		}
 		return xerrors.Errorf("error rendering template: %w", err)
 	}
 
@@ -65,30 +235,347 @@ func Render(c *modulir.Context, basePath, innerPath string, writer io.Writer,
 	return nil
 }
 
+// RenderChain renders an Ace view through an ordered chain of layouts, allowing
+// for inheritance hierarchies deeper than the single base and inner template
+// that Ace supports natively (e.g. site base → section layout → page).
+//
+// Layouts are ordered from outermost to innermost. The innermost layout is
+// rendered with the view as its inner template, and its output is then
+// injected into the `= yield main` of each successive outer layout.
+// Intermediate layouts should therefore be written like a base (with a `=
+// yield main`) rather than with `= content` blocks. All layouts receive the
+// same locals.
+func RenderChain(c *modulir.Context, layoutPaths []string, innerPath string, writer io.Writer,
+	opts *ace.Options, locals map[string]interface{},
+) error {
+	if len(layoutPaths) < 1 {
+		return xerrors.Errorf("at least one layout is required to render chain")
+	}
+
+	if opts == nil {
+		opts = &ace.Options{}
+	}
+
+	last := len(layoutPaths) - 1
+
+	var b bytes.Buffer
+	if err := Render(c, layoutPaths[last], innerPath, &b, opts, locals); err != nil {
+		return err
+	}
+
+	// Each outer layout is loaded with a synthetic inner template that does
+	// nothing but fill its yield with the content rendered so far. Options
+	// are copied so that the synthetic Asset function doesn't leak back to
+	// the caller.
+	chainOpts := *opts
+	chainOpts.Asset = chainAsset(opts)
+
+	for i := last - 1; i >= 0; i-- {
+		chainLocals := make(map[string]interface{}, len(locals)+1)
+		for k, v := range locals {
+			chainLocals[k] = v
+		}
+		chainLocals[chainContentKey] = template.HTML(b.String()) //nolint:gosec
+
+		b.Reset()
+		if err := Render(c, layoutPaths[i], chainInnerPath, &b, &chainOpts, chainLocals); err != nil {
+			return err
+		}
+	}
+
+	if _, err := b.WriteTo(writer); err != nil {
+		return xerrors.Errorf("error writing rendered chain: %w", err)
+	}
+
+	c.Log.Debugf("mace: Rendered view '%s' through chain %v", innerPath, layoutPaths)
+	return nil
+}
+
 // RenderFile is a shortcut for loading an Ace template and rendering it to a
 // target file.
 func RenderFile(c *modulir.Context, basePath, innerPath, target string,
 	opts *ace.Options, locals map[string]interface{},
 ) error {
-	template, err := Load(c, basePath, innerPath, opts)
-	if err != nil {
-		return xerrors.Errorf("error loading template: %w", err)
+	return RenderFileWithOptions(c, basePath, innerPath, target, opts, locals, nil)
+}
+
+// RenderFileWithOptions is a shortcut for loading an Ace template and
+// rendering it to a target file.
+//
+// Unlike RenderFile, its behavior can be tweaked.
+func RenderFileWithOptions(c *modulir.Context, basePath, innerPath, target string,
+	opts *ace.Options, locals map[string]interface{}, renderOpts *RenderOptions,
+) error {
+	// Render to a buffer first so that the target isn't created or truncated
+	// if rendering fails.
+	var b bytes.Buffer
+	if err := RenderWithOptions(c, basePath, innerPath, &b, opts, locals, renderOpts); err != nil {
+		return err
 	}
 
-	file, err := os.Create(target)
+	file, err := c.CreateTarget(target)
 	if err != nil {
-		return xerrors.Errorf("error creating target file: %w", err)
+		return err
 	}
 	defer file.Close()
 
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
+	if _, err := b.WriteTo(file); err != nil {
+		return xerrors.Errorf("error writing target file: %w", err)
+	}
 
-	err = template.Execute(writer, locals)
-	if err != nil {
-		return xerrors.Errorf("error rendering template: %w", err)
+	if err := file.Commit(); err != nil {
+		return xerrors.Errorf("error closing target file: %w", err)
 	}
 
 	c.Log.Debugf("mace: Rendered view '%s' to '%s'", innerPath, target)
 	return nil
 }
+
+//
+// Private
+//
+
+// Executes a template to writer, failing with an error wrapping
+// context.DeadlineExceeded if it doesn't finish within the given timeout. A
+// timeout of zero executes the template directly.
+//
+// Template execution can't be interrupted, so on a timeout the template is
+// left running in a goroutine. It renders to a buffer which is only copied to
+// writer on success so that an abandoned template never writes to it.
+func executeWithTimeout(tmpl *template.Template, writer io.Writer,
+	locals map[string]interface{}, timeout time.Duration,
+) error {
+	if timeout <= 0 {
+		return tmpl.Execute(writer, locals)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	var b bytes.Buffer
+
+	go func() {
+		done <- tmpl.Execute(&b, locals)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+
+		if _, err := b.WriteTo(writer); err != nil {
+			return xerrors.Errorf("error writing rendered template: %w", err)
+		}
+
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Key in the locals passed to outer layouts of a chain under which the
+// content rendered so far is stored.
+const chainContentKey = "_maceChainContent"
+
+// Name of the synthetic inner template used to inject content into outer
+// layouts of a chain. It never exists on disk and is served by chainAsset.
+const chainInnerPath = "_mace_chain"
+
+// Contents of the synthetic inner template used to inject content into outer
+// layouts of a chain.
+var chainInnerData = []byte("= content main\n  {{." + chainContentKey + "}}\n")
+
+// Produces an Ace Asset function that serves the synthetic chain inner
+// template, and otherwise falls back to the original options' Asset function
+// or the filesystem.
+func chainAsset(opts *ace.Options) func(string) ([]byte, error) {
+	ext := opts.Extension
+	if ext == "" {
+		ext = "ace"
+	}
+	chainInnerName := filepath.Join(opts.BaseDir, chainInnerPath+"."+ext)
+
+	return func(name string) ([]byte, error) {
+		if name == chainInnerName {
+			return chainInnerData, nil
+		}
+
+		if opts.Asset != nil {
+			return opts.Asset(name)
+		}
+
+		return os.ReadFile(name)
+	}
+}
+
+// Matches the error produced when parsing a template that references a
+// function that's not in its FuncMap, capturing the function's name.
+var undefinedFuncRE = regexp.MustCompile(`function "([^"]+)" not defined`)
+
+// Given an error from loading a template, returns the names of every function
+// referenced by the template but missing from opts.FuncMap, sorted for
+// stability. Returns nil if the error wasn't caused by an undefined function.
+//
+// Go's template parser stops at the first undefined function it finds, so
+// this works by repeatedly reloading the template with a stub standing in for
+// each function found so far until it loads cleanly or fails for some other
+// reason.
+func undefinedFuncs(basePath, innerPath string, opts *ace.Options, err error) []string {
+	// Stubbed templates must never make it into Ace's cache.
+	stubOpts := *opts
+	stubOpts.DynamicReload = true
+	stubOpts.FuncMap = make(template.FuncMap, len(opts.FuncMap))
+	for name, fn := range opts.FuncMap {
+		stubOpts.FuncMap[name] = fn
+	}
+
+	var undefined []string
+	for err != nil {
+		matches := undefinedFuncRE.FindStringSubmatch(err.Error())
+		if matches == nil {
+			break
+		}
+
+		name := matches[1]
+		if _, ok := stubOpts.FuncMap[name]; ok {
+			break
+		}
+
+		undefined = append(undefined, name)
+		stubOpts.FuncMap[name] = func(...interface{}) string { return "" }
+
+		_, err = ace.Load(basePath, innerPath, &stubOpts)
+	}
+
+	sort.Strings(undefined)
+	return undefined
+}
+
+// Checks that a page is a struct (or a pointer to one) and that none of its
+// fields tagged with `mace:"required"` are zero values. All missing fields are
+// listed in the returned error.
+func validatePage(page interface{}) error {
+	val := reflect.ValueOf(page)
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return xerrors.Errorf("page is a nil pointer")
+		}
+		val = val.Elem()
+	}
+
+	if val.Kind() != reflect.Struct {
+		return xerrors.Errorf("page must be a struct, but was %T", page)
+	}
+
+	var missing []string
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+		if field.Tag.Get("mace") != "required" {
+			continue
+		}
+
+		if val.Field(i).IsZero() {
+			missing = append(missing, field.Name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return xerrors.Errorf("page %T is missing required field(s): %s",
+			page, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// Returns the keys in locals that aren't referenced as a field anywhere in the
+// given template or any of its associated templates, sorted for stability.
+//
+// This is a conservative check in that a key is considered referenced if a
+// field of the same name appears anywhere, even if it's accessed on a value
+// other than the top-level locals.
+func unusedLocals(tmpl *template.Template, locals map[string]interface{}) []string {
+	referenced := make(map[string]struct{})
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			collectFieldNames(t.Tree.Root, referenced)
+		}
+	}
+
+	var unused []string
+	for key := range locals {
+		if _, ok := referenced[key]; !ok {
+			unused = append(unused, key)
+		}
+	}
+
+	sort.Strings(unused)
+	return unused
+}
+
+// Walks a template parse tree and adds the name of every field accessed in it
+// to the given set.
+func collectFieldNames(node parse.Node, names map[string]struct{}) {
+	switch n := node.(type) {
+	case *parse.ActionNode:
+		collectFieldNames(n.Pipe, names)
+	case *parse.ChainNode:
+		collectFieldNames(n.Node, names)
+		for _, field := range n.Field {
+			names[field] = struct{}{}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			collectFieldNames(arg, names)
+		}
+	case *parse.FieldNode:
+		for _, ident := range n.Ident {
+			names[ident] = struct{}{}
+		}
+	case *parse.IfNode:
+		collectFieldNames(&n.BranchNode, names)
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			collectFieldNames(child, names)
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			collectFieldNames(cmd, names)
+		}
+	case *parse.RangeNode:
+		collectFieldNames(&n.BranchNode, names)
+	case *parse.TemplateNode:
+		collectFieldNames(n.Pipe, names)
+	case *parse.VariableNode:
+		// The first identifier is the variable itself (e.g. `$`), and any
+		// that follow are fields on it.
+		for _, ident := range n.Ident[1:] {
+			names[ident] = struct{}{}
+		}
+	case *parse.WithNode:
+		collectFieldNames(&n.BranchNode, names)
+	case *parse.BranchNode:
+		collectFieldNames(n.Pipe, names)
+		collectFieldNames(n.List, names)
+		collectFieldNames(n.ElseList, names)
+	}
+}
+
+// Returns a copy of locals with the given key set to value so that the
+// addition doesn't leak back to the caller.
+func withLocal(locals map[string]interface{}, key string, value interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(locals)+1)
+	for k, v := range locals {
+		copied[k] = v
+	}
+	copied[key] = value
+	return copied
+}
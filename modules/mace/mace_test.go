@@ -0,0 +1,333 @@
+package mace
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+	"github.com/yosssi/ace"
+
+	"github.com/brandur/modulir/modules/mtesting"
+)
+
+//go:embed testdata/embed
+var testEmbedFS embed.FS
+
+func TestAssetFS(t *testing.T) {
+	fsys, err := fs.Sub(testEmbedFS, "testdata/embed")
+	assert.NoError(t, err)
+
+	var b bytes.Buffer
+	err = Render(mtesting.NewContext(), "base.ace", "page.ace", &b,
+		&ace.Options{Asset: AssetFS(fsys), DynamicReload: true},
+		map[string]interface{}{"Title": "Hello"})
+	assert.NoError(t, err)
+
+	assert.Equal(t,
+		`<!DOCTYPE html><html><body><p class="partial">Partial</p><p>Hello</p></body></html>`,
+		strings.TrimSpace(b.String()))
+
+	_, err = AssetFS(fsys)("missing.ace")
+	assert.Error(t, err)
+}
+
+func TestLoad_UndefinedFuncs(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTemplate(t, dir, "base.ace", `
+= doctype html
+html
+  body
+    p {{Titleize .Title}}
+    = yield main
+`)
+	writeTemplate(t, dir, "page.ace", `
+= content main
+  p {{Upcase .Title}}
+  p {{Known .Title}}
+  p {{Formatt .Title}}
+`)
+
+	opts := &ace.Options{
+		DynamicReload: true,
+		FuncMap: template.FuncMap{
+			"Known": func(s string) string { return s },
+		},
+	}
+
+	_, err := Load(mtesting.NewContext(), filepath.Join(dir, "base.ace"), filepath.Join(dir, "page.ace"), opts)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "undefined function(s): Formatt, Titleize, Upcase")
+
+	// The caller's FuncMap isn't modified.
+	assert.Len(t, opts.FuncMap, 1)
+
+	// Errors unrelated to functions are passed through.
+	_, err = Load(mtesting.NewContext(), filepath.Join(dir, "base.ace"), filepath.Join(dir, "missing.ace"), opts)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "undefined function(s)")
+}
+
+func TestRenderChain(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTemplate(t, dir, "base.ace", `
+= doctype html
+html
+  body
+    = yield main
+`)
+	writeTemplate(t, dir, "section.ace", `
+div.section
+  h1 {{.Section}}
+  = yield main
+`)
+	writeTemplate(t, dir, "page.ace", `
+= content main
+  p {{.Title}}
+`)
+
+	var b bytes.Buffer
+	err := RenderChain(mtesting.NewContext(),
+		[]string{filepath.Join(dir, "base.ace"), filepath.Join(dir, "section.ace")},
+		filepath.Join(dir, "page.ace"),
+		&b, &ace.Options{DynamicReload: true},
+		map[string]interface{}{"Section": "Articles", "Title": "Hello"})
+	assert.NoError(t, err)
+
+	assert.Equal(t,
+		`<!DOCTYPE html><html><body><div class="section"><h1>Articles</h1><p>Hello</p></div></body></html>`,
+		strings.TrimSpace(b.String()))
+}
+
+func TestRenderChain_NoLayouts(t *testing.T) {
+	var b bytes.Buffer
+	err := RenderChain(mtesting.NewContext(), nil, "page.ace", &b, nil, nil)
+	assert.EqualError(t, err, "at least one layout is required to render chain")
+}
+
+func TestRenderWithOptions_Site(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTemplate(t, dir, "base.ace", `
+= doctype html
+html
+  body
+    = yield main
+`)
+	writeTemplate(t, dir, "page.ace", `
+= content main
+  {{if .Site.Production}}
+    script src="/analytics.js"
+  {{end}}
+  p {{.Body}}
+`)
+
+	basePath := filepath.Join(dir, "base.ace")
+	innerPath := filepath.Join(dir, "page.ace")
+	locals := map[string]interface{}{"Body": "World"}
+
+	t.Run("Development", func(t *testing.T) {
+		var b bytes.Buffer
+		err := RenderWithOptions(mtesting.NewContext(), basePath, innerPath, &b,
+			nil, locals, nil)
+		assert.NoError(t, err)
+		assert.NotContains(t, b.String(), "analytics.js")
+		assert.Contains(t, b.String(), "<p>World</p>")
+	})
+
+	t.Run("Production", func(t *testing.T) {
+		c := mtesting.NewContext()
+		c.Production = true
+
+		var b bytes.Buffer
+		err := RenderWithOptions(c, basePath, innerPath, &b, nil, locals, nil)
+		assert.NoError(t, err)
+		assert.Contains(t, b.String(), `<script src="/analytics.js"></script>`)
+
+		// Locals passed in aren't modified.
+		assert.Equal(t, map[string]interface{}{"Body": "World"}, locals)
+	})
+
+	t.Run("ExistingLocal", func(t *testing.T) {
+		c := mtesting.NewContext()
+		c.Production = true
+
+		// A site passed in locals takes precedence.
+		var b bytes.Buffer
+		err := RenderWithOptions(c, basePath, innerPath, &b, nil,
+			map[string]interface{}{"Body": "World", SiteKey: &Site{}}, nil)
+		assert.NoError(t, err)
+		assert.NotContains(t, b.String(), "analytics.js")
+	})
+}
+
+func TestRenderWithOptions_Strict(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTemplate(t, dir, "base.ace", `
+= doctype html
+html
+  body
+    = yield main
+`)
+	writeTemplate(t, dir, "page.ace", `
+= content main
+  p {{.Titel}}
+`)
+
+	basePath := filepath.Join(dir, "base.ace")
+	innerPath := filepath.Join(dir, "page.ace")
+	locals := map[string]interface{}{"Title": "Hello"}
+
+	t.Run("NotStrict", func(t *testing.T) {
+		var b bytes.Buffer
+		err := RenderWithOptions(mtesting.NewContext(), basePath, innerPath, &b,
+			&ace.Options{DynamicReload: true}, locals, nil)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		var b bytes.Buffer
+		err := RenderWithOptions(mtesting.NewContext(), basePath, innerPath, &b,
+			nil, locals, &RenderOptions{Strict: true})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `map has no entry for key "Titel"`)
+	})
+}
+
+func TestRenderWithOptions_Page(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTemplate(t, dir, "base.ace", `
+= doctype html
+html
+  body
+    = yield main
+`)
+	writeTemplate(t, dir, "page.ace", `
+= content main
+  h1 {{.Page.Title}}
+  p {{.Body}}
+`)
+
+	type page struct {
+		Description string
+		Title       string `mace:"required"`
+	}
+
+	basePath := filepath.Join(dir, "base.ace")
+	innerPath := filepath.Join(dir, "page.ace")
+	locals := map[string]interface{}{"Body": "World"}
+
+	t.Run("Valid", func(t *testing.T) {
+		var b bytes.Buffer
+		err := RenderWithOptions(mtesting.NewContext(), basePath, innerPath, &b,
+			nil, locals, &RenderOptions{Page: &page{Title: "Hello"}})
+		assert.NoError(t, err)
+		assert.Contains(t, b.String(), "<h1>Hello</h1>")
+		assert.Contains(t, b.String(), "<p>World</p>")
+
+		// Locals passed in aren't modified.
+		assert.Equal(t, map[string]interface{}{"Body": "World"}, locals)
+	})
+
+	t.Run("MissingRequiredField", func(t *testing.T) {
+		var b bytes.Buffer
+		err := RenderWithOptions(mtesting.NewContext(), basePath, innerPath, &b,
+			nil, locals, &RenderOptions{Page: &page{Description: "A page"}})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "missing required field(s): Title")
+		assert.Empty(t, b.String())
+	})
+
+	t.Run("NotStruct", func(t *testing.T) {
+		var b bytes.Buffer
+		err := RenderWithOptions(mtesting.NewContext(), basePath, innerPath, &b,
+			nil, locals, &RenderOptions{Page: "Hello"})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "page must be a struct")
+	})
+}
+
+func TestRenderWithOptions_Timeout(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTemplate(t, dir, "base.ace", `
+= doctype html
+html
+  body
+    = yield main
+`)
+	writeTemplate(t, dir, "page.ace", `
+= content main
+  p {{slow}}
+`)
+
+	basePath := filepath.Join(dir, "base.ace")
+	innerPath := filepath.Join(dir, "page.ace")
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	opts := &ace.Options{
+		DynamicReload: true,
+		FuncMap: template.FuncMap{
+			"slow": func() string {
+				<-unblock
+				return "done"
+			},
+		},
+	}
+
+	var b bytes.Buffer
+	start := time.Now()
+	err := RenderWithOptions(mtesting.NewContext(), basePath, innerPath, &b,
+		opts, nil, &RenderOptions{Timeout: 50 * time.Millisecond})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "error rendering view '"+innerPath+"': timed out after 50ms")
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Nothing is written by an abandoned template.
+	assert.Equal(t, "", b.String())
+
+	// Templates that finish in time render normally.
+	opts.FuncMap["slow"] = func() string { return "fast" }
+	err = RenderWithOptions(mtesting.NewContext(), basePath, innerPath, &b,
+		opts, nil, &RenderOptions{Timeout: 5 * time.Second})
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`<!DOCTYPE html><html><body><p>fast</p></body></html>`,
+		strings.TrimSpace(b.String()))
+}
+
+func TestUnusedLocals(t *testing.T) {
+	tmpl := template.Must(template.New("test").Parse(
+		`{{.Used}} {{range .Items}}{{.Nested}}{{end}} {{with $.Other}}{{end}}`))
+
+	assert.Equal(t,
+		[]string{"Stale", "Typo"},
+		unusedLocals(tmpl, map[string]interface{}{
+			"Items": nil,
+			"Other": nil,
+			"Stale": nil,
+			"Typo":  nil,
+			"Used":  nil,
+		}),
+	)
+}
+
+func writeTemplate(t *testing.T, dir, name, data string) {
+	t.Helper()
+
+	err := os.WriteFile(filepath.Join(dir, name), []byte(strings.TrimSpace(data)+"\n"), 0o600)
+	assert.NoError(t, err)
+}
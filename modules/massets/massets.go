@@ -0,0 +1,238 @@
+// Package massets provides a validation helper that checks that every static
+// asset (stylesheets, scripts, images, fonts, etc.) referenced from a built
+// site actually exists in its target directory.
+package massets
+
+import (
+	"bytes"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/xerrors"
+
+	"github.com/brandur/modulir"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Public
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// MissingAsset is a reference to a static asset that doesn't exist in the
+// target directory.
+type MissingAsset struct {
+	// Path is the path on disk where the asset was expected to be found.
+	Path string
+
+	// Ref is the reference to the asset exactly as it appeared in Source.
+	Ref string
+
+	// Source is the path of the HTML or CSS file containing the reference.
+	Source string
+}
+
+// Report is the result of validating assets in a target directory.
+type Report struct {
+	// Missing are references to assets that don't exist, sorted by source and
+	// then by reference.
+	Missing []*MissingAsset
+
+	// NumChecked is the total number of asset references that were checked.
+	NumChecked int
+}
+
+// OK returns true if no assets were missing.
+func (r *Report) OK() bool {
+	return len(r.Missing) < 1
+}
+
+// Validate walks the given target directory, scans every HTML and CSS file
+// for references to local static assets, and reports any that don't exist.
+//
+// In HTML, assets are the targets of `src` and `srcset` attributes, `href`s on
+// `<link>` elements, and `url(...)`s in inline styles. Links to other pages
+// (i.e. `href`s on `<a>` elements) aren't considered. In CSS, assets are the
+// targets of `url(...)`.
+//
+// References to remote URLs, `data:` URIs, and fragments are skipped. Paths
+// starting with `/` are resolved relative to the target directory and all
+// others relative to the directory of the file that contains them.
+func Validate(c *modulir.Context, targetDir string) (*Report, error) {
+	report := &Report{}
+
+	err := filepath.WalkDir(targetDir, func(source string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		var refs []string
+		switch strings.ToLower(filepath.Ext(source)) {
+		case ".css":
+			data, err := os.ReadFile(source)
+			if err != nil {
+				return xerrors.Errorf("error reading file: %w", err)
+			}
+			refs = extractCSSRefs(data)
+
+		case ".htm", ".html":
+			data, err := os.ReadFile(source)
+			if err != nil {
+				return xerrors.Errorf("error reading file: %w", err)
+			}
+			refs, err = extractHTMLRefs(data)
+			if err != nil {
+				return xerrors.Errorf("error parsing HTML in '%s': %w", source, err)
+			}
+
+		default:
+			return nil
+		}
+
+		for _, ref := range refs {
+			assetPath, ok := resolveRef(targetDir, source, ref)
+			if !ok {
+				continue
+			}
+
+			report.NumChecked++
+
+			if _, err := os.Stat(assetPath); err != nil {
+				if !os.IsNotExist(err) {
+					return xerrors.Errorf("error checking asset '%s': %w", assetPath, err)
+				}
+
+				report.Missing = append(report.Missing,
+					&MissingAsset{Path: assetPath, Ref: ref, Source: source})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("error validating assets: %w", err)
+	}
+
+	sort.SliceStable(report.Missing, func(i, j int) bool {
+		if report.Missing[i].Source != report.Missing[j].Source {
+			return report.Missing[i].Source < report.Missing[j].Source
+		}
+		return report.Missing[i].Ref < report.Missing[j].Ref
+	})
+
+	c.Log.Debugf("massets: Validated %v asset reference(s) in '%s'; %v missing",
+		report.NumChecked, targetDir, len(report.Missing))
+	return report, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Matches a CSS `url(...)` with optional quotes.
+var cssURLRE = regexp.MustCompile(`url\(\s*['"]?([^'")]+?)['"]?\s*\)`)
+
+func extractCSSRefs(data []byte) []string {
+	matches := cssURLRE.FindAllSubmatch(data, -1)
+
+	refs := make([]string, 0, len(matches))
+	for _, match := range matches {
+		refs = append(refs, string(match[1]))
+	}
+	return refs
+}
+
+func extractHTMLRefs(data []byte) ([]string, error) {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, xerrors.Errorf("error parsing HTML: %w", err)
+	}
+
+	var refs []string
+
+	var walk func(*html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode {
+			for _, attr := range node.Attr {
+				switch {
+				case attr.Key == "src":
+					refs = append(refs, attr.Val)
+
+				case attr.Key == "srcset":
+					refs = append(refs, parseSrcset(attr.Val)...)
+
+				case attr.Key == "href" && node.Data == "link":
+					refs = append(refs, attr.Val)
+
+				case attr.Key == "style":
+					refs = append(refs, extractCSSRefs([]byte(attr.Val))...)
+				}
+			}
+
+			if node.Data == "style" && node.FirstChild != nil {
+				refs = append(refs, extractCSSRefs([]byte(node.FirstChild.Data))...)
+			}
+		}
+
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+
+	return refs, nil
+}
+
+// Extracts the URLs from a srcset value like `a@2x.jpg 2x, a.jpg 1x`.
+func parseSrcset(srcset string) []string {
+	var refs []string
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) > 0 {
+			refs = append(refs, fields[0])
+		}
+	}
+	return refs
+}
+
+// Resolves an asset reference to a path on disk. Returns false if the
+// reference isn't to a local asset and shouldn't be checked.
+func resolveRef(targetDir, source, ref string) (string, bool) {
+	ref = strings.TrimSpace(ref)
+
+	if ref == "" || strings.HasPrefix(ref, "#") || strings.HasPrefix(ref, "//") {
+		return "", false
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+
+	if strings.HasPrefix(u.Path, "/") {
+		return filepath.Join(targetDir, filepath.FromSlash(path.Clean(u.Path))), true
+	}
+
+	return filepath.Join(filepath.Dir(source), filepath.FromSlash(u.Path)), true
+}
@@ -0,0 +1,80 @@
+package massets
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/brandur/modulir/modules/mtesting"
+)
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFile(t, dir, "index.html", `<!DOCTYPE html>
+<html>
+<head>
+  <link rel="stylesheet" href="/assets/app.css">
+  <script src="/assets/app.js"></script>
+</head>
+<body>
+  <a href="/articles/missing-page">Pages aren't assets</a>
+  <a href="https://example.com">Neither are remote links</a>
+  <img src="images/photo.jpg" srcset="images/photo@2x.jpg 2x, images/photo.jpg 1x">
+  <img src="data:image/png;base64,iVBORw0KGgo=">
+  <img src="https://example.com/remote.jpg">
+</body>
+</html>`)
+	writeFile(t, dir, "assets/app.css", `
+@font-face {
+  font-family: "Body";
+  src: url("/assets/fonts/body.woff2") format("woff2"),
+       url('../assets/fonts/missing.woff') format("woff");
+}
+body { background: url(/assets/bg.png?v=1#frag); }
+`)
+	writeFile(t, dir, "assets/app.js", "")
+	writeFile(t, dir, "assets/bg.png", "")
+	writeFile(t, dir, "assets/fonts/body.woff2", "")
+	writeFile(t, dir, "images/photo.jpg", "")
+
+	report, err := Validate(mtesting.NewContext(), dir)
+	assert.NoError(t, err)
+
+	assert.False(t, report.OK())
+	assert.Equal(t, 8, report.NumChecked)
+	assert.Equal(t, []*MissingAsset{
+		{
+			Path:   filepath.Join(dir, "assets/fonts/missing.woff"),
+			Ref:    "../assets/fonts/missing.woff",
+			Source: filepath.Join(dir, "assets/app.css"),
+		},
+		{
+			Path:   filepath.Join(dir, "images/photo@2x.jpg"),
+			Ref:    "images/photo@2x.jpg",
+			Source: filepath.Join(dir, "index.html"),
+		},
+	}, report.Missing)
+}
+
+func TestValidate_OK(t *testing.T) {
+	dir := t.TempDir()
+
+	writeFile(t, dir, "index.html", `<link rel="stylesheet" href="/app.css">`)
+	writeFile(t, dir, "app.css", `body { color: red; }`)
+
+	report, err := Validate(mtesting.NewContext(), dir)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 1, report.NumChecked)
+}
+
+func writeFile(t *testing.T, dir, name, data string) {
+	t.Helper()
+
+	target := filepath.Join(dir, name)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(target), 0o755))
+	assert.NoError(t, os.WriteFile(target, []byte(data), 0o600))
+}
@@ -1,11 +1,16 @@
 package matom
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"io"
+	"os"
+	"sync"
 	"time"
 
 	"golang.org/x/xerrors"
+
+	"github.com/brandur/modulir"
 )
 
 // Category is a category of an Atom entry.
@@ -92,3 +97,97 @@ func (f *Feed) Encode(w io.Writer, indent string) error {
 
 	return nil
 }
+
+// EntryCache caches rendered feed entries keyed by the path of the source
+// they were generated from. This allows feeds to be regenerated on every build
+// while only re-rendering the entries whose sources actually changed, as
+// determined by modulir.Context.Changed.
+//
+// The cache may be persisted to disk with Save and restored with
+// LoadEntryCache so that it survives across process restarts.
+type EntryCache struct {
+	entries map[string]*cachedEntry
+	mu      sync.Mutex
+}
+
+// NewEntryCache initializes and returns a new, empty EntryCache.
+func NewEntryCache() *EntryCache {
+	return &EntryCache{entries: make(map[string]*cachedEntry)}
+}
+
+// LoadEntryCache loads an EntryCache previously persisted with Save. If no
+// file exists at the given path, an empty cache is returned.
+func LoadEntryCache(path string) (*EntryCache, error) {
+	cache := NewEntryCache()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("error reading entry cache: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		return nil, xerrors.Errorf("error unmarshaling entry cache: %w", err)
+	}
+
+	// A file containing `null` unmarshals to a nil map.
+	if cache.entries == nil {
+		cache.entries = make(map[string]*cachedEntry)
+	}
+
+	return cache, nil
+}
+
+// Entry returns the entry for the given source path. If the context reports
+// that the source hasn't changed and an entry for it is cached, the cached
+// entry is returned. Otherwise, render is invoked to produce a fresh one which
+// is cached for next time.
+func (ec *EntryCache) Entry(c *modulir.Context, source string, render func() (*Entry, error)) (*Entry, error) {
+	// Always call Changed so that the source is tracked and watched, even if
+	// it has no cached entry yet.
+	changed := c.Changed(source)
+
+	ec.mu.Lock()
+	cached, ok := ec.entries[source]
+	ec.mu.Unlock()
+
+	if ok && !changed {
+		return cached.Entry, nil
+	}
+
+	entry, err := render()
+	if err != nil {
+		return nil, err
+	}
+
+	ec.mu.Lock()
+	ec.entries[source] = &cachedEntry{Entry: entry}
+	ec.mu.Unlock()
+
+	return entry, nil
+}
+
+// Save persists the cache to the given path so that it can be restored with
+// LoadEntryCache.
+func (ec *EntryCache) Save(path string) error {
+	ec.mu.Lock()
+	data, err := json.Marshal(ec.entries)
+	ec.mu.Unlock()
+
+	if err != nil {
+		return xerrors.Errorf("error marshaling entry cache: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return xerrors.Errorf("error writing entry cache: %w", err)
+	}
+
+	return nil
+}
+
+// A single entry in an EntryCache.
+type cachedEntry struct {
+	Entry *Entry `json:"entry"`
+}
@@ -3,11 +3,97 @@ package matom
 import (
 	"bytes"
 	"encoding/xml"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/require"
+
+	"github.com/brandur/modulir/modules/mtesting"
 )
 
+func TestEntryCache(t *testing.T) {
+	dir := t.TempDir()
+
+	sources := []string{filepath.Join(dir, "a.md"), filepath.Join(dir, "b.md")}
+	for _, source := range sources {
+		assert.NoError(t, os.WriteFile(source, []byte(source), 0o600))
+	}
+
+	c := mtesting.NewContext()
+
+	rendered := make(map[string]int)
+	buildEntries := func(cache *EntryCache) []*Entry {
+		// Finish the round so that the context considers seen sources
+		// unchanged until they're modified.
+		defer c.ResetBuild()
+
+		entries := make([]*Entry, len(sources))
+		for i, source := range sources {
+			source := source
+
+			entry, err := cache.Entry(c, source, func() (*Entry, error) {
+				rendered[source]++
+				return &Entry{
+					Title:   filepath.Base(source),
+					Content: &EntryContent{Content: "Content of " + source, Type: "html"},
+				}, nil
+			})
+			assert.NoError(t, err)
+
+			entries[i] = entry
+		}
+		return entries
+	}
+
+	cache := NewEntryCache()
+
+	// First build renders everything.
+	entries := buildEntries(cache)
+	assert.Equal(t, map[string]int{sources[0]: 1, sources[1]: 1}, rendered)
+
+	// Round trip the cache through disk to simulate a new process.
+	cachePath := filepath.Join(dir, "entry_cache.json")
+	assert.NoError(t, cache.Save(cachePath))
+	cache, err := LoadEntryCache(cachePath)
+	assert.NoError(t, err)
+
+	// Change one source.
+	later := time.Now().Add(1 * time.Hour)
+	assert.NoError(t, os.Chtimes(sources[1], later, later))
+
+	// Second build only renders the changed entry, and cached entries are
+	// equivalent to what was rendered originally.
+	cachedEntries := buildEntries(cache)
+	assert.Equal(t, map[string]int{sources[0]: 1, sources[1]: 2}, rendered)
+	assert.Equal(t, entries, cachedEntries)
+}
+
+func TestLoadEntryCache_Null(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "entry_cache.json")
+	assert.NoError(t, os.WriteFile(cachePath, []byte("null"), 0o600))
+
+	cache, err := LoadEntryCache(cachePath)
+	assert.NoError(t, err)
+	assert.Empty(t, cache.entries)
+
+	// Storing an entry doesn't panic on a nil map.
+	source := filepath.Join(t.TempDir(), "a.md")
+	assert.NoError(t, os.WriteFile(source, []byte("a"), 0o600))
+	_, err = cache.Entry(mtesting.NewContext(), source, func() (*Entry, error) {
+		return &Entry{Title: "a"}, nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, cache.entries, 1)
+}
+
+func TestLoadEntryCache_NotExist(t *testing.T) {
+	cache, err := LoadEntryCache(filepath.Join(t.TempDir(), "not_exist.json"))
+	assert.NoError(t, err)
+	assert.Empty(t, cache.entries)
+}
+
 func TestFeed(t *testing.T) {
 	f := &Feed{
 		Title: "My Blog",
@@ -0,0 +1,507 @@
+// Package mcontent provides helpers for working with collections of content
+// like articles or posts that are common to many static sites.
+package mcontent
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/brandur/modulir"
+	"github.com/brandur/modulir/modules/mfile"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Public
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// DateLayouts are the layouts accepted by ParseDate, tried in order. Layouts
+// with a time zone are listed before those without one so that an explicit
+// zone is always respected.
+var DateLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04 -0700",
+	time.RFC1123Z,
+	time.RFC1123,
+
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"January 2, 2006",
+	"Jan 2, 2006",
+}
+
+// Granularity is the length of the periods that items are grouped into by
+// GroupByPeriod.
+type Granularity int
+
+// Granularities at which items can be grouped by GroupByPeriod.
+const (
+	GranularityYear Granularity = iota
+	GranularityMonth
+)
+
+// JSONPage is the document written for each page by WriteJSONPages.
+type JSONPage struct {
+	// Items are the serialized items on the page.
+	Items []interface{} `json:"items"`
+
+	// Next is the URL path of the next page, or nil if this is the last one.
+	Next *string `json:"next"`
+
+	// Page is the page's 1-based number.
+	Page int `json:"page"`
+
+	// Prev is the URL path of the previous page, or nil if this is the first
+	// one.
+	Prev *string `json:"prev"`
+
+	// TotalItems is the number of items across all pages.
+	TotalItems int `json:"total_items"`
+
+	// TotalPages is the number of pages.
+	TotalPages int `json:"total_pages"`
+}
+
+// Page is a page of items, as returned by Paginate.
+type Page[T any] struct {
+	// Items are the items on the page, in the order they were given.
+	Items []T
+
+	// Next is the following page, or nil if this is the last one.
+	Next *Page[T]
+
+	// Number is the page's 1-based number.
+	Number int
+
+	// Prev is the preceding page, or nil if this is the first one.
+	Prev *Page[T]
+}
+
+// PeriodGroup is a group of items that fall within the same period, as
+// returned by GroupByPeriod.
+type PeriodGroup[T any] struct {
+	// Items are the items within the period, in the order they were given.
+	Items []T
+
+	// Next is the group for the closest later period that has items, or nil
+	// if this is the latest one.
+	Next *PeriodGroup[T]
+
+	// Prev is the group for the closest earlier period that has items, or nil
+	// if this is the earliest one.
+	Prev *PeriodGroup[T]
+
+	// Start is the beginning of the period (e.g. midnight on January 1st for
+	// a year) in the location of the dates of its items.
+	Start time.Time
+}
+
+// Tag is a single tag in a TagIndex along with the items carrying it.
+type Tag[T any] struct {
+	// Items are the items carrying the tag, in the order they were given.
+	// An item appears only once even if it carries the tag more than once.
+	Items []T
+
+	// Name is the tag as it should be displayed, which is the first spelling
+	// of it that was encountered (with surrounding whitespace trimmed).
+	Name string
+
+	// Slug is the normalized form of the tag, suitable for use in URLs, under
+	// which its variants are indexed. See TagSlug.
+	Slug string
+
+	// Variants are the distinct spellings of the tag that were encountered,
+	// in the order they were first seen. There's more than one if the tag
+	// was spelled inconsistently (e.g. "Postgres" and "postgres").
+	Variants []string
+}
+
+// Count returns the number of items carrying the tag.
+func (t *Tag[T]) Count() int {
+	return len(t.Items)
+}
+
+// TagIndex maps tags to the items carrying them, as built by BuildTagIndex.
+type TagIndex[T any] struct {
+	// Tags are the tags in the index keyed by their slugs.
+	Tags map[string]*Tag[T]
+}
+
+// ByCount returns the index's tags ordered by the number of items carrying
+// them, most first, which is the usual order for a tag cloud. Ties are broken
+// by slug.
+func (i *TagIndex[T]) ByCount() []*Tag[T] {
+	tags := i.BySlug()
+	sort.SliceStable(tags, func(a, b int) bool {
+		return tags[a].Count() > tags[b].Count()
+	})
+	return tags
+}
+
+// BySlug returns the index's tags ordered alphabetically by slug.
+func (i *TagIndex[T]) BySlug() []*Tag[T] {
+	tags := make([]*Tag[T], 0, len(i.Tags))
+	for _, tag := range i.Tags {
+		tags = append(tags, tag)
+	}
+
+	sort.Slice(tags, func(a, b int) bool {
+		return tags[a].Slug < tags[b].Slug
+	})
+	return tags
+}
+
+// Duplicates returns the index's tags that were spelled more than one way,
+// ordered by slug.
+func (i *TagIndex[T]) Duplicates() []*Tag[T] {
+	var duplicates []*Tag[T]
+	for _, tag := range i.BySlug() {
+		if len(tag.Variants) > 1 {
+			duplicates = append(duplicates, tag)
+		}
+	}
+	return duplicates
+}
+
+// BuildTagIndex builds an index of the tags returned by tagsOf for each of
+// items, which is useful for rendering tag pages and tag clouds. Tags are
+// normalized with TagSlug, so spellings that differ only in case or
+// whitespace are indexed together, and a warning is logged for each tag that
+// was spelled more than one way so that its spellings can be made consistent.
+func BuildTagIndex[T any](c *modulir.Context, items []T, tagsOf func(T) []string) *TagIndex[T] {
+	index := &TagIndex[T]{Tags: make(map[string]*Tag[T])}
+
+	for _, item := range items {
+		seen := make(map[string]struct{})
+
+		for _, variant := range tagsOf(item) {
+			slug := TagSlug(variant)
+			if slug == "" {
+				continue
+			}
+
+			tag, ok := index.Tags[slug]
+			if !ok {
+				tag = &Tag[T]{Name: strings.TrimSpace(variant), Slug: slug}
+				index.Tags[slug] = tag
+			}
+
+			if !containsString(tag.Variants, variant) {
+				tag.Variants = append(tag.Variants, variant)
+			}
+
+			if _, ok := seen[slug]; ok {
+				continue
+			}
+			seen[slug] = struct{}{}
+
+			tag.Items = append(tag.Items, item)
+		}
+	}
+
+	for _, tag := range index.Duplicates() {
+		quoted := make([]string, len(tag.Variants))
+		for i, variant := range tag.Variants {
+			quoted[i] = "'" + variant + "'"
+		}
+
+		c.Log.Warnf("mcontent: Tags %s differ only in case or whitespace; indexed together as '%s'",
+			strings.Join(quoted, ", "), tag.Slug)
+	}
+
+	return index
+}
+
+// FilterDrafts excludes items for which isDraft returns true (e.g. those with
+// `draft: true` in their frontmatter) if the context is building for
+// production, and otherwise returns items unchanged so that drafts can be
+// previewed in development. Call it on each collection that should hide
+// drafts before passing it to feeds, sitemaps, and index listings.
+//
+// The order of items is preserved. items isn't modified.
+func FilterDrafts[T any](c *modulir.Context, items []T, isDraft func(T) bool) []T {
+	if !c.Production {
+		return items
+	}
+
+	published := make([]T, 0, len(items))
+	for _, item := range items {
+		if !isDraft(item) {
+			published = append(published, item)
+		}
+	}
+	return published
+}
+
+// GroupByPeriod groups items by the year or month of the date returned by
+// dateOf, which is useful for rendering an archive page per period. Groups are
+// returned in the order that their first item appears in items, so passing
+// items sorted by date (e.g. most recent first) yields groups in the same
+// order. Regardless of order, each group's Prev and Next link to its
+// chronological neighbours.
+func GroupByPeriod[T any](items []T, dateOf func(T) time.Time, granularity Granularity) []*PeriodGroup[T] {
+	var groups []*PeriodGroup[T]
+	groupsByStart := make(map[time.Time]*PeriodGroup[T])
+
+	for _, item := range items {
+		start := periodStart(dateOf(item), granularity)
+
+		group, ok := groupsByStart[start]
+		if !ok {
+			group = &PeriodGroup[T]{Start: start}
+			groups = append(groups, group)
+			groupsByStart[start] = group
+		}
+
+		group.Items = append(group.Items, item)
+	}
+
+	chronological := make([]*PeriodGroup[T], len(groups))
+	copy(chronological, groups)
+	sort.SliceStable(chronological, func(i, j int) bool {
+		return chronological[i].Start.Before(chronological[j].Start)
+	})
+
+	for i, group := range chronological {
+		if i > 0 {
+			group.Prev = chronological[i-1]
+		}
+		if i < len(chronological)-1 {
+			group.Next = chronological[i+1]
+		}
+	}
+
+	return groups
+}
+
+// Paginate splits items into pages of at most perPage items each, which is
+// useful for rendering paginated indexes or API endpoints. There's always at
+// least one page, which is empty if there are no items. A perPage of zero or
+// less puts every item on a single page.
+func Paginate[T any](items []T, perPage int) []*Page[T] {
+	if perPage <= 0 {
+		perPage = len(items)
+	}
+
+	pages := []*Page[T]{{Number: 1}}
+	for i, item := range items {
+		page := pages[len(pages)-1]
+
+		if i > 0 && i%perPage == 0 {
+			page = &Page[T]{Number: len(pages) + 1, Prev: page}
+			pages[len(pages)-1].Next = page
+			pages = append(pages, page)
+		}
+
+		page.Items = append(page.Items, item)
+	}
+
+	return pages
+}
+
+// ParseDate parses a date like one found in a piece of content's frontmatter
+// using any of DateLayouts. If the date doesn't specify a time zone, it's
+// assumed to be in defaultLoc (or UTC if defaultLoc is nil). The returned time
+// is always normalized to defaultLoc so that dates from different sources
+// render and sort consistently.
+func ParseDate(s string, defaultLoc *time.Location) (time.Time, error) {
+	if defaultLoc == nil {
+		defaultLoc = time.UTC
+	}
+
+	s = strings.TrimSpace(s)
+
+	for _, layout := range DateLayouts {
+		t, err := time.ParseInLocation(layout, s, defaultLoc)
+		if err == nil {
+			return t.In(defaultLoc), nil
+		}
+	}
+
+	return time.Time{}, xerrors.Errorf("error parsing date '%s': doesn't match any known layout", s)
+}
+
+// Related finds items related to the current item by scoring each one in all
+// by the number of tags it shares with the current item, and returns the top
+// n. The current item is excluded, as are any items that share no tags at all.
+//
+// Ties are broken by the order of items in all, so pass them in a stable,
+// meaningful order (e.g. sorted by published date, most recent first) to get
+// deterministic results.
+func Related[T comparable](current T, all []T, tagsOf func(T) []string, n int) []T {
+	currentTags := make(map[string]struct{})
+	for _, tag := range tagsOf(current) {
+		currentTags[tag] = struct{}{}
+	}
+
+	scored := make([]scoredItem[T], 0, len(all))
+	for _, item := range all {
+		if item == current {
+			continue
+		}
+
+		score := 0
+		seen := make(map[string]struct{})
+		for _, tag := range tagsOf(item) {
+			if _, ok := seen[tag]; ok {
+				continue
+			}
+			seen[tag] = struct{}{}
+
+			if _, ok := currentTags[tag]; ok {
+				score++
+			}
+		}
+
+		if score > 0 {
+			scored = append(scored, scoredItem[T]{item, score})
+		}
+	}
+
+	// Stable so that ties retain the order they had in all.
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].score > scored[j].score
+	})
+
+	if n >= 0 && len(scored) > n {
+		scored = scored[0:n]
+	}
+
+	related := make([]T, len(scored))
+	for i, s := range scored {
+		related[i] = s.item
+	}
+	return related
+}
+
+// TagSlug normalizes a tag for use in a URL by lowercasing it and replacing
+// runs of whitespace with single hyphens, so "Rate  Limiting " becomes
+// "rate-limiting".
+func TagSlug(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(tag)), "-")
+}
+
+// WriteJSONPages writes items as a paginated JSON API (see JSONPage) into the
+// context's TargetDir so that a static site can double as a simple read-only
+// API for client-side apps. Items are split into pages with Paginate.
+//
+// pathFor returns the URL path of the page with the given number (e.g.
+// `/api/posts.json` for page 1 and `/api/posts/2.json` for the others), which
+// is used for next and previous links, and as the page's path relative to
+// TargetDir. serialize selects the fields of an item to include, usually by
+// returning a map or a struct with JSON tags.
+func WriteJSONPages[T any](c *modulir.Context, items []T, perPage int,
+	pathFor func(page int) string, serialize func(T) interface{},
+) error {
+	pages := Paginate(items, perPage)
+
+	for _, page := range pages {
+		doc := JSONPage{
+			Items:      make([]interface{}, len(page.Items)),
+			Page:       page.Number,
+			TotalItems: len(items),
+			TotalPages: len(pages),
+		}
+
+		for i, item := range page.Items {
+			doc.Items[i] = serialize(item)
+		}
+
+		if page.Next != nil {
+			next := pathFor(page.Next.Number)
+			doc.Next = &next
+		}
+
+		if page.Prev != nil {
+			prev := pathFor(page.Prev.Number)
+			doc.Prev = &prev
+		}
+
+		if err := writeJSONPage(c, c.TargetPath(pathFor(page.Number)), &doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Returns whether the given slice contains the given string.
+func containsString(s []string, needle string) bool {
+	for _, v := range s {
+		if v == needle {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the start of the period at the given granularity that contains t.
+func periodStart(t time.Time, granularity Granularity) time.Time {
+	switch granularity {
+	case GranularityMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// Writes a single page for WriteJSONPages to the given target.
+func writeJSONPage(c *modulir.Context, target string, doc *JSONPage) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return xerrors.Errorf("error encoding JSON page %d: %w", doc.Page, err)
+	}
+
+	if err := mfile.EnsureDir(c, filepath.Dir(target)); err != nil {
+		return err
+	}
+
+	file, err := c.CreateTarget(target)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return xerrors.Errorf("error writing JSON page: %w", err)
+	}
+
+	if err := file.Commit(); err != nil {
+		return xerrors.Errorf("error closing JSON page: %w", err)
+	}
+
+	c.Log.Debugf("mcontent: Wrote JSON page %d to '%s'", doc.Page, target)
+	return nil
+}
+
+// An item paired with its score when calculating related items.
+type scoredItem[T any] struct {
+	item  T
+	score int
+}
@@ -0,0 +1,330 @@
+package mcontent
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/brandur/modulir"
+)
+
+type testItem struct {
+	Draft       bool
+	Name        string
+	PublishedAt time.Time
+	Tags        []string
+}
+
+func TestBuildTagIndex(t *testing.T) {
+	log := &recordingLogger{}
+	c := modulir.NewContext(&modulir.Args{Log: log})
+
+	items := []*testItem{
+		{Name: "a", Tags: []string{"Go", "postgres"}},
+		{Name: "b", Tags: []string{"go", "Rate Limiting", "GO"}},
+		{Name: "c", Tags: []string{"postgres", " rate  limiting", ""}},
+		{Name: "d", Tags: []string{"go"}},
+	}
+
+	index := BuildTagIndex(c, items, func(item *testItem) []string { return item.Tags })
+
+	names := func(items []*testItem) []string {
+		names := make([]string, len(items))
+		for i, item := range items {
+			names[i] = item.Name
+		}
+		return names
+	}
+
+	assert.Len(t, index.Tags, 3)
+
+	goTag := index.Tags["go"]
+	assert.Equal(t, "Go", goTag.Name)
+	assert.Equal(t, []string{"a", "b", "d"}, names(goTag.Items))
+	assert.Equal(t, 3, goTag.Count())
+	assert.Equal(t, []string{"Go", "go", "GO"}, goTag.Variants)
+
+	rateLimitingTag := index.Tags["rate-limiting"]
+	assert.Equal(t, "Rate Limiting", rateLimitingTag.Name)
+	assert.Equal(t, []string{"b", "c"}, names(rateLimitingTag.Items))
+
+	slugs := func(tags []*Tag[*testItem]) []string {
+		slugs := make([]string, len(tags))
+		for i, tag := range tags {
+			slugs[i] = tag.Slug
+		}
+		return slugs
+	}
+
+	assert.Equal(t, []string{"go", "postgres", "rate-limiting"}, slugs(index.BySlug()))
+	assert.Equal(t, []string{"go", "postgres", "rate-limiting"}, slugs(index.ByCount()))
+	assert.Equal(t, []string{"go", "rate-limiting"}, slugs(index.Duplicates()))
+
+	assert.Equal(t, []string{
+		"mcontent: Tags 'Go', 'go', 'GO' differ only in case or whitespace; indexed together as 'go'",
+		"mcontent: Tags 'Rate Limiting', ' rate  limiting' differ only in case or whitespace; " +
+			"indexed together as 'rate-limiting'",
+	}, log.warnings)
+}
+
+func TestFilterDrafts(t *testing.T) {
+	items := []*testItem{
+		{Name: "a"},
+		{Name: "b", Draft: true},
+		{Name: "c"},
+	}
+
+	isDraft := func(item *testItem) bool { return item.Draft }
+
+	names := func(items []*testItem) []string {
+		names := make([]string, len(items))
+		for i, item := range items {
+			names[i] = item.Name
+		}
+		return names
+	}
+
+	dev := modulir.NewContext(&modulir.Args{})
+	assert.Equal(t, []string{"a", "b", "c"}, names(FilterDrafts(dev, items, isDraft)))
+
+	prod := modulir.NewContext(&modulir.Args{Production: true})
+	assert.Equal(t, []string{"a", "c"}, names(FilterDrafts(prod, items, isDraft)))
+
+	// The original collection is left intact.
+	assert.Len(t, items, 3)
+}
+
+func TestGroupByPeriod(t *testing.T) {
+	// Ordered by date, most recent first, as a caller would normally do.
+	items := []*testItem{
+		{Name: "2022-02-b", PublishedAt: time.Date(2022, 2, 20, 0, 0, 0, 0, time.UTC)},
+		{Name: "2022-02-a", PublishedAt: time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "2022-01", PublishedAt: time.Date(2022, 1, 31, 23, 59, 0, 0, time.UTC)},
+		{Name: "2021-12", PublishedAt: time.Date(2021, 12, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "2019-06", PublishedAt: time.Date(2019, 6, 15, 0, 0, 0, 0, time.UTC)},
+	}
+
+	dateOf := func(item *testItem) time.Time { return item.PublishedAt }
+
+	type group struct {
+		start      time.Time
+		names      []string
+		prev, next *time.Time
+	}
+
+	simplify := func(groups []*PeriodGroup[*testItem]) []group {
+		simplified := make([]group, len(groups))
+		for i, g := range groups {
+			simplified[i] = group{start: g.Start}
+			for _, item := range g.Items {
+				simplified[i].names = append(simplified[i].names, item.Name)
+			}
+			if g.Prev != nil {
+				simplified[i].prev = &g.Prev.Start
+			}
+			if g.Next != nil {
+				simplified[i].next = &g.Next.Start
+			}
+		}
+		return simplified
+	}
+
+	date := func(year int, month time.Month) *time.Time {
+		t := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+		return &t
+	}
+
+	assert.Equal(t,
+		[]group{
+			{*date(2022, 1), []string{"2022-02-b", "2022-02-a", "2022-01"}, date(2021, 1), nil},
+			{*date(2021, 1), []string{"2021-12"}, date(2019, 1), date(2022, 1)},
+			{*date(2019, 1), []string{"2019-06"}, nil, date(2021, 1)},
+		},
+		simplify(GroupByPeriod(items, dateOf, GranularityYear)),
+	)
+
+	assert.Equal(t,
+		[]group{
+			{*date(2022, 2), []string{"2022-02-b", "2022-02-a"}, date(2022, 1), nil},
+			{*date(2022, 1), []string{"2022-01"}, date(2021, 12), date(2022, 2)},
+			{*date(2021, 12), []string{"2021-12"}, date(2019, 6), date(2022, 1)},
+			{*date(2019, 6), []string{"2019-06"}, nil, date(2021, 12)},
+		},
+		simplify(GroupByPeriod(items, dateOf, GranularityMonth)),
+	)
+
+	assert.Empty(t, GroupByPeriod(nil, dateOf, GranularityYear))
+}
+
+func TestRelated(t *testing.T) {
+	now := time.Now()
+
+	current := &testItem{Name: "current", Tags: []string{"go", "postgres", "testing"}}
+
+	// Ordered by date, most recent first, as a caller would normally do.
+	all := []*testItem{
+		{Name: "newest-one-tag", PublishedAt: now, Tags: []string{"go"}},
+		current,
+		{Name: "two-tags", PublishedAt: now.Add(-1 * time.Hour), Tags: []string{"go", "postgres"}},
+		{Name: "no-tags", PublishedAt: now.Add(-2 * time.Hour), Tags: []string{"ruby"}},
+		{Name: "three-tags", PublishedAt: now.Add(-3 * time.Hour), Tags: []string{"go", "postgres", "testing"}},
+		{Name: "older-one-tag", PublishedAt: now.Add(-4 * time.Hour), Tags: []string{"testing", "testing"}},
+	}
+
+	tagsOf := func(item *testItem) []string { return item.Tags }
+
+	names := func(items []*testItem) []string {
+		names := make([]string, len(items))
+		for i, item := range items {
+			names[i] = item.Name
+		}
+		return names
+	}
+
+	assert.Equal(t,
+		[]string{"three-tags", "two-tags", "newest-one-tag", "older-one-tag"},
+		names(Related(current, all, tagsOf, 10)),
+	)
+
+	assert.Equal(t,
+		[]string{"three-tags", "two-tags", "newest-one-tag"},
+		names(Related(current, all, tagsOf, 3)),
+	)
+
+	assert.Equal(t,
+		[]string{},
+		names(Related(current, all, tagsOf, 0)),
+	)
+}
+
+func TestPaginate(t *testing.T) {
+	numbers := func(pages []*Page[int]) [][]int {
+		items := make([][]int, len(pages))
+		for i, page := range pages {
+			assert.Equal(t, i+1, page.Number)
+			items[i] = page.Items
+
+			if i > 0 {
+				assert.Same(t, pages[i-1], page.Prev)
+			} else {
+				assert.Nil(t, page.Prev)
+			}
+
+			if i < len(pages)-1 {
+				assert.Same(t, pages[i+1], page.Next)
+			} else {
+				assert.Nil(t, page.Next)
+			}
+		}
+		return items
+	}
+
+	assert.Equal(t, [][]int{{1, 2}, {3, 4}, {5}}, numbers(Paginate([]int{1, 2, 3, 4, 5}, 2)))
+	assert.Equal(t, [][]int{{1, 2}, {3, 4}}, numbers(Paginate([]int{1, 2, 3, 4}, 2)))
+	assert.Equal(t, [][]int{{1, 2, 3}}, numbers(Paginate([]int{1, 2, 3}, 0)))
+	assert.Equal(t, [][]int{nil}, numbers(Paginate([]int{}, 2)))
+}
+
+func TestParseDate(t *testing.T) {
+	pacific, err := time.LoadLocation("America/Los_Angeles")
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		in       string
+		loc      *time.Location
+		expected time.Time
+	}{
+		{"2021-03-04T05:06:07Z", nil, time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)},
+		{"2021-03-04T05:06:07.123Z", nil, time.Date(2021, 3, 4, 5, 6, 7, 123000000, time.UTC)},
+		{"2021-03-04T05:06:07-08:00", nil, time.Date(2021, 3, 4, 13, 6, 7, 0, time.UTC)},
+		{"2021-03-04 05:06:07 -0800", nil, time.Date(2021, 3, 4, 13, 6, 7, 0, time.UTC)},
+		{"2021-03-04T05:06:07", nil, time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)},
+		{"2021-03-04 05:06", nil, time.Date(2021, 3, 4, 5, 6, 0, 0, time.UTC)},
+		{" 2021-03-04 ", nil, time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{"March 4, 2021", nil, time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{"Mar 4, 2021", nil, time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)},
+
+		// Dates without a zone are in the default location, and those with
+		// one are normalized to it.
+		{"2021-03-04", pacific, time.Date(2021, 3, 4, 0, 0, 0, 0, pacific)},
+		{"2021-03-04T08:00:00Z", pacific, time.Date(2021, 3, 4, 0, 0, 0, 0, pacific)},
+	}
+
+	for _, tc := range testCases {
+		actual, err := ParseDate(tc.in, tc.loc)
+		assert.NoError(t, err, tc.in)
+		assert.True(t, tc.expected.Equal(actual), "%s: expected %v, got %v", tc.in, tc.expected, actual)
+
+		expectedLoc := tc.loc
+		if expectedLoc == nil {
+			expectedLoc = time.UTC
+		}
+		assert.Equal(t, expectedLoc, actual.Location(), tc.in)
+	}
+
+	_, err = ParseDate("not a date", nil)
+	assert.EqualError(t, err, "error parsing date 'not a date': doesn't match any known layout")
+}
+
+func TestWriteJSONPages(t *testing.T) {
+	c := modulir.NewContext(&modulir.Args{
+		Log:       &modulir.Logger{Level: modulir.LevelInfo},
+		TargetDir: t.TempDir(),
+	})
+
+	items := []*testItem{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	pathFor := func(page int) string {
+		if page == 1 {
+			return "/api/posts.json"
+		}
+		return fmt.Sprintf("/api/posts/%d.json", page)
+	}
+
+	err := WriteJSONPages(c, items, 2, pathFor, func(item *testItem) interface{} {
+		return map[string]string{"name": item.Name}
+	})
+	assert.NoError(t, err)
+
+	readPage := func(path string) string {
+		data, err := os.ReadFile(c.TargetPath(path))
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	assert.JSONEq(t, `{
+		"items": [{"name": "a"}, {"name": "b"}],
+		"next": "/api/posts/2.json",
+		"page": 1,
+		"prev": null,
+		"total_items": 3,
+		"total_pages": 2
+	}`, readPage("/api/posts.json"))
+
+	assert.JSONEq(t, `{
+		"items": [{"name": "c"}],
+		"next": null,
+		"page": 2,
+		"prev": "/api/posts.json",
+		"total_items": 3,
+		"total_pages": 2
+	}`, readPage("/api/posts/2.json"))
+}
+
+// A logger that records warnings so that they can be asserted against.
+type recordingLogger struct {
+	warnings []string
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) {}
+
+func (l *recordingLogger) Errorf(format string, v ...interface{}) {}
+
+func (l *recordingLogger) Infof(format string, v ...interface{}) {}
+
+func (l *recordingLogger) Warnf(format string, v ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, v...))
+}
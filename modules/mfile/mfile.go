@@ -6,6 +6,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	gocache "github.com/patrickmn/go-cache"
@@ -32,7 +33,7 @@ func CopyFile(c *modulir.Context, source, target string) error {
 	}
 	defer in.Close()
 
-	out, err := os.Create(target)
+	out, err := c.CreateTarget(target)
 	if err != nil {
 		return xerrors.Errorf("error creating copy target: %w", err)
 	}
@@ -43,6 +44,10 @@ func CopyFile(c *modulir.Context, source, target string) error {
 		return xerrors.Errorf("error copying data: %w", err)
 	}
 
+	if err := out.Commit(); err != nil {
+		return xerrors.Errorf("error closing copy target: %w", err)
+	}
+
 	c.Log.Debugf("mfile: Copied '%s' to '%s'", source, target)
 	return nil
 }
@@ -176,6 +181,8 @@ func MustAbs(path string) string {
 // an underscore), and Vim backup (i.e. suffixed with a tilde) files, and
 // returns a list of full paths (easier to plumb into other functions), and
 // sets up a watch on the listed source.
+//
+// The directory is read from the context's FS if one is set.
 func ReadDir(c *modulir.Context, source string) ([]string, error) {
 	return ReadDirWithOptions(c, source, nil)
 }
@@ -205,9 +212,13 @@ type ReadDirOptions struct {
 // some amount of time to make it faster. The downside of this of course is
 // that we occasionally get a stale cache when a new file is added and don't
 // see it.
+//
+// If the context has a watcher, cached results are expired as soon as a
+// change is detected within their directory (or any subdirectory).
 func ReadDirCached(c *modulir.Context, source string,
 	opts *ReadDirOptions,
 ) ([]string, error) {
+	subscribeReadDirCache(c)
 	// Try to use a result from an expiring cache to speed up build loops that
 	// run within close proximity of each other. Listing files is one of the
 	// slower operations throughout the build loop, so this helps speed it up
@@ -238,7 +249,7 @@ func ReadDirCached(c *modulir.Context, source string,
 func ReadDirWithOptions(c *modulir.Context, source string,
 	opts *ReadDirOptions,
 ) ([]string, error) {
-	infos, err := os.ReadDir(source)
+	infos, err := c.ReadDir(source)
 	if err != nil {
 		return nil, xerrors.Errorf("error reading directory: %w", err)
 	}
@@ -300,10 +311,61 @@ func ReadDirWithOptions(c *modulir.Context, source string,
 // directory) for some period of time. It turns out these calls are relatively
 // slow and this helps speed up the build loop.
 //
-// The downside is that new files are not discovered right away, and often
-// necessitate a server restart. A future improvement might be to have Modulir
-// provide a simplified events channel that we can listen to in order to expire
-// entries from the cache.
+// The downside is that new files are not discovered right away. When running
+// with a watcher, entries are expired early by subscribing to the context's
+// watch events (see subscribeReadDirCache), but only for changes in
+// directories being watched.
 //
 // Arguments are (defaultExpiration, cleanupInterval).
 var readDirCache = gocache.New(5*time.Minute, 10*time.Minute)
+
+// Makes sure that subscribeReadDirCache only subscribes once. The cache is
+// global, so one subscription is enough.
+var readDirCacheSubscribeOnce sync.Once
+
+// Expires entries in readDirCache for the directory containing the given
+// changed path along with any of its parents (whose results may include it if
+// they were read recursively). Entries for the path itself are also expired in
+// case it was a directory.
+func expireReadDirCache(c *modulir.Context, changedPath string) {
+	changedPath = absPath(changedPath)
+	changedDir := filepath.Dir(changedPath)
+
+	for source := range readDirCache.Items() {
+		sourcePath := absPath(source)
+
+		if sourcePath == changedPath || sourcePath == changedDir ||
+			strings.HasPrefix(changedDir, sourcePath+string(filepath.Separator)) {
+			c.Log.Debugf("mfile: Expiring cached results of ReadDir: %s", source)
+			readDirCache.Delete(source)
+		}
+	}
+}
+
+// Returns the absolute version of the given path, or the cleaned path if it
+// can't be made absolute.
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
+
+// Subscribes to the context's watch events so that entries in readDirCache are
+// expired as changes are detected. Does nothing if the context has no watcher.
+func subscribeReadDirCache(c *modulir.Context) {
+	if c.Watcher == nil {
+		return
+	}
+
+	readDirCacheSubscribeOnce.Do(func() {
+		events := c.WatchEvents()
+
+		go func() {
+			for event := range events {
+				expireReadDirCache(c, event.Path)
+			}
+		}()
+	})
+}
@@ -1,5 +1,90 @@
 package mfile
 
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/brandur/modulir/modules/mtesting"
+)
+
+func TestReadDirFS(t *testing.T) {
+	c := mtesting.NewContextWithFS(fstest.MapFS{
+		"content/a.md":        &fstest.MapFile{Data: []byte("a")},
+		"content/_meta.md":    &fstest.MapFile{Data: []byte("meta")},
+		"content/.hidden":     &fstest.MapFile{Data: []byte("hidden")},
+		"content/b.md~":       &fstest.MapFile{Data: []byte("backup")},
+		"content/sub/c.md":    &fstest.MapFile{Data: []byte("c")},
+		"other/not-listed.md": &fstest.MapFile{Data: []byte("other")},
+	})
+
+	files, err := ReadDir(c, "content")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"content/a.md"}, files)
+
+	files, err = ReadDirWithOptions(c, "content", &ReadDirOptions{RecurseDirs: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"content/a.md", "content/sub/c.md"}, files)
+
+	_, err = ReadDir(c, "missing")
+	assert.Error(t, err)
+}
+
+func TestCopyFileGzip(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.txt")
+	target := filepath.Join(dir, "target.txt")
+
+	err := os.WriteFile(source, []byte("hello, world"), 0o600)
+	assert.NoError(t, err)
+
+	c := mtesting.NewContext()
+	c.Gzip = true
+
+	err = CopyFile(c, source, target)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world", string(data))
+
+	gzipFile, err := os.Open(target + ".gz")
+	assert.NoError(t, err)
+	defer gzipFile.Close()
+
+	gzipReader, err := gzip.NewReader(gzipFile)
+	assert.NoError(t, err)
+
+	data, err = io.ReadAll(gzipReader)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world", string(data))
+}
+
+func TestExpireReadDirCache(t *testing.T) {
+	c := mtesting.NewContext()
+
+	readDirCache.SetDefault("content", []string{"content/a.md"})
+	readDirCache.SetDefault("content/sub", []string{"content/sub/b.md"})
+	readDirCache.SetDefault("other", []string{"other/c.md"})
+	defer readDirCache.Flush()
+
+	// Expires the directory containing the change and its parents, but not
+	// unrelated directories.
+	expireReadDirCache(c, "content/sub/new.md")
+
+	_, ok := readDirCache.Get("content")
+	assert.False(t, ok)
+	_, ok = readDirCache.Get("content/sub")
+	assert.False(t, ok)
+	_, ok = readDirCache.Get("other")
+	assert.True(t, ok)
+}
+
 // Hopefully the beginnings of getting some testing started.
 /*
 import (
@@ -4,16 +4,20 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	gocache "github.com/patrickmn/go-cache"
@@ -33,22 +37,109 @@ import (
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// AVIFEncBin is the location of the `avifenc` binary that ships with the
+// libavif project (an AVIF encoder). If configured, sizes with a Format of
+// PhotoFormatAVIF are resized by ImageMagick into an intermediate PNG which is
+// then encoded by avifenc, which tends to produce better results than
+// ImageMagick's own AVIF encoder.
+var AVIFEncBin string
+
+// HTTPClient is the client used by FetchAndResizeImage to fetch images. Its
+// timeout bounds the entire fetch, including reading the response body, so
+// that a hung server can't stall a build indefinitely. Replace it to change
+// the timeout or customize things like its transport.
+//
+// Defaults to a client with a 60 second timeout that follows up to 10
+// redirects, but won't follow one from HTTPS to plain HTTP. If set to nil,
+// http.DefaultClient is used instead.
+var HTTPClient = &http.Client{
+	CheckRedirect: checkRedirect,
+	Timeout:       60 * time.Second,
+}
+
+// JPEGQuality is the quality (from 1 to 100) at which resized images are
+// encoded, which can be overridden for individual sizes with
+// PhotoSize.Quality. It's mainly meaningful for lossy formats like JPEG, WebP,
+// and AVIF. It's passed to ImageMagick for PNGs as well, which interprets it
+// as a compression level instead.
+//
+// Defaults to 85.
+var JPEGQuality = 85
+
+// KeepColorProfile causes the ICC color profile of resized images to be kept
+// when StripMetadata is set so that their colors display correctly, while
+// other metadata like EXIF (which may contain GPS coordinates) is still
+// removed. It only applies to images resized with ImageMagick. Those resized
+// in pure Go never keep any metadata, including color profiles.
+//
+// Defaults to false.
+var KeepColorProfile = false
+
 // MagickBin is the location of the `magick` binary that ships with the
-// ImageMagick project (an image manipulation utility).
+// ImageMagick project (an image manipulation utility). It's used to resize
+// images if configured.
 //
-// Must be configured to use this package.
+// If left unset, JPEGs and PNGs are resized in pure Go instead, which needs
+// no external binaries but is slower and always crops from the center of an
+// image regardless of gravity. Other formats need ImageMagick (see
+// RequireMagick).
 var MagickBin string
 
+// MozJPEGArgs are extra arguments passed to mozjpeg's `cjpeg` (see
+// MozJPEGBin) after the ones that modulir always passes, like
+// `[]string{"-quant-table", "3"}`.
+//
+// Defaults to no extra arguments.
+var MozJPEGArgs []string
+
 // MozJPEGBin is the location of the `cjpeg` binary that ships with the mozjpeg
 // project (a JPG optimizer). If configured, JPEGs are passed through an
-// optimization pass after resizing them.
+// optimization pass after resizing them, which re-encodes them at the same
+// quality as they were resized at (see JPEGQuality).
 var MozJPEGBin string
 
+// RequireMagick indicates whether ImageMagick is required to be configured
+// (via MagickBin) for images that can't be resized in pure Go (i.e. those that
+// aren't JPEGs or PNGs) to be resized. When it is and MagickBin is unset,
+// resizing them fails with an error.
+//
+// Set this to false to allow contributors without the full image toolchain
+// installed to build a site. In that case, a warning is logged and such
+// images are copied to their targets unchanged instead of being resized, except
+// for sizes with a Format, which are skipped. No marker is written so that images are properly resized on the next build
+// where ImageMagick is available.
+//
+// Defaults to true.
+var RequireMagick = true
+
+// ResizeConcurrency is the maximum number of sizes of a single image that
+// ResizeImage resizes at once. Builds already resize many images in parallel,
+// so it's kept small to avoid starting too many ImageMagick processes, but
+// lets a large photo's sizes be generated together instead of one by one.
+//
+// Defaults to 4. Values less than 1 are treated as 1.
+var ResizeConcurrency = 4
+
+// PNGQuantArgs are extra arguments passed to `pngquant` (see PNGQuantBin)
+// after the ones that modulir always passes, like
+// `[]string{"--quality", "65-80"}`.
+//
+// Defaults to no extra arguments.
+var PNGQuantArgs []string
+
 // PNGQuantBin is the location of the `pnqquant` binary (a PNG optimizer). If
 // configured, PNGs are passed through an optimization pass after resizing
 // them.
 var PNGQuantBin string
 
+// StripMetadata causes metadata like EXIF, which may contain the GPS
+// coordinates of where a photo was taken, to be removed from resized images
+// for privacy. Set it to false to keep metadata like copyright information in
+// resized images, or see KeepColorProfile to keep only the color profile.
+//
+// Defaults to true.
+var StripMetadata = true
+
 // TempDir is a path to a temporary directory where fetched images can be
 // stored.
 var TempDir string
@@ -74,6 +165,16 @@ type PhotoCropSettings struct {
 	Portrait string
 }
 
+// PhotoFormat is an image format that a PhotoSize can be encoded to
+// independent of the format of the original image.
+type PhotoFormat string
+
+// Possible options for photo formats. Both need ImageMagick (see MagickBin).
+const (
+	PhotoFormatAVIF PhotoFormat = "avif"
+	PhotoFormatWebP PhotoFormat = "webp"
+)
+
 // PhotoGravity is the crop gravity for ImageMagick.
 type PhotoGravity string
 
@@ -95,6 +196,36 @@ type PhotoSize struct {
 	Suffix       string
 	Width        int
 	CropSettings *PhotoCropSettings
+
+	// AllowUpscale allows images narrower than Width (after cropping) to be
+	// enlarged to it. Enlarged images tend to look blurry, so by default
+	// they're left at their original width instead.
+	//
+	// Defaults to false.
+	AllowUpscale bool
+
+	// Format is a format that this size is encoded to, which is used in
+	// place of the target extension passed to FetchAndResizeImage or
+	// ResizeImage. This allows, for example, a JPEG to be resized into both a
+	// JPEG and a WebP of the same width that can be served from a `<picture>`
+	// element.
+	//
+	// Defaults to an empty string, which encodes to the target extension.
+	Format PhotoFormat
+
+	// Quality overrides JPEGQuality for this size only, which allows say
+	// higher quality hero images and more aggressively compressed thumbnails
+	// to be produced in the same build.
+	//
+	// Defaults to JPEGQuality.
+	Quality int
+
+	// Gravity overrides the crop gravity passed to FetchAndResizeImage or
+	// ResizeImage for this size only, which is useful when a particular crop
+	// of a photo needs to favor a different part of it than the default.
+	//
+	// Defaults to the crop gravity passed to the resize function.
+	Gravity PhotoGravity
 }
 
 // FetchAndResizeImage fetches an image from a URL and resizes it according to
@@ -102,6 +233,20 @@ type PhotoSize struct {
 func FetchAndResizeImage(c *modulir.Context,
 	u *url.URL, targetDir, targetSlug, targetExt string,
 	cropGravity PhotoGravity, photoSizes []PhotoSize,
+) (bool, error) {
+	return FetchAndResizeImageWithContext(context.Background(), c,
+		u, targetDir, targetSlug, targetExt, cropGravity, photoSizes)
+}
+
+// FetchAndResizeImageWithContext fetches an image from a URL and resizes it
+// according to specifications.
+//
+// Unlike FetchAndResizeImage, it takes a context which is used for the image's
+// HTTP fetch so that an in-flight download is aborted if the context is
+// cancelled (say because the build is being torn down).
+func FetchAndResizeImageWithContext(ctx context.Context, c *modulir.Context,
+	u *url.URL, targetDir, targetSlug, targetExt string,
+	cropGravity PhotoGravity, photoSizes []PhotoSize,
 ) (bool, error) {
 	if TempDir == "" {
 		return false, xerrors.Errorf("mimage.TempDir must be configured for image fetching")
@@ -110,7 +255,7 @@ func FetchAndResizeImage(c *modulir.Context,
 	// source without an extension, e.g. `content/photographs/123`
 	sourceNoExt := filepath.Join(targetDir, targetSlug)
 
-	if _, exists := markerExists(c, sourceNoExt); exists {
+	if _, exists := markerExists(c, sourceNoExt, photoSizes); exists {
 		return false, nil
 	}
 
@@ -124,7 +269,7 @@ func FetchAndResizeImage(c *modulir.Context,
 		}
 	}
 
-	err := fetchData(c, u, originalPath)
+	err := fetchData(ctx, c, u, originalPath)
 	if err != nil {
 		return true, xerrors.Errorf("error fetching image '%s': %w", targetSlug, err)
 	}
@@ -132,8 +277,11 @@ func FetchAndResizeImage(c *modulir.Context,
 	return ResizeImage(c, originalPath, targetDir, targetSlug, targetExt, cropGravity, photoSizes)
 }
 
-// ResizeImage fetches an image from a URL and resizes it according to
-// specifications.
+// ResizeImage resizes an image at originalPath according to specifications.
+// It's skipped if the image's marker exists, regardless of whether the
+// original has changed since, which suits originals that are downloaded
+// somewhere temporary like FetchAndResizeImage's. For originals that live on
+// disk permanently, see ResizeLocalImage.
 func ResizeImage(c *modulir.Context,
 	originalPath, targetDir, targetSlug, targetExt string,
 	cropGravity PhotoGravity, photoSizes []PhotoSize,
@@ -141,7 +289,7 @@ func ResizeImage(c *modulir.Context,
 	// source without an extension, e.g. `content/photographs/123`
 	sourceNoExt := filepath.Join(targetDir, targetSlug)
 
-	markerPath, exists := markerExists(c, sourceNoExt)
+	markerPath, exists := markerExists(c, sourceNoExt, photoSizes)
 	if exists {
 		return false, nil
 	}
@@ -162,12 +310,48 @@ func ResizeImage(c *modulir.Context,
 		cropGravity = PhotoGravityCenter
 	}
 
-	for _, size := range photoSizes {
-		err := resizeImage(c, originalPath,
-			sourceNoExt+size.Suffix+targetExt, size.Width, size.CropSettings, cropGravity)
+	// Each size is independent, so they're resized concurrently. Errors are
+	// kept by index so that the one reported is deterministic.
+	copied := make([]bool, len(photoSizes))
+	errs := make([]error, len(photoSizes))
+
+	concurrency := ResizeConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i, size := range photoSizes {
+		i, size := i, size
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			copied[i], errs[i] = resizeImageSize(c, originalPath, sourceNoExt, targetSlug,
+				targetExt, cropGravity, size)
+		}()
+	}
+	wg.Wait()
+
+	var anyCopied bool
+	for i, err := range errs {
 		if err != nil {
-			return true, xerrors.Errorf("error resizing image '%s': %w", targetSlug, err)
+			return true, err
 		}
+		anyCopied = anyCopied || copied[i]
+	}
+
+	// Draft images haven't been optimized and copied ones haven't been resized,
+	// so leave the marker off so that they're fully processed by the next
+	// non-draft build with ImageMagick available.
+	if c.Draft || anyCopied {
+		return true, nil
 	}
 
 	// After everything is done, created a marker file to indicate that the
@@ -181,6 +365,81 @@ func ResizeImage(c *modulir.Context,
 	return true, nil
 }
 
+// ResizeImageWithPlaceholder is the same as ResizeImage, but also returns a
+// placeholder for the image: a tiny, blurry version of it (about 20 pixels
+// wide) encoded as a `data:` URI that's small enough to be inlined into a
+// page, where it can be shown (say as a `background-image`) while the full
+// image loads. The placeholder isn't cropped.
+//
+// The placeholder is persisted next to the marker (e.g. as `123.placeholder`)
+// so that it's available on later builds that skip resizing, including ones
+// where the original image isn't. It's only built if it doesn't exist yet.
+func ResizeImageWithPlaceholder(c *modulir.Context,
+	originalPath, targetDir, targetSlug, targetExt string,
+	cropGravity PhotoGravity, photoSizes []PhotoSize,
+) (bool, string, error) {
+	executed, err := ResizeImage(c, originalPath, targetDir, targetSlug, targetExt,
+		cropGravity, photoSizes)
+	if err != nil {
+		return executed, "", err
+	}
+
+	placeholderPath := filepath.Join(targetDir, targetSlug) + placeholderExt
+
+	data, err := os.ReadFile(placeholderPath)
+	if err == nil {
+		return executed, string(data), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return executed, "", xerrors.Errorf("error reading placeholder for image '%s': %w", targetSlug, err)
+	}
+
+	placeholder, err := buildPlaceholder(originalPath)
+	if errors.Is(err, errPlaceholderNoMagick) && !RequireMagick {
+		c.Log.Warnf("mimage.MagickBin not configured; not building placeholder for image '%s'",
+			targetSlug)
+		return true, "", nil
+	}
+	if err != nil {
+		return true, "", xerrors.Errorf("error building placeholder for image '%s': %w", targetSlug, err)
+	}
+
+	if err := os.WriteFile(placeholderPath, []byte(placeholder), 0o644); err != nil { //nolint:gosec
+		return true, "", xerrors.Errorf("error writing placeholder for image '%s': %w", targetSlug, err)
+	}
+
+	return true, placeholder, nil
+}
+
+// ResizeLocalImage resizes an image on the local filesystem according to
+// specifications, making it the local counterpart to FetchAndResizeImage for
+// originals that don't need to be fetched over HTTP.
+//
+// Like FetchAndResizeImage, resizing is skipped if the image's marker exists,
+// so it's cheap to call on every build. Unlike it, a marker older than the
+// original is ignored so that edits to the original get picked up.
+func ResizeLocalImage(c *modulir.Context,
+	localPath, targetDir, targetSlug, targetExt string,
+	cropGravity PhotoGravity, photoSizes []PhotoSize,
+) (bool, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return false, xerrors.Errorf("error reading image '%s': %w", targetSlug, err)
+	}
+
+	markerPath := markerPathFor(filepath.Join(targetDir, targetSlug), photoSizes)
+	if markerInfo, err := os.Stat(markerPath); err == nil && markerInfo.ModTime().Before(info.ModTime()) {
+		c.Log.Debugf("Resizing photo because original is newer than marker: %s", localPath)
+
+		photoMarkerCache.Delete(markerPath)
+		if err := os.Remove(markerPath); err != nil {
+			return false, xerrors.Errorf("error removing marker for image '%s': %w", targetSlug, err)
+		}
+	}
+
+	return ResizeImage(c, localPath, targetDir, targetSlug, targetExt, cropGravity, photoSizes)
+}
+
 //////////////////////////////////////////////////////////////////////////////
 //
 //
@@ -198,23 +457,54 @@ func ResizeImage(c *modulir.Context,
 // Arguments are (defaultExpiration, cleanupInterval).
 var photoMarkerCache = gocache.New(5*time.Minute, 10*time.Minute)
 
+// Maximum number of redirects followed by the default HTTPClient, which is the
+// same as Go's default.
+const maxRedirects = 10
+
+// Redirect policy of the default HTTPClient. Like Go's default, it gives up
+// after maxRedirects, but it also refuses to follow a redirect that would
+// downgrade a fetch from HTTPS to plain HTTP.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return xerrors.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	if prev := via[len(via)-1]; prev.URL.Scheme == "https" && req.URL.Scheme == "http" {
+		return xerrors.Errorf("refusing to follow redirect from HTTPS to HTTP")
+	}
+
+	return nil
+}
+
 // fetchData is a helper for fetching a file via HTTP and storing it the local
 // filesystem.
-func fetchData(c *modulir.Context, u *url.URL, target string) error {
+func fetchData(ctx context.Context, c *modulir.Context, u *url.URL, target string) error {
 	c.Log.Debugf("Fetching file: %v", u.String())
 
-	req, err := http.NewRequestWithContext(context.TODO(), http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return xerrors.Errorf("error creating request: %w", err)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	client := HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	// The client's errors include the URL of the request that failed, which
+	// is the final one if the original was redirected.
+	resp, err := client.Do(req)
 	if err != nil {
-		return xerrors.Errorf("error fetching: %v", u.String())
+		return xerrors.Errorf("error fetching '%v': %w", u.String(), err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		if finalURL := resp.Request.URL.String(); finalURL != u.String() {
+			return xerrors.Errorf("unexpected status code fetching '%v' (redirected to '%v'): %d",
+				u.String(), finalURL, resp.StatusCode)
+		}
+
 		return xerrors.Errorf("unexpected status code fetching '%v': %d",
 			u.String(), resp.StatusCode)
 	}
@@ -239,14 +529,14 @@ func fetchData(c *modulir.Context, u *url.URL, target string) error {
 	return nil
 }
 
-func markerExists(c *modulir.Context, sourceNoExt string) (string, bool) {
+func markerExists(c *modulir.Context, sourceNoExt string, photoSizes []PhotoSize) (string, bool) {
 	// A "marker" is an empty file that we commit to a photograph directory
 	// that indicates that we've already done the work to fetch and resize a
 	// photo. It allows us to skip duplicate work even if we don't have the
 	// work's results available locally. This is important for CI where we
 	// store results to an S3 bucket, but don't pull them all back down again
 	// for every build.
-	markerPath := sourceNoExt + ".marker"
+	markerPath := markerPathFor(sourceNoExt, photoSizes)
 
 	// We use an in-memory cache to store whether markers exist for some period
 	// of time because going to the filesystem to check every one of them is
@@ -268,11 +558,104 @@ func markerExists(c *modulir.Context, sourceNoExt string) (string, bool) {
 	return markerPath, false
 }
 
-func resizeImage(_ *modulir.Context,
-	source, target string, width int, cropSettings *PhotoCropSettings, cropGravity PhotoGravity,
+// Returns the path of the marker for a photo given its sizes. Sizes with a
+// Format add it to the marker's name (e.g. `123.avif.webp.marker`) so that
+// adding a format to existing photos causes them to be resized again, while
+// photos without any keep the plain `123.marker` they've always had.
+func markerPathFor(sourceNoExt string, photoSizes []PhotoSize) string {
+	var formats []string
+	for _, size := range photoSizes {
+		if size.Format != "" && !containsString(formats, string(size.Format)) {
+			formats = append(formats, string(size.Format))
+		}
+	}
+
+	if len(formats) < 1 {
+		return sourceNoExt + ".marker"
+	}
+
+	sort.Strings(formats)
+	return sourceNoExt + "." + strings.Join(formats, ".") + ".marker"
+}
+
+// Returns the extension that the size is encoded to, which is targetExt
+// unless the size has a Format.
+func (s PhotoSize) ext(targetExt string) string {
+	if s.Format != "" {
+		return "." + string(s.Format)
+	}
+	return targetExt
+}
+
+// Returns the size's gravity if it has one, and defaultGravity otherwise.
+func (s PhotoSize) gravity(defaultGravity PhotoGravity) PhotoGravity {
+	if s.Gravity != "" {
+		return s.Gravity
+	}
+	return defaultGravity
+}
+
+// Returns the size's quality if it has one, and JPEGQuality otherwise.
+func (s PhotoSize) quality() int {
+	if s.Quality > 0 {
+		return s.Quality
+	}
+	return JPEGQuality
+}
+
+// Produces a single size of an image for ResizeImage, resizing it or falling
+// back to copying it if it can't be resized. A size that's encoded to a
+// different format can't be copied, so it's skipped instead. Returns whether
+// it was copied or skipped.
+func resizeImageSize(c *modulir.Context,
+	originalPath, sourceNoExt, targetSlug, targetExt string,
+	cropGravity PhotoGravity, size PhotoSize,
+) (bool, error) {
+	target := sourceNoExt + size.Suffix + size.ext(targetExt)
+
+	if MagickBin == "" && !canResizeNatively(originalPath, target) {
+		if RequireMagick {
+			return false, xerrors.Errorf("mimage.MagickBin must be configured for resizing image '%s'",
+				targetSlug)
+		}
+
+		// Copying the original under another format's extension would produce
+		// a file whose contents don't match its name.
+		if size.ext(targetExt) != targetExt {
+			c.Log.Warnf("mimage.MagickBin not configured; skipping %s size '%s' of image '%s'",
+				size.Format, size.Suffix, targetSlug)
+			return true, nil
+		}
+
+		c.Log.Warnf("mimage.MagickBin not configured; copying image '%s' without resizing",
+			targetSlug)
+
+		if err := mfile.CopyFile(c, originalPath, target); err != nil {
+			return false, xerrors.Errorf("error copying image '%s': %w", targetSlug, err)
+		}
+
+		return true, nil
+	}
+
+	err := resizeImage(c, originalPath, target, size, size.gravity(cropGravity))
+	if err != nil {
+		return false, xerrors.Errorf("error resizing image '%s': %w", targetSlug, err)
+	}
+
+	return false, nil
+}
+
+// Resizes source into target according to the given size, cropping with the
+// given gravity (which overrides the size's).
+func resizeImage(c *modulir.Context,
+	source, target string, size PhotoSize, cropGravity PhotoGravity,
 ) error {
 	if MagickBin == "" {
-		return xerrors.Errorf("mimage.MagickBin must be configured for image resizing")
+		if !canResizeNatively(source, target) {
+			return xerrors.Errorf("mimage.MagickBin must be configured for image resizing")
+		}
+
+		return resizeImageNative(c, source, target, size)
 	}
 
 	commandArgs := []string{
@@ -301,20 +684,86 @@ func resizeImage(_ *modulir.Context,
 		return xerrors.Errorf("error converting height '%s' to integer: %w", dimensions[1], err)
 	}
 
-	// Consider square if ratio of width to height within 10%
-	ratio := float64(imageWidth) / float64(imageHeight)
-	isSquare := ratio > 0.90 && ratio < 1.10
+	// AVIFs are resized into an intermediate PNG which avifenc then encodes.
+	resizeTarget := target
+	if AVIFEncBin != "" && strings.ToLower(filepath.Ext(target)) == ".avif" {
+		tempFile, err := os.CreateTemp("", "mimage-*.png")
+		if err != nil {
+			return xerrors.Errorf("error creating intermediate image: %w", err)
+		}
+		tempFile.Close()
+		defer os.Remove(tempFile.Name())
 
-	var isLandscape bool
-	var isPortrait bool
-	if !isSquare {
-		isLandscape = imageWidth > imageHeight
-		isPortrait = imageWidth < imageHeight
+		resizeTarget = tempFile.Name()
 	}
 
+	var optimizeCmd *exec.Cmd
+	if resizeTarget == target {
+		optimizeCmd = newOptimizeCmd(c, target, size.quality())
+	}
+
+	// If we have an optimizer then output to stdout and let it take in the
+	// resized image via pipe. If not, then just resize to the target file
+	// immediately.
+	resizeArgs := buildResizeArgs(source, resizeTarget, imageWidth, imageHeight,
+		size, cropGravity, optimizeCmd != nil)
+
 	var resizeErrOut bytes.Buffer
 	var optimizeErrOut bytes.Buffer
 
+	//nolint:gosec
+	resizeCmd := exec.Command(resizeArgs[0], resizeArgs[1:]...)
+	resizeCmd.Stderr = &resizeErrOut
+
+	r, w := io.Pipe()
+	if optimizeCmd != nil {
+		optimizeCmd.Stderr = &optimizeErrOut
+
+		resizeCmd.Stdout = w
+		optimizeCmd.Stdin = r
+	}
+
+	if err := resizeCmd.Start(); err != nil {
+		return xerrors.Errorf("error starting resize command: %w", err)
+	}
+
+	if optimizeCmd != nil {
+		if err := optimizeCmd.Start(); err != nil {
+			return xerrors.Errorf("error starting optimize command: %w", err)
+		}
+	}
+
+	if err := resizeCmd.Wait(); err != nil {
+		return xerrors.Errorf("error resizing (stderr: %v): %w", resizeErrOut.String(), err)
+	}
+
+	w.Close()
+
+	if optimizeCmd != nil {
+		if err := optimizeCmd.Wait(); err != nil {
+			return xerrors.Errorf("error resizing: (stderr: %v): %w", optimizeErrOut.String(), err)
+		}
+	}
+
+	if resizeTarget != target {
+		//nolint:gosec
+		out, err := exec.Command(AVIFEncBin, resizeTarget, target).CombinedOutput()
+		if err != nil {
+			return xerrors.Errorf("error encoding AVIF (out: '%s'): %w", string(out), err)
+		}
+	}
+
+	return nil
+}
+
+// Builds the arguments (including the ImageMagick binary) for the command that
+// resizes and crops source into target according to size given the source
+// image's dimensions. The given gravity overrides the size's. If toStdout is
+// set, output is directed to stdout instead of target so that it can be piped
+// into an optimizer.
+func buildResizeArgs(source, target string, imageWidth, imageHeight int,
+	size PhotoSize, cropGravity PhotoGravity, toStdout bool,
+) []string {
 	// This is a little awkward, but we start out with some shared arguments,
 	// add a few conditional ones based on landscape versus portrait, then add
 	// a few more shared arguments. The order of the pipeline is important in
@@ -328,105 +777,111 @@ func resizeImage(_ *modulir.Context,
 		string(cropGravity),
 	}
 
-	if cropSettings != nil {
-		switch {
-		case isSquare && cropSettings.Square != "":
-			resizeArgs = append(
-				resizeArgs,
-				"-crop",
-				cropSettings.Square,
-			)
-
-		case isLandscape && cropSettings.Landscape != "":
-			resizeArgs = append(
-				resizeArgs,
-				"-crop",
-				cropSettings.Landscape,
-			)
-
-		case isPortrait && cropSettings.Portrait != "":
-			resizeArgs = append(
-				resizeArgs,
-				"-crop",
-				cropSettings.Portrait,
-			)
-		}
+	if crop := cropRatio(size.CropSettings, imageWidth, imageHeight); crop != "" {
+		resizeArgs = append(
+			resizeArgs,
+			"-crop",
+			crop,
+		)
+	}
+
+	// The `>` flag only resizes images larger than the geometry.
+	geometry := fmt.Sprintf("%vx", size.Width)
+	if !size.AllowUpscale {
+		geometry += ">"
 	}
 
 	resizeArgs = append(
 		resizeArgs,
 		"-resize",
-		fmt.Sprintf("%vx", width),
+		geometry,
 		"-quality",
-		"85",
+		strconv.Itoa(size.quality()),
 	)
 
-	ext := strings.ToLower(filepath.Ext(source))
+	// Metadata is removed after `-auto-orient` has had a chance to use it.
+	switch {
+	case StripMetadata && KeepColorProfile:
+		resizeArgs = append(resizeArgs, "+profile", "!icc,*")
+	case StripMetadata:
+		resizeArgs = append(resizeArgs, "-strip")
+	}
 
-	// If we have mozjpeg then output to stdout and let it take in the resized
-	// JPEG via pipe. Some for PNG. If not, then just resize to the target file
-	// immediately.
 	switch {
-	case ext == ".jpg" && MozJPEGBin != "":
-		resizeArgs = append(resizeArgs, "JPEG:-")
-	case ext == ".png" && PNGQuantBin != "":
+	case !toStdout:
+		resizeArgs = append(resizeArgs, target)
+	case strings.ToLower(filepath.Ext(target)) == ".png":
 		resizeArgs = append(resizeArgs, "PNG:-")
 	default:
-		resizeArgs = append(resizeArgs, target)
+		resizeArgs = append(resizeArgs, "JPEG:-")
 	}
 
-	//nolint:gosec
-	resizeCmd := exec.Command(resizeArgs[0], resizeArgs[1:]...)
-	resizeCmd.Stderr = &resizeErrOut
+	return resizeArgs
+}
 
-	var optimizeCmd *exec.Cmd
-	r, w := io.Pipe()
-	if ext == ".jpg" && MozJPEGBin != "" {
-		optimizeCmd = exec.Command(
-			MozJPEGBin,
-			"-optimize",
-			"-outfile",
-			target,
-			"-progressive",
-		)
-	} else if ext == ".png" && PNGQuantBin != "" {
-		optimizeCmd = exec.Command(
-			PNGQuantBin,
-			"--force", // overwrites an existing output file
-			"--output",
-			target,
-			"-",
-		)
+// Returns the crop ratio from cropSettings (which may be nil) that applies to
+// an image with the given dimensions depending on whether it's square,
+// landscape, or portrait, or an empty string if it shouldn't be cropped.
+func cropRatio(cropSettings *PhotoCropSettings, imageWidth, imageHeight int) string {
+	if cropSettings == nil {
+		return ""
 	}
 
-	if optimizeCmd != nil {
-		optimizeCmd.Stderr = &optimizeErrOut
+	// Consider square if ratio of width to height within 10%
+	ratio := float64(imageWidth) / float64(imageHeight)
 
-		resizeCmd.Stdout = w
-		optimizeCmd.Stdin = r
+	switch {
+	case ratio > 0.90 && ratio < 1.10:
+		return cropSettings.Square
+	case imageWidth > imageHeight:
+		return cropSettings.Landscape
+	default:
+		return cropSettings.Portrait
 	}
+}
 
-	if err := resizeCmd.Start(); err != nil {
-		return xerrors.Errorf("error starting resize command: %w", err)
+// Returns a command that optimizes a resized image read from stdin and writes
+// it to target, or nil if no optimizer is configured for the type of target.
+// JPEGs are re-encoded at the given quality. Optimizers are skipped for draft
+// builds because they're slow.
+func newOptimizeCmd(c *modulir.Context, target string, quality int) *exec.Cmd {
+	if c != nil && c.Draft {
+		return nil
 	}
 
-	if optimizeCmd != nil {
-		if err := optimizeCmd.Start(); err != nil {
-			return xerrors.Errorf("error starting optimize command: %w", err)
+	ext := strings.ToLower(filepath.Ext(target))
+
+	switch {
+	case ext == ".jpg" && MozJPEGBin != "":
+		args := []string{
+			"-optimize",
+			"-outfile",
+			target,
+			"-progressive",
+			"-quality",
+			strconv.Itoa(quality),
 		}
-	}
+		return exec.Command(MozJPEGBin, append(args, MozJPEGArgs...)...)
 
-	if err := resizeCmd.Wait(); err != nil {
-		return xerrors.Errorf("error resizing (stderr: %v): %w", resizeErrOut.String(), err)
+	case ext == ".png" && PNGQuantBin != "":
+		args := []string{
+			"--force", // overwrites an existing output file
+			"--output",
+			target,
+		}
+		args = append(args, PNGQuantArgs...)
+		return exec.Command(PNGQuantBin, append(args, "-")...)
 	}
 
-	w.Close()
+	return nil
+}
 
-	if optimizeCmd != nil {
-		if err := optimizeCmd.Wait(); err != nil {
-			return xerrors.Errorf("error resizing: (stderr: %v): %w", optimizeErrOut.String(), err)
+// Returns whether the given slice contains the given string.
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
 		}
 	}
-
-	return nil
+	return false
 }
@@ -1,22 +1,195 @@
 package mimage
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/require"
+
+	"github.com/brandur/modulir/modules/mtesting"
 )
 
+// Without MAGICK_BIN, images are resized in pure Go.
 func init() {
 	MagickBin = os.Getenv("MAGICK_BIN")
-	if MagickBin == "" {
-		panic("set MAGICK_BIN env to the location of ImageMagick")
-	}
 
 	MozJPEGBin = os.Getenv("MOZJPEG_BIN")
 	PNGQuantBin = os.Getenv("PNGQUANT_BIN")
 }
 
+func TestBuildResizeArgs_Gravity(t *testing.T) {
+	cropSettings := &PhotoCropSettings{Landscape: "3:2"}
+
+	// A size without a gravity uses the default.
+	size := PhotoSize{Suffix: "", Width: 100, CropSettings: cropSettings}
+	assert.Equal(t, []string{
+		MagickBin, "convert", "in.jpg", "-auto-orient", "-gravity", "center",
+		"-crop", "3:2", "-resize", "100x>", "-quality", "85", "-strip", "out.jpg",
+	}, buildResizeArgs("in.jpg", "out.jpg", 300, 200,
+		size, size.gravity(PhotoGravityCenter), false))
+
+	// A size's gravity overrides the default.
+	size.Gravity = PhotoGravityNorthEast
+	assert.Equal(t, []string{
+		MagickBin, "convert", "in.jpg", "-auto-orient", "-gravity", "northeast",
+		"-crop", "3:2", "-resize", "100x>", "-quality", "85", "-strip", "out.jpg",
+	}, buildResizeArgs("in.jpg", "out.jpg", 300, 200,
+		size, size.gravity(PhotoGravityCenter), false))
+}
+
+func TestBuildResizeArgs_Format(t *testing.T) {
+	// The target's extension determines the output format.
+	assert.Equal(t, []string{
+		MagickBin, "convert", "in.jpg", "-auto-orient", "-gravity", "center",
+		"-resize", "100x>", "-quality", "85", "-strip", "out.webp",
+	}, buildResizeArgs("in.jpg", "out.webp", 300, 200,
+		PhotoSize{Width: 100}, PhotoGravityCenter, false))
+
+	// Including when piping into an optimizer.
+	args := buildResizeArgs("in.jpg", "out.png", 300, 200,
+		PhotoSize{Width: 100}, PhotoGravityCenter, true)
+	assert.Equal(t, "PNG:-", args[len(args)-1])
+}
+
+func TestBuildResizeArgs_Quality(t *testing.T) {
+	oldQuality := JPEGQuality
+	JPEGQuality = 70
+	defer func() {
+		JPEGQuality = oldQuality
+	}()
+
+	// Sizes use the default quality.
+	args := buildResizeArgs("in.jpg", "out.jpg", 300, 200,
+		PhotoSize{Width: 100}, PhotoGravityCenter, false)
+	assert.Equal(t, []string{"-quality", "70"}, args[len(args)-4:len(args)-2])
+
+	// Unless they override it.
+	args = buildResizeArgs("in.jpg", "out.jpg", 300, 200,
+		PhotoSize{Width: 100, Quality: 95}, PhotoGravityCenter, false)
+	assert.Equal(t, []string{"-quality", "95"}, args[len(args)-4:len(args)-2])
+}
+
+func TestBuildResizeArgs_Metadata(t *testing.T) {
+	oldKeepColorProfile, oldStripMetadata := KeepColorProfile, StripMetadata
+	defer func() {
+		KeepColorProfile, StripMetadata = oldKeepColorProfile, oldStripMetadata
+	}()
+
+	// Metadata is stripped by default.
+	args := buildResizeArgs("in.jpg", "out.jpg", 300, 200,
+		PhotoSize{Width: 100}, PhotoGravityCenter, false)
+	assert.Equal(t, []string{"-strip", "out.jpg"}, args[len(args)-2:])
+
+	// All profiles except the color profile are removed if it's being kept.
+	KeepColorProfile = true
+	args = buildResizeArgs("in.jpg", "out.jpg", 300, 200,
+		PhotoSize{Width: 100}, PhotoGravityCenter, false)
+	assert.Equal(t, []string{"+profile", "!icc,*", "out.jpg"}, args[len(args)-3:])
+	assert.NotContains(t, args, "-strip")
+
+	// Nothing is removed if stripping is disabled.
+	StripMetadata = false
+	args = buildResizeArgs("in.jpg", "out.jpg", 300, 200,
+		PhotoSize{Width: 100}, PhotoGravityCenter, false)
+	assert.Equal(t, []string{"-quality", "85", "out.jpg"}, args[len(args)-3:])
+}
+
+func TestBuildResizeArgs_Upscale(t *testing.T) {
+	// By default, images narrower than the width aren't enlarged.
+	args := buildResizeArgs("in.jpg", "out.jpg", 300, 200,
+		PhotoSize{Width: 600}, PhotoGravityCenter, false)
+	assert.Contains(t, args, "600x>")
+
+	args = buildResizeArgs("in.jpg", "out.jpg", 300, 200,
+		PhotoSize{Width: 600, AllowUpscale: true}, PhotoGravityCenter, false)
+	assert.Contains(t, args, "600x")
+	assert.NotContains(t, args, "600x>")
+}
+
+func TestMarkerPathFor(t *testing.T) {
+	assert.Equal(t, "photos/123.marker", markerPathFor("photos/123", []PhotoSize{
+		{Suffix: "", Width: 100},
+		{Suffix: "@2x", Width: 200},
+	}))
+
+	assert.Equal(t, "photos/123.avif.webp.marker", markerPathFor("photos/123", []PhotoSize{
+		{Suffix: "", Width: 100},
+		{Suffix: "", Width: 100, Format: PhotoFormatWebP},
+		{Suffix: "@2x", Width: 200, Format: PhotoFormatWebP},
+		{Suffix: "", Width: 100, Format: PhotoFormatAVIF},
+	}))
+}
+
+func TestNewOptimizeCmd_Args(t *testing.T) {
+	oldMozJPEGBin, oldPNGQuantBin := MozJPEGBin, PNGQuantBin
+	MozJPEGBin, PNGQuantBin = "/usr/bin/cjpeg", "/usr/bin/pngquant"
+	oldMozJPEGArgs, oldPNGQuantArgs := MozJPEGArgs, PNGQuantArgs
+	MozJPEGArgs, PNGQuantArgs = []string{"-quant-table", "3"}, []string{"--quality", "65-80"}
+	defer func() {
+		MozJPEGBin, PNGQuantBin = oldMozJPEGBin, oldPNGQuantBin
+		MozJPEGArgs, PNGQuantArgs = oldMozJPEGArgs, oldPNGQuantArgs
+	}()
+
+	c := mtesting.NewContext()
+
+	assert.Equal(t, []string{
+		MozJPEGBin, "-optimize", "-outfile", "out.jpg", "-progressive",
+		"-quality", "90", "-quant-table", "3",
+	}, newOptimizeCmd(c, "out.jpg", 90).Args)
+
+	// Input is read from stdin, which has to be the last argument.
+	assert.Equal(t, []string{
+		PNGQuantBin, "--force", "--output", "out.png", "--quality", "65-80", "-",
+	}, newOptimizeCmd(c, "out.png", 90).Args)
+}
+
+func TestNewOptimizeCmd_Draft(t *testing.T) {
+	oldMozJPEGBin, oldPNGQuantBin := MozJPEGBin, PNGQuantBin
+	MozJPEGBin, PNGQuantBin = "/usr/bin/cjpeg", "/usr/bin/pngquant"
+	defer func() {
+		MozJPEGBin, PNGQuantBin = oldMozJPEGBin, oldPNGQuantBin
+	}()
+
+	c := mtesting.NewContext()
+
+	cmd := newOptimizeCmd(c, "out.jpg", 85)
+	assert.NotNil(t, cmd)
+	assert.Equal(t, MozJPEGBin, cmd.Path)
+
+	cmd = newOptimizeCmd(c, "out.png", 85)
+	assert.NotNil(t, cmd)
+	assert.Equal(t, PNGQuantBin, cmd.Path)
+
+	// Draft builds skip optimization.
+	c.Draft = true
+	assert.Nil(t, newOptimizeCmd(c, "out.jpg", 85))
+	assert.Nil(t, newOptimizeCmd(c, "out.png", 85))
+}
+
+func TestNewOptimizeCmd_Format(t *testing.T) {
+	oldMozJPEGBin, oldPNGQuantBin := MozJPEGBin, PNGQuantBin
+	MozJPEGBin, PNGQuantBin = "/usr/bin/cjpeg", "/usr/bin/pngquant"
+	defer func() {
+		MozJPEGBin, PNGQuantBin = oldMozJPEGBin, oldPNGQuantBin
+	}()
+
+	// Formats other than JPEG and PNG have no optimizer.
+	c := mtesting.NewContext()
+	assert.Nil(t, newOptimizeCmd(c, "out.avif", 85))
+	assert.Nil(t, newOptimizeCmd(c, "out.webp", 85))
+}
+
 func TestResizeImageJPEG(t *testing.T) {
 	if MozJPEGBin == "" {
 		t.Logf("MOZ_JPEG_BIN not set; skipping full JPEG resize test")
@@ -26,12 +199,12 @@ func TestResizeImageJPEG(t *testing.T) {
 	d, _ := os.Getwd()
 	t.Logf("pwd = %v\n", d)
 
-	tmpfile, err := os.CreateTemp("", "resized_image_jpeg")
+	tmpfile, err := os.CreateTemp("", "resized_image_jpeg_*.jpg")
 	assert.NoError(t, err)
 	defer os.Remove(tmpfile.Name())
 
 	err = resizeImage(nil, "./samples/square.jpg", tmpfile.Name(),
-		100, nil, PhotoGravityCenter)
+		PhotoSize{Width: 100}, PhotoGravityCenter)
 	assert.NoError(t, err)
 }
 
@@ -45,12 +218,12 @@ func TestResizeImageJPEG_NoMozJPEG(t *testing.T) {
 	d, _ := os.Getwd()
 	t.Logf("pwd = %v\n", d)
 
-	tmpfile, err := os.CreateTemp("", "resized_image_jpeg_no_mozjpeg")
+	tmpfile, err := os.CreateTemp("", "resized_image_jpeg_no_mozjpeg_*.jpg")
 	assert.NoError(t, err)
 	defer os.Remove(tmpfile.Name())
 
 	err = resizeImage(nil, "./samples/square.jpg", tmpfile.Name(),
-		100, nil, PhotoGravityCenter)
+		PhotoSize{Width: 100}, PhotoGravityCenter)
 	assert.NoError(t, err)
 }
 
@@ -63,12 +236,12 @@ func TestResizeImagePNG(t *testing.T) {
 	d, _ := os.Getwd()
 	t.Logf("pwd = %v\n", d)
 
-	tmpfile, err := os.CreateTemp("", "resized_image_png")
+	tmpfile, err := os.CreateTemp("", "resized_image_png_*.png")
 	assert.NoError(t, err)
 	defer os.Remove(tmpfile.Name())
 
 	err = resizeImage(nil, "./samples/sample.png", tmpfile.Name(),
-		100, nil, PhotoGravityCenter)
+		PhotoSize{Width: 100}, PhotoGravityCenter)
 	assert.NoError(t, err)
 }
 
@@ -82,11 +255,420 @@ func TestResizeImagePNG_NoPNGQuant(t *testing.T) {
 	d, _ := os.Getwd()
 	t.Logf("pwd = %v\n", d)
 
-	tmpfile, err := os.CreateTemp("", "resized_image_png_no_pngquant")
+	tmpfile, err := os.CreateTemp("", "resized_image_png_no_pngquant_*.png")
 	assert.NoError(t, err)
 	defer os.Remove(tmpfile.Name())
 
 	err = resizeImage(nil, "./samples/sample.png", tmpfile.Name(),
-		100, nil, PhotoGravityCenter)
+		PhotoSize{Width: 100}, PhotoGravityCenter)
+	assert.NoError(t, err)
+}
+
+func TestResizeImage_ErrorOrder(t *testing.T) {
+	oldBin, oldRequire := MagickBin, RequireMagick
+	MagickBin, RequireMagick = "", false
+	defer func() {
+		MagickBin, RequireMagick = oldBin, oldRequire
+	}()
+
+	source := filepath.Join(t.TempDir(), "image.webp")
+	assert.NoError(t, os.WriteFile(source, []byte("webp"), 0o600))
+
+	// Sizes are resized concurrently, but the error reported is always the
+	// one from the first size that failed. Copying into a subdirectory that
+	// doesn't exist fails.
+	for i := 0; i < 10; i++ {
+		targetDir := t.TempDir()
+
+		_, err := ResizeImage(mtesting.NewContext(), source,
+			targetDir, "image", "", PhotoGravityCenter, []PhotoSize{
+				{Suffix: "", Width: 100},
+				{Suffix: "/a/image", Width: 200},
+				{Suffix: "/b/image", Width: 300},
+			})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), filepath.Join(targetDir, "image", "a"))
+
+		// The sizes that could be produced still were, but without a marker.
+		assert.FileExists(t, filepath.Join(targetDir, "image.webp"))
+		assert.NoFileExists(t, filepath.Join(targetDir, "image.marker"))
+	}
+}
+
+func TestResizeImage_Format(t *testing.T) {
+	if MagickBin == "" {
+		t.Logf("MAGICK_BIN not set; skipping format resize test")
+		return
+	}
+
+	targetDir := t.TempDir()
+
+	executed, err := ResizeImage(mtesting.NewContext(), "./samples/square.jpg",
+		targetDir, "square", "", PhotoGravityCenter, []PhotoSize{
+			{Suffix: "", Width: 100},
+			{Suffix: "", Width: 100, Format: PhotoFormatWebP},
+		})
+	assert.NoError(t, err)
+	assert.True(t, executed)
+
+	assert.FileExists(t, filepath.Join(targetDir, "square.jpg"))
+	assert.FileExists(t, filepath.Join(targetDir, "square.webp"))
+	assert.FileExists(t, filepath.Join(targetDir, "square.webp.marker"))
+}
+
+func TestResizeImage_Native(t *testing.T) {
+	oldBin := MagickBin
+	MagickBin = ""
+	defer func() {
+		MagickBin = oldBin
+	}()
+
+	targetDir := t.TempDir()
+
+	executed, err := ResizeImage(mtesting.NewContext(), "./samples/landscape.jpg",
+		targetDir, "landscape", "", PhotoGravityCenter, []PhotoSize{
+			{Suffix: "", Width: 100},
+			{Suffix: "_cropped", Width: 100, CropSettings: &PhotoCropSettings{Landscape: "2:1"}},
+		})
+	assert.NoError(t, err)
+	assert.True(t, executed)
+
+	config := decodeConfig(t, filepath.Join(targetDir, "landscape.jpg"))
+	assert.Equal(t, 100, config.Width)
+	assert.Less(t, config.Height, 100)
+
+	config = decodeConfig(t, filepath.Join(targetDir, "landscape_cropped.jpg"))
+	assert.Equal(t, 100, config.Width)
+	assert.Equal(t, 50, config.Height)
+
+	assert.FileExists(t, filepath.Join(targetDir, "landscape.marker"))
+}
+
+func TestResizeImage_NativeAutoOrient(t *testing.T) {
+	oldBin := MagickBin
+	MagickBin = ""
+	defer func() {
+		MagickBin = oldBin
+	}()
+
+	dir := t.TempDir()
+
+	// A landscape JPEG whose EXIF orientation says that it should be rotated
+	// a quarter turn to display as portrait.
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 20)), nil))
+
+	exif := []byte("Exif\x00\x00" +
+		"MM\x00\x2a\x00\x00\x00\x08" + // big endian TIFF header with IFD at 8
+		"\x00\x01" + // 1 entry
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00" + // orientation: 6
+		"\x00\x00\x00\x00") // no next IFD
+
+	data := buf.Bytes()
+	oriented := append([]byte{}, data[0:2]...)
+	oriented = append(oriented, 0xFF, 0xE1, 0x00, byte(len(exif)+2))
+	oriented = append(oriented, exif...)
+	oriented = append(oriented, data[2:]...)
+
+	assert.Equal(t, 6, exifOrientation(oriented))
+	assert.Equal(t, 1, exifOrientation(data))
+
+	source := filepath.Join(dir, "rotated.jpg")
+	assert.NoError(t, os.WriteFile(source, oriented, 0o600))
+
+	assert.NoError(t, resizeImage(nil, source, filepath.Join(dir, "resized.png"),
+		PhotoSize{Width: 10}, PhotoGravityCenter))
+
+	config := decodeConfig(t, filepath.Join(dir, "resized.png"))
+	assert.Equal(t, 10, config.Width)
+	assert.Equal(t, 20, config.Height)
+}
+
+func TestResizeImage_NativeNoUpscale(t *testing.T) {
+	oldBin := MagickBin
+	MagickBin = ""
+	defer func() {
+		MagickBin = oldBin
+	}()
+
+	dir := t.TempDir()
+	original := decodeConfig(t, "./samples/sample.png")
+
+	// An image narrower than the requested width keeps its original width.
+	assert.NoError(t, resizeImage(nil, "./samples/sample.png", filepath.Join(dir, "small.png"),
+		PhotoSize{Width: original.Width * 2}, PhotoGravityCenter))
+
+	config := decodeConfig(t, filepath.Join(dir, "small.png"))
+	assert.Equal(t, original.Width, config.Width)
+	assert.Equal(t, original.Height, config.Height)
+
+	// Unless upscaling is allowed.
+	assert.NoError(t, resizeImage(nil, "./samples/sample.png", filepath.Join(dir, "large.png"),
+		PhotoSize{Width: original.Width * 2, AllowUpscale: true}, PhotoGravityCenter))
+
+	config = decodeConfig(t, filepath.Join(dir, "large.png"))
+	assert.Equal(t, original.Width*2, config.Width)
+}
+
+func TestResizeImage_NoMagickNotRequired(t *testing.T) {
+	oldBin, oldRequire := MagickBin, RequireMagick
+	MagickBin, RequireMagick = "", false
+	defer func() {
+		MagickBin, RequireMagick = oldBin, oldRequire
+	}()
+
+	// A format that can't be resized without ImageMagick.
+	source := filepath.Join(t.TempDir(), "image.webp")
+	assert.NoError(t, os.WriteFile(source, []byte("webp"), 0o600))
+
+	targetDir := t.TempDir()
+
+	executed, err := ResizeImage(mtesting.NewContext(), source,
+		targetDir, "image", "", PhotoGravityCenter, []PhotoSize{
+			{Suffix: "", Width: 100},
+			{Suffix: "@2x", Width: 200},
+			{Suffix: "", Width: 100, Format: PhotoFormatAVIF},
+		})
+	assert.NoError(t, err)
+	assert.True(t, executed)
+
+	for _, name := range []string{"image.webp", "image@2x.webp"} {
+		copied, err := os.ReadFile(filepath.Join(targetDir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("webp"), copied)
+	}
+
+	// Sizes that need converting to another format are skipped rather than
+	// copied under the wrong extension.
+	assert.NoFileExists(t, filepath.Join(targetDir, "image.avif"))
+
+	// No marker is written so that the image gets resized properly later.
+	assert.NoFileExists(t, filepath.Join(targetDir, "image.marker"))
+}
+
+func TestResizeImage_NoMagickRequired(t *testing.T) {
+	oldBin := MagickBin
+	MagickBin = ""
+	defer func() {
+		MagickBin = oldBin
+	}()
+
+	source := filepath.Join(t.TempDir(), "image.webp")
+	assert.NoError(t, os.WriteFile(source, []byte("webp"), 0o600))
+
+	_, err := ResizeImage(mtesting.NewContext(), source,
+		t.TempDir(), "image", "", PhotoGravityCenter, []PhotoSize{
+			{Suffix: "", Width: 100},
+		})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "mimage.MagickBin must be configured")
+}
+
+func TestResizeImageWithPlaceholder(t *testing.T) {
+	oldBin := MagickBin
+	MagickBin = ""
+	defer func() {
+		MagickBin = oldBin
+	}()
+
+	data, err := os.ReadFile("./samples/landscape.jpg")
+	assert.NoError(t, err)
+
+	original := filepath.Join(t.TempDir(), "landscape.jpg")
+	assert.NoError(t, os.WriteFile(original, data, 0o600))
+
+	targetDir := t.TempDir()
+	photoSizes := []PhotoSize{{Suffix: "", Width: 100}}
+
+	executed, placeholder, err := ResizeImageWithPlaceholder(mtesting.NewContext(), original,
+		targetDir, "landscape", "", PhotoGravityCenter, photoSizes)
+	assert.NoError(t, err)
+	assert.True(t, executed)
+
+	prefix := "data:image/jpeg;base64,"
+	assert.True(t, strings.HasPrefix(placeholder, prefix))
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(placeholder, prefix))
+	assert.NoError(t, err)
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(decoded))
+	assert.NoError(t, err)
+	assert.Equal(t, placeholderWidth, config.Width)
+
+	// The placeholder is persisted, so it's available on later builds even if
+	// the original image isn't.
+	assert.NoError(t, os.Remove(original))
+
+	executed, persisted, err := ResizeImageWithPlaceholder(mtesting.NewContext(), original,
+		targetDir, "landscape", "", PhotoGravityCenter, photoSizes)
+	assert.NoError(t, err)
+	assert.False(t, executed)
+	assert.Equal(t, placeholder, persisted)
+}
+
+func TestResizeLocalImage(t *testing.T) {
+	oldBin := MagickBin
+	MagickBin = ""
+	defer func() {
+		MagickBin = oldBin
+	}()
+
+	data, err := os.ReadFile("./samples/landscape.jpg")
+	assert.NoError(t, err)
+
+	original := filepath.Join(t.TempDir(), "landscape.jpg")
+	assert.NoError(t, os.WriteFile(original, data, 0o600))
+
+	targetDir := t.TempDir()
+	photoSizes := []PhotoSize{{Suffix: "", Width: 100}}
+
+	executed, err := ResizeLocalImage(mtesting.NewContext(), original,
+		targetDir, "landscape", "", PhotoGravityCenter, photoSizes)
+	assert.NoError(t, err)
+	assert.True(t, executed)
+	assert.Equal(t, 100, decodeConfig(t, filepath.Join(targetDir, "landscape.jpg")).Width)
+
+	// Skipped because the marker exists.
+	executed, err = ResizeLocalImage(mtesting.NewContext(), original,
+		targetDir, "landscape", "", PhotoGravityCenter, photoSizes)
+	assert.NoError(t, err)
+	assert.False(t, executed)
+
+	// Resized again once the original is newer than the marker.
+	future := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(original, future, future))
+
+	executed, err = ResizeLocalImage(mtesting.NewContext(), original,
+		targetDir, "landscape", "", PhotoGravityCenter, photoSizes)
+	assert.NoError(t, err)
+	assert.True(t, executed)
+	assert.FileExists(t, filepath.Join(targetDir, "landscape.marker"))
+
+	// An original that doesn't exist is an error.
+	_, err = ResizeLocalImage(mtesting.NewContext(), filepath.Join(t.TempDir(), "missing.jpg"),
+		targetDir, "missing", "", PhotoGravityCenter, photoSizes)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "error reading image 'missing'")
+}
+
+func TestCheckRedirect(t *testing.T) {
+	newRequest := func(rawURL string) *http.Request {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, rawURL, nil)
+		assert.NoError(t, err)
+		return req
+	}
+
+	via := []*http.Request{newRequest("https://example.com/a.jpg")}
+	assert.NoError(t, checkRedirect(newRequest("https://example.com/b.jpg"), via))
+
+	assert.EqualError(t, checkRedirect(newRequest("http://example.com/b.jpg"), via),
+		"refusing to follow redirect from HTTPS to HTTP")
+
+	for len(via) < maxRedirects {
+		via = append(via, newRequest("https://example.com/a.jpg"))
+	}
+	assert.EqualError(t, checkRedirect(newRequest("https://example.com/b.jpg"), via),
+		"stopped after 10 redirects")
+}
+
+func TestFetchData_Cancelled(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Simulate a very slow download.
+		select {
+		case <-unblock:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/slow.jpg")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = fetchData(ctx, mtesting.NewContext(), u, filepath.Join(t.TempDir(), "slow.jpg"))
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestFetchData_Redirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved.jpg":
+			http.Redirect(w, r, "/image.jpg", http.StatusMovedPermanently)
+		case "/gone.jpg":
+			http.Redirect(w, r, "/missing.jpg", http.StatusMovedPermanently)
+		case "/image.jpg":
+			_, _ = w.Write([]byte("image"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/moved.jpg")
+	assert.NoError(t, err)
+
+	target := filepath.Join(t.TempDir(), "image.jpg")
+	assert.NoError(t, fetchData(context.Background(), mtesting.NewContext(), u, target))
+
+	data, err := os.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("image"), data)
+
+	// Errors include the URL that was redirected to.
+	u, err = url.Parse(server.URL + "/gone.jpg")
+	assert.NoError(t, err)
+
+	err = fetchData(context.Background(), mtesting.NewContext(), u, target)
+	assert.EqualError(t, err, "unexpected status code fetching '"+server.URL+"/gone.jpg' "+
+		"(redirected to '"+server.URL+"/missing.jpg'): 404")
+}
+
+func TestFetchData_Timeout(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Simulate a server that hangs.
+		select {
+		case <-unblock:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	oldClient := HTTPClient
+	HTTPClient = &http.Client{Timeout: 50 * time.Millisecond}
+	defer func() {
+		HTTPClient = oldClient
+	}()
+
+	u, err := url.Parse(server.URL + "/hung.jpg")
+	assert.NoError(t, err)
+
+	start := time.Now()
+	err = fetchData(context.Background(), mtesting.NewContext(), u, filepath.Join(t.TempDir(), "hung.jpg"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Client.Timeout exceeded")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// Decodes the config (including dimensions) of the image at the given path.
+func decodeConfig(t *testing.T, path string) image.Config {
+	t.Helper()
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
 	assert.NoError(t, err)
+	return config
 }
@@ -0,0 +1,302 @@
+package mimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/xerrors"
+
+	"github.com/brandur/modulir"
+)
+
+// Extensions of the image formats that can be resized without ImageMagick.
+var nativeFormats = map[string]bool{
+	".jpeg": true,
+	".jpg":  true,
+	".png":  true,
+}
+
+// Returns whether source can be resized into target without ImageMagick.
+func canResizeNatively(source, target string) bool {
+	return nativeFormats[strings.ToLower(filepath.Ext(source))] &&
+		nativeFormats[strings.ToLower(filepath.Ext(target))]
+}
+
+// Resizes source into target in pure Go, which is used in place of
+// ImageMagick when MagickBin isn't configured. Like ImageMagick's
+// `-auto-orient`, the image is first rotated according to its EXIF
+// orientation. Crops are always taken from the center of the image because
+// gravity isn't supported. The result is passed through an optimizer if one
+// is configured.
+func resizeImageNative(c *modulir.Context, source, target string, size PhotoSize) error {
+	resized, err := scaleImageNative(source, size)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if strings.ToLower(filepath.Ext(target)) == ".png" {
+		err = png.Encode(&buf, resized)
+	} else {
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: size.quality()})
+	}
+	if err != nil {
+		return xerrors.Errorf("error encoding resized image: %w", err)
+	}
+
+	optimizeCmd := newOptimizeCmd(c, target, size.quality())
+	if optimizeCmd == nil {
+		if err := os.WriteFile(target, buf.Bytes(), 0o644); err != nil { //nolint:gosec
+			return xerrors.Errorf("error writing resized image: %w", err)
+		}
+		return nil
+	}
+
+	var optimizeErrOut bytes.Buffer
+	optimizeCmd.Stdin = &buf
+	optimizeCmd.Stderr = &optimizeErrOut
+
+	if err := optimizeCmd.Run(); err != nil {
+		return xerrors.Errorf("error optimizing (stderr: %v): %w", optimizeErrOut.String(), err)
+	}
+
+	return nil
+}
+
+// Decodes source, orients it, and crops and scales it according to size. See
+// resizeImageNative.
+func scaleImageNative(source string, size PhotoSize) (image.Image, error) {
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return nil, xerrors.Errorf("error reading image: %w", err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, xerrors.Errorf("error decoding image: %w", err)
+	}
+
+	img = orientImage(img, exifOrientation(data))
+
+	bounds := img.Bounds()
+	if ratio := cropRatio(size.CropSettings, bounds.Dx(), bounds.Dy()); ratio != "" {
+		img, err = cropImageCenter(img, ratio)
+		if err != nil {
+			return nil, err
+		}
+		bounds = img.Bounds()
+	}
+
+	width := size.Width
+	if !size.AllowUpscale && width > bounds.Dx() {
+		width = bounds.Dx()
+	}
+
+	height := int(math.Round(float64(bounds.Dy()) * float64(width) / float64(bounds.Dx())))
+	if height < 1 {
+		height = 1
+	}
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Over, nil)
+
+	return resized, nil
+}
+
+// Crops the largest area with the given aspect ratio (like "3:2") from the
+// center of an image.
+func cropImageCenter(img image.Image, ratio string) (image.Image, error) {
+	parts := strings.Split(ratio, ":")
+	if len(parts) != 2 {
+		return nil, xerrors.Errorf("crop ratio '%s' should be like '3:2'", ratio)
+	}
+
+	ratioWidth, err := strconv.Atoi(parts[0])
+	if err != nil || ratioWidth <= 0 {
+		return nil, xerrors.Errorf("crop ratio '%s' should be like '3:2'", ratio)
+	}
+
+	ratioHeight, err := strconv.Atoi(parts[1])
+	if err != nil || ratioHeight <= 0 {
+		return nil, xerrors.Errorf("crop ratio '%s' should be like '3:2'", ratio)
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	cropWidth := int(math.Round(float64(height) * float64(ratioWidth) / float64(ratioHeight)))
+	cropHeight := height
+	if cropWidth > width {
+		cropWidth = width
+		cropHeight = int(math.Round(float64(width) * float64(ratioHeight) / float64(ratioWidth)))
+	}
+
+	x := bounds.Min.X + (width-cropWidth)/2
+	y := bounds.Min.Y + (height-cropHeight)/2
+	rect := image.Rect(x, y, x+cropWidth, y+cropHeight)
+
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect), nil
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, cropWidth, cropHeight))
+	draw.Draw(cropped, cropped.Bounds(), img, rect.Min, draw.Src)
+	return cropped, nil
+}
+
+// Reads the EXIF orientation (1 through 8) of a JPEG or PNG image. Returns 1,
+// meaning that no rotation is needed, if the image doesn't have one.
+func exifOrientation(data []byte) int {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		// JPEG: EXIF data is in an APP1 segment before the image data.
+		for i := 2; i+4 <= len(data); {
+			if data[i] != 0xFF {
+				return 1
+			}
+
+			marker := data[i+1]
+			switch {
+			case marker == 0xFF:
+				// Fill byte.
+				i++
+				continue
+			case marker == 0xD9 || marker == 0xDA:
+				// End of image or start of scan.
+				return 1
+			case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+				// Markers without a length.
+				i += 2
+				continue
+			}
+
+			size := int(binary.BigEndian.Uint16(data[i+2:]))
+			if size < 2 || i+2+size > len(data) {
+				return 1
+			}
+
+			segment := data[i+4 : i+2+size]
+			if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				return tiffOrientation(segment[6:])
+			}
+
+			i += 2 + size
+		}
+
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		// PNG: EXIF data is in an `eXIf` chunk.
+		for i := 8; i+8 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[i:]))
+			if length < 0 || i+12+length > len(data) {
+				return 1
+			}
+
+			if string(data[i+4:i+8]) == "eXIf" {
+				return tiffOrientation(data[i+8 : i+8+length])
+			}
+
+			i += 12 + length
+		}
+	}
+
+	return 1
+}
+
+// Rotates and flips an image so that it displays upright given its EXIF
+// orientation.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Orientations 5 through 8 involve a quarter turn.
+	orientedWidth, orientedHeight := width, height
+	if orientation >= 5 {
+		orientedWidth, orientedHeight = height, width
+	}
+
+	oriented := image.NewRGBA(image.Rect(0, 0, orientedWidth, orientedHeight))
+
+	for y := 0; y < orientedHeight; y++ {
+		for x := 0; x < orientedWidth; x++ {
+			var sourceX, sourceY int
+
+			switch orientation {
+			case 2: // flip horizontally
+				sourceX, sourceY = width-1-x, y
+			case 3: // rotate 180 degrees
+				sourceX, sourceY = width-1-x, height-1-y
+			case 4: // flip vertically
+				sourceX, sourceY = x, height-1-y
+			case 5: // transpose
+				sourceX, sourceY = y, x
+			case 6: // rotate 90 degrees clockwise
+				sourceX, sourceY = y, height-1-x
+			case 7: // transverse
+				sourceX, sourceY = width-1-y, height-1-x
+			case 8: // rotate 90 degrees counterclockwise
+				sourceX, sourceY = width-1-y, x
+			}
+
+			oriented.Set(x, y, img.At(bounds.Min.X+sourceX, bounds.Min.Y+sourceY))
+		}
+	}
+
+	return oriented
+}
+
+// Reads the orientation tag from the first IFD of some TIFF-formatted EXIF
+// data. Returns 1 if there isn't one.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 0 || offset+2 > len(tiff) {
+		return 1
+	}
+
+	numEntries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < numEntries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		// 0x0112 is the orientation tag, whose value is a short stored at the
+		// start of the entry's value field.
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,72 @@
+package mimage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"os/exec"
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+// Extension of the file that a placeholder is persisted to next to the
+// marker.
+const placeholderExt = ".placeholder"
+
+// Quality at which placeholders are encoded. They're blurry anyway, so it can
+// be low to keep them small.
+const placeholderQuality = 50
+
+// Width in pixels of placeholders built by buildPlaceholder. Browsers scale
+// them up to the size of the full image.
+const placeholderWidth = 20
+
+// Error returned by buildPlaceholder when an image's format needs ImageMagick
+// but MagickBin isn't configured.
+var errPlaceholderNoMagick = errors.New("mimage.MagickBin must be configured for building placeholders")
+
+// Builds a placeholder for the image at source: a tiny JPEG version of it
+// encoded as a base64 `data:` URI. ImageMagick is used if it's configured,
+// and otherwise the image is scaled in pure Go if its format allows it.
+func buildPlaceholder(source string) (string, error) {
+	var data []byte
+
+	switch {
+	case MagickBin != "":
+		var errOut bytes.Buffer
+
+		//nolint:gosec
+		cmd := exec.Command(MagickBin, "convert", source, "-auto-orient",
+			"-resize", fmt.Sprintf("%vx", placeholderWidth),
+			"-strip",
+			"-quality", strconv.Itoa(placeholderQuality),
+			"JPEG:-")
+		cmd.Stderr = &errOut
+
+		out, err := cmd.Output()
+		if err != nil {
+			return "", xerrors.Errorf("error building placeholder (stderr: %v): %w", errOut.String(), err)
+		}
+		data = out
+
+	case canResizeNatively(source, "placeholder.jpg"):
+		img, err := scaleImageNative(source, PhotoSize{Width: placeholderWidth})
+		if err != nil {
+			return "", err
+		}
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: placeholderQuality}); err != nil {
+			return "", xerrors.Errorf("error encoding placeholder: %w", err)
+		}
+		data = buf.Bytes()
+
+	default:
+		return "", errPlaceholderNoMagick
+	}
+
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,48 @@
+//go:build goldmark
+
+package mmarkdown
+
+import (
+	"bytes"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+	"golang.org/x/xerrors"
+)
+
+const defaultBackend = BackendGoldmark
+
+// A goldmark instance configured to produce output as close as possible to
+// Black Friday's with its default extensions and HTML flags. Raw HTML must be
+// passed through because transforms like those in mmarkdownext inject it
+// before rendering.
+//
+// GFM's extensions are enabled individually to leave out task lists, which
+// Black Friday doesn't support and mmarkdownext renders itself.
+var goldmarkMarkdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.DefinitionList,
+		extension.Linkify,
+		extension.Strikethrough,
+		extension.Table,
+		extension.Typographer,
+	),
+	goldmark.WithParserOptions(
+		parser.WithHeadingAttribute(),
+	),
+	goldmark.WithRendererOptions(
+		html.WithUnsafe(),
+		html.WithXHTML(),
+	),
+)
+
+func renderGoldmark(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	if err := goldmarkMarkdown.Convert(data, &b); err != nil {
+		return nil, xerrors.Errorf("error rendering Markdown with goldmark: %w", err)
+	}
+
+	return b.Bytes(), nil
+}
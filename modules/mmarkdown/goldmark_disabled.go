@@ -0,0 +1,14 @@
+//go:build !goldmark
+
+package mmarkdown
+
+import (
+	"golang.org/x/xerrors"
+)
+
+const defaultBackend = BackendBlackfriday
+
+func renderGoldmark(data []byte) ([]byte, error) {
+	return nil, xerrors.Errorf("backend '%s' isn't available; build with `-tags goldmark` to enable it",
+		BackendGoldmark)
+}
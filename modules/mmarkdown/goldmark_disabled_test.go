@@ -0,0 +1,29 @@
+//go:build !goldmark
+
+package mmarkdown
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/brandur/modulir/modules/mtesting"
+)
+
+func TestRender_GoldmarkUnavailable(t *testing.T) {
+	oldBackend := DefaultBackend
+	DefaultBackend = BackendGoldmark
+	defer func() {
+		DefaultBackend = oldBackend
+	}()
+
+	// Falls back to Black Friday instead of panicking.
+	assert.Equal(t, "<p>Some <strong>strong</strong> text.</p>\n",
+		string(Render(mtesting.NewContext(), []byte("Some **strong** text."))))
+}
+
+func TestRenderWithBackend_GoldmarkUnavailable(t *testing.T) {
+	_, err := RenderWithBackend(BackendGoldmark, []byte("Some text."))
+	assert.EqualError(t, err,
+		"backend 'goldmark' isn't available; build with `-tags goldmark` to enable it")
+}
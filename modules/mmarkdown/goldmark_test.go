@@ -0,0 +1,25 @@
+//go:build goldmark
+
+package mmarkdown
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestRenderWithBackend_Goldmark(t *testing.T) {
+	data, err := RenderWithBackend(BackendGoldmark, []byte("Some **strong** text."))
+	assert.NoError(t, err)
+	assert.Equal(t, "<p>Some <strong>strong</strong> text.</p>\n", string(data))
+
+	// Raw HTML is passed through.
+	data, err = RenderWithBackend(BackendGoldmark, []byte(`<div class="note">Note</div>`+"\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, `<div class="note">Note</div>`+"\n", string(data))
+
+	// Task lists are left for mmarkdownext to render.
+	data, err = RenderWithBackend(BackendGoldmark, []byte("* [ ] Todo\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "<ul>\n<li>[ ] Todo</li>\n</ul>\n", string(data))
+}
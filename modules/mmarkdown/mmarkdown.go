@@ -1,7 +1,7 @@
 package mmarkdown
 
 import (
-	"os"
+	"io"
 
 	"golang.org/x/xerrors"
 	"gopkg.in/russross/blackfriday.v2"
@@ -19,27 +19,115 @@ import (
 //
 //////////////////////////////////////////////////////////////////////////////
 
-// Render is a shortcut for rendering some source data to Markdown via Black
-// Friday.
+// Backend is an engine used to render Markdown.
+type Backend string
+
+// The possible values of Backend.
+const (
+	// BackendBlackfriday renders Markdown with Black Friday.
+	BackendBlackfriday Backend = "blackfriday"
+
+	// BackendGoldmark renders Markdown with goldmark, which is CommonMark
+	// compliant. It's only available in programs built with the `goldmark`
+	// build tag.
+	BackendGoldmark Backend = "goldmark"
+)
+
+// DefaultBackend is the backend used to render Markdown. It may be changed at
+// runtime to switch backends.
+//
+// Defaults to BackendBlackfriday, or BackendGoldmark in programs built with
+// the `goldmark` build tag.
+var DefaultBackend = defaultBackend
+
+// Render is a shortcut for rendering some source data to Markdown via
+// DefaultBackend.
+//
+// If DefaultBackend isn't available (say it's BackendGoldmark in a program
+// built without the `goldmark` build tag), a warning is logged and Black
+// Friday is used instead. Use RenderWithBackend to get an error instead.
 func Render(c *modulir.Context, data []byte) []byte {
-	return blackfriday.Run(data)
+	outData, err := RenderWithBackend(DefaultBackend, data)
+	if err != nil {
+		if c != nil {
+			c.Log.Warnf("mmarkdown: %v; falling back to Black Friday", err)
+		}
+		return blackfriday.Run(data)
+	}
+	return outData
+}
+
+// RenderWithBackend renders some source data to Markdown via the given
+// backend. Black Friday is used with its default extensions, and goldmark with
+// equivalents of them (including GitHub Flavored Markdown, definition lists,
+// typographic substitutions, and heading IDs) and raw HTML passed through.
+func RenderWithBackend(backend Backend, data []byte) ([]byte, error) {
+	switch backend {
+	case BackendBlackfriday:
+		return blackfriday.Run(data), nil
+	case BackendGoldmark:
+		return renderGoldmark(data)
+	}
+
+	return nil, xerrors.Errorf("unknown Markdown backend '%s'", backend)
+}
+
+// RenderSource reads a source file and renders it to Markdown via
+// DefaultBackend. Its signature makes it suitable for use with
+// modulir.Context.RegisterRenderer.
+func RenderSource(c *modulir.Context, source string) ([]byte, error) {
+	data, err := c.ReadFile(source)
+	if err != nil {
+		return nil, xerrors.Errorf("error reading file: %w", err)
+	}
+
+	return RenderWithBackend(DefaultBackend, data)
+}
+
+// RenderTo is a shortcut for rendering some source data to Markdown via
+// DefaultBackend and writing the result to the given writer.
+func RenderTo(c *modulir.Context, data []byte, w io.Writer) error {
+	outData, err := RenderWithBackend(DefaultBackend, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(outData)
+	if err != nil {
+		return xerrors.Errorf("error writing rendered Markdown: %w", err)
+	}
+
+	return nil
 }
 
 // RenderFile is a shortcut for rendering a source file to Markdown in a target
-// file via Black Friday.
+// file via DefaultBackend. The source is read from the context's FS if one is
+// set.
 func RenderFile(c *modulir.Context, source, target string) error {
-	inData, err := os.ReadFile(source)
+	inData, err := c.ReadFile(source)
 	if err != nil {
 		return xerrors.Errorf("error reading file: %w", err)
 	}
 
-	outData := Render(c, inData)
+	outData, err := RenderWithBackend(DefaultBackend, inData)
+	if err != nil {
+		return err
+	}
 
-	err = os.WriteFile(target, outData, 0o600)
+	file, err := c.CreateTarget(target)
 	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(outData); err != nil {
 		return xerrors.Errorf("error writing file: %w", err)
 	}
 
+	if err := file.Commit(); err != nil {
+		return xerrors.Errorf("error closing file: %w", err)
+	}
+
 	c.Log.Debugf("mmarkdown: Rendered '%s' to '%s'", source, target)
 	return nil
 }
@@ -0,0 +1,48 @@
+package mmarkdown
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/brandur/modulir/modules/mtesting"
+)
+
+func TestRenderWithBackend(t *testing.T) {
+	data, err := RenderWithBackend(BackendBlackfriday, []byte("Some **strong** text."))
+	assert.NoError(t, err)
+	assert.Equal(t, "<p>Some <strong>strong</strong> text.</p>\n", string(data))
+
+	_, err = RenderWithBackend(Backend("unknown"), []byte("Some text."))
+	assert.EqualError(t, err, "unknown Markdown backend 'unknown'")
+}
+
+func TestRenderTo(t *testing.T) {
+	c := mtesting.NewContext()
+	data := []byte("# Title\n\nSome **strong** text.")
+
+	var b bytes.Buffer
+	err := RenderTo(c, data, &b)
+	assert.NoError(t, err)
+	assert.Equal(t, string(Render(c, data)), b.String())
+}
+
+func TestRenderSource(t *testing.T) {
+	c := mtesting.NewContextWithFS(fstest.MapFS{
+		"content/page.md": &fstest.MapFile{Data: []byte("Some **strong** text.")},
+	})
+	c.RegisterRenderer(".md", RenderSource)
+
+	data, err := c.RenderOne("content/page.md")
+	assert.NoError(t, err)
+	assert.Equal(t, "<p>Some <strong>strong</strong> text.</p>\n", string(data))
+
+	_, err = c.RenderOne("content/page.txt")
+	assert.EqualError(t, err,
+		"no renderer registered for extension '.txt' (source: 'content/page.txt')")
+
+	_, err = c.RenderOne("content/missing.md")
+	assert.Error(t, err)
+}
@@ -0,0 +1,47 @@
+//go:build chroma
+
+package mmarkdownext
+
+import (
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"golang.org/x/xerrors"
+)
+
+// Highlights some code with chroma, producing a complete `<pre>` element. The
+// plain text lexer is used if language is empty or unknown.
+func highlightCode(code, language string, options *RenderOptions) (string, error) {
+	var lexer chroma.Lexer
+	if language != "" {
+		lexer = lexers.Get(language)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	theme := options.SyntaxTheme
+	if theme == "" {
+		theme = defaultSyntaxTheme
+	}
+
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(options.SyntaxHighlight == SyntaxHighlightClasses),
+	)
+
+	iterator, err := lexer.Tokenise(nil, code)
+	if err != nil {
+		return "", xerrors.Errorf("error tokenizing code: %w", err)
+	}
+
+	var b strings.Builder
+	if err := formatter.Format(&b, styles.Get(theme), iterator); err != nil {
+		return "", xerrors.Errorf("error formatting code: %w", err)
+	}
+
+	return b.String(), nil
+}
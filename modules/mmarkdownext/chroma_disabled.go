@@ -0,0 +1,11 @@
+//go:build !chroma
+
+package mmarkdownext
+
+import (
+	"golang.org/x/xerrors"
+)
+
+func highlightCode(code, language string, options *RenderOptions) (string, error) {
+	return "", xerrors.Errorf("syntax highlighting isn't available; build with `-tags chroma` to enable it")
+}
@@ -0,0 +1,16 @@
+//go:build !chroma
+
+package mmarkdownext
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestTransformSyntaxHighlighting_Unavailable(t *testing.T) {
+	_, err := transformSyntaxHighlighting(`<pre><code class="language-ruby">puts 1
+</code></pre>`, &RenderOptions{SyntaxHighlight: SyntaxHighlightInline})
+	assert.EqualError(t, err,
+		"error highlighting code: syntax highlighting isn't available; build with `-tags chroma` to enable it")
+}
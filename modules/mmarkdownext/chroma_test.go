@@ -0,0 +1,35 @@
+//go:build chroma
+
+package mmarkdownext
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestTransformSyntaxHighlighting_Chroma(t *testing.T) {
+	source := "```ruby\nputs \"hello\"\n```"
+
+	t.Run("Inline", func(t *testing.T) {
+		rendered := must(Render(source, &RenderOptions{SyntaxHighlight: SyntaxHighlightInline})).(string)
+		assert.Contains(t, rendered, `<pre tabindex="0" style="`)
+		assert.Contains(t, rendered, "puts")
+		assert.NotContains(t, rendered, "language-ruby")
+		assert.NotContains(t, rendered, `class="`)
+	})
+
+	t.Run("Classes", func(t *testing.T) {
+		rendered := must(Render(source, &RenderOptions{SyntaxHighlight: SyntaxHighlightClasses})).(string)
+		assert.Contains(t, rendered, `<pre tabindex="0" class="chroma">`)
+		assert.Contains(t, rendered, "puts")
+		assert.NotContains(t, rendered, `style="`)
+	})
+
+	t.Run("UnknownLanguage", func(t *testing.T) {
+		rendered := must(Render("```not-a-language\n<hello>\n```",
+			&RenderOptions{SyntaxHighlight: SyntaxHighlightClasses})).(string)
+		assert.Contains(t, rendered, `<pre tabindex="0" class="chroma">`)
+		assert.Contains(t, rendered, "&lt;hello&gt;")
+	})
+}
@@ -0,0 +1,178 @@
+package mmarkdownext
+
+// emojiShortcodes maps the names of commonly used GitHub-style emoji
+// shortcodes (e.g. "tada" for `:tada:`) to the emoji they stand for. It's used
+// by transformEmoji when RenderOptions.Emoji is set.
+var emojiShortcodes = map[string]string{
+	"+1":                         "👍",
+	"-1":                         "👎",
+	"100":                        "💯",
+	"alarm_clock":                "⏰",
+	"angry":                      "😠",
+	"apple":                      "🍎",
+	"arrow_down":                 "⬇️",
+	"arrow_left":                 "⬅️",
+	"arrow_right":                "➡️",
+	"arrow_up":                   "⬆️",
+	"art":                        "🎨",
+	"astonished":                 "😲",
+	"balloon":                    "🎈",
+	"bang":                       "❗",
+	"beer":                       "🍺",
+	"beers":                      "🍻",
+	"bell":                       "🔔",
+	"bike":                       "🚲",
+	"bird":                       "🐦",
+	"blush":                      "😊",
+	"bomb":                       "💣",
+	"book":                       "📖",
+	"books":                      "📚",
+	"boom":                       "💥",
+	"bowtie":                     "🎀",
+	"broken_heart":               "💔",
+	"bug":                        "🐛",
+	"bulb":                       "💡",
+	"cake":                       "🍰",
+	"calendar":                   "📆",
+	"camera":                     "📷",
+	"cat":                        "🐱",
+	"chart_with_downwards_trend": "📉",
+	"chart_with_upwards_trend":   "📈",
+	"check":                      "✔️",
+	"clap":                       "👏",
+	"clipboard":                  "📋",
+	"closed_lock_with_key":       "🔐",
+	"cloud":                      "☁️",
+	"coffee":                     "☕",
+	"computer":                   "💻",
+	"confused":                   "😕",
+	"construction":               "🚧",
+	"cookie":                     "🍪",
+	"cool":                       "🆒",
+	"cry":                        "😢",
+	"crystal_ball":               "🔮",
+	"dart":                       "🎯",
+	"disappointed":               "😞",
+	"dizzy":                      "💫",
+	"dog":                        "🐶",
+	"earth_americas":             "🌎",
+	"envelope":                   "✉️",
+	"exclamation":                "❗",
+	"eyes":                       "👀",
+	"facepalm":                   "🤦",
+	"fire":                       "🔥",
+	"fireworks":                  "🎆",
+	"flushed":                    "😳",
+	"gear":                       "⚙️",
+	"gem":                        "💎",
+	"ghost":                      "👻",
+	"gift":                       "🎁",
+	"globe_with_meridians":       "🌐",
+	"grin":                       "😁",
+	"grinning":                   "😀",
+	"hammer":                     "🔨",
+	"hammer_and_wrench":          "🛠️",
+	"hand":                       "✋",
+	"heart":                      "❤️",
+	"heart_eyes":                 "😍",
+	"heavy_check_mark":           "✔️",
+	"heavy_minus_sign":           "➖",
+	"heavy_plus_sign":            "➕",
+	"hourglass":                  "⌛",
+	"house":                      "🏠",
+	"hugs":                       "🤗",
+	"hushed":                     "😯",
+	"information_source":         "ℹ️",
+	"innocent":                   "😇",
+	"joy":                        "😂",
+	"key":                        "🔑",
+	"kissing_heart":              "😘",
+	"laughing":                   "😆",
+	"link":                       "🔗",
+	"lipstick":                   "💄",
+	"lock":                       "🔒",
+	"loudspeaker":                "📢",
+	"mag":                        "🔍",
+	"mailbox":                    "📫",
+	"memo":                       "📝",
+	"microscope":                 "🔬",
+	"money_with_wings":           "💸",
+	"moon":                       "🌔",
+	"mortar_board":               "🎓",
+	"muscle":                     "💪",
+	"nerd_face":                  "🤓",
+	"neutral_face":               "😐",
+	"no_entry":                   "⛔",
+	"no_entry_sign":              "🚫",
+	"ok":                         "🆗",
+	"ok_hand":                    "👌",
+	"open_mouth":                 "😮",
+	"package":                    "📦",
+	"paperclip":                  "📎",
+	"partying_face":              "🥳",
+	"pencil":                     "📝",
+	"pencil2":                    "✏️",
+	"pensive":                    "😔",
+	"pizza":                      "🍕",
+	"point_down":                 "👇",
+	"point_left":                 "👈",
+	"point_right":                "👉",
+	"point_up":                   "☝️",
+	"pray":                       "🙏",
+	"pushpin":                    "📌",
+	"question":                   "❓",
+	"rage":                       "😡",
+	"raised_hands":               "🙌",
+	"recycle":                    "♻️",
+	"relaxed":                    "☺️",
+	"relieved":                   "😌",
+	"rocket":                     "🚀",
+	"rofl":                       "🤣",
+	"rotating_light":             "🚨",
+	"scream":                     "😱",
+	"see_no_evil":                "🙈",
+	"seedling":                   "🌱",
+	"shrug":                      "🤷",
+	"skull":                      "💀",
+	"sleeping":                   "😴",
+	"slightly_smiling_face":      "🙂",
+	"smile":                      "😄",
+	"smiley":                     "😃",
+	"smirk":                      "😏",
+	"snail":                      "🐌",
+	"snowflake":                  "❄️",
+	"sob":                        "😭",
+	"sparkles":                   "✨",
+	"speech_balloon":             "💬",
+	"star":                       "⭐",
+	"star2":                      "🌟",
+	"stuck_out_tongue":           "😛",
+	"sunglasses":                 "😎",
+	"sunny":                      "☀️",
+	"sweat":                      "😓",
+	"sweat_smile":                "😅",
+	"tada":                       "🎉",
+	"thinking":                   "🤔",
+	"thought_balloon":            "💭",
+	"thumbsdown":                 "👎",
+	"thumbsup":                   "👍",
+	"tired_face":                 "😫",
+	"trophy":                     "🏆",
+	"turtle":                     "🐢",
+	"umbrella":                   "☔",
+	"unamused":                   "😒",
+	"unlock":                     "🔓",
+	"upside_down_face":           "🙃",
+	"v":                          "✌️",
+	"warning":                    "⚠️",
+	"wave":                       "👋",
+	"weary":                      "😩",
+	"white_check_mark":           "✅",
+	"wink":                       "😉",
+	"worried":                    "😟",
+	"wrench":                     "🔧",
+	"x":                          "❌",
+	"yum":                        "😋",
+	"zap":                        "⚡",
+	"zzz":                        "💤",
+}
@@ -0,0 +1,37 @@
+//go:build goldmark
+
+package mmarkdownext
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/brandur/modulir/modules/mmarkdown"
+)
+
+func TestRender_Goldmark(t *testing.T) {
+	// The full render stack should produce the same document with either
+	// backend, modulo whitespace between tags.
+	for _, source := range []string{
+		"**strong**",
+		"## A Header (#a-header)\n\nSome text.\n\n## Another Header\n\nMore text.",
+		"Hello [1].\n\n[1] A footnote.",
+		"```ruby\nputs 1\n```",
+		"![Image](/assets/image.jpg)",
+		"[Link](/about) and [another](https://example.com).",
+		"* [ ] Todo\n* [x] Done",
+	} {
+		options := &RenderOptions{
+			AbsoluteURL: "https://brandur.org",
+			Backend:     mmarkdown.BackendBlackfriday,
+			NoFollow:    true,
+		}
+		expected := must(Render(source, options)).(string)
+
+		options.Backend = mmarkdown.BackendGoldmark
+		actual := must(Render(source, options)).(string)
+
+		assert.Equal(t, collapseHTML(expected), collapseHTML(actual), "source: %q", source)
+	}
+}
@@ -5,16 +5,31 @@ package mmarkdownext
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"html"
+	"image"
+	_ "image/gif"  // register GIF decoding for image dimensions
+	_ "image/jpeg" // register JPEG decoding for image dimensions
+	_ "image/png"  // register PNG decoding for image dimensions
+	"mime"
+	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"golang.org/x/xerrors"
 	"gopkg.in/russross/blackfriday.v2"
 
+	"github.com/brandur/modulir"
+	"github.com/brandur/modulir/modules/mmarkdown"
 	"github.com/brandur/modulir/modules/mtemplate"
+	"github.com/brandur/modulir/modules/mtoc"
 )
 
 //////////////////////////////////////////////////////////////////////////////
@@ -27,17 +42,142 @@ import (
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// SyntaxHighlight is a mode for highlighting code blocks. See
+// RenderOptions.SyntaxHighlight.
+type SyntaxHighlight string
+
+// The possible values of SyntaxHighlight.
+const (
+	// SyntaxHighlightNone leaves code blocks unhighlighted.
+	SyntaxHighlightNone SyntaxHighlight = ""
+
+	// SyntaxHighlightClasses highlights code blocks by giving tokens CSS
+	// classes. A stylesheet for them must be included separately, and can be
+	// generated with chroma's `html.Formatter.WriteCSS`.
+	SyntaxHighlightClasses SyntaxHighlight = "classes"
+
+	// SyntaxHighlightInline highlights code blocks with inline styles from
+	// RenderOptions.SyntaxTheme.
+	SyntaxHighlightInline SyntaxHighlight = "inline"
+)
+
+// Names of the passes that make up DefaultPipeline, for use with
+// InsertPassAfter, InsertPassBefore, and RemovePass.
+const (
+	PassCodeWithLanguagePrefix = "code_with_language_prefix"
+	PassEmoji                  = "emoji"
+	PassFigures                = "figures"
+	PassFootnotes              = "footnotes"
+	PassGoTemplate             = "go_template"
+	PassHeaders                = "headers"
+	PassImageDimensions        = "image_dimensions"
+	PassImagesAndLinks         = "images_and_links"
+	PassImagesToAMP            = "images_to_amp"
+	PassImagesToDataURIs       = "images_to_data_uris"
+	PassMarkdown               = "markdown"
+	PassMathExtract            = "math_extract"
+	PassMathRender             = "math_render"
+	PassSyntaxHighlighting     = "syntax_highlighting"
+	PassTaskLists              = "task_lists"
+	PassTOC                    = "toc"
+	PassTypography             = "typography"
+)
+
+// RenderFunc is a single pass of a pipeline used by Render, which transforms
+// the document produced by the previous pass.
+type RenderFunc func(source string, options *RenderOptions) (string, error)
+
 // FuncMap is the map of helper functions that will be used when passing the
 // Markdown through a Go template step.
 var FuncMap = template.FuncMap{}
 
 // RenderOptions describes a rendering operation to be customized.
 type RenderOptions struct {
+	// AMP rewrites images to `<amp-img>` elements so that the output can be
+	// used in AMP pages. AMP requires explicit dimensions, so any image that
+	// doesn't already carry `width` and `height` attributes has them read from
+	// the image itself, resolved relative to InlineImagesRoot. Attributes that
+	// AMP disallows are stripped.
+	AMP bool
+
 	// AbsoluteURL is the absolute URL of the final site. If set, the Markdown
 	// renderer replaces the sources of any images or links that pointed to
 	// relative URLs with absolute URLs.
 	AbsoluteURL string
 
+	// Backend is the engine used for the core Markdown rendering pass. The
+	// transformations made before and after it are the same regardless of
+	// backend.
+	//
+	// Defaults to mmarkdown.DefaultBackend.
+	Backend mmarkdown.Backend
+
+	// BlackfridayOptions are additional options passed to Blackfriday when
+	// rendering Markdown, like `blackfriday.WithExtensions`. They're applied
+	// after the defaults, so they can be used to override them. They only
+	// apply to mmarkdown.BackendBlackfriday.
+	BlackfridayOptions []blackfriday.Option
+
+	// Draft renders a lower-fidelity document faster for previews by skipping
+	// Retina srcsets as if NoRetina were set. It's meant to be set from
+	// modulir.Context.Draft.
+	Draft bool
+
+	// Emoji replaces GitHub-style emoji shortcodes like `:tada:` in the
+	// rendered document's prose with the emoji they stand for. Shortcodes
+	// that aren't recognized are left as they are, as is text in code.
+	Emoji bool
+
+	// HTMLRendererParameters are parameters for Blackfriday's HTML renderer,
+	// allowing things like renderer flags or a heading ID prefix to be set.
+	// They only apply to mmarkdown.BackendBlackfriday.
+	//
+	// Defaults to nil, which uses Blackfriday's default renderer with common
+	// HTML flags.
+	HTMLRendererParameters *blackfriday.HTMLRendererParameters
+
+	// ImageDimensions adds `width` and `height` attributes to local images
+	// (those with `/`-rooted sources) so that browsers can reserve space for
+	// them before they load, avoiding layout shift. Dimensions are read from
+	// the images under InlineImagesRoot and cached. Images that already
+	// declare a width or height, SVGs, and remote images are left alone.
+	ImageDimensions bool
+
+	// InlineImagesRoot is the directory from which local images are read when
+	// inlining them with InlineImagesUnder or measuring them for
+	// ImageDimensions or AMP. Image sources are resolved relative to it.
+	InlineImagesRoot string
+
+	// InlineImagesUnder causes local images whose file size is smaller than
+	// this number of bytes to be inlined into the document as base64 `data:`
+	// URIs, saving an extra request for tiny images like icons. Remote images
+	// and SVGs are never inlined.
+	//
+	// Defaults to zero, which disables inlining.
+	InlineImagesUnder int
+
+	// Log receives warnings about problems that are skipped over rather than
+	// failing the render, like a local image that's missing when inlining it
+	// or reading its dimensions.
+	//
+	// Defaults to nil, in which case warnings are discarded.
+	Log modulir.LoggerInterface
+
+	// Math renders LaTeX math delimited by `$...$` (inline) or `$$...$$`
+	// (display, which may span lines) into markup that a client-side library
+	// like KaTeX's auto-render extension or MathJax can typeset:
+	//
+	//	<span class="math inline">\(...\)</span>
+	//	<span class="math display">\[...\]</span>
+	//
+	// Math is protected from other passes, so it isn't rendered as Markdown
+	// or touched by Go templates, footnotes, or typography. Dollar signs in
+	// code are left alone, and ones escaped as `\$` are rendered as plain
+	// dollar signs. To avoid mistaking prices for math, an opening `$` of
+	// inline math must not be followed by a space, and the closing one must
+	// not be preceded by a space or followed by a digit.
+	Math bool
+
 	// NoFollow adds `rel="nofollow"` to any external links.
 	NoFollow bool
 
@@ -50,15 +190,199 @@ type RenderOptions struct {
 	// NoRetina disables the Retina.JS rendering attributes.
 	NoRetina bool
 
+	// NoTaskLists disables rendering list items that start with GitHub-style
+	// `[ ]` or `[x]` as disabled checkboxes. Goldmark renders task lists on
+	// its own regardless.
+	NoTaskLists bool
+
+	// Pipeline is the ordered set of passes that Render runs the document
+	// through, which allows passes to be removed, reordered, or added. Build
+	// one by modifying DefaultPipeline, say with RemovePass to drop the
+	// deprecated figures pass:
+	//
+	//	mmarkdownext.RemovePass(mmarkdownext.DefaultPipeline(), mmarkdownext.PassFigures)
+	//
+	// Defaults to nil, which uses DefaultPipeline.
+	Pipeline []RenderFunc
+
+	// Smartypants makes typographic substitutions in the rendered document's
+	// prose, converting straight quotes to curly ones, `--` to em dashes,
+	// and `...` to ellipses. Text in `<code>`, `<kbd>`, `<pre>`, `<script>`,
+	// and `<style>` elements is left alone, as are tags and their attributes.
+	Smartypants bool
+
+	// SyntaxHighlight causes code blocks to be highlighted with chroma. The
+	// language of fenced code blocks is used to pick a lexer, and code whose
+	// language is missing or unknown is formatted as plain text. Chroma is
+	// only available in programs built with the `chroma` build tag, and
+	// rendering fails if this is set without it.
+	//
+	// Defaults to SyntaxHighlightNone, which leaves code blocks untouched.
+	SyntaxHighlight SyntaxHighlight
+
+	// SyntaxTheme is the name of the chroma style used to highlight code
+	// blocks with SyntaxHighlightInline (e.g. "monokai"). Unknown names fall
+	// back to chroma's default style.
+	//
+	// Defaults to "github".
+	SyntaxTheme string
+
+	// TOC inserts a table of contents built from the document's headers with
+	// mtoc. It replaces a `[[TOC]]` marker on a line of its own if there is
+	// one, and otherwise goes at the top of the document.
+	TOC bool
+
+	// TOCMaxLevel is the deepest level of header included in the table of
+	// contents when TOC is set. For example, if it's 3, only h1s, h2s, and h3s
+	// are included.
+	//
+	// Defaults to 0, which includes headers of every level.
+	TOCMaxLevel int
+
 	// TemplateData is data injected while rendering Go templates.
 	TemplateData interface{}
 }
 
+// FirstImage returns the source of the first image in some rendered HTML (like
+// the output of Render), which is useful for picking an image for social cards
+// or feed thumbnails. The second return value is false if there's no image.
+//
+// Only images whose `src` is their first attribute are found, which is always
+// the case for images rendered from Markdown.
+func FirstImage(content string) (string, bool) {
+	matches := imageRE.FindStringSubmatch(content)
+	if matches == nil {
+		return "", false
+	}
+
+	return html.UnescapeString(matches[1]), true
+}
+
+// DefaultPipeline returns a new copy of the pipeline of passes used by Render
+// when RenderOptions.Pipeline isn't set, which can be modified to produce a
+// custom pipeline. In order, its passes are those named PassMathExtract,
+// PassGoTemplate, PassHeaders, PassFigures, PassMarkdown, PassTaskLists,
+// PassCodeWithLanguagePrefix, PassSyntaxHighlighting, PassFootnotes,
+// PassTypography, PassEmoji, PassMathRender, PassTOC, PassImagesToDataURIs,
+// PassImageDimensions, PassImagesAndLinks, and PassImagesToAMP.
+func DefaultPipeline() []RenderFunc {
+	pipeline := make([]RenderFunc, len(renderStack))
+	copy(pipeline, renderStack)
+	return pipeline
+}
+
+// InsertPassAfter returns a copy of the given pipeline with pass inserted
+// immediately after the default pass with the given name (e.g. PassMarkdown).
+// Returns an error if the named pass isn't in the pipeline.
+func InsertPassAfter(pipeline []RenderFunc, name string, pass RenderFunc) ([]RenderFunc, error) {
+	i, err := passIndex(pipeline, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return insertPass(pipeline, i+1, pass), nil
+}
+
+// InsertPassBefore returns a copy of the given pipeline with pass inserted
+// immediately before the default pass with the given name (e.g.
+// PassMarkdown). Returns an error if the named pass isn't in the pipeline.
+func InsertPassBefore(pipeline []RenderFunc, name string, pass RenderFunc) ([]RenderFunc, error) {
+	i, err := passIndex(pipeline, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return insertPass(pipeline, i, pass), nil
+}
+
+// PipelineBuilder builds a custom pipeline by inserting and removing passes
+// relative to the named passes of DefaultPipeline, so that it can be extended
+// surgically without knowing the full order of passes. Its methods can be
+// chained:
+//
+//	pipeline, err := mmarkdownext.NewPipelineBuilder().
+//		InsertBefore(mmarkdownext.PassFootnotes, myPass).
+//		InsertAfter(mmarkdownext.PassMarkdown, myOtherPass).
+//		Build()
+//
+// The first error encountered (like a pass name that's not in the pipeline)
+// causes later operations to be ignored, and is returned by Build.
+type PipelineBuilder struct {
+	err      error
+	pipeline []RenderFunc
+}
+
+// NewPipelineBuilder returns a new PipelineBuilder that starts from
+// DefaultPipeline.
+func NewPipelineBuilder() *PipelineBuilder {
+	return &PipelineBuilder{pipeline: DefaultPipeline()}
+}
+
+// Build returns the built pipeline, which can be used as
+// RenderOptions.Pipeline, or the first error encountered while building it.
+func (b *PipelineBuilder) Build() ([]RenderFunc, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	pipeline := make([]RenderFunc, len(b.pipeline))
+	copy(pipeline, b.pipeline)
+	return pipeline, nil
+}
+
+// InsertAfter inserts pass immediately after the default pass with the given
+// name. See InsertPassAfter.
+func (b *PipelineBuilder) InsertAfter(name string, pass RenderFunc) *PipelineBuilder {
+	if b.err == nil {
+		b.pipeline, b.err = InsertPassAfter(b.pipeline, name, pass)
+	}
+	return b
+}
+
+// InsertBefore inserts pass immediately before the default pass with the
+// given name. See InsertPassBefore.
+func (b *PipelineBuilder) InsertBefore(name string, pass RenderFunc) *PipelineBuilder {
+	if b.err == nil {
+		b.pipeline, b.err = InsertPassBefore(b.pipeline, name, pass)
+	}
+	return b
+}
+
+// Remove removes the default pass with the given name. See RemovePass.
+func (b *PipelineBuilder) Remove(name string) *PipelineBuilder {
+	if b.err == nil {
+		b.pipeline = RemovePass(b.pipeline, name)
+	}
+	return b
+}
+
+// RemovePass returns a copy of the given pipeline without the default pass
+// with the given name (e.g. PassFigures). The pipeline is copied unchanged if
+// the named pass isn't in it.
+func RemovePass(pipeline []RenderFunc, name string) []RenderFunc {
+	removed := make([]RenderFunc, 0, len(pipeline))
+
+	pass, ok := namedPasses[name]
+	for _, f := range pipeline {
+		if ok && samePass(f, pass) {
+			continue
+		}
+		removed = append(removed, f)
+	}
+
+	return removed
+}
+
 // Render a Markdown string to HTML while applying all custom project-specific
 // filters including footnotes and stable header links.
 func Render(s string, options *RenderOptions) (string, error) {
+	pipeline := renderStack
+	if options != nil && options.Pipeline != nil {
+		pipeline = options.Pipeline
+	}
+
 	var err error
-	for _, f := range renderStack {
+	for _, f := range pipeline {
 		s, err = f(s, options)
 		if err != nil {
 			return "", err
@@ -80,38 +404,182 @@ func Render(s string, options *RenderOptions) (string, error) {
 // renderStack is the full set of functions that we'll run on an input string
 // to get our fully rendered Markdown. This includes the rendering itself, but
 // also a number of custom transformation options.
-var renderStack = []func(string, *RenderOptions) (string, error){
+var renderStack = []RenderFunc{
 	//
 	// Pre-transformation functions
 	//
 
+	// Must come first so that math is hidden from every pass that follows
+	// until `transformMathRender`.
+	transformMathExtract,
+
 	transformGoTemplate,
 	transformHeaders,
 
 	// DEPRECATED: Use Go template helpers instead.
 	transformFigures,
 
-	// The actual Blackfriday rendering
-	func(source string, _ *RenderOptions) (string, error) {
-		return string(blackfriday.Run([]byte(source))), nil
-	},
+	// The actual Markdown rendering
+	renderMarkdown,
 
 	//
 	// Post-transformation functions
 	//
 
+	transformTaskLists,
+
 	// DEPRECATED: Find a different way to do this.
 	transformCodeWithLanguagePrefix,
 
+	// Should come after `transformCodeWithLanguagePrefix` so that all code
+	// blocks carry a `language-` class.
+	transformSyntaxHighlighting,
+
 	transformFootnotes,
 
-	// Should come before `transformImagesAndLinksToAbsoluteURLs` so that
-	// relative links that are later converted to absolute aren't tagged with
-	// `rel="nofollow"`.
-	transformLinksToNoFollow,
+	// Should come after `transformSyntaxHighlighting` and
+	// `transformFootnotes` so that the markup they add is skipped.
+	transformTypography,
+
+	transformEmoji,
+
+	// Should come after `transformFootnotes`, `transformTypography`, and
+	// `transformEmoji` so that they don't modify math.
+	transformMathRender,
+
+	// Must come after `renderMarkdown` so that headers (whose IDs are
+	// assigned by `transformHeaders`) have been rendered to HTML.
+	transformTOC,
+
+	// Should come before `transformImagesAndLinks` so that inlined images
+	// aren't given absolute URLs or a Retina srcset.
+	transformImagesToDataURIs,
+
+	// Should come before `transformImagesAndLinks` so that local images still
+	// have `/`-rooted sources.
+	transformImageDimensions,
+
+	// Adds `rel="nofollow"` to external links, makes relative images and
+	// links absolute, and gives images a Retina srcset in a single pass over
+	// the document.
+	transformImagesAndLinks,
+
+	// Should come last so that AMP images carry the final `src` and `srcset`.
+	transformImagesToAMP,
+}
+
+// The passes of renderStack, keyed by their exported names.
+var namedPasses = map[string]RenderFunc{
+	PassCodeWithLanguagePrefix: transformCodeWithLanguagePrefix,
+	PassEmoji:                  transformEmoji,
+	PassFigures:                transformFigures,
+	PassFootnotes:              transformFootnotes,
+	PassGoTemplate:             transformGoTemplate,
+	PassHeaders:                transformHeaders,
+	PassImageDimensions:        transformImageDimensions,
+	PassImagesAndLinks:         transformImagesAndLinks,
+	PassImagesToAMP:            transformImagesToAMP,
+	PassImagesToDataURIs:       transformImagesToDataURIs,
+	PassMarkdown:               renderMarkdown,
+	PassMathExtract:            transformMathExtract,
+	PassMathRender:             transformMathRender,
+	PassSyntaxHighlighting:     transformSyntaxHighlighting,
+	PassTaskLists:              transformTaskLists,
+	PassTOC:                    transformTOC,
+	PassTypography:             transformTypography,
+}
+
+// Returns a copy of pipeline with pass inserted at index i.
+func insertPass(pipeline []RenderFunc, i int, pass RenderFunc) []RenderFunc {
+	inserted := make([]RenderFunc, 0, len(pipeline)+1)
+	inserted = append(inserted, pipeline[0:i]...)
+	inserted = append(inserted, pass)
+	inserted = append(inserted, pipeline[i:]...)
+	return inserted
+}
+
+// Returns the index of the default pass with the given name in pipeline.
+func passIndex(pipeline []RenderFunc, name string) (int, error) {
+	pass, ok := namedPasses[name]
+	if !ok {
+		return 0, xerrors.Errorf("unknown pass '%s'", name)
+	}
+
+	for i, f := range pipeline {
+		if samePass(f, pass) {
+			return i, nil
+		}
+	}
+
+	return 0, xerrors.Errorf("pass '%s' not found in pipeline", name)
+}
+
+// Returns whether two passes are the same function. Functions aren't
+// comparable in Go, so their code pointers are compared instead, which is
+// reliable for the top-level functions that make up the default pipeline.
+func samePass(a, b RenderFunc) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// Logs a warning to Log, or discards it if Log isn't set.
+func (o *RenderOptions) warnf(format string, v ...interface{}) {
+	if o.Log != nil {
+		o.Log.Warnf(format, v...)
+	}
+}
+
+// Matches HTML comments and tags, between which is the text that
+// transformHTMLText transforms.
+var htmlTagRE = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+
+// Matches the opening or closing tag of an element whose text is meant to be
+// taken literally, and which is skipped by transformHTMLText.
+var literalTagRE = regexp.MustCompile(`(?i)^<(/?)(code|kbd|pre|script|style)\b`)
+
+// Rewrites the text between the tags and comments of some HTML with f, which
+// allows passes to make substitutions in a document's prose without touching
+// its markup. Tags and their attributes are never passed to f, and neither is
+// text inside `<code>`, `<kbd>`, `<pre>`, `<script>`, or `<style>` elements.
+func transformHTMLText(source string, f func(text string) string) string {
+	var sb strings.Builder
+	sb.Grow(len(source))
+
+	var (
+		last    = 0
+		literal = 0
+	)
+
+	writeText := func(text string) {
+		if literal > 0 || text == "" {
+			sb.WriteString(text)
+			return
+		}
+
+		sb.WriteString(f(text))
+	}
+
+	for _, loc := range htmlTagRE.FindAllStringIndex(source, -1) {
+		writeText(source[last:loc[0]])
+
+		tag := source[loc[0]:loc[1]]
+		if matches := literalTagRE.FindStringSubmatch(tag); matches != nil {
+			switch {
+			case matches[1] == "/":
+				if literal > 0 {
+					literal--
+				}
+			case !strings.HasSuffix(tag, "/>"):
+				literal++
+			}
+		}
+
+		sb.WriteString(tag)
+		last = loc[1]
+	}
+
+	writeText(source[last:])
 
-	transformImagesAndLinksToAbsoluteURLs,
-	transformImagesToRetina,
+	return sb.String()
 }
 
 // Look for any whitespace between HTML tags.
@@ -128,12 +596,97 @@ func collapseHTML(html string) string {
 	return html
 }
 
+func renderMarkdown(source string, options *RenderOptions) (string, error) {
+	backend := mmarkdown.DefaultBackend
+	if options != nil && options.Backend != "" {
+		backend = options.Backend
+	}
+
+	if options == nil || backend != mmarkdown.BackendBlackfriday {
+		data, err := mmarkdown.RenderWithBackend(backend, []byte(source))
+		if err != nil {
+			return "", xerrors.Errorf("error rendering Markdown: %w", err)
+		}
+		return string(data), nil
+	}
+
+	var opts []blackfriday.Option
+
+	if options.HTMLRendererParameters != nil {
+		opts = append(opts, blackfriday.WithRenderer(
+			blackfriday.NewHTMLRenderer(*options.HTMLRendererParameters)))
+	}
+
+	opts = append(opts, options.BlackfridayOptions...)
+
+	return string(blackfriday.Run([]byte(source), opts...)), nil
+}
+
 var codeRE = regexp.MustCompile(`<code class="(\w+)">`)
 
 func transformCodeWithLanguagePrefix(source string, options *RenderOptions) (string, error) {
 	return codeRE.ReplaceAllString(source, `<code class="language-$1">`), nil
 }
 
+// Matches a code block and its language, if it has one.
+var codeBlockRE = regexp.MustCompile(`(?s)<pre><code(?: class="language-([^"]+)")?>(.*?)</code></pre>`)
+
+// The chroma style used for highlighting when RenderOptions.SyntaxTheme isn't
+// set.
+const defaultSyntaxTheme = "github"
+
+func transformSyntaxHighlighting(source string, options *RenderOptions) (string, error) {
+	if options == nil || options.SyntaxHighlight == SyntaxHighlightNone {
+		return source, nil
+	}
+
+	var highlightErr error
+
+	source = codeBlockRE.ReplaceAllStringFunc(source, func(block string) string {
+		if highlightErr != nil {
+			return block
+		}
+
+		matches := codeBlockRE.FindStringSubmatch(block)
+
+		highlighted, err := highlightCode(html.UnescapeString(matches[2]), matches[1], options)
+		if err != nil {
+			highlightErr = xerrors.Errorf("error highlighting code: %w", err)
+			return block
+		}
+
+		return highlighted
+	})
+
+	if highlightErr != nil {
+		return "", highlightErr
+	}
+
+	return source, nil
+}
+
+// Matches the start of a list item beginning with a GitHub-style task list
+// checkbox like `[ ]` or `[x]`, which is wrapped in a paragraph if the list is
+// loose.
+var taskListItemRE = regexp.MustCompile(`<li>(<p>)?\[([ xX])\]\s+`)
+
+func transformTaskLists(source string, options *RenderOptions) (string, error) {
+	if options != nil && options.NoTaskLists {
+		return source, nil
+	}
+
+	return taskListItemRE.ReplaceAllStringFunc(source, func(item string) string {
+		matches := taskListItemRE.FindStringSubmatch(item)
+
+		checkbox := `<input type="checkbox" disabled>`
+		if matches[2] != " " {
+			checkbox = `<input type="checkbox" checked disabled>`
+		}
+
+		return `<li class="task-list-item">` + matches[1] + checkbox + " "
+	}), nil
+}
+
 const figureHTML = `
 <figure>
   <p><a href="%s"><img src="%s" class="overflowing"></a></p>
@@ -203,6 +756,350 @@ const headerHTMLNoLink = `
 <h%v>%s</h%v>
 `
 
+// Matches a `[[TOC]]` marker after it's been wrapped in a paragraph by the
+// Markdown renderer.
+var tocMarkerRE = regexp.MustCompile(`<p>\[\[TOC\]\]</p>\n?`)
+
+func transformTOC(source string, options *RenderOptions) (string, error) {
+	if options == nil || !options.TOC {
+		return source, nil
+	}
+
+	maxLevel := options.TOCMaxLevel
+	if maxLevel <= 0 {
+		maxLevel = -1
+	}
+
+	toc, err := mtoc.RenderFromHTMLWithMaxLevel(source, maxLevel)
+	if err != nil {
+		return "", xerrors.Errorf("error rendering table of contents: %w", err)
+	}
+
+	if loc := tocMarkerRE.FindStringIndex(source); loc != nil {
+		return source[0:loc[0]] + toc + source[loc[1]:], nil
+	}
+
+	return toc + source, nil
+}
+
+// Matches an emoji shortcode like `:tada:`.
+var emojiShortcodeRE = regexp.MustCompile(`:([a-z0-9_+-]+):`)
+
+func transformEmoji(source string, options *RenderOptions) (string, error) {
+	if options == nil || !options.Emoji {
+		return source, nil
+	}
+
+	return transformHTMLText(source, func(text string) string {
+		return emojiShortcodeRE.ReplaceAllStringFunc(text, func(shortcode string) string {
+			if emoji, ok := emojiShortcodes[shortcode[1:len(shortcode)-1]]; ok {
+				return emoji
+			}
+			return shortcode
+		})
+	}), nil
+}
+
+// Matches a line that opens or closes a fenced code block, capturing the fence.
+var codeFenceRE = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+
+// Matches the placeholder that transformMathExtract substitutes for math,
+// capturing its kind ("D" for display or "I" for inline) and its hex-encoded
+// TeX. It's made up only of letters and digits so that no pass (including the
+// Markdown renderer) modifies it.
+var mathPlaceholderRE = regexp.MustCompile(`MMDXMATH([DI])([0-9a-f]*)MMDXEND`)
+
+// Replaces math in the Markdown source with placeholders that are turned into
+// markup by transformMathRender at the end of the pipeline. Because the TeX
+// is encoded into the placeholders themselves, no state needs to be carried
+// between the two passes.
+//
+// Fenced and indented code blocks are skipped line by line, and the remaining
+// runs of lines are given to extractMath, which skips code spans.
+func transformMathExtract(source string, options *RenderOptions) (string, error) {
+	if options == nil || !options.Math || !strings.Contains(source, "$") {
+		return source, nil
+	}
+
+	var (
+		fence      string
+		inIndented bool
+		prevBlank  = true
+		sb         strings.Builder
+		text       strings.Builder
+	)
+
+	flushText := func() {
+		sb.WriteString(extractMath(text.String()))
+		text.Reset()
+	}
+
+	for _, line := range strings.SplitAfter(source, "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		blank := strings.TrimSpace(trimmed) == ""
+
+		switch {
+		case fence != "":
+			sb.WriteString(line)
+
+			if matches := codeFenceRE.FindStringSubmatch(trimmed); matches != nil &&
+				matches[1][0] == fence[0] && len(matches[1]) >= len(fence) &&
+				strings.TrimSpace(trimmed[len(matches[0]):]) == "" {
+				fence = ""
+			}
+
+		case codeFenceRE.MatchString(trimmed):
+			flushText()
+			sb.WriteString(line)
+			fence = codeFenceRE.FindStringSubmatch(trimmed)[1]
+
+		case !blank && (strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")) &&
+			(prevBlank || inIndented):
+			flushText()
+			sb.WriteString(line)
+			inIndented = true
+
+		default:
+			// Blank lines can appear within an indented code block.
+			if blank && inIndented {
+				sb.WriteString(line)
+			} else {
+				text.WriteString(line)
+				inIndented = false
+			}
+		}
+
+		prevBlank = blank
+	}
+
+	flushText()
+
+	return sb.String(), nil
+}
+
+// Replaces the math in some Markdown text containing no code blocks with
+// placeholders. See transformMathExtract.
+func extractMath(text string) string {
+	if !strings.Contains(text, "$") {
+		return text
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(text))
+
+	for i := 0; i < len(text); {
+		switch {
+		case text[i] == '\\' && i+1 < len(text):
+			// Escaped dollar signs are unescaped because not every Markdown
+			// renderer does so.
+			if text[i+1] == '$' {
+				sb.WriteByte('$')
+			} else {
+				sb.WriteString(text[i : i+2])
+			}
+			i += 2
+
+		case text[i] == '`':
+			// Code spans end at the next run of the same number of backticks.
+			// A run that's never closed is just text.
+			n := 1
+			for i+n < len(text) && text[i+n] == '`' {
+				n++
+			}
+
+			end := strings.Index(text[i+n:], strings.Repeat("`", n))
+			if end < 0 {
+				sb.WriteString(text[i : i+n])
+				i += n
+				continue
+			}
+
+			sb.WriteString(text[i : i+n+end+n])
+			i += n + end + n
+
+		case strings.HasPrefix(text[i:], "$$"):
+			end := strings.Index(text[i+2:], "$$")
+			tex := ""
+			if end >= 0 {
+				tex = strings.TrimSpace(text[i+2 : i+2+end])
+			}
+
+			if tex == "" {
+				sb.WriteString("$$")
+				i += 2
+				continue
+			}
+
+			sb.WriteString(mathPlaceholder("D", tex))
+			i += 2 + end + 2
+
+		case text[i] == '$':
+			end := inlineMathEnd(text[i:])
+			if end < 0 {
+				sb.WriteByte('$')
+				i++
+				continue
+			}
+
+			sb.WriteString(mathPlaceholder("I", text[i+1:i+end]))
+			i += end + 1
+
+		default:
+			sb.WriteByte(text[i])
+			i++
+		}
+	}
+
+	return sb.String()
+}
+
+// Returns the index of the `$` closing the inline math that starts at the
+// beginning of text, or -1 if it doesn't start inline math. Inline math
+// doesn't span lines.
+func inlineMathEnd(text string) int {
+	if len(text) < 3 || text[1] == ' ' || text[1] == '\t' || text[1] == '\n' {
+		return -1
+	}
+
+	for j := 1; j < len(text); j++ {
+		switch text[j] {
+		case '\\':
+			j++
+		case '\n':
+			return -1
+		case '$':
+			if text[j-1] == ' ' || text[j-1] == '\t' {
+				continue
+			}
+			if j+1 < len(text) && text[j+1] >= '0' && text[j+1] <= '9' {
+				continue
+			}
+			return j
+		}
+	}
+
+	return -1
+}
+
+// Returns a placeholder for math of the given kind. See mathPlaceholderRE.
+func mathPlaceholder(kind, tex string) string {
+	return "MMDXMATH" + kind + hex.EncodeToString([]byte(tex)) + "MMDXEND"
+}
+
+// Replaces the placeholders left by transformMathExtract with markup that
+// client-side libraries can typeset.
+func transformMathRender(source string, options *RenderOptions) (string, error) {
+	if !strings.Contains(source, "MMDXMATH") {
+		return source, nil
+	}
+
+	var renderErr error
+	source = mathPlaceholderRE.ReplaceAllStringFunc(source, func(placeholder string) string {
+		matches := mathPlaceholderRE.FindStringSubmatch(placeholder)
+
+		tex, err := hex.DecodeString(matches[2])
+		if err != nil {
+			renderErr = xerrors.Errorf("error decoding math: %w", err)
+			return placeholder
+		}
+
+		if matches[1] == "D" {
+			return `<span class="math display">\[` + html.EscapeString(string(tex)) + `\]</span>`
+		}
+		return `<span class="math inline">\(` + html.EscapeString(string(tex)) + `\)</span>`
+	})
+	if renderErr != nil {
+		return "", renderErr
+	}
+
+	return source, nil
+}
+
+func transformTypography(source string, options *RenderOptions) (string, error) {
+	if options == nil || !options.Smartypants {
+		return source, nil
+	}
+
+	prev := byte(' ')
+
+	return transformHTMLText(source, func(text string) string {
+		text, prev = smartenText(text, prev)
+		return text
+	}), nil
+}
+
+// Substitutions made by smartenText, checked in order at each position.
+// Quotes are handled separately because they depend on what comes before
+// them.
+var typographyReplacements = []struct {
+	from, to string
+}{
+	{"---", "&mdash;"},
+	{"--", "&mdash;"},
+	{"...", "&hellip;"},
+}
+
+// Makes typographic substitutions in some HTML text (i.e. text that's known
+// not to contain tags). prev is the byte that preceded the text, which
+// determines whether a leading quote opens or closes, and the last byte of the
+// text is returned along with the result for the same purpose.
+func smartenText(text string, prev byte) (string, byte) {
+	var sb strings.Builder
+	sb.Grow(len(text))
+
+outer:
+	for i := 0; i < len(text); {
+		var quote byte
+		var size int
+
+		switch {
+		case text[i] == '"' || text[i] == '\'':
+			quote, size = text[i], 1
+		case strings.HasPrefix(text[i:], "&quot;"):
+			quote, size = '"', len("&quot;")
+		case strings.HasPrefix(text[i:], "&#34;"):
+			quote, size = '"', len("&#34;")
+		case strings.HasPrefix(text[i:], "&#39;"):
+			quote, size = '\'', len("&#39;")
+		}
+
+		if quote != 0 {
+			opening := prev == ' ' || prev == '\n' || prev == '\t' || prev == '\r' ||
+				strings.IndexByte("([{-", prev) != -1
+
+			switch {
+			case quote == '"' && opening:
+				sb.WriteString("&ldquo;")
+			case quote == '"':
+				sb.WriteString("&rdquo;")
+			case opening:
+				sb.WriteString("&lsquo;")
+			default:
+				sb.WriteString("&rsquo;")
+			}
+
+			prev = quote
+			i += size
+			continue
+		}
+
+		for _, replacement := range typographyReplacements {
+			if strings.HasPrefix(text[i:], replacement.from) {
+				sb.WriteString(replacement.to)
+				prev = replacement.from[0]
+				i += len(replacement.from)
+				continue outer
+			}
+		}
+
+		sb.WriteByte(text[i])
+		prev = text[i]
+		i++
+	}
+
+	return sb.String(), prev
+}
+
 // Matches one of the following:
 //
 //	# header
@@ -350,65 +1247,344 @@ func transformFootnotes(source string, options *RenderOptions) (string, error) {
 	return source, nil
 }
 
+// Matches any of the images or links that are candidates for rewriting by
+// transformImagesAndLinks. Alternatives are ordered so that a complete image
+// tag (which can be given a srcset) is preferred over a bare relative image
+// prefix.
+var imageAndLinkRE = regexp.MustCompile(
+	`<img src="([^"]+)"([^>]*)|<img src="/|<a href="/|<a href="http[^"]+"`)
+
+// Rewrites the images and links of a document in a single scan of it, which
+// makes a noticeable difference for large documents compared to one scan per
+// rewrite. In order:
+//
+//   - External links are given `rel="nofollow"` if NoFollow is set.
+//   - Relative images and links are made absolute if AbsoluteURL is set.
+//   - Images are given a Retina srcset unless NoRetina or Draft are set, or
+//     they're SVGs, data URIs, or already have a srcset.
+func transformImagesAndLinks(source string, options *RenderOptions) (string, error) {
+	var absoluteURL string
+	var noFollow, noRetina bool
+	if options != nil {
+		absoluteURL = options.AbsoluteURL
+		noFollow = options.NoFollow
+		noRetina = options.NoRetina || options.Draft
+	}
+
+	indexes := imageAndLinkRE.FindAllStringSubmatchIndex(source, -1)
+	if indexes == nil {
+		return source, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(source))
+
+	last := 0
+	for _, loc := range indexes {
+		b.WriteString(source[last:loc[0]])
+		last = loc[1]
+
+		match := source[loc[0]:loc[1]]
+
+		switch {
+		case strings.HasPrefix(match, `<a href="/`):
+			if absoluteURL != "" {
+				match = `<a href="` + absoluteURL + `/`
+			}
+
+		case strings.HasPrefix(match, `<a href="http`):
+			if noFollow {
+				match += ` rel="nofollow"`
+			}
+
+		case loc[2] == -1:
+			// A bare relative image prefix without a complete src.
+			if absoluteURL != "" {
+				match = `<img src="` + absoluteURL + `/`
+			}
+
+		default:
+			src, rest := source[loc[2]:loc[3]], source[loc[4]:loc[5]]
+
+			if absoluteURL != "" && strings.HasPrefix(src, "/") {
+				src = absoluteURL + src
+			}
+
+			if noRetina || filepath.Ext(src) == ".svg" || strings.Contains(rest, "srcset") ||
+				strings.HasPrefix(src, "data:") {
+				match = `<img src="` + src + `"` + rest
+			} else {
+				match = `<img src="` + src + `" srcset="` +
+					mtemplate.RetinaSrcset(src, string(mtemplate.To2X(src))) + `"` + rest
+			}
+		}
+
+		b.WriteString(match)
+	}
+	b.WriteString(source[last:])
+
+	return b.String(), nil
+}
+
+// Matches an image and captures its source and remaining attributes.
 var imageRE = regexp.MustCompile(`<img src="([^"]+)"([^>]*)`)
 
-func transformImagesToRetina(source string, options *RenderOptions) (string, error) {
-	if options != nil && options.NoRetina {
+func transformImagesToDataURIs(source string, options *RenderOptions) (string, error) {
+	if options == nil || options.InlineImagesUnder <= 0 {
 		return source, nil
 	}
 
-	// The basic idea here is that we give every image a `srcset` that includes
-	// 2x so that browsers will replace it with a retina version.
-	return imageRE.ReplaceAllStringFunc(source, func(img string) string {
+	source = imageRE.ReplaceAllStringFunc(source, func(img string) string {
 		matches := imageRE.FindStringSubmatch(img)
+		src := matches[1]
 
-		// SVGs are resolution-agnostic and don't need replacing.
-		if filepath.Ext(matches[1]) == ".svg" {
-			return fmt.Sprintf(`<img src="%s"%s`, matches[1], matches[2])
+		// Skip remote images and anything that's already a data URI.
+		if strings.HasPrefix(src, "//") || strings.Contains(src, ":") {
+			return img
 		}
 
-		// If the image already has a srcset, do nothing.
-		if strings.Contains(matches[2], "srcset") {
-			return fmt.Sprintf(`<img src="%s"%s`, matches[1], matches[2])
+		ext := strings.ToLower(filepath.Ext(src))
+		mimeType := mime.TypeByExtension(ext)
+		if ext == ".svg" || !strings.HasPrefix(mimeType, "image/") {
+			return img
 		}
 
-		return fmt.Sprintf(`<img src="%s" srcset="%s 2x, %s 1x"%s`,
-			matches[1],
-			mtemplate.To2X(matches[1]),
-			matches[1],
-			matches[2],
-		)
-	}), nil
+		imagePath := filepath.Join(options.InlineImagesRoot, filepath.FromSlash(src))
+
+		info, err := os.Stat(imagePath)
+		if err != nil {
+			options.warnf("mmarkdownext: Not inlining image '%s': %v", src, err)
+			return img
+		}
+
+		if info.Size() >= int64(options.InlineImagesUnder) {
+			return img
+		}
+
+		data, err := os.ReadFile(imagePath)
+		if err != nil {
+			options.warnf("mmarkdownext: Not inlining image '%s': %v", src, err)
+			return img
+		}
+
+		return fmt.Sprintf(`<img src="data:%s;base64,%s"%s`,
+			mimeType, base64.StdEncoding.EncodeToString(data), matches[2])
+	})
+
+	return source, nil
 }
 
-var relativeImageRE = regexp.MustCompile(`<img src="/`)
+// Attributes that AMP allows on `<amp-img>`. Anything else carried over from
+// an `<img>` is dropped.
+var ampImageAttributes = map[string]bool{
+	"alt":         true,
+	"attribution": true,
+	"class":       true,
+	"height":      true,
+	"id":          true,
+	"sizes":       true,
+	"src":         true,
+	"srcset":      true,
+	"title":       true,
+	"width":       true,
+}
 
-var relativeLinkRE = regexp.MustCompile(`<a href="/`)
+var (
+	attributeRE = regexp.MustCompile(`([a-zA-Z-]+)="([^"]*)"`)
+	imageTagRE  = regexp.MustCompile(`<img\s[^>]*>`)
+)
 
-func transformImagesAndLinksToAbsoluteURLs(source string, options *RenderOptions) (string, error) {
-	if options == nil || options.AbsoluteURL == "" {
+func transformImagesToAMP(source string, options *RenderOptions) (string, error) {
+	if options == nil || !options.AMP {
 		return source, nil
 	}
 
-	source = relativeImageRE.ReplaceAllStringFunc(source, func(img string) string {
-		return `<img src="` + options.AbsoluteURL + `/`
-	})
+	var ampErr error
+
+	source = imageTagRE.ReplaceAllStringFunc(source, func(img string) string {
+		var b strings.Builder
+		b.WriteString("<amp-img")
+
+		var src string
+		var hasHeight, hasWidth bool
+		for _, matches := range attributeRE.FindAllStringSubmatch(img, -1) {
+			name := strings.ToLower(matches[1])
+			if !ampImageAttributes[name] {
+				continue
+			}
+
+			switch name {
+			case "height":
+				hasHeight = true
+			case "src":
+				src = html.UnescapeString(matches[2])
+			case "width":
+				hasWidth = true
+			}
+
+			b.WriteString(" " + name + `="` + matches[2] + `"`)
+		}
+
+		if !hasWidth || !hasHeight {
+			width, height, err := imageDimensions(src, options)
+			if err != nil {
+				if ampErr == nil {
+					ampErr = err
+				}
+				return img
+			}
 
-	source = relativeLinkRE.ReplaceAllStringFunc(source, func(img string) string {
-		return `<a href="` + options.AbsoluteURL + `/`
+			if !hasWidth {
+				fmt.Fprintf(&b, ` width="%d"`, width)
+			}
+			if !hasHeight {
+				fmt.Fprintf(&b, ` height="%d"`, height)
+			}
+		}
+
+		b.WriteString(` layout="responsive"></amp-img>`)
+		return b.String()
 	})
 
+	if ampErr != nil {
+		return "", ampErr
+	}
+
 	return source, nil
 }
 
-var absoluteLinkRE = regexp.MustCompile(`<a href="http[^"]+"`)
+// Reads the width and height of an image, either from a `data:` URI or from a
+// local file under InlineImagesRoot. Remote images can't be measured.
+func imageDimensions(src string, options *RenderOptions) (int, int, error) {
+	if options.AbsoluteURL != "" {
+		src = strings.TrimPrefix(src, options.AbsoluteURL)
+	}
+
+	var config image.Config
+	var err error
+
+	switch {
+	case strings.HasPrefix(src, "data:"):
+		i := strings.Index(src, ";base64,")
+		if i == -1 {
+			return 0, 0, xerrors.Errorf("unsupported data URI for AMP image")
+		}
 
-func transformLinksToNoFollow(source string, options *RenderOptions) (string, error) {
-	if options == nil || !options.NoFollow {
+		var data []byte
+		data, err = base64.StdEncoding.DecodeString(src[i+len(";base64,"):])
+		if err != nil {
+			return 0, 0, xerrors.Errorf("error decoding data URI for AMP image: %w", err)
+		}
+
+		config, _, err = image.DecodeConfig(bytes.NewReader(data))
+
+	case strings.HasPrefix(src, "//") || strings.Contains(src, ":"):
+		return 0, 0, xerrors.Errorf(
+			"AMP image '%s' is remote and needs explicit width and height attributes", src)
+
+	default:
+		config, err = localImageConfig(filepath.Join(options.InlineImagesRoot, filepath.FromSlash(src)))
+	}
+
+	if err != nil {
+		return 0, 0, xerrors.Errorf("error reading dimensions of AMP image '%s': %w", src, err)
+	}
+
+	return config.Width, config.Height, nil
+}
+
+func transformImageDimensions(source string, options *RenderOptions) (string, error) {
+	if options == nil || !options.ImageDimensions {
 		return source, nil
 	}
 
-	return absoluteLinkRE.ReplaceAllStringFunc(source, func(link string) string {
-		return fmt.Sprintf(`%s rel="nofollow"`, link)
-	}), nil
+	source = imageTagRE.ReplaceAllStringFunc(source, func(img string) string {
+		var src string
+		for _, matches := range attributeRE.FindAllStringSubmatch(img, -1) {
+			switch strings.ToLower(matches[1]) {
+			case "height", "width":
+				return img
+			case "src":
+				src = html.UnescapeString(matches[2])
+			}
+		}
+
+		if i := strings.IndexAny(src, "?#"); i != -1 {
+			src = src[0:i]
+		}
+
+		if !strings.HasPrefix(src, "/") || strings.HasPrefix(src, "//") ||
+			strings.EqualFold(filepath.Ext(src), ".svg") {
+			return img
+		}
+
+		config, err := localImageConfig(filepath.Join(options.InlineImagesRoot, filepath.FromSlash(src)))
+		if err != nil {
+			options.warnf("mmarkdownext: Not adding dimensions to image '%s': %v", src, err)
+			return img
+		}
+
+		closing := ">"
+		if strings.HasSuffix(img, "/>") {
+			closing = " />"
+		}
+
+		return strings.TrimRight(strings.TrimSuffix(strings.TrimSuffix(img, ">"), "/"), " ") +
+			fmt.Sprintf(` width="%d" height="%d"`, config.Width, config.Height) + closing
+	})
+
+	return source, nil
+}
+
+// A cached image config along with the modification time and size of the
+// file it was read from, which are used to tell whether it's still current.
+type cachedImageConfig struct {
+	config  image.Config
+	modTime time.Time
+	size    int64
+}
+
+// Image configs read by localImageConfig, keyed by path.
+var imageConfigCache = struct {
+	sync.Mutex
+	configs map[string]*cachedImageConfig
+}{configs: make(map[string]*cachedImageConfig)}
+
+// Reads the config (including the dimensions) of a local image. Results are
+// cached by path so that an image referenced from many documents, or across
+// rebuilds, is only opened once for as long as it's unchanged.
+func localImageConfig(path string) (image.Config, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return image.Config{}, xerrors.Errorf("error opening image: %w", err)
+	}
+
+	imageConfigCache.Lock()
+	cached, ok := imageConfigCache.configs[path]
+	imageConfigCache.Unlock()
+
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.config, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, xerrors.Errorf("error opening image: %w", err)
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Config{}, xerrors.Errorf("error decoding image: %w", err)
+	}
+
+	imageConfigCache.Lock()
+	imageConfigCache.configs[path] = &cachedImageConfig{
+		config:  config,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+	}
+	imageConfigCache.Unlock()
+
+	return config, nil
 }
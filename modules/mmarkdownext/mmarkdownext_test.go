@@ -1,9 +1,19 @@
 package mmarkdownext
 
 import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/require"
+	"gopkg.in/russross/blackfriday.v2"
+
+	"github.com/brandur/modulir/modules/mmarkdown"
+	"github.com/brandur/modulir/modules/mtoc"
 )
 
 func TestCollapseHTML(t *testing.T) {
@@ -13,10 +23,171 @@ func TestCollapseHTML(t *testing.T) {
 </p>`))
 }
 
+func TestDefaultPipeline(t *testing.T) {
+	pipeline := DefaultPipeline()
+	assert.Len(t, pipeline, len(renderStack))
+
+	// It's a copy that can be modified without affecting Render.
+	pipeline[0] = nil
+	assert.NotNil(t, renderStack[0])
+}
+
+func TestFirstImage(t *testing.T) {
+	src, ok := FirstImage(`<p>Hello</p><img src="/assets/a.jpg?w=1&amp;h=2" alt="A"><img src="/assets/b.jpg">`)
+	assert.True(t, ok)
+	assert.Equal(t, "/assets/a.jpg?w=1&h=2", src)
+
+	src, ok = FirstImage(must(Render("Hello\n\n![Image](/assets/c.jpg)", &RenderOptions{NoRetina: true})).(string))
+	assert.True(t, ok)
+	assert.Equal(t, "/assets/c.jpg", src)
+
+	src, ok = FirstImage("<p>No images here</p>")
+	assert.False(t, ok)
+	assert.Equal(t, "", src)
+}
+
+func TestPipelineBuilder(t *testing.T) {
+	var order []string
+	record := func(name string) RenderFunc {
+		return func(source string, options *RenderOptions) (string, error) {
+			// Whether Markdown has been rendered yet shows where the pass ran.
+			order = append(order, fmt.Sprintf("%s (rendered: %v)", name,
+				strings.Contains(source, "<p>")))
+			return source, nil
+		}
+	}
+
+	pipeline, err := NewPipelineBuilder().
+		InsertBefore(PassFootnotes, record("before footnotes")).
+		InsertAfter(PassMarkdown, record("after markdown")).
+		InsertBefore(PassMarkdown, record("before markdown")).
+		Remove(PassFigures).
+		Build()
+	assert.NoError(t, err)
+	assert.Len(t, pipeline, len(renderStack)+2)
+
+	assert.Equal(t, "<p><strong>strong</strong></p>\n",
+		must(Render("**strong**", &RenderOptions{Pipeline: pipeline})))
+	assert.Equal(t, []string{
+		"before markdown (rendered: false)",
+		"after markdown (rendered: true)",
+		"before footnotes (rendered: true)",
+	}, order)
+
+	// The first error is returned, and later operations are ignored.
+	_, err = NewPipelineBuilder().
+		Remove(PassFigures).
+		InsertAfter(PassFigures, record("after figures")).
+		InsertAfter("unknown", record("after unknown")).
+		Build()
+	assert.EqualError(t, err, "pass 'figures' not found in pipeline")
+}
+
 func TestRender(t *testing.T) {
 	assert.Equal(t, "<p><strong>strong</strong></p>\n", must(Render("**strong**", nil)))
 }
 
+func TestRender_Math(t *testing.T) {
+	source := "Euler: $e^{i\\pi} + 1 = 0$ costs $5 or $10. [1]\n" +
+		"\n" +
+		"$$\n" +
+		"\\sum_{i=1}^{n} i = \\frac{n(n+1)}{2}\n" +
+		"$$\n" +
+		"\n" +
+		"Not templates: ${{x}}$, or code: `$a$`.\n" +
+		"\n" +
+		"```\n" +
+		"$b$\n" +
+		"```\n" +
+		"\n" +
+		"[1] A footnote with $x_1 * x_2$.\n"
+
+	rendered := must(Render(source, &RenderOptions{Math: true})).(string)
+
+	assert.Contains(t, rendered, `Euler: <span class="math inline">\(e^{i\pi} + 1 = 0\)</span> costs $5 or $10.`)
+	assert.Contains(t, rendered,
+		`<p><span class="math display">\[\sum_{i=1}^{n} i = \frac{n(n+1)}{2}\]</span></p>`)
+	assert.Contains(t, rendered, `Not templates: <span class="math inline">\({{x}}\)</span>`)
+	assert.Contains(t, rendered, `<code>$a$</code>`)
+	assert.Contains(t, rendered, "<pre><code>$b$\n</code></pre>")
+	assert.Contains(t, rendered, `A footnote with <span class="math inline">\(x_1 * x_2\)</span>`)
+
+	// Does nothing unless enabled.
+	assert.NotContains(t, must(Render("$x$", nil)), "math")
+}
+
+func TestRender_Pipeline(t *testing.T) {
+	source := `!fig src="fig-src" caption="fig-caption"`
+
+	upcase := func(source string, options *RenderOptions) (string, error) {
+		return strings.ToUpper(source), nil
+	}
+
+	// The default pipeline is used when none is given.
+	assert.Contains(t, must(Render(source, &RenderOptions{})), "<figure>")
+
+	t.Run("RemovePass", func(t *testing.T) {
+		pipeline := RemovePass(DefaultPipeline(), PassFigures)
+		assert.Len(t, pipeline, len(renderStack)-1)
+		rendered := must(Render(source, &RenderOptions{Pipeline: pipeline}))
+		assert.NotContains(t, rendered, "<figure>")
+		assert.Contains(t, rendered, "<p>!fig src=")
+
+		// Removing a pass that's not in the pipeline is a no-op.
+		assert.Len(t, RemovePass(pipeline, PassFigures), len(renderStack)-1)
+	})
+
+	t.Run("InsertPassBefore", func(t *testing.T) {
+		pipeline, err := InsertPassBefore(DefaultPipeline(), PassMarkdown, upcase)
+		assert.NoError(t, err)
+		assert.Len(t, pipeline, len(renderStack)+1)
+		assert.Equal(t, "<p><strong>STRONG</strong></p>\n",
+			must(Render("**strong**", &RenderOptions{Pipeline: pipeline})))
+	})
+
+	t.Run("InsertPassAfter", func(t *testing.T) {
+		pipeline, err := InsertPassAfter(DefaultPipeline(), PassMarkdown, upcase)
+		assert.NoError(t, err)
+		assert.Equal(t, "<P><STRONG>STRONG</STRONG></P>\n",
+			must(Render("**strong**", &RenderOptions{Pipeline: pipeline})))
+	})
+
+	t.Run("InsertPassErrors", func(t *testing.T) {
+		_, err := InsertPassAfter(DefaultPipeline(), "unknown", upcase)
+		assert.EqualError(t, err, "unknown pass 'unknown'")
+
+		_, err = InsertPassBefore(RemovePass(DefaultPipeline(), PassFigures), PassFigures, upcase)
+		assert.EqualError(t, err, "pass 'figures' not found in pipeline")
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Equal(t, "**strong**", must(Render("**strong**", &RenderOptions{Pipeline: []RenderFunc{}})))
+	})
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	assert.Equal(t, "<p><strong>strong</strong></p>\n", must(renderMarkdown("**strong**", nil)))
+	assert.Equal(t, "<p><strong>strong</strong></p>\n", must(renderMarkdown("**strong**", &RenderOptions{})))
+
+	t.Run("HeadingIDPrefix", func(t *testing.T) {
+		options := &RenderOptions{
+			Backend: mmarkdown.BackendBlackfriday,
+			BlackfridayOptions: []blackfriday.Option{
+				blackfriday.WithExtensions(blackfriday.CommonExtensions | blackfriday.AutoHeadingIDs),
+			},
+			HTMLRendererParameters: &blackfriday.HTMLRendererParameters{
+				Flags:           blackfriday.CommonHTMLFlags,
+				HeadingIDPrefix: "doc-",
+			},
+		}
+
+		assert.Equal(t,
+			`<h1 id="doc-the-title">The Title</h1>`+"\n",
+			must(renderMarkdown("# The Title", options)),
+		)
+	})
+}
+
 func TestTransformCodeWithLanguagePrefix(t *testing.T) {
 	assert.Equal(t,
 		`<code class="language-ruby">`,
@@ -24,6 +195,39 @@ func TestTransformCodeWithLanguagePrefix(t *testing.T) {
 	)
 }
 
+func TestTransformSyntaxHighlighting(t *testing.T) {
+	source := `<pre><code class="language-ruby">puts &quot;hello&quot;
+</code></pre>`
+
+	// Code blocks are left untouched unless highlighting is enabled.
+	assert.Equal(t, source, must(transformSyntaxHighlighting(source, nil)))
+	assert.Equal(t, source, must(transformSyntaxHighlighting(source, &RenderOptions{})))
+}
+
+func TestTransformEmoji(t *testing.T) {
+	options := &RenderOptions{Emoji: true}
+
+	assert.Equal(t,
+		"<p>Shipped 🎉 👍 with :notanemoji: at 12:30:45.</p>",
+		must(transformEmoji("<p>Shipped :tada: :+1: with :notanemoji: at 12:30:45.</p>", options)),
+	)
+
+	// Attributes and code are left alone.
+	assert.Equal(t,
+		`<p><a href="/:tada:" title=":tada:">🎉</a> <code>:tada:</code></p>`+"\n"+
+			`<pre><code>:rocket:</code></pre>`,
+		must(transformEmoji(
+			`<p><a href="/:tada:" title=":tada:">:tada:</a> <code>:tada:</code></p>`+"\n"+
+				`<pre><code>:rocket:</code></pre>`,
+			options,
+		)),
+	)
+
+	// Does nothing unless enabled.
+	assert.Equal(t, "<p>:tada:</p>", must(transformEmoji("<p>:tada:</p>", nil)))
+	assert.Equal(t, "<p>:tada:</p>", must(transformEmoji("<p>:tada:</p>", &RenderOptions{})))
+}
+
 func TestTransformFigures(t *testing.T) {
 	assert.Equal(t, `
 <figure>
@@ -191,35 +395,213 @@ Conclusion.
 	)
 }
 
+func TestTransformImageDimensions(t *testing.T) {
+	dir := t.TempDir()
+
+	// A 1x1 transparent PNG.
+	pngData, err := base64.StdEncoding.DecodeString(
+		"iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNkYAAAAAYAAjCB0C8AAAAASUVORK5CYII=")
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "assets"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "assets/icon.png"), pngData, 0o600))
+
+	options := &RenderOptions{ImageDimensions: true, InlineImagesRoot: dir}
+
+	assert.Equal(t,
+		`<img src="/assets/icon.png" alt="icon" width="1" height="1" />`,
+		must(transformImageDimensions(`<img src="/assets/icon.png" alt="icon" />`, options)),
+	)
+
+	assert.Equal(t,
+		`<img src="/assets/icon.png?v=2" width="1" height="1">`,
+		must(transformImageDimensions(`<img src="/assets/icon.png?v=2">`, options)),
+	)
+
+	// Images that declare dimensions, SVGs, and remote images are left alone.
+	for _, img := range []string{
+		`<img src="/assets/icon.png" width="640">`,
+		`<img src="/assets/missing.svg">`,
+		`<img src="https://example.com/a.png">`,
+		`<img src="//example.com/a.png">`,
+	} {
+		assert.Equal(t, img, must(transformImageDimensions(img, options)))
+	}
+
+	// A missing image is left alone with a warning instead of failing the
+	// render, and images after it are still measured.
+	log := &recordingLogger{}
+	options.Log = log
+	assert.Equal(t,
+		`<img src="/assets/missing.png"><img src="/assets/icon.png" width="1" height="1">`,
+		must(transformImageDimensions(`<img src="/assets/missing.png"><img src="/assets/icon.png">`, options)),
+	)
+	assert.Len(t, log.warnings, 1)
+	assert.Contains(t, log.warnings[0], "/assets/missing.png")
+	options.Log = nil
+
+	// Dimensions are cached, but refreshed when the image changes.
+	config, err := localImageConfig(filepath.Join(dir, "assets/icon.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, config.Width)
+
+	imageConfigCache.Lock()
+	imageConfigCache.configs[filepath.Join(dir, "assets/icon.png")].config.Width = 2
+	imageConfigCache.Unlock()
+
+	config, err = localImageConfig(filepath.Join(dir, "assets/icon.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, config.Width)
+
+	modTime := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "assets/icon.png"), modTime, modTime))
+
+	config, err = localImageConfig(filepath.Join(dir, "assets/icon.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, config.Width)
+
+	// Nothing happens without the option.
+	assert.Equal(t,
+		`<img src="/assets/icon.png">`,
+		must(transformImageDimensions(`<img src="/assets/icon.png">`, nil)),
+	)
+}
+
+func TestTransformImagesToAMP(t *testing.T) {
+	dir := t.TempDir()
+
+	// A 1x1 transparent PNG.
+	pngData, err := base64.StdEncoding.DecodeString(
+		"iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNkYAAAAAYAAjCB0C8AAAAASUVORK5CYII=")
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "assets"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "assets/icon.png"), pngData, 0o600))
+
+	options := &RenderOptions{AMP: true, InlineImagesRoot: dir}
+
+	// Dimensions are read from the image and disallowed attributes are
+	// dropped.
+	assert.Equal(t,
+		`<amp-img src="/assets/icon.png" alt="icon" width="1" height="1" layout="responsive"></amp-img>`,
+		must(transformImagesToAMP(`<img src="/assets/icon.png" alt="icon" style="float: left" />`, options)),
+	)
+
+	// Explicit dimensions are kept, so remote images can be used.
+	assert.Equal(t,
+		`<amp-img src="https://example.com/a.png" width="640" height="480" layout="responsive"></amp-img>`,
+		must(transformImagesToAMP(`<img src="https://example.com/a.png" width="640" height="480">`, options)),
+	)
+
+	_, err = transformImagesToAMP(`<img src="https://example.com/a.png">`, options)
+	assert.Error(t, err)
+
+	_, err = transformImagesToAMP(`<img src="/assets/missing.png">`, options)
+	assert.Error(t, err)
+
+	// Nothing happens without the option.
+	assert.Equal(t,
+		`<img src="/assets/icon.png">`,
+		must(transformImagesToAMP(`<img src="/assets/icon.png">`, nil)),
+	)
+
+	// Through the full render stack, the srcset and absolute URL are kept.
+	options.AbsoluteURL = "https://brandur.org"
+	assert.Equal(t,
+		`<p><amp-img src="https://brandur.org/assets/icon.png" `+
+			`srcset="https://brandur.org/assets/icon@2x.png 2x, https://brandur.org/assets/icon.png 1x" `+
+			`alt="icon" width="1" height="1" layout="responsive"></amp-img></p>`+"\n",
+		must(Render(`![icon](/assets/icon.png)`, options)),
+	)
+}
+
+func TestTransformImagesToDataURIs(t *testing.T) {
+	dir := t.TempDir()
+
+	// A 1x1 transparent PNG.
+	pngData, err := base64.StdEncoding.DecodeString(
+		"iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNkYAAAAAYAAjCB0C8AAAAASUVORK5CYII=")
+	assert.NoError(t, err)
+	pngURI := "data:image/png;base64," + base64.StdEncoding.EncodeToString(pngData)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "assets"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "assets/icon.png"), pngData, 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "assets/large.png"), make([]byte, 1024), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "assets/icon.svg"), []byte("<svg></svg>"), 0o600))
+
+	options := &RenderOptions{InlineImagesRoot: dir, InlineImagesUnder: 512}
+
+	assert.Equal(t,
+		`<img src="`+pngURI+`" alt="icon">`,
+		must(transformImagesToDataURIs(`<img src="/assets/icon.png" alt="icon">`, options)),
+	)
+
+	// Images at or above the threshold, SVGs, and remote images are left
+	// alone.
+	for _, img := range []string{
+		`<img src="/assets/large.png">`,
+		`<img src="/assets/icon.svg">`,
+		`<img src="https://example.com/icon.png">`,
+	} {
+		assert.Equal(t, img, must(transformImagesToDataURIs(img, options)))
+	}
+
+	// Nothing is inlined without a threshold.
+	assert.Equal(t,
+		`<img src="/assets/icon.png">`,
+		must(transformImagesToDataURIs(`<img src="/assets/icon.png">`, nil)),
+	)
+
+	// A missing image is left alone with a warning instead of failing the
+	// render.
+	log := &recordingLogger{}
+	options.Log = log
+	assert.Equal(t,
+		`<img src="/assets/missing.png">`,
+		must(transformImagesToDataURIs(`<img src="/assets/missing.png">`, options)),
+	)
+	assert.Len(t, log.warnings, 1)
+	assert.Contains(t, log.warnings[0], "/assets/missing.png")
+	options.Log = nil
+
+	// Through the full render stack, inlined images don't get a srcset or an
+	// absolute URL.
+	options.AbsoluteURL = "https://brandur.org"
+	assert.Equal(t,
+		`<p><img src="`+pngURI+`" alt="icon" /></p>`+"\n",
+		must(Render(`![icon](/assets/icon.png)`, options)),
+	)
+}
+
 func TestTransformImagesToRetina(t *testing.T) {
 	assert.Equal(t,
 		`<img src="/assets/hello.jpg" srcset="/assets/hello@2x.jpg 2x, /assets/hello.jpg 1x">`,
-		must(transformImagesToRetina(`<img src="/assets/hello.jpg">`, nil)),
+		must(transformImagesAndLinks(`<img src="/assets/hello.jpg">`, nil)),
 	)
 
 	// No srcset is inserted for resolution agnostic SVGs.
 	assert.Equal(t,
 		`<img src="/assets/hello.svg">`,
-		must(transformImagesToRetina(`<img src="/assets/hello.svg">`, nil)),
+		must(transformImagesAndLinks(`<img src="/assets/hello.svg">`, nil)),
 	)
 
 	// Don't change images that already have a srcset.
 	assert.Equal(t,
 		`<img src="/assets/hello.jpg" srcset="pre-existing">`,
-		must(transformImagesToRetina(`<img src="/assets/hello.jpg" srcset="pre-existing">`, nil)),
+		must(transformImagesAndLinks(`<img src="/assets/hello.jpg" srcset="pre-existing">`, nil)),
 	)
 
 	// Make sure transformation works with other attributes in the <img> tag (I
 	// previously introduced a bug relating to this).
 	assert.Equal(t,
 		`<img src="/assets/hello.svg" class="overflowing">`,
-		must(transformImagesToRetina(`<img src="/assets/hello.svg" class="overflowing">`, nil)),
+		must(transformImagesAndLinks(`<img src="/assets/hello.svg" class="overflowing">`, nil)),
 	)
 
 	// No replacement when we've explicitly requested no retina conversion
 	assert.Equal(t,
 		`<img src="/assets/hello.jpg">`,
-		must(transformImagesToRetina(
+		must(transformImagesAndLinks(
 			`<img src="/assets/hello.jpg">`,
 			&RenderOptions{NoRetina: true},
 		)),
@@ -227,48 +609,72 @@ func TestTransformImagesToRetina(t *testing.T) {
 }
 
 func TestTransformImagesToAbsoluteURLs(t *testing.T) {
+	// Retina srcsets are disabled so that only absolute URLs are checked.
+
 	// An image
 	assert.Equal(t,
 		`<img src="https://brandur.org/assets/hello.jpg">`,
-		must(transformImagesAndLinksToAbsoluteURLs(
+		must(transformImagesAndLinks(
 			`<img src="/assets/hello.jpg">`,
-			&RenderOptions{AbsoluteURL: "https://brandur.org"},
+			&RenderOptions{AbsoluteURL: "https://brandur.org", NoRetina: true},
 		)),
 	)
 
 	// A link
 	assert.Equal(t,
 		`<a href="https://brandur.org/relative">Relative</a>`,
-		must(transformImagesAndLinksToAbsoluteURLs(
+		must(transformImagesAndLinks(
 			`<a href="/relative">Relative</a>`,
-			&RenderOptions{AbsoluteURL: "https://brandur.org"},
+			&RenderOptions{AbsoluteURL: "https://brandur.org", NoRetina: true},
 		)),
 	)
 
 	// URLs that are already absolute are left alone.
 	assert.Equal(t,
 		`<img src="https://example.com/assets/hello.jpg">`,
-		must(transformImagesAndLinksToAbsoluteURLs(
+		must(transformImagesAndLinks(
 			`<img src="https://example.com/assets/hello.jpg">`,
-			&RenderOptions{AbsoluteURL: "https://brandur.org"},
+			&RenderOptions{AbsoluteURL: "https://brandur.org", NoRetina: true},
 		)),
 	)
 
-	// Should pass through if options are nil.
+	// Should pass through without an absolute URL.
 	assert.Equal(t,
 		`<img src="/assets/hello.jpg">`,
-		must(transformImagesAndLinksToAbsoluteURLs(
+		must(transformImagesAndLinks(
 			`<img src="/assets/hello.jpg">`,
-			nil,
+			&RenderOptions{NoRetina: true},
 		)),
 	)
 }
 
+func TestTransformImagesAndLinks(t *testing.T) {
+	source := `<p><a href="https://example.com">Example</a> and ` +
+		`<a href="/relative">Relative</a></p>` +
+		`<img src="/assets/hello.jpg">` +
+		`<img src="/assets/hello.svg" class="overflowing">` +
+		`<img src="https://example.com/assets/hello.png" alt="remote">` +
+		`<img src="/assets/hello.jpg" srcset="pre-existing">`
+
+	assert.Equal(t,
+		`<p><a href="https://example.com" rel="nofollow">Example</a> and `+
+			`<a href="https://brandur.org/relative">Relative</a></p>`+
+			`<img src="https://brandur.org/assets/hello.jpg" `+
+			`srcset="https://brandur.org/assets/hello@2x.jpg 2x, https://brandur.org/assets/hello.jpg 1x">`+
+			`<img src="https://brandur.org/assets/hello.svg" class="overflowing">`+
+			`<img src="https://example.com/assets/hello.png" `+
+			`srcset="https://example.com/assets/hello@2x.png 2x, https://example.com/assets/hello.png 1x" alt="remote">`+
+			`<img src="https://brandur.org/assets/hello.jpg" srcset="pre-existing">`,
+		must(transformImagesAndLinks(source,
+			&RenderOptions{AbsoluteURL: "https://brandur.org", NoFollow: true})),
+	)
+}
+
 func TestTransformLinksToNoFollow(t *testing.T) {
 	assert.Equal(t,
 		`<a href="https://example.com" rel="nofollow">Example</a>`+
 			`<span class="hello">Hello</span>`,
-		must(transformLinksToNoFollow(
+		must(transformImagesAndLinks(
 			`<a href="https://example.com">Example</a>`+
 				`<span class="hello">Hello</span>`,
 			&RenderOptions{NoFollow: true},
@@ -278,7 +684,7 @@ func TestTransformLinksToNoFollow(t *testing.T) {
 	// URLs that are relative should be left alone.
 	assert.Equal(t,
 		`<a href="/relative">Relative link</a>`,
-		must(transformLinksToNoFollow(
+		must(transformImagesAndLinks(
 			`<a href="/relative">Relative link</a>`,
 			&RenderOptions{NoFollow: true},
 		)),
@@ -287,16 +693,205 @@ func TestTransformLinksToNoFollow(t *testing.T) {
 	// Should pass through if options are nil.
 	assert.Equal(t,
 		`<a href="https://example.com">Example</a>`,
-		must(transformLinksToNoFollow(
+		must(transformImagesAndLinks(
 			`<a href="https://example.com">Example</a>`,
 			nil,
 		)),
 	)
 }
 
+func TestTransformMath(t *testing.T) {
+	options := &RenderOptions{Math: true}
+
+	render := func(source string) string {
+		extracted := must(transformMathExtract(source, options)).(string)
+
+		// Math is hidden from the passes in between.
+		assert.NotContains(t, extracted, "{{")
+
+		return must(transformMathRender(extracted, options)).(string)
+	}
+
+	assert.Equal(t, `Inline <span class="math inline">\(a &lt; b\)</span>.`,
+		render("Inline $a < b$."))
+	assert.Equal(t, `Template <span class="math inline">\({{x}}\)</span>`,
+		render("Template ${{x}}$"))
+	assert.Equal(t, "<span class=\"math display\">\\[x^{2}\\]</span>\n",
+		render("$$\nx^{2}\n$$\n"))
+
+	// Not math.
+	for _, source := range []string{
+		"It costs $5 or $10.",
+		"A $ sign and $ another.",
+		"Spans $lines\nno$.",
+		"Empty $$ $$.",
+		"Escaped \\$x$.",
+		"Code `$x$` and ``$y$``.",
+		"```\n$x$\n```\n",
+		"~~~~\n$x$\n~~~\n$y$\n~~~~\n",
+		"Para.\n\n    $x$\n\n    $y$\n",
+	} {
+		rendered := render(source)
+		assert.NotContains(t, rendered, "math", "source: %q", source)
+	}
+
+	// Escaped dollar signs are unescaped.
+	assert.Equal(t, "Escaped $x$.", render("Escaped \\$x$."))
+
+	// Math after code is still found.
+	assert.Equal(t, "```\n$x$\n```\n<span class=\"math inline\">\\(y\\)</span>\n",
+		render("```\n$x$\n```\n$y$\n"))
+
+	// Does nothing unless enabled.
+	assert.Equal(t, "$x$", must(transformMathExtract("$x$", nil)))
+	assert.Equal(t, "$x$", must(transformMathExtract("$x$", &RenderOptions{})))
+}
+
+func TestTransformTOC(t *testing.T) {
+	headers := `<h2 id="a" class="link"><a href="#a">A</a></h2>
+<p>Text</p>
+<h3 id="b" class="link"><a href="#b">B</a></h3>
+`
+	source := "<p>Intro</p>\n<p>[[TOC]]</p>\n" + headers
+
+	toc := must(mtoc.RenderFromHTML(headers)).(string)
+	assert.Contains(t, toc, `<a href="#b">B</a>`)
+
+	// Replaces the marker.
+	assert.Equal(t,
+		"<p>Intro</p>\n"+toc+headers,
+		must(transformTOC(source, &RenderOptions{TOC: true})),
+	)
+
+	// Goes at the top of the document without a marker.
+	assert.Equal(t,
+		toc+headers,
+		must(transformTOC(headers, &RenderOptions{TOC: true})),
+	)
+
+	// Respects the maximum level.
+	tocMaxLevel := must(mtoc.RenderFromHTMLWithMaxLevel(headers, 2)).(string)
+	assert.NotContains(t, tocMaxLevel, `<a href="#b">B</a>`)
+	assert.Equal(t,
+		tocMaxLevel+headers,
+		must(transformTOC(headers, &RenderOptions{TOC: true, TOCMaxLevel: 2})),
+	)
+
+	// Does nothing unless enabled.
+	assert.Equal(t, source, must(transformTOC(source, nil)))
+	assert.Equal(t, source, must(transformTOC(source, &RenderOptions{})))
+}
+
+func TestTransformTaskLists(t *testing.T) {
+	assert.Equal(t,
+		`<ul>
+<li class="task-list-item"><input type="checkbox" disabled> Todo</li>
+<li class="task-list-item"><input type="checkbox" checked disabled> Done</li>
+<li>Not a task</li>
+<li>Not [x] a task</li>
+</ul>
+`,
+		must(transformTaskLists(`<ul>
+<li>[ ] Todo</li>
+<li>[x] Done</li>
+<li>Not a task</li>
+<li>Not [x] a task</li>
+</ul>
+`, nil)),
+	)
+
+	// Loose lists wrap items in paragraphs.
+	assert.Equal(t,
+		`<li class="task-list-item"><p><input type="checkbox" checked disabled> Done</p></li>`,
+		must(transformTaskLists(`<li><p>[X] Done</p></li>`, nil)),
+	)
+
+	// Renders end to end.
+	assert.Equal(t,
+		"<ul>\n<li class=\"task-list-item\"><input type=\"checkbox\" disabled> Todo</li>\n</ul>\n",
+		must(Render("* [ ] Todo", nil)),
+	)
+
+	// Does nothing if disabled.
+	assert.Equal(t,
+		`<li>[ ] Todo</li>`,
+		must(transformTaskLists(`<li>[ ] Todo</li>`, &RenderOptions{NoTaskLists: true})),
+	)
+}
+
+func TestTransformTypography(t *testing.T) {
+	options := &RenderOptions{Smartypants: true}
+
+	assert.Equal(t,
+		"<p>&ldquo;Hello,&rdquo; she said&mdash;it&rsquo;s late&hellip;</p>",
+		must(transformTypography(`<p>&quot;Hello,&quot; she said--it's late...</p>`, options)),
+	)
+
+	// Quotes that span tags open and close correctly.
+	assert.Equal(t,
+		"<p>&ldquo;<em>Emphasis</em>&rdquo; and &lsquo;<a href=\"/\">link</a>&rsquo;</p>",
+		must(transformTypography(`<p>"<em>Emphasis</em>" and '<a href="/">link</a>'</p>`, options)),
+	)
+
+	// Attributes are left alone.
+	assert.Equal(t,
+		`<a href="/a--b" title="a -- b...">a&mdash;b</a>`,
+		must(transformTypography(`<a href="/a--b" title="a -- b...">a--b</a>`, options)),
+	)
+
+	// Code is left alone.
+	assert.Equal(t,
+		"<p>Run <code>git log --oneline</code>&hellip;</p>\n"+
+			"<pre><code class=\"language-sh\">ls --all\necho &quot;...&quot;\n</code></pre>\n"+
+			"<p>&ldquo;Done&rdquo;&mdash;<kbd>--help</kbd></p>",
+		must(transformTypography(
+			"<p>Run <code>git log --oneline</code>...</p>\n"+
+				"<pre><code class=\"language-sh\">ls --all\necho &quot;...&quot;\n</code></pre>\n"+
+				"<p>\"Done\"--<kbd>--help</kbd></p>",
+			options,
+		)),
+	)
+
+	// Comments are left alone.
+	assert.Equal(t,
+		"<!-- a -- b --><p>a&mdash;b</p>",
+		must(transformTypography("<!-- a -- b --><p>a--b</p>", options)),
+	)
+
+	// Does nothing unless enabled.
+	assert.Equal(t, "<p>a--b</p>", must(transformTypography("<p>a--b</p>", nil)))
+	assert.Equal(t, "<p>a--b</p>", must(transformTypography("<p>a--b</p>", &RenderOptions{})))
+}
+
+func BenchmarkTransformImagesAndLinks(b *testing.B) {
+	source := strings.Repeat(`<p>Some text with <a href="https://example.com">a link</a>, `+
+		`<a href="/relative">a relative link</a>, and an image:</p>`+
+		`<img src="/assets/hello.jpg" alt="hello">`+"\n", 1000)
+	options := &RenderOptions{AbsoluteURL: "https://brandur.org", NoFollow: true}
+
+	for i := 0; i < b.N; i++ {
+		_, _ = transformImagesAndLinks(source, options)
+	}
+}
+
 func must(v interface{}, err error) interface{} {
 	if err != nil {
 		panic(err)
 	}
 	return v
 }
+
+// A logger that records warnings so that they can be asserted against.
+type recordingLogger struct {
+	warnings []string
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) {}
+
+func (l *recordingLogger) Errorf(format string, v ...interface{}) {}
+
+func (l *recordingLogger) Infof(format string, v ...interface{}) {}
+
+func (l *recordingLogger) Warnf(format string, v ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,108 @@
+// Package mmetrics exposes Prometheus metrics about the jobs run by a job
+// pool, which is useful for monitoring the health of a long running build
+// loop.
+package mmetrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/brandur/modulir"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Public
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Metrics is a set of Prometheus collectors tracking the jobs run by a pool.
+// Collectors are updated at the end of every round (i.e. each call to the
+// pool's Wait).
+type Metrics struct {
+	jobDuration  *prometheus.HistogramVec
+	jobsErrored  prometheus.Counter
+	jobsExecuted prometheus.Counter
+	jobsQueued   prometheus.Gauge
+	registry     *prometheus.Registry
+}
+
+// New registers collectors for the given pool and hooks into it so that they're
+// updated after each round.
+//
+// Collectors are registered to a registry private to the returned Metrics,
+// so it's safe to call New multiple times for different pools. Serve them
+// with Handler.
+func New(pool *modulir.Pool) *Metrics {
+	m := &Metrics{
+		jobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "modulir_job_duration_seconds",
+			Help:    "Time taken to run jobs, labeled by job category.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, []string{"category"}),
+		jobsErrored: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "modulir_jobs_errored_total",
+			Help: "Total number of jobs that errored.",
+		}),
+		jobsExecuted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "modulir_jobs_executed_total",
+			Help: "Total number of jobs that executed (i.e. did work).",
+		}),
+		jobsQueued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "modulir_jobs_queued",
+			Help: "Number of jobs queued in the last round.",
+		}),
+		registry: prometheus.NewRegistry(),
+	}
+
+	m.registry.MustRegister(m.jobDuration, m.jobsErrored, m.jobsExecuted, m.jobsQueued)
+
+	pool.OnWait(m.observe)
+
+	return m
+}
+
+// Handler returns an HTTP handler that serves metrics in Prometheus' exposition
+// format. It can be mounted on any mux (e.g. at `/metrics`), including the dev
+// server's through modulir.Config.Handlers:
+//
+//	Handlers: map[string]func(c *modulir.Context) http.Handler{
+//		"/metrics": func(c *modulir.Context) http.Handler {
+//			return mmetrics.New(c.Pool).Handler()
+//		},
+//	},
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Updates collectors with the results of the pool's last round.
+func (m *Metrics) observe(pool *modulir.Pool) {
+	m.jobsQueued.Set(float64(len(pool.JobsAll)))
+	m.jobsErrored.Add(float64(len(pool.JobsErrored)))
+	m.jobsExecuted.Add(float64(len(pool.JobsExecuted)))
+
+	for _, job := range pool.JobsAll {
+		// Skip jobs that never ran.
+		if job.StartedAt.IsZero() {
+			continue
+		}
+
+		m.jobDuration.WithLabelValues(job.Category).Observe(job.Duration.Seconds())
+	}
+}
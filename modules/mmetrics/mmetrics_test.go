@@ -0,0 +1,42 @@
+package mmetrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/brandur/modulir"
+)
+
+func TestMetrics(t *testing.T) {
+	pool := modulir.NewPool(&modulir.Logger{Level: modulir.LevelInfo}, 2)
+	m := New(pool)
+
+	newJob := func(category string, err error) *modulir.Job {
+		job := modulir.NewJob("job", func() (bool, error) { return true, err })
+		job.Category = category
+		return job
+	}
+
+	pool.StartRound(0)
+	pool.Jobs <- newJob("images", nil)
+	pool.Jobs <- newJob("images", nil)
+	pool.Jobs <- newJob("templates", xerrors.Errorf("error"))
+	pool.Wait()
+
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, recorder.Code)
+
+	body, err := io.ReadAll(recorder.Body)
+	assert.NoError(t, err)
+
+	assert.Contains(t, string(body), "modulir_jobs_queued 3\n")
+	assert.Contains(t, string(body), "modulir_jobs_executed_total 3\n")
+	assert.Contains(t, string(body), "modulir_jobs_errored_total 1\n")
+	assert.Contains(t, string(body), `modulir_job_duration_seconds_count{category="images"} 2`+"\n")
+	assert.Contains(t, string(body), `modulir_job_duration_seconds_count{category="templates"} 1`+"\n")
+}
@@ -1,18 +1,25 @@
 package mtemplate
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"math"
 	"net/url"
+	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	texttemplate "text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/xerrors"
 )
@@ -27,9 +34,39 @@ import (
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// PlainWhitespace causes helpers that format values for display (like
+// FormatTime) to leave ordinary spaces in their output instead of replacing
+// them with non-breaking spaces. Non-breaking spaces keep values from wrapping
+// in HTML, but may be undesirable in other outputs like plain text emails.
+//
+// Defaults to false.
+var PlainWhitespace = false
+
+// SrcsetAscending causes srcset attributes generated for Retina images to list
+// their descriptors in ascending order (`1x` then `2x`) instead of the
+// default of `2x` first. Some tools that validate srcset expect the ascending
+// form.
+//
+// Defaults to false.
+var SrcsetAscending = false
+
+// GitRepoDir is the directory in which git is invoked to look up information
+// for GitRevision and GitDirty.
+//
+// Defaults to an empty string, which is the current working directory.
+var GitRepoDir = ""
+
+// BreadcrumbsSeparator is the separator placed between crumbs rendered by
+// Breadcrumbs.
+//
+// Defaults to " / ".
+var BreadcrumbsSeparator = " / "
+
 // FuncMap is a set of helper functions to make available in templates for the
 // project.
 var FuncMap = template.FuncMap{
+	"AbsURL":                       AbsURL,
+	"Breadcrumbs":                  Breadcrumbs,
 	"CollapseParagraphs":           CollapseParagraphs,
 	"DistanceOfTimeInWords":        DistanceOfTimeInWords,
 	"DistanceOfTimeInWordsFromNow": DistanceOfTimeInWordsFromNow,
@@ -40,6 +77,8 @@ var FuncMap = template.FuncMap{
 	"FormatTime":                   FormatTime,
 	"FormatTimeRFC3339UTC":         FormatTimeRFC3339UTC,
 	"FormatTimeSimpleDate":         FormatTimeSimpleDate,
+	"GitDirty":                     GitDirty,
+	"GitRevision":                  GitRevision,
 	"HTMLRender":                   HTMLRender,
 	"HTMLSafePassThrough":          HTMLSafePassThrough,
 	"ImgSrcAndAlt":                 ImgSrcAndAlt,
@@ -47,11 +86,93 @@ var FuncMap = template.FuncMap{
 	"Map":                          Map,
 	"MapVal":                       MapVal,
 	"MapValAdd":                    MapValAdd,
+	"MinifyCSS":                    MinifyCSS,
+	"MinifyJSON":                   MinifyJSON,
 	"QueryEscape":                  QueryEscape,
+	"ResponsiveImg":                ResponsiveImg,
 	"RomanNumeral":                 RomanNumeral,
 	"RoundToString":                RoundToString,
 	"TimeIn":                       TimeIn,
 	"To2X":                         To2X,
+	"URLJoin":                      URLJoin,
+}
+
+// AbsURL produces an absolute URL from a base like `https://example.com` and a
+// path like `blog/my-post`. The path is normalized with URLJoin so that
+// missing or doubled slashes between the two are handled. A path that's
+// already an absolute URL is returned unchanged.
+//
+// Returns an error if base isn't an absolute URL with a scheme and host.
+func AbsURL(base, path string) (string, error) {
+	if u, err := url.Parse(path); err == nil && u.IsAbs() {
+		return path, nil
+	}
+
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", xerrors.Errorf("error parsing base URL '%s': %w", base, err)
+	}
+	if baseURL.Scheme == "" || baseURL.Host == "" {
+		return "", xerrors.Errorf("base URL '%s' should include a scheme and host", base)
+	}
+
+	root := &url.URL{Scheme: baseURL.Scheme, User: baseURL.User, Host: baseURL.Host}
+	return root.String() + URLJoin(baseURL.Path, path), nil
+}
+
+// Breadcrumbs renders breadcrumb navigation for the given URL path, with one
+// crumb for the root and one for each cumulative segment of the path (e.g.
+// `/blog/my-post` produces crumbs for `/`, `/blog`, and `/blog/my-post`).
+// Every crumb except the last links to its path. The last is marked as the
+// current page instead. Crumbs are separated by BreadcrumbsSeparator.
+//
+// titleFor looks up a human-readable title for a segment, and is passed an
+// empty string for the root. If it's nil or returns an empty string, a title
+// is generated from the segment by replacing dashes and underscores with
+// spaces and capitalizing words, and the root is titled "Home".
+func Breadcrumbs(path string, titleFor func(segment string) string) template.HTML {
+	segments := strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+
+	crumbTitle := func(segment string) string {
+		if titleFor != nil {
+			if title := titleFor(segment); title != "" {
+				return title
+			}
+		}
+
+		if segment == "" {
+			return "Home"
+		}
+
+		words := strings.FieldsFunc(segment, func(r rune) bool { return r == '-' || r == '_' })
+		for i, word := range words {
+			first, size := utf8.DecodeRuneInString(word)
+			words[i] = string(unicode.ToUpper(first)) + word[size:]
+		}
+		return strings.Join(words, " ")
+	}
+
+	crumbs := make([]string, 0, len(segments)+1)
+	for i := 0; i <= len(segments); i++ {
+		var segment string
+		if i > 0 {
+			segment = segments[i-1]
+		}
+
+		title := template.HTMLEscapeString(crumbTitle(segment))
+
+		if i == len(segments) {
+			crumbs = append(crumbs, fmt.Sprintf(`<span aria-current="page">%s</span>`, title))
+			break
+		}
+
+		href := "/" + strings.Join(segments[0:i], "/")
+		crumbs = append(crumbs, fmt.Sprintf(`<a href="%s">%s</a>`,
+			template.HTMLEscapeString(href), title))
+	}
+
+	return template.HTML(fmt.Sprintf(`<nav aria-label="Breadcrumb" class="breadcrumbs">%s</nav>`,
+		strings.Join(crumbs, template.HTMLEscapeString(BreadcrumbsSeparator))))
 }
 
 // CollapseParagraphs strips paragraph tags out of rendered HTML. Note that it
@@ -271,7 +392,13 @@ func (r *htmlElementRenderer) render() template.HTML {
 }
 
 func (img *HTMLImage) render() template.HTML {
-	element := htmlElementRenderer{
+	return img.element().render()
+}
+
+// element produces a renderer for the image so that its attributes can be
+// tweaked before rendering.
+func (img *HTMLImage) element() *htmlElementRenderer {
+	element := &htmlElementRenderer{
 		Name: "img",
 		Attrs: map[string]string{
 			"loading": "lazy",
@@ -285,14 +412,14 @@ func (img *HTMLImage) render() template.HTML {
 
 	if ext := filepath.Ext(img.Src); ext != ".svg" {
 		retinaSource := strings.TrimSuffix(img.Src, ext) + "@2x" + ext
-		element.Attrs["srcset"] = fmt.Sprintf("%s 2x, %s 1x", retinaSource, img.Src)
+		element.Attrs["srcset"] = RetinaSrcset(img.Src, retinaSource)
 	}
 
 	if img.Class != "" {
 		element.Attrs["class"] = img.Class
 	}
 
-	return element.render()
+	return element
 }
 
 // HTMLRender renders a series of mtemplate HTML elements.
@@ -335,6 +462,34 @@ func FormatTimeSimpleDate(t time.Time) string {
 	return toNonBreakingWhitespace(t.Format("January 2, 2006"))
 }
 
+// GitDirty returns true if the git repository has uncommitted changes. Like
+// GitRevision, the result is cached until the repository's HEAD moves or
+// ResetGitInfo is called, so changes to the working tree alone aren't picked
+// up. Returns false when not in a git repository.
+func GitDirty() bool {
+	return loadGitInfo().dirty
+}
+
+// GitRevision returns the short SHA of the git repository's current HEAD,
+// which is useful for cache busting or "built from" footers. It's cached so
+// that git isn't invoked for every template render, and looked up again
+// automatically when HEAD moves (like after a commit or checkout). Returns an
+// empty string when not in a git repository.
+func GitRevision() string {
+	return loadGitInfo().revision
+}
+
+// ResetGitInfo clears cached git information so that it's looked up again the
+// next time GitRevision or GitDirty is called. New commits are picked up
+// without it, but it can be called at the start of each build so that GitDirty
+// reflects changes to the working tree.
+func ResetGitInfo() {
+	gitInfoMu.Lock()
+	defer gitInfoMu.Unlock()
+
+	gitInfoCached = nil
+}
+
 type mapVal struct {
 	key string
 	val interface{}
@@ -371,11 +526,159 @@ func MapValAdd(m map[string]interface{}, vals ...*mapVal) map[string]interface{}
 	return mCopy
 }
 
+// MinifyCSS minifies a fragment of CSS, like the contents of an inline
+// `<style>` element, so that its source can be kept readable. Comments are
+// removed, runs of whitespace are collapsed, whitespace is removed around
+// characters where it's never meaningful (like braces and semicolons), and
+// the semicolon after a block's last declaration is dropped. The contents of
+// strings are left untouched.
+func MinifyCSS(s string) template.CSS {
+	out := make([]byte, 0, len(s))
+	pendingSpace := false
+
+	for i := 0; i < len(s); {
+		c := s[i]
+
+		switch {
+		// Comments separate tokens like whitespace does.
+		case c == '/' && i+1 < len(s) && s[i+1] == '*':
+			end := strings.Index(s[i+2:], "*/")
+			if end == -1 {
+				i = len(s)
+			} else {
+				i += 2 + end + 2
+			}
+			pendingSpace = true
+			continue
+
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			pendingSpace = true
+			i++
+			continue
+		}
+
+		if pendingSpace && len(out) > 0 &&
+			!strings.ContainsRune("{};,:", rune(out[len(out)-1])) &&
+			!strings.ContainsRune("{};,", rune(c)) {
+			out = append(out, ' ')
+		}
+		pendingSpace = false
+
+		switch c {
+		case '"', '\'':
+			end := i + 1
+			for end < len(s) && s[end] != c {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end < len(s) {
+				end++ // closing quote
+			} else {
+				end = len(s)
+			}
+
+			out = append(out, s[i:end]...)
+			i = end
+			continue
+
+		case '}':
+			if len(out) > 0 && out[len(out)-1] == ';' {
+				out = out[:len(out)-1]
+			}
+		}
+
+		out = append(out, c)
+		i++
+	}
+
+	return template.CSS(out) //nolint:gosec
+}
+
+// MinifyJSON minifies a JSON document, like the contents of an inline
+// `<script type="application/ld+json">` element, so that its source can be
+// kept readable. Insignificant whitespace is removed, and the characters `<`,
+// `>`, and `&` in strings are escaped (as in `\u003c`) so that the document
+// can't break out of the element. An error is returned if s isn't valid JSON.
+//
+// It returns template.JS because html/template would otherwise quote the
+// document as a string in a script element.
+func MinifyJSON(s string) (template.JS, error) {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, []byte(s)); err != nil {
+		return "", xerrors.Errorf("error minifying JSON: %w", err)
+	}
+
+	var escaped bytes.Buffer
+	json.HTMLEscape(&escaped, compacted.Bytes())
+
+	return template.JS(escaped.String()), nil //nolint:gosec
+}
+
 // QueryEscape escapes a URL.
 func QueryEscape(s string) string {
 	return url.QueryEscape(s)
 }
 
+type responsiveImgContextKey struct{}
+
+// ResponsiveImgContextContainer tracks the number of images rendered with
+// ResponsiveImg in a single page render.
+type ResponsiveImgContextContainer struct {
+	// NumEager is the number of images at the top of the page that will be
+	// loaded eagerly with high priority. Images after them are lazy loaded.
+	NumEager int
+
+	// NumRendered is the number of images that have been rendered so far.
+	NumRendered int
+}
+
+// ResponsiveImgContext sets a context container that counts images rendered
+// with ResponsiveImg. It should be called once for every page that's rendered
+// so that each page's count starts from zero.
+func ResponsiveImgContext(ctx context.Context, numEager int) (context.Context, *ResponsiveImgContextContainer) {
+	container := &ResponsiveImgContextContainer{NumEager: numEager}
+	return context.WithValue(ctx, responsiveImgContextKey{}, container), container
+}
+
+// ResponsiveImg renders an image with loading hints based on its position in
+// the page. The first images (as configured by ResponsiveImgContext) are
+// loaded eagerly with a high fetch priority because they're likely to be
+// above the fold and candidates for Largest Contentful Paint, and all
+// subsequent ones are lazy loaded.
+//
+// ResponsiveImgContext must be called first to set a context container.
+func ResponsiveImg(ctx context.Context, src, alt string) template.HTML {
+	v := ctx.Value(responsiveImgContextKey{})
+	if v == nil {
+		panic("context key not set; ResponsiveImgContext must be called")
+	}
+
+	container := v.(*ResponsiveImgContextContainer)
+
+	element := (&HTMLImage{Src: src, Alt: alt}).element()
+	if container.NumRendered < container.NumEager {
+		element.Attrs["fetchpriority"] = "high"
+		element.Attrs["loading"] = "eager"
+	}
+
+	container.NumRendered++
+
+	return element.render()
+}
+
+// RetinaSrcset produces the value of a srcset attribute for an image with a
+// standard resolution source and a 2x (Retina) source. Descriptor order is
+// controlled by SrcsetAscending.
+func RetinaSrcset(src, retinaSrc string) string {
+	if SrcsetAscending {
+		return fmt.Sprintf("%s 1x, %s 2x", src, retinaSrc)
+	}
+
+	return fmt.Sprintf("%s 2x, %s 1x", retinaSrc, src)
+}
+
 func RomanNumeral(num int) string {
 	const maxRomanNumber int = 3999
 
@@ -440,6 +743,40 @@ func To2X(imagePath string) template.HTML {
 	return template.HTML(strings.Join(parts, "."))
 }
 
+// URLJoin joins path segments into a single path with exactly one slash
+// between each segment, so that `URLJoin("/blog/", "/my-post")` and
+// `URLJoin("blog", "my-post")` both produce `/blog/my-post`. The result always
+// has a leading slash, and has a trailing slash only if the last non-empty
+// segment did. Empty segments are ignored.
+func URLJoin(segments ...string) string {
+	var parts []string
+	var trailingSlash bool
+
+	for _, segment := range segments {
+		if segment == "" {
+			continue
+		}
+
+		trailingSlash = strings.HasSuffix(segment, "/")
+
+		for _, part := range strings.Split(segment, "/") {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+
+	if len(parts) < 1 {
+		return "/"
+	}
+
+	joined := "/" + strings.Join(parts, "/")
+	if trailingSlash {
+		joined += "/"
+	}
+	return joined
+}
+
 //////////////////////////////////////////////////////////////////////////////
 //
 //
@@ -450,6 +787,9 @@ func To2X(imagePath string) template.HTML {
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// Unicode non-breaking space (U+00A0).
+const nonBreakingSpace = "\u00A0"
+
 // Look for any whitespace between HTML tags.
 var whitespaceRE = regexp.MustCompile(`>\s+<`)
 
@@ -464,11 +804,119 @@ func collapseHTML(html string) string {
 	return html
 }
 
+// Git information about the current build, cached after it's first looked up.
+type gitInfo struct {
+	dirty bool
+
+	// Identifies the state of HEAD when the information was looked up so that
+	// it can be invalidated when HEAD moves. See gitHeadFingerprint.
+	fingerprint string
+
+	// Path to the repository's git directory. Empty when not in a git
+	// repository.
+	gitDir string
+
+	revision string
+}
+
+var (
+	gitInfoCached *gitInfo
+	gitInfoMu     sync.Mutex
+)
+
+func loadGitInfo() *gitInfo {
+	gitInfoMu.Lock()
+	defer gitInfoMu.Unlock()
+
+	if gitInfoCached != nil && (gitInfoCached.gitDir == "" ||
+		gitHeadFingerprint(gitInfoCached.gitDir) == gitInfoCached.fingerprint) {
+		return gitInfoCached
+	}
+
+	info := &gitInfo{}
+
+	// Any error is taken to mean that this isn't a git repository (or git
+	// isn't installed), in which case empty information is returned.
+	out, err := runGit("rev-parse", "--absolute-git-dir")
+	if err == nil {
+		info.gitDir = strings.TrimSpace(out)
+
+		// Taken before looking up the revision so that if HEAD moves in
+		// between, the information is looked up again next time rather than
+		// being cached with a stale revision.
+		info.fingerprint = gitHeadFingerprint(info.gitDir)
+
+		out, err = runGit("rev-parse", "--short", "HEAD")
+		if err == nil {
+			info.revision = strings.TrimSpace(out)
+
+			out, err = runGit("status", "--porcelain")
+			if err == nil {
+				info.dirty = strings.TrimSpace(out) != ""
+			}
+		}
+	}
+
+	gitInfoCached = info
+	return info
+}
+
+// Returns a string that changes when the given git directory's HEAD moves. It's
+// built from the contents of HEAD and the ref that it points to, which is read
+// from disk rather than by invoking git so that it's cheap enough to check on
+// every call. Refs that have been packed are represented by the modification
+// time and size of packed-refs instead.
+func gitHeadFingerprint(gitDir string) string {
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.Write(head)
+
+	ref := strings.TrimSpace(string(head))
+	if !strings.HasPrefix(ref, "ref: ") {
+		// A detached HEAD contains the commit itself.
+		return sb.String()
+	}
+
+	refPath := filepath.Join(gitDir, filepath.FromSlash(strings.TrimPrefix(ref, "ref: ")))
+	if data, err := os.ReadFile(refPath); err == nil {
+		sb.Write(data)
+		return sb.String()
+	}
+
+	if info, err := os.Stat(filepath.Join(gitDir, "packed-refs")); err == nil {
+		fmt.Fprintf(&sb, "packed-refs %d %d", info.ModTime().UnixNano(), info.Size())
+	}
+
+	return sb.String()
+}
+
+func runGit(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = GitRepoDir
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", xerrors.Errorf("error running git %v: %w", args, err)
+	}
+
+	return string(out), nil
+}
+
 // There is no "round" function built into Go :/.
 func round(f float64) float64 {
 	return math.Floor(f + .5)
 }
 
+// Replaces spaces with non-breaking spaces so that formatted values like dates
+// aren't wrapped across lines, unless disabled with PlainWhitespace.
 func toNonBreakingWhitespace(str string) string {
-	return strings.ReplaceAll(str, " ", " ")
+	if PlainWhitespace {
+		return str
+	}
+
+	return strings.ReplaceAll(str, " ", nonBreakingSpace)
 }
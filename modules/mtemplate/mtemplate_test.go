@@ -4,6 +4,9 @@ import (
 	"context"
 	"html/template"
 	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -22,6 +25,74 @@ func init() {
 	}
 }
 
+func TestAbsURL(t *testing.T) {
+	mustAbsURL := func(base, path string) string {
+		s, err := AbsURL(base, path)
+		assert.NoError(t, err)
+		return s
+	}
+
+	assert.Equal(t, "https://example.com/blog/post", mustAbsURL("https://example.com", "blog/post"))
+	assert.Equal(t, "https://example.com/blog/post", mustAbsURL("https://example.com/", "/blog/post"))
+	assert.Equal(t, "https://example.com/blog/post", mustAbsURL("https://example.com//", "//blog//post"))
+	assert.Equal(t, "https://example.com/blog/", mustAbsURL("https://example.com", "blog/"))
+	assert.Equal(t, "https://example.com/", mustAbsURL("https://example.com", ""))
+
+	// Base with a path
+	assert.Equal(t, "https://example.com/site/blog/post", mustAbsURL("https://example.com/site/", "/blog/post"))
+
+	// Path that's already absolute
+	assert.Equal(t, "https://other.com/post", mustAbsURL("https://example.com", "https://other.com/post"))
+
+	// Invalid bases
+	_, err := AbsURL("example.com", "blog/post")
+	assert.Error(t, err)
+	_, err = AbsURL("/blog", "post")
+	assert.Error(t, err)
+}
+
+func TestBreadcrumbs(t *testing.T) {
+	titles := map[string]string{"blog": "The Blog"}
+	titleFor := func(segment string) string { return titles[segment] }
+
+	assert.Equal(t,
+		template.HTML(`<nav aria-label="Breadcrumb" class="breadcrumbs">`+
+			`<a href="/">Home</a> / `+
+			`<a href="/blog">The Blog</a> / `+
+			`<a href="/blog/2021">2021</a> / `+
+			`<span aria-current="page">My First Post</span>`+
+			`</nav>`),
+		Breadcrumbs("/blog/2021/my-first_post/", titleFor),
+	)
+
+	assert.Equal(t,
+		template.HTML(`<nav aria-label="Breadcrumb" class="breadcrumbs"><span aria-current="page">Home</span></nav>`),
+		Breadcrumbs("/", nil),
+	)
+
+	// Capitalizes the first letter of a segment even when it's multibyte.
+	assert.Equal(t,
+		template.HTML(`<nav aria-label="Breadcrumb" class="breadcrumbs">`+
+			`<a href="/">Home</a> / `+
+			`<span aria-current="page">Été 2023</span>`+
+			`</nav>`),
+		Breadcrumbs("/été-2023", nil),
+	)
+
+	t.Run("Separator", func(t *testing.T) {
+		BreadcrumbsSeparator = " > "
+		defer func() {
+			BreadcrumbsSeparator = " / "
+		}()
+
+		assert.Equal(t,
+			template.HTML(`<nav aria-label="Breadcrumb" class="breadcrumbs">`+
+				`<a href="/">Home</a> &gt; <span aria-current="page">Blog</span></nav>`),
+			Breadcrumbs("/blog", nil),
+		)
+	})
+}
+
 func TestCollapseHTML(t *testing.T) {
 	assert.Equal(t, "<p><strong>strong</strong></p>", collapseHTML(`
 <p>
@@ -229,7 +300,17 @@ func TestFigure(t *testing.T) {
 }
 
 func TestFormatTime(t *testing.T) {
-	assert.Equal(t, "July 3, 2016 12:34", FormatTime(testTime, "January 2, 2006 15:04"))
+	assert.Equal(t, "July\u00A03,\u00A02016\u00A012:34", FormatTime(testTime, "January 2, 2006 15:04"))
+}
+
+func TestFormatTime_PlainWhitespace(t *testing.T) {
+	PlainWhitespace = true
+	defer func() {
+		PlainWhitespace = false
+	}()
+
+	assert.Equal(t, "July 3, 2016 12:34", FormatTime(testTime, "January 2, 2006 15:04"))
+	assert.Equal(t, "July 3, 2016", FormatTimeSimpleDate(testTime))
 }
 
 func TestFormatTimeRFC3339UTC(t *testing.T) {
@@ -237,7 +318,82 @@ func TestFormatTimeRFC3339UTC(t *testing.T) {
 }
 
 func TestFormatTimeSimpleDate(t *testing.T) {
-	assert.Equal(t, "July 3, 2016", FormatTimeSimpleDate(testTime))
+	assert.Equal(t, "July\u00A03,\u00A02016", FormatTimeSimpleDate(testTime))
+}
+
+func TestGitRevision(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+
+	GitRepoDir = dir
+	ResetGitInfo()
+	defer func() {
+		GitRepoDir = ""
+		ResetGitInfo()
+	}()
+
+	t.Run("NotARepository", func(t *testing.T) {
+		ResetGitInfo()
+		assert.Equal(t, "", GitRevision())
+		assert.False(t, GitDirty())
+	})
+
+	git := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	git("init", "--quiet")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0o600))
+	git("add", "file")
+	git("commit", "--quiet", "-m", "Initial commit")
+	revision := git("rev-parse", "--short", "HEAD")
+
+	t.Run("Clean", func(t *testing.T) {
+		ResetGitInfo()
+		assert.Equal(t, revision, GitRevision())
+		assert.False(t, GitDirty())
+	})
+
+	t.Run("DirtyAndCached", func(t *testing.T) {
+		ResetGitInfo()
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("changed"), 0o600))
+		assert.True(t, GitDirty())
+
+		// Cached until reset, even after the repository is clean again.
+		git("checkout", "--quiet", "file")
+		assert.True(t, GitDirty())
+
+		ResetGitInfo()
+		assert.False(t, GitDirty())
+	})
+
+	t.Run("NewCommit", func(t *testing.T) {
+		ResetGitInfo()
+		assert.Equal(t, revision, GitRevision())
+
+		// Picked up without a reset.
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("changed"), 0o600))
+		git("commit", "--quiet", "--all", "-m", "Second commit")
+		newRevision := git("rev-parse", "--short", "HEAD")
+		assert.NotEqual(t, revision, newRevision)
+		assert.Equal(t, newRevision, GitRevision())
+		assert.False(t, GitDirty())
+
+		// And when HEAD moves back to a previous commit.
+		git("checkout", "--quiet", revision)
+		assert.Equal(t, revision, GitRevision())
+	})
 }
 
 func TestHTMLImageRender(t *testing.T) {
@@ -267,6 +423,20 @@ func TestHTMLImageRender(t *testing.T) {
 			string(img.render()),
 		)
 	})
+
+	t.Run("SrcsetAscending", func(t *testing.T) {
+		SrcsetAscending = true
+		defer func() {
+			SrcsetAscending = false
+		}()
+
+		img := HTMLImage{Src: "src.jpg", Alt: "alt"}
+		assert.Equal(
+			t,
+			`<img alt="alt" loading="lazy" src="src.jpg" srcset="src.jpg 1x, src@2x.jpg 2x">`,
+			string(img.render()),
+		)
+	})
 }
 
 func TestHTMLRender(t *testing.T) {
@@ -334,10 +504,102 @@ func TestMapValAdd(t *testing.T) {
 	assert.NotContains(t, m, "New")
 }
 
+func TestMinifyCSS(t *testing.T) {
+	for css, expected := range map[string]string{
+		"": "",
+
+		`
+/* Layout */
+body {
+    margin: 0 auto;
+    font-family: "Helvetica Neue", sans-serif;
+}
+
+a:hover, a:focus {
+    color: rgba(0, 0, 0, 0.5) !important;
+}
+`: `body{margin:0 auto;font-family:"Helvetica Neue",sans-serif}a:hover,a:focus{color:rgba(0,0,0,0.5) !important}`,
+
+		// Whitespace that's significant to selectors and values is kept.
+		"nav :first-child { width: calc(100% - 2 * 10px); }": "nav :first-child{width:calc(100% - 2 * 10px)}",
+
+		// Comments separate tokens.
+		"a/**/b { }": "a b{}",
+
+		// String contents are untouched, even if they look like comments or
+		// contain escaped quotes.
+		`p::before { content: "/* not a comment */  ;}"; }`:       `p::before{content:"/* not a comment */  ;}"}`,
+		`p::after { content: 'it\'s   here'; }`:                   `p::after{content:'it\'s   here'}`,
+		"@media (min-width: 800px) {\n  .a { display: none; }\n}": "@media (min-width:800px){.a{display:none}}",
+	} {
+		assert.Equal(t, template.CSS(expected), MinifyCSS(css), "css: %q", css)
+	}
+}
+
+func TestMinifyJSON(t *testing.T) {
+	minified, err := MinifyJSON(`
+{
+    "@context": "https://schema.org",
+    "@type": "Article",
+    "headline": "Spaces   and { braces } are kept",
+    "description": "</script><script>alert(1)</script>",
+    "wordCount": 1234
+}
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, template.JS(`{"@context":"https://schema.org","@type":"Article",`+
+		`"headline":"Spaces   and { braces } are kept",`+
+		`"description":"\u003c/script\u003e\u003cscript\u003ealert(1)\u003c/script\u003e",`+
+		`"wordCount":1234}`), minified)
+
+	_, err = MinifyJSON(`{"headline": }`)
+	assert.Error(t, err)
+}
+
 func TestQueryEscape(t *testing.T) {
 	assert.Equal(t, "a%2Bb", QueryEscape("a+b"))
 }
 
+func TestResponsiveImg(t *testing.T) {
+	ctx, container := ResponsiveImgContext(context.Background(), 1)
+
+	assert.Equal(t,
+		`<img alt="first" fetchpriority="high" loading="eager" src="first.jpg" srcset="first@2x.jpg 2x, first.jpg 1x">`,
+		string(ResponsiveImg(ctx, "first.jpg", "first")),
+	)
+	assert.Equal(t,
+		`<img alt="second" loading="lazy" src="second.jpg" srcset="second@2x.jpg 2x, second.jpg 1x">`,
+		string(ResponsiveImg(ctx, "second.jpg", "second")),
+	)
+	assert.Equal(t,
+		`<img alt="third" loading="lazy" src="third.svg">`,
+		string(ResponsiveImg(ctx, "third.svg", "third")),
+	)
+	assert.Equal(t, 3, container.NumRendered)
+
+	// A new context for the next page starts counting again.
+	ctx, _ = ResponsiveImgContext(context.Background(), 1)
+	assert.Equal(t,
+		`<img alt="first" fetchpriority="high" loading="eager" src="first.jpg" srcset="first@2x.jpg 2x, first.jpg 1x">`,
+		string(ResponsiveImg(ctx, "first.jpg", "first")),
+	)
+
+	assert.Panics(t, func() {
+		ResponsiveImg(context.Background(), "first.jpg", "first")
+	})
+}
+
+func TestRetinaSrcset(t *testing.T) {
+	assert.Equal(t, "src@2x.jpg 2x, src.jpg 1x", RetinaSrcset("src.jpg", "src@2x.jpg"))
+
+	SrcsetAscending = true
+	defer func() {
+		SrcsetAscending = false
+	}()
+
+	assert.Equal(t, "src.jpg 1x, src@2x.jpg 2x", RetinaSrcset("src.jpg", "src@2x.jpg"))
+}
+
 func TestRomanNumeral(t *testing.T) {
 	assert.Equal(t, "I", RomanNumeral(1))
 	assert.Equal(t, "II", RomanNumeral(2))
@@ -397,6 +659,26 @@ func TestTo2X(t *testing.T) {
 		To2X("photos/reddit/rd_xxx_01/11%20-%20t9kxD78.jpg"))
 }
 
+func TestURLJoin(t *testing.T) {
+	assert.Equal(t, "/blog/post", URLJoin("blog", "post"))
+	assert.Equal(t, "/blog/post", URLJoin("/blog/", "/post"))
+
+	// Double slashes
+	assert.Equal(t, "/blog/post", URLJoin("/blog//", "//post"))
+	assert.Equal(t, "/blog/post", URLJoin("/blog//post"))
+
+	// Missing slashes
+	assert.Equal(t, "/blog/post", URLJoin("blog/post"))
+
+	// Trailing slashes
+	assert.Equal(t, "/blog/post/", URLJoin("blog", "post/"))
+	assert.Equal(t, "/blog/", URLJoin("blog/", ""))
+
+	// Empty
+	assert.Equal(t, "/", URLJoin())
+	assert.Equal(t, "/", URLJoin("", "/", ""))
+}
+
 //////////////////////////////////////////////////////////////////////////////
 //
 //
@@ -19,6 +19,7 @@ import (
 // FuncMap is a set of helper functions to make available in templates for the
 // project.
 var FuncMap = template.FuncMap{
+	"FirstImage":      FirstImage,
 	"IncludeMarkdown": IncludeMarkdown,
 }
 
@@ -37,6 +38,24 @@ func Context(ctx context.Context) (context.Context, *ContextContainer) {
 	return context.WithValue(ctx, ContextKey{}, container), container
 }
 
+// FirstImage returns the source of the first image in some rendered HTML, or an
+// empty string if there isn't one. It's a template-friendly version of
+// mmarkdownext.FirstImage that accepts either a string or template.HTML.
+func FirstImage(content interface{}) string {
+	var s string
+	switch v := content.(type) {
+	case string:
+		s = v
+	case template.HTML:
+		s = string(v)
+	default:
+		panic(fmt.Sprintf("FirstImage expects a string or template.HTML, but got %T", content))
+	}
+
+	src, _ := mmarkdownext.FirstImage(s)
+	return src
+}
+
 func IncludeMarkdown(ctx context.Context, filename string) template.HTML {
 	data, err := os.ReadFile(filename)
 	if err != nil {
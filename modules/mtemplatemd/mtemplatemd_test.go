@@ -2,6 +2,7 @@ package mtemplatemd
 
 import (
 	"context"
+	"html/template"
 	"os"
 	"strings"
 	"testing"
@@ -29,3 +30,11 @@ func TestIncludeMarkdown(t *testing.T) {
 	assert.Contains(t, container.dependenciesMap, tmpfile.Name())
 	assert.Contains(t, container.Dependencies, tmpfile.Name())
 }
+
+func TestFirstImage(t *testing.T) {
+	assert.Equal(t, "/assets/a.jpg", FirstImage(
+		`<p>Hello</p><img src="/assets/a.jpg" alt="A"><img src="/assets/b.jpg">`))
+	assert.Equal(t, "/assets/a.jpg", FirstImage(template.HTML(`<img src="/assets/a.jpg">`)))
+	assert.Equal(t, "", FirstImage("<p>No images here</p>"))
+	assert.Panics(t, func() { FirstImage(1) })
+}
@@ -1,20 +1,152 @@
 package mtesting
 
 import (
+	"bytes"
+	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	assert "github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
 
 	"github.com/brandur/modulir"
 )
 
+// DifferenceKind is the kind of a Difference between two directories.
+type DifferenceKind string
+
+// Kinds of Difference between two directories.
+const (
+	// DifferenceAdded is a file that's in the second directory, but not the
+	// first.
+	DifferenceAdded DifferenceKind = "added"
+
+	// DifferenceChanged is a file that's in both directories, but whose
+	// contents differ.
+	DifferenceChanged DifferenceKind = "changed"
+
+	// DifferenceRemoved is a file that's in the first directory, but not the
+	// second.
+	DifferenceRemoved DifferenceKind = "removed"
+)
+
+// Difference is a difference in a file between two directories, as returned
+// by DiffDirs.
+type Difference struct {
+	// Diff is a line-based diff of the file's contents for changed text files
+	// with removed lines prefixed by "-" and added lines by "+". It's empty for
+	// added or removed files and for binary files.
+	Diff string
+
+	// Kind is the kind of difference.
+	Kind DifferenceKind
+
+	// Path is the path of the file relative to the directories being
+	// compared.
+	Path string
+}
+
+// String returns a human-readable description of the difference.
+func (d *Difference) String() string {
+	if d.Diff == "" {
+		return fmt.Sprintf("%s: %s", d.Kind, d.Path)
+	}
+	return fmt.Sprintf("%s: %s\n%s", d.Kind, d.Path, d.Diff)
+}
+
+// AssertDirsEqual fails the test if the files in the expected and actual
+// directories differ, reporting each difference. It's useful for checking
+// that a change to a build function produces byte-identical output.
+func AssertDirsEqual(t *testing.T, expected, actual string) {
+	t.Helper()
+
+	diffs, err := DiffDirs(expected, actual)
+	assert.NoError(t, err)
+
+	if len(diffs) > 0 {
+		descriptions := make([]string, len(diffs))
+		for i, diff := range diffs {
+			descriptions[i] = diff.String()
+		}
+
+		assert.Fail(t, fmt.Sprintf("Directories '%s' and '%s' differ", expected, actual),
+			strings.Join(descriptions, "\n"))
+	}
+}
+
+// DiffDirs compares the files in directories a and b, returning a Difference
+// for each file that was added (in b, but not a), removed (in a, but not b),
+// or changed. Differences are sorted by path. Empty directories are ignored.
+func DiffDirs(a, b string) ([]*Difference, error) {
+	aFiles, err := listFiles(a)
+	if err != nil {
+		return nil, err
+	}
+
+	bFiles, err := listFiles(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []*Difference
+
+	for path := range aFiles {
+		if _, ok := bFiles[path]; !ok {
+			diffs = append(diffs, &Difference{Kind: DifferenceRemoved, Path: path})
+		}
+	}
+
+	for path := range bFiles {
+		if _, ok := aFiles[path]; !ok {
+			diffs = append(diffs, &Difference{Kind: DifferenceAdded, Path: path})
+			continue
+		}
+
+		aData, err := os.ReadFile(filepath.Join(a, path))
+		if err != nil {
+			return nil, xerrors.Errorf("error reading file: %w", err)
+		}
+
+		bData, err := os.ReadFile(filepath.Join(b, path))
+		if err != nil {
+			return nil, xerrors.Errorf("error reading file: %w", err)
+		}
+
+		if bytes.Equal(aData, bData) {
+			continue
+		}
+
+		diff := &Difference{Kind: DifferenceChanged, Path: path}
+		if isText(aData) && isText(bData) {
+			diff.Diff = diffLines(string(aData), string(bData))
+		}
+		diffs = append(diffs, diff)
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+
+	return diffs, nil
+}
+
 // NewContext is a convenience helper to create a new modulir.Context suitable
 // for use in the test suite.
 func NewContext() *modulir.Context {
 	return modulir.NewContext(&modulir.Args{Log: &modulir.Logger{Level: modulir.LevelInfo}})
 }
 
+// NewContextWithFS is the same as NewContext, but produces a context that reads
+// source content from the given filesystem (like an fstest.MapFS).
+func NewContextWithFS(fsys fs.FS) *modulir.Context {
+	return modulir.NewContext(&modulir.Args{FS: fsys, Log: &modulir.Logger{Level: modulir.LevelInfo}})
+}
+
 // WriteTempFile writes the given data to a temporary file. It returns the path
 // to the temporary file which should be removed with `defer os.Remove(path)`.
 func WriteTempFile(t *testing.T, data []byte) string {
@@ -31,3 +163,111 @@ func WriteTempFile(t *testing.T, data []byte) string {
 
 	return tempFile.Name()
 }
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// The maximum number of cells in the table used to diff two files' lines.
+// Files larger than this are reported as changed without a diff.
+const maxDiffCells = 10_000_000
+
+// Produces a line-based diff of a and b from their longest common subsequence
+// of lines. Only added and removed lines are included.
+func diffLines(a, b string) string {
+	aLines := strings.SplitAfter(a, "\n")
+	bLines := strings.SplitAfter(b, "\n")
+
+	if (len(aLines)+1)*(len(bLines)+1) > maxDiffCells {
+		return ""
+	}
+
+	// lengths[i][j] is the length of the longest common subsequence of
+	// aLines[i:] and bLines[j:].
+	lengths := make([][]int, len(aLines)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(bLines)+1)
+	}
+
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			switch {
+			case aLines[i] == bLines[j]:
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] >= lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	writeLine := func(prefix, line string) {
+		sb.WriteString(prefix + strings.TrimSuffix(line, "\n") + "\n")
+	}
+
+	i, j := 0, 0
+	for i < len(aLines) && j < len(bLines) {
+		switch {
+		case aLines[i] == bLines[j]:
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			writeLine("-", aLines[i])
+			i++
+		default:
+			writeLine("+", bLines[j])
+			j++
+		}
+	}
+	for ; i < len(aLines); i++ {
+		writeLine("-", aLines[i])
+	}
+	for ; j < len(bLines); j++ {
+		writeLine("+", bLines[j])
+	}
+
+	return sb.String()
+}
+
+// Guesses whether data is text by checking that it's valid UTF-8 without any
+// NUL bytes.
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) == -1
+}
+
+// Lists the paths of all files beneath dir relative to it, using forward
+// slashes.
+func listFiles(dir string) (map[string]struct{}, error) {
+	files := make(map[string]struct{})
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(rel)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("error listing files in '%s': %w", dir, err)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,57 @@
+package mtesting
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestDiffDirs(t *testing.T) {
+	writeFiles := func(dir string, files map[string]string) {
+		for path, contents := range files {
+			assert.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0o755))
+			assert.NoError(t, os.WriteFile(filepath.Join(dir, path), []byte(contents), 0o600))
+		}
+	}
+
+	a := t.TempDir()
+	writeFiles(a, map[string]string{
+		"index.html":         "<h1>Hello</h1>\n<p>One</p>\n<p>Two</p>\n",
+		"articles/old.html":  "old",
+		"assets/image.png":   "\x89PNG\x00a",
+		"assets/app.css":     "body {}\n",
+		"articles/same.html": "same",
+	})
+
+	b := t.TempDir()
+	writeFiles(b, map[string]string{
+		"index.html":         "<h1>Hello</h1>\n<p>Uno</p>\n<p>Two</p>\n",
+		"articles/new.html":  "new",
+		"assets/image.png":   "\x89PNG\x00b",
+		"assets/app.css":     "body {}\n",
+		"articles/same.html": "same",
+	})
+
+	diffs, err := DiffDirs(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []*Difference{
+		{Kind: DifferenceAdded, Path: "articles/new.html"},
+		{Kind: DifferenceRemoved, Path: "articles/old.html"},
+		{Kind: DifferenceChanged, Path: "assets/image.png"},
+		{Kind: DifferenceChanged, Path: "index.html", Diff: "-<p>One</p>\n+<p>Uno</p>\n"},
+	}, diffs)
+
+	assert.Equal(t, "added: articles/new.html", diffs[0].String())
+	assert.Equal(t, "changed: index.html\n-<p>One</p>\n+<p>Uno</p>\n", diffs[3].String())
+
+	// Identical trees have no differences.
+	diffs, err = DiffDirs(a, a)
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+	AssertDirsEqual(t, a, a)
+
+	_, err = DiffDirs(a, filepath.Join(b, "missing"))
+	assert.Error(t, err)
+}
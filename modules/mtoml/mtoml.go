@@ -3,7 +3,6 @@ package mtoml
 import (
 	"bytes"
 	"errors"
-	"os"
 
 	"github.com/pelletier/go-toml/v2"
 	"golang.org/x/xerrors"
@@ -11,9 +10,10 @@ import (
 	"github.com/brandur/modulir"
 )
 
-// ParseFile is a shortcut from parsing a source file as TOML.
+// ParseFile is a shortcut from parsing a source file as TOML. The file is read
+// from the context's FS if one is set.
 func ParseFile(c *modulir.Context, source string, v interface{}) error {
-	data, err := os.ReadFile(source)
+	data, err := c.ReadFile(source)
 	if err != nil {
 		return xerrors.Errorf("error reading file: %w", err)
 	}
@@ -30,7 +30,7 @@ func ParseFile(c *modulir.Context, source string, v interface{}) error {
 // ParseFileFrontmatter is a shortcut from parsing a source file's frontmatter
 // (i.e. data at the top between `+++` lines) as TOML.
 func ParseFileFrontmatter(c *modulir.Context, source string, v interface{}) ([]byte, error) {
-	data, err := os.ReadFile(source)
+	data, err := c.ReadFile(source)
 	if err != nil {
 		return nil, xerrors.Errorf("error reading file: %w", err)
 	}
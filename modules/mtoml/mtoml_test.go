@@ -3,6 +3,7 @@ package mtoml
 import (
 	"os"
 	"testing"
+	"testing/fstest"
 
 	assert "github.com/stretchr/testify/require"
 
@@ -69,3 +70,25 @@ foo = "bar"
 		assert.Equal(t, []byte(nil), content)
 	}
 }
+
+func TestParseFileFS(t *testing.T) {
+	type testStruct struct {
+		Foo string `toml:"foo"`
+	}
+
+	c := mtesting.NewContextWithFS(fstest.MapFS{
+		"data.toml":  &fstest.MapFile{Data: []byte(`foo = "bar"`)},
+		"content.md": &fstest.MapFile{Data: []byte("+++\nfoo = \"bar\"\n+++\n\nother")},
+	})
+
+	var v testStruct
+	err := ParseFile(c, "data.toml", &v)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", v.Foo)
+
+	v = testStruct{}
+	content, err := ParseFileFrontmatter(c, "content.md", &v)
+	assert.NoError(t, err)
+	assert.Equal(t, "bar", v.Foo)
+	assert.Equal(t, []byte("other"), content)
+}
@@ -0,0 +1,322 @@
+// Package mwellknown provides builders for small files with conventional
+// formats that sites serve from well-known locations, like
+// `/.well-known/security.txt` (RFC 9116) and `/humans.txt`.
+package mwellknown
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/brandur/modulir"
+	"github.com/brandur/modulir/modules/mfile"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Public
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Field is a single named field of a humans.txt, like "Twitter: @brandur".
+type Field struct {
+	Name  string
+	Value string
+}
+
+// HumansTxt describes the contents of a humans.txt (see humanstxt.org), which
+// credits the people behind a site. Sections that are empty are omitted.
+type HumansTxt struct {
+	// Site are fields describing the site itself, like "Last update",
+	// "Standards", or "Software".
+	Site []Field
+
+	// Team are the people who built the site, each described by their own
+	// set of fields (e.g. "Developer", "Contact", and "Location").
+	Team []Person
+
+	// Thanks are people being thanked, described in the same way as Team.
+	Thanks []Person
+}
+
+// Encode validates the humans.txt and writes it to w. At least one section
+// must have fields, and field names and values must be non-empty and fit on
+// a single line.
+func (h *HumansTxt) Encode(w io.Writer) error {
+	if len(h.Site) == 0 && len(h.Team) == 0 && len(h.Thanks) == 0 {
+		return xerrors.Errorf("humans.txt must have at least one of Site, Team, or Thanks")
+	}
+
+	var buf bytes.Buffer
+
+	writeSection := func(name string, groups []Person) error {
+		if len(groups) == 0 {
+			return nil
+		}
+
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "/* %s */\n", name)
+
+		for i, fields := range groups {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+
+			for _, field := range fields {
+				if err := validateLine(field.Name, "field name"); err != nil {
+					return err
+				}
+				if err := validateLine(field.Value, "value of field '"+field.Name+"'"); err != nil {
+					return err
+				}
+
+				fmt.Fprintf(&buf, "\t%s: %s\n", field.Name, field.Value)
+			}
+		}
+
+		return nil
+	}
+
+	if err := writeSection("TEAM", h.Team); err != nil {
+		return err
+	}
+	if err := writeSection("THANKS", h.Thanks); err != nil {
+		return err
+	}
+	if len(h.Site) > 0 {
+		if err := writeSection("SITE", []Person{h.Site}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return xerrors.Errorf("error writing humans.txt: %w", err)
+	}
+
+	return nil
+}
+
+// Person is a single person credited in a humans.txt, described by a set of
+// fields.
+type Person []Field
+
+// SecurityTxt describes the contents of a security.txt as specified by RFC
+// 9116, which tells security researchers how to report vulnerabilities. Each
+// slice field produces one line per value.
+type SecurityTxt struct {
+	// Acknowledgments are URIs of pages recognizing past reporters.
+	Acknowledgments []string
+
+	// Canonical are the URIs at which the security.txt is served. They're
+	// recommended if Sign is set.
+	Canonical []string
+
+	// Contact are URIs for reporting vulnerabilities (e.g.
+	// "mailto:security@example.com" or "https://example.com/security"), in
+	// order of preference. At least one is required.
+	Contact []string
+
+	// Encryption are URIs of keys that reporters should use to encrypt their
+	// reports.
+	Encryption []string
+
+	// Expires is the time after which the security.txt should no longer be
+	// considered current. It's required, must be in the future, and RFC 9116
+	// recommends that it be less than a year out.
+	Expires time.Time
+
+	// Hiring are URIs of security-related job postings.
+	Hiring []string
+
+	// Policy are URIs of the site's vulnerability disclosure policy.
+	Policy []string
+
+	// PreferredLanguages are language tags (e.g. "en") of the languages that
+	// reports are preferred in.
+	PreferredLanguages []string
+
+	// Sign optionally signs the encoded security.txt, which RFC 9116
+	// recommends be done with an OpenPGP cleartext signature (say with
+	// `golang.org/x/crypto/openpgp/clearsign`). It's passed the unsigned
+	// document and returns the document to be written.
+	//
+	// Defaults to nil, which leaves the security.txt unsigned.
+	Sign func(data []byte) ([]byte, error)
+}
+
+// Encode validates the security.txt and writes it to w. An error is returned
+// if Contact or Expires are missing, Expires has passed, or any URI isn't
+// absolute.
+func (s *SecurityTxt) Encode(w io.Writer) error {
+	if len(s.Contact) == 0 {
+		return xerrors.Errorf("security.txt must have at least one Contact")
+	}
+
+	if s.Expires.IsZero() {
+		return xerrors.Errorf("security.txt must have Expires")
+	}
+
+	if !s.Expires.After(time.Now()) {
+		return xerrors.Errorf("security.txt Expires has already passed: %s",
+			s.Expires.UTC().Format(time.RFC3339))
+	}
+
+	var buf bytes.Buffer
+
+	writeURIs := func(name string, uris []string) error {
+		for _, uri := range uris {
+			if err := validateURI(uri, name); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(&buf, "%s: %s\n", name, uri)
+		}
+		return nil
+	}
+
+	if err := writeURIs("Contact", s.Contact); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(&buf, "Expires: %s\n", s.Expires.UTC().Format(time.RFC3339))
+
+	if err := writeURIs("Encryption", s.Encryption); err != nil {
+		return err
+	}
+	if err := writeURIs("Acknowledgments", s.Acknowledgments); err != nil {
+		return err
+	}
+
+	if len(s.PreferredLanguages) > 0 {
+		for _, lang := range s.PreferredLanguages {
+			if err := validateLine(lang, "preferred language"); err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(&buf, "Preferred-Languages: %s\n", strings.Join(s.PreferredLanguages, ", "))
+	}
+
+	if err := writeURIs("Canonical", s.Canonical); err != nil {
+		return err
+	}
+	if err := writeURIs("Policy", s.Policy); err != nil {
+		return err
+	}
+	if err := writeURIs("Hiring", s.Hiring); err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+
+	if s.Sign != nil {
+		var err error
+		data, err = s.Sign(data)
+		if err != nil {
+			return xerrors.Errorf("error signing security.txt: %w", err)
+		}
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return xerrors.Errorf("error writing security.txt: %w", err)
+	}
+
+	return nil
+}
+
+// WriteHumansTxt validates the given humans.txt and writes it to `humans.txt`
+// in the context's TargetDir.
+func WriteHumansTxt(c *modulir.Context, h *HumansTxt) error {
+	return writeTarget(c, c.TargetPath("humans.txt"), h.Encode)
+}
+
+// WriteSecurityTxt validates the given security.txt and writes it to
+// `.well-known/security.txt` in the context's TargetDir.
+func WriteSecurityTxt(c *modulir.Context, s *SecurityTxt) error {
+	return writeTarget(c, c.TargetPath(".well-known", "security.txt"), s.Encode)
+}
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Checks that the given value is non-empty and fits on a single line, which
+// both formats require of their values.
+func validateLine(value, desc string) error {
+	if strings.TrimSpace(value) == "" {
+		return xerrors.Errorf("%s must not be empty", desc)
+	}
+
+	if strings.ContainsAny(value, "\r\n") {
+		return xerrors.Errorf("%s must not contain a newline: %q", desc, value)
+	}
+
+	return nil
+}
+
+// Checks that the given value of a security.txt field is an absolute URI.
+func validateURI(value, field string) error {
+	if err := validateLine(value, field); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return xerrors.Errorf("%s '%s' isn't a valid URI: %w", field, value, err)
+	}
+
+	if u.Scheme == "" {
+		return xerrors.Errorf("%s '%s' must be an absolute URI like 'mailto:' or 'https:'", field, value)
+	}
+
+	return nil
+}
+
+// Encodes a document into the given target, which is validated in full
+// before the target is created so that a bad document doesn't leave a
+// partially written file behind.
+func writeTarget(c *modulir.Context, target string, encode func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := encode(&buf); err != nil {
+		return err
+	}
+
+	if err := mfile.EnsureDir(c, filepath.Dir(target)); err != nil {
+		return err
+	}
+
+	file, err := c.CreateTarget(target)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return xerrors.Errorf("error writing '%s': %w", target, err)
+	}
+
+	if err := file.Commit(); err != nil {
+		return xerrors.Errorf("error closing '%s': %w", target, err)
+	}
+
+	c.Log.Debugf("mwellknown: Wrote '%s'", target)
+	return nil
+}
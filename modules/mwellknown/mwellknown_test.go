@@ -0,0 +1,138 @@
+package mwellknown
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+
+	"github.com/brandur/modulir"
+)
+
+func TestHumansTxtEncode(t *testing.T) {
+	humans := &HumansTxt{
+		Site: []Field{
+			{"Last update", "2023/01/02"},
+			{"Software", "Modulir"},
+		},
+		Team: []Person{
+			{{"Developer", "Brandur"}, {"Location", "San Francisco"}},
+			{{"Designer", "Someone"}},
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, humans.Encode(&buf))
+	assert.Equal(t, `/* TEAM */
+	Developer: Brandur
+	Location: San Francisco
+
+	Designer: Someone
+
+/* SITE */
+	Last update: 2023/01/02
+	Software: Modulir
+`, buf.String())
+
+	assert.EqualError(t, (&HumansTxt{}).Encode(&buf),
+		"humans.txt must have at least one of Site, Team, or Thanks")
+
+	assert.EqualError(t,
+		(&HumansTxt{Thanks: []Person{{{"Name", ""}}}}).Encode(&buf),
+		"value of field 'Name' must not be empty")
+
+	assert.EqualError(t,
+		(&HumansTxt{Site: []Field{{"Software", "Modulir\nInjected: field"}}}).Encode(&buf),
+		`value of field 'Software' must not contain a newline: "Modulir\nInjected: field"`)
+}
+
+func TestSecurityTxtEncode(t *testing.T) {
+	expires := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+
+	security := &SecurityTxt{
+		Canonical:          []string{"https://example.com/.well-known/security.txt"},
+		Contact:            []string{"mailto:security@example.com", "https://example.com/security"},
+		Expires:            expires,
+		PreferredLanguages: []string{"en", "fr"},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, security.Encode(&buf))
+	assert.Equal(t, `Contact: mailto:security@example.com
+Contact: https://example.com/security
+Expires: `+expires.UTC().Format(time.RFC3339)+`
+Preferred-Languages: en, fr
+Canonical: https://example.com/.well-known/security.txt
+`, buf.String())
+
+	// Signed.
+	buf.Reset()
+	security.Sign = func(data []byte) ([]byte, error) {
+		return append([]byte("-----BEGIN PGP SIGNED MESSAGE-----\n"), data...), nil
+	}
+	assert.NoError(t, security.Encode(&buf))
+	assert.True(t, strings.HasPrefix(buf.String(), "-----BEGIN PGP SIGNED MESSAGE-----\nContact: "))
+}
+
+func TestSecurityTxtEncode_Validation(t *testing.T) {
+	expires := time.Now().Add(24 * time.Hour)
+
+	for _, tc := range []struct {
+		security *SecurityTxt
+		err      string
+	}{
+		{
+			&SecurityTxt{Expires: expires},
+			"security.txt must have at least one Contact",
+		},
+		{
+			&SecurityTxt{Contact: []string{"mailto:security@example.com"}},
+			"security.txt must have Expires",
+		},
+		{
+			&SecurityTxt{
+				Contact: []string{"mailto:security@example.com"},
+				Expires: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			},
+			"security.txt Expires has already passed: 2020-01-02T03:04:05Z",
+		},
+		{
+			&SecurityTxt{Contact: []string{"security@example.com"}, Expires: expires},
+			"Contact 'security@example.com' must be an absolute URI like 'mailto:' or 'https:'",
+		},
+		{
+			&SecurityTxt{
+				Contact: []string{"mailto:security@example.com"},
+				Expires: expires,
+				Policy:  []string{""},
+			},
+			"Policy must not be empty",
+		},
+	} {
+		assert.EqualError(t, tc.security.Encode(&bytes.Buffer{}), tc.err)
+	}
+}
+
+func TestWriteSecurityTxt(t *testing.T) {
+	c := modulir.NewContext(&modulir.Args{
+		Log:       &modulir.Logger{Level: modulir.LevelInfo},
+		TargetDir: t.TempDir(),
+	})
+
+	assert.NoError(t, WriteSecurityTxt(c, &SecurityTxt{
+		Contact: []string{"mailto:security@example.com"},
+		Expires: time.Now().Add(24 * time.Hour),
+	}))
+
+	data, err := os.ReadFile(c.TargetPath(".well-known", "security.txt"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "Contact: mailto:security@example.com\n"))
+
+	// Nothing is written for an invalid document.
+	assert.Error(t, WriteHumansTxt(c, &HumansTxt{}))
+	_, err = os.Stat(c.TargetPath("humans.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -3,7 +3,6 @@ package myaml
 import (
 	"bytes"
 	"errors"
-	"os"
 
 	"golang.org/x/xerrors"
 	"gopkg.in/yaml.v2"
@@ -11,9 +10,10 @@ import (
 	"github.com/brandur/modulir"
 )
 
-// ParseFile is a shortcut from parsing a source file as YAML.
+// ParseFile is a shortcut from parsing a source file as YAML. The file is read
+// from the context's FS if one is set.
 func ParseFile(c *modulir.Context, source string, v interface{}) error {
-	raw, err := os.ReadFile(source)
+	raw, err := c.ReadFile(source)
 	if err != nil {
 		return xerrors.Errorf("error reading file: %w", err)
 	}
@@ -30,7 +30,7 @@ func ParseFile(c *modulir.Context, source string, v interface{}) error {
 // ParseFileFrontmatter is a shortcut from parsing a source file's frontmatter
 // (i.e. data at the top between `---` lines) as YAML.
 func ParseFileFrontmatter(c *modulir.Context, source string, v interface{}) ([]byte, error) {
-	data, err := os.ReadFile(source)
+	data, err := c.ReadFile(source)
 	if err != nil {
 		return nil, xerrors.Errorf("error reading file: %w", err)
 	}
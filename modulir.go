@@ -2,10 +2,17 @@ package modulir
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,12 +33,118 @@ import (
 
 // Config contains configuration.
 type Config struct {
+	// BasicAuthPassword is the password that clients of the HTTP server must
+	// provide with HTTP Basic Auth. See BasicAuthUser.
+	//
+	// Defaults to not requiring authentication if left unset (along with
+	// BasicAuthUser).
+	BasicAuthPassword string
+
+	// BasicAuthUser is the user that clients of the HTTP server must provide
+	// with HTTP Basic Auth, which is useful for gating access to a preview
+	// server that's been shared (say through a tunnel). If either it or
+	// BasicAuthPassword are set, all requests (including the websocket) must
+	// carry both or are rejected with a 401.
+	//
+	// Defaults to not requiring authentication if left unset (along with
+	// BasicAuthPassword).
+	BasicAuthUser string
+
+	// BrotliEncoder is used by the HTTP server to compress responses with
+	// Brotli on the fly for clients that accept it. Modulir doesn't include a
+	// Brotli implementation, so one must be provided, like:
+	//
+	//     func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }
+	//
+	// using `github.com/andybalholm/brotli`. Precompressed ".br" siblings of
+	// files in TargetDir are served to these clients regardless.
+	//
+	// Defaults to nil, in which case responses are compressed with gzip
+	// unless a precompressed Brotli sibling is available.
+	BrotliEncoder func(io.Writer) io.WriteCloser
+
+	// BuildCachePath is a path at which a Context.BuildCache is persisted so
+	// that it survives restarts. It's loaded at startup and saved at the end
+	// of a build with Build, or on a graceful shutdown (i.e. USR2) with
+	// BuildLoop. Targets checked with Context.ChangedTarget whose sources'
+	// contents haven't changed since they were last written are then not
+	// rebuilt on the first build after a restart.
+	//
+	// Defaults to not using a build cache if left unset.
+	BuildCachePath string
+
 	// Concurrency is the number of concurrent workers to run during the build
 	// step.
 	//
 	// Defaults to 10.
 	Concurrency int
 
+	// ContentETag causes the HTTP server to derive ETags from hashes of the
+	// contents of the files it serves rather than from their modification
+	// times and sizes. Builds that rewrite a file without changing it then
+	// don't invalidate clients' cached copies, and a request carrying a
+	// matching If-None-Match gets a 304.
+	//
+	// Defaults to false.
+	ContentETag bool
+
+	// Draft causes a fast, lower-fidelity build to be produced by skipping
+	// expensive steps like image optimization. See Context.Draft for the
+	// behaviors it changes.
+	//
+	// Defaults to false.
+	Draft bool
+
+	// FailFast causes each job pool to stop running jobs after the first job
+	// error in a round rather than running every job to completion. See
+	// Pool.FailFast.
+	//
+	// Defaults to false.
+	FailFast bool
+
+	// FS is a filesystem from which source content is read. See Context.FS.
+	//
+	// Defaults to nil, which reads from the operating system's filesystem.
+	FS fs.FS
+
+	// Gzip causes target files to also be written as gzipped siblings with a
+	// ".gz" suffix. See Context.Gzip.
+	//
+	// Defaults to false.
+	Gzip bool
+
+	// Handlers are additional handlers mounted on the HTTP server's mux, keyed
+	// by pattern (like `/metrics`). Each is a function that's called once with
+	// the build's context before the build loop starts so that handlers that
+	// need it can be constructed, like one serving metrics for its job pool
+	// from mmetrics. Patterns mustn't conflict with those of Modulir's own
+	// routes (like `/` or `/websocket`).
+	//
+	// Defaults to nil.
+	Handlers map[string]func(c *Context) http.Handler
+
+	// HashContent causes changes to files to be detected by comparing hashes
+	// of their contents in addition to their modified times. See
+	// Context.HashContent.
+	//
+	// Defaults to false.
+	HashContent bool
+
+	// JobsBufferSize is the buffer size of each job pool's Jobs channel. See
+	// Pool.JobsBufferSize for the tradeoffs involved.
+	//
+	// Defaults to 500.
+	JobsBufferSize int
+
+	// Listener is a listener on which the HTTP server serves content in place
+	// of one that it creates for Port, which is useful for tests that listen
+	// on an ephemeral port (e.g. with `net.Listen("tcp", "127.0.0.1:0")`) to
+	// avoid conflicts, then get the chosen address from its Addr. Port and
+	// PortAutoIncrement are ignored if it's set.
+	//
+	// Defaults to creating a listener for Port if left unset.
+	Listener net.Listener
+
 	// Log specifies a logger to use.
 	//
 	// Defaults to an instance of Logger running at informational level.
@@ -43,22 +156,149 @@ type Config struct {
 	// Defaults to false.
 	LogColor bool
 
+	// MaintenancePage is the path to a page that the HTTP server responds
+	// with (along with a 503 status) for every request instead of serving
+	// content from TargetDir. It's useful for previewing a maintenance page,
+	// or for serving something coherent during a long cold build. Endpoints
+	// used by the websocket are still served.
+	//
+	// Defaults to serving content from TargetDir if left unset.
+	MaintenancePage string
+
+	// ModTimeCachePath is a path at which the modified times of files seen
+	// by Context.Changed are persisted so that they survive restarts. It's
+	// loaded at startup and saved at the end of a build with Build, or on a
+	// graceful shutdown (i.e. USR2) with BuildLoop. Files that haven't changed
+	// since are then not rebuilt on the first build after a restart.
+	//
+	// Defaults to not persisting the cache if left unset.
+	ModTimeCachePath string
+
+	// NotFoundPath is the path of a file relative to TargetDir (e.g.
+	// "404.html") whose contents the HTTP server responds with (along with a
+	// 404 status) when a requested file isn't found, which is how hosts like
+	// Netlify or S3 behave. If the file doesn't exist, the server's default
+	// 404 response is used instead.
+	//
+	// Defaults to the default 404 response if left unset.
+	NotFoundPath string
+
+	// Pools specifies additional named job pools to create along with the
+	// main one, keyed by name with values being the concurrency at which
+	// each should run. Retrieve them with Context.PoolFor.
+	//
+	// Defaults to no additional pools.
+	Pools map[string]int
+
 	// Port specifies the port on which to serve content from TargetDir over
 	// HTTP.
 	//
 	// Defaults to not running if left unset.
 	Port int
 
+	// PortAutoIncrement causes the HTTP server to try the next few ports in
+	// turn if Port is already in use instead of exiting, which is useful when
+	// running multiple sites at once. The port that was bound is logged.
+	//
+	// Defaults to false.
+	PortAutoIncrement bool
+
+	// Production indicates that the build is one for production rather than
+	// for previewing in development. See Context.Production.
+	//
+	// Defaults to false.
+	Production bool
+
+	// ReportPath is a path to which a JSON report of the build is written after
+	// each run of the build loop. It contains the build's duration, job
+	// counts, the slowest jobs, and any errors, and is useful for feeding
+	// dashboards. The file is overwritten on every loop so that it always
+	// reflects the latest build.
+	//
+	// Defaults to not writing a report if left unset.
+	ReportPath string
+
+	// SlowJobThreshold causes each job pool to log executed jobs that took
+	// longer than the given duration at the end of each round. See
+	// Pool.SlowJobThreshold.
+	//
+	// Defaults to zero, which disables it.
+	SlowJobThreshold time.Duration
+
+	// SelfRestart causes BuildLoop to watch its own executable and restart
+	// itself when it changes (e.g. after being recompiled with changes to the
+	// build function) so that changes take effect without having to restart
+	// it manually.
+	//
+	// A restart is the same as the one prompted by a USR2 signal: the build
+	// loop is told to finish, the watcher is closed, the HTTP server is shut
+	// down gracefully (giving open connections up to five seconds), and the
+	// process is replaced with a fresh one by invoking the executable at the
+	// same path with the same arguments and environment (the exec syscall).
+	// The process ID is kept. Go opens files and sockets as close-on-exec, so
+	// any that remain open (like websockets) are closed by the exec, which
+	// prompts clients to reconnect to the new process.
+	//
+	// Defaults to false.
+	SelfRestart bool
+
+	// SelfRestartPaths are additional files or directories whose changes
+	// trigger a restart when SelfRestart is enabled. For directories, a change
+	// to any file directly within them triggers a restart. Note that a restart
+	// always execs the original executable, so these are useful for files
+	// that it loads at startup, or for a directory that a tool rebuilds the
+	// executable into.
+	//
+	// Defaults to no additional paths.
+	SelfRestartPaths []string
+
 	// SourceDir is the directory containing source files.
 	//
 	// Defaults to ".".
 	SourceDir string
 
+	// SPAFallback is the path of a file relative to TargetDir (e.g.
+	// "index.html") that the HTTP server responds with for requests that
+	// don't match an existing file, which allows a single-page app to handle
+	// its own client-side routes. Requests for paths with a file extension
+	// are assumed to be for assets and never fall back. The websocket
+	// endpoints always take precedence.
+	//
+	// Defaults to serving a 404 for missing files if left unset.
+	SPAFallback string
+
 	// TargetDir is the directory where the site will be built to.
 	//
 	// Defaults to "./public".
 	TargetDir string
 
+	// TLSCertFile is the path to a certificate with which to serve content
+	// over HTTPS instead of HTTP, which is useful for testing browser APIs
+	// that require a secure context (like service workers). Must be set along
+	// with TLSKeyFile. A certificate for localhost can be generated with a
+	// tool like mkcert.
+	//
+	// Defaults to serving over HTTP if left unset.
+	TLSCertFile string
+
+	// TLSKeyFile is the path to the private key matching TLSCertFile.
+	//
+	// Defaults to serving over HTTP if left unset.
+	TLSKeyFile string
+
+	// TraceChanges causes every decision about whether a file has changed to
+	// be logged along with the reason for it. See Context.TraceChanges.
+	//
+	// Defaults to false.
+	TraceChanges bool
+
+	// WatchIgnore is a set of glob patterns for paths whose changes
+	// shouldn't trigger a rebuild, in addition to any in a `.gitignore` in
+	// SourceDir. See Context.WatchIgnore.
+	//
+	// Defaults to no patterns.
+	WatchIgnore []string
+
 	// Websocket indicates that Modulir should be started in development
 	// mode with a websocket that provides features like live reload.
 	//
@@ -66,9 +306,135 @@ type Config struct {
 	Websocket bool
 }
 
+// BuildErrors are the errors that occurred during a build, as returned by
+// BuildOnce. Errors with identical messages are deduplicated.
+//
+// It supports errors.Is and errors.As over the errors it contains, so an
+// errored job can be extracted with:
+//
+//	var job *modulir.Job
+//	if errors.As(err, &job) {
+//		...
+//	}
+type BuildErrors struct {
+	counts map[string]int
+	errs   []error
+}
+
+// NewBuildErrors initializes a BuildErrors from the given errors, dropping any
+// whose message is identical to an earlier one's. Returns nil if there are no
+// errors.
+func NewBuildErrors(errs []error) *BuildErrors {
+	if len(errs) < 1 {
+		return nil
+	}
+
+	e := &BuildErrors{counts: make(map[string]int)}
+	for _, err := range errs {
+		message := err.Error()
+		if e.counts[message] == 0 {
+			e.errs = append(e.errs, err)
+		}
+		e.counts[message]++
+	}
+
+	return e
+}
+
+// As finds the first of the contained errors that matches target as per
+// errors.As, and if one does, sets target to it.
+func (e *BuildErrors) As(target interface{}) bool {
+	for _, err := range e.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Error returns a message including those of each of the contained errors (up
+// to a limit).
+func (e *BuildErrors) Error() string {
+	if len(e.errs) == 1 {
+		return e.errs[0].Error()
+	}
+
+	messages := make([]string, 0, len(e.errs))
+	for i, err := range e.errs {
+		if i >= maxMessages {
+			messages = append(messages, fmt.Sprintf("... and %v more", len(e.errs)-maxMessages))
+			break
+		}
+		messages = append(messages, err.Error())
+	}
+
+	return fmt.Sprintf("%v build errors: %s", len(e.errs), strings.Join(messages, "; "))
+}
+
+// Errors returns the contained errors with duplicates removed, in the order
+// that they occurred.
+func (e *BuildErrors) Errors() []error {
+	return e.errs
+}
+
+// Is reports whether any of the contained errors matches target as per
+// errors.Is.
+func (e *BuildErrors) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary renders a human-readable summary of the errors with one per line,
+// grouped into errored jobs and other build errors. Errors that occurred more
+// than once are annotated with the number of times they did.
+func (e *BuildErrors) Summary() string {
+	var jobLines, otherLines []string
+
+	for _, err := range e.errs {
+		line := "  " + err.Error()
+
+		var job *Job
+		if errors.As(err, &job) {
+			line = fmt.Sprintf("  %s: %v", job.Name, job.Err)
+		}
+
+		if count := e.counts[err.Error()]; count > 1 {
+			line += fmt.Sprintf(" (x%v)", count)
+		}
+
+		if job != nil {
+			jobLines = append(jobLines, line)
+		} else {
+			otherLines = append(otherLines, line)
+		}
+	}
+
+	var sb strings.Builder
+	if len(jobLines) > 0 {
+		sb.WriteString("Job errors:\n" + strings.Join(jobLines, "\n") + "\n")
+	}
+	if len(otherLines) > 0 {
+		sb.WriteString("Build errors:\n" + strings.Join(otherLines, "\n") + "\n")
+	}
+	return sb.String()
+}
+
 // Build is one of the main entry points to the program. Call this to build
-// only one time.
+// only one time. The process exits with status 1 if the build fails.
 func Build(config *Config, f func(*Context) []error) {
+	if err := BuildOnce(config, f); err != nil {
+		os.Exit(1)
+	}
+}
+
+// BuildOnce is like Build, but instead of exiting when the build fails, it
+// returns any errors that occurred as a *BuildErrors. Errors are logged
+// either way. It's useful for programs that embed a build.
+func BuildOnce(config *Config, f func(*Context) []error) error {
 	var buildCompleteMu sync.Mutex
 	buildComplete := sync.NewCond(&buildCompleteMu)
 	finish := make(chan struct{}, 1)
@@ -76,13 +442,20 @@ func Build(config *Config, f func(*Context) []error) {
 	// Signal the build loop to finish immediately
 	finish <- struct{}{}
 
+	config = initConfigDefaults(config)
 	c := initContext(config, nil)
 	ensureTargetDir(c)
-
-	success := build(c, f, finish, buildComplete)
-	if !success {
-		os.Exit(1)
+	loadBuildCache(c, config.BuildCachePath)
+	loadModTimeCache(c, config.ModTimeCachePath)
+
+	errs := build(c, config, f, finish, buildComplete)
+	saveBuildCache(c, config.BuildCachePath)
+	saveModTimeCache(c, config.ModTimeCachePath)
+	if len(errs) > 0 {
+		return NewBuildErrors(errs)
 	}
+
+	return nil
 }
 
 // BuildLoop is one of the main entry points to the program. Call this to build
@@ -98,26 +471,40 @@ func BuildLoop(config *Config, f func(*Context) []error) {
 	}
 	defer watcher.Close()
 
+	config = initConfigDefaults(config)
 	c := initContext(config, watcher)
 	ensureTargetDir(c)
+	loadBuildCache(c, config.BuildCachePath)
+	loadModTimeCache(c, config.ModTimeCachePath)
 
-	// Serve HTTP
-	var server *http.Server
+	// Serve HTTP. Started before the build loop so that handlers from
+	// Config.Handlers are constructed before the first round.
+	server := startServingTargetDirHTTP(c, config, buildComplete)
+
+	// Run the build loop. Loops forever until receiving on finish, then
+	// closes buildDone.
+	buildDone := make(chan struct{})
 	go func() {
-		server = startServingTargetDirHTTP(c, buildComplete)
+		build(c, config, f, finish, buildComplete)
+		close(buildDone)
 	}()
 
-	// Run the build loop. Loops forever until receiving on finish.
-	go build(c, f, finish, buildComplete)
-
 	// Listen for signals. Modulir will gracefully exit and re-exec itself upon
 	// receipt of USR2.
 	signals := make(chan os.Signal, 1024)
 	signal.Notify(signals, unix.SIGUSR2)
+
+	// Self-restarts go through the same path as USR2.
+	if config.SelfRestart {
+		if err := watchSelfRestart(c, config.SelfRestartPaths, signals); err != nil {
+			exitWithError(xerrors.Errorf("error starting self-restart watcher: %w", err))
+		}
+	}
+
 	for {
 		s := <-signals
 		if s == unix.SIGUSR2 {
-			shutdownAndExec(c, finish, watcher, server)
+			shutdownAndExec(c, config, finish, buildDone, watcher, server)
 		}
 	}
 }
@@ -132,13 +519,37 @@ func BuildLoop(config *Config, f func(*Context) []error) {
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// A machine-readable report of a single run of the build loop. See
+// Config.ReportPath.
+type buildReport struct {
+	DurationSeconds float64             `json:"duration_seconds"`
+	Errors          []*buildReportError `json:"errors"`
+	NumJobs         int                 `json:"num_jobs"`
+	NumJobsErrored  int                 `json:"num_jobs_errored"`
+	NumJobsExecuted int                 `json:"num_jobs_executed"`
+	NumRounds       int                 `json:"num_rounds"`
+	SlowestJobs     []*buildReportJob   `json:"slowest_jobs"`
+}
+
+// A job that errored in a build report.
+type buildReportError struct {
+	Message string `json:"message"`
+	Name    string `json:"name"`
+}
+
+// A job that executed in a build report.
+type buildReportJob struct {
+	DurationSeconds float64 `json:"duration_seconds"`
+	Name            string  `json:"name"`
+}
+
 // Runs an infinite built loop until a signal is received over the `finish`
 // channel.
 //
 // Returns true of the last build was successful and false otherwise.
-func build(c *Context, f func(*Context) []error,
+func build(c *Context, config *Config, f func(*Context) []error,
 	finish chan struct{}, buildComplete *sync.Cond,
-) bool {
+) []error {
 	rebuild := make(chan map[string]struct{})
 	rebuildDone := make(chan struct{})
 
@@ -168,13 +579,21 @@ func build(c *Context, f func(*Context) []error,
 
 		// Do one wait round as the build loop might not have waited on its
 		// last phase, but only bother if it looks like any jobs were enqueued.
-		if len(c.Pool.Jobs) > 0 {
+		if c.numJobsQueued() > 0 {
 			lastRoundErrors = c.Wait()
 		}
 
-		// Context's Wait restarts the pool, so wait on that one more time to
-		// shut it back down.
-		c.Pool.Wait()
+		// Context's Wait restarts the pools, so wait on them one more time to
+		// shut them back down.
+		c.waitPools()
+
+		// Every job has finished, so files checked during the loop can be
+		// considered seen, including by a future process that loads the
+		// saved mod time cache. Not so if the loop was canceled, in which
+		// case some of their jobs may have been cut short or skipped.
+		if !c.round.isCanceled() {
+			c.fileModTimeCache.promote()
+		}
 
 		buildDuration := time.Since(c.Stats.Start)
 
@@ -184,6 +603,7 @@ func build(c *Context, f func(*Context) []error,
 
 		c.Pool.LogErrorsSlice(errors)
 		c.Pool.LogSlowestSlice(c.Stats.JobsExecuted)
+		c.Pool.LogStatsByCategorySlice(c.Stats.JobsExecuted)
 
 		success := len(c.Stats.JobsErrored) == 0
 
@@ -200,8 +620,22 @@ func build(c *Context, f func(*Context) []error,
 			len(c.Stats.JobsExecuted), c.Stats.NumJobs, c.Stats.NumRounds, len(c.Stats.JobsErrored),
 		)
 
+		if config.ReportPath != "" {
+			if err := writeReport(c, config.ReportPath, buildDuration); err != nil {
+				c.Log.Errorf("Error writing build report: %v", err)
+			}
+		}
+
 		c.QuickPaths = nil
 
+		buildComplete.L.Lock()
+		if onlyStylesheetsChanged(lastChangedSources) {
+			c.buildCompleteEvent = websocketEventCSSReload
+		} else {
+			c.buildCompleteEvent = websocketEventBuildComplete
+		}
+		buildComplete.L.Unlock()
+
 		buildComplete.Broadcast()
 
 		if c.FirstRun {
@@ -213,7 +647,7 @@ func build(c *Context, f func(*Context) []error,
 		select {
 		case <-finish:
 			c.Log.Infof("Build loop detected finish signal; stopping")
-			return len(errors) < 1
+			return errors
 
 		case lastChangedSources = <-rebuild:
 			c.Log.Infof("Build loop detected change on %v; rebuilding",
@@ -230,6 +664,31 @@ func colorByStatus(c *Context, s string, success bool) string {
 	return c.colorizer.Red(s).String()
 }
 
+// Extensions of stylesheet sources. Changes to only these can be picked up by
+// clients without a full page reload.
+var stylesheetExts = map[string]struct{}{
+	".css":  {},
+	".less": {},
+	".sass": {},
+	".scss": {},
+}
+
+// Returns whether the given set of changed sources is non-empty and contains
+// only stylesheets.
+func onlyStylesheetsChanged(changedSources map[string]struct{}) bool {
+	if len(changedSources) < 1 {
+		return false
+	}
+
+	for source := range changedSources {
+		if _, ok := stylesheetExts[strings.ToLower(filepath.Ext(source))]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Calculates the total duration given a set of jobs.
 func calculateTotalDuration(jobs []*Job) time.Duration {
 	var totalTime time.Duration
@@ -284,18 +743,71 @@ func initConfigDefaults(config *Config) *Config {
 func initContext(config *Config, watcher *fsnotify.Watcher) *Context {
 	config = initConfigDefaults(config)
 
+	pools := make(map[string]*Pool, len(config.Pools))
+	for name, concurrency := range config.Pools {
+		pools[name] = NewPool(config.Log, concurrency)
+		pools[name].FailFast = config.FailFast
+		pools[name].JobsBufferSize = config.JobsBufferSize
+		pools[name].SlowJobThreshold = config.SlowJobThreshold
+	}
+
+	pool := NewPool(config.Log, config.Concurrency)
+	pool.FailFast = config.FailFast
+	pool.JobsBufferSize = config.JobsBufferSize
+	pool.SlowJobThreshold = config.SlowJobThreshold
+
+	var buildCache *BuildCache
+	if config.BuildCachePath != "" {
+		buildCache = NewBuildCache()
+	}
+
 	return NewContext(&Args{
-		Log:       config.Log,
-		LogColor:  config.LogColor,
-		Port:      config.Port,
-		Pool:      NewPool(config.Log, config.Concurrency),
-		SourceDir: config.SourceDir,
-		TargetDir: config.TargetDir,
-		Watcher:   watcher,
-		Websocket: config.Websocket,
+		BuildCache:   buildCache,
+		Draft:        config.Draft,
+		FS:           config.FS,
+		Gzip:         config.Gzip,
+		HashContent:  config.HashContent,
+		Log:          config.Log,
+		LogColor:     config.LogColor,
+		Port:         config.Port,
+		Pool:         pool,
+		Pools:        pools,
+		Production:   config.Production,
+		SourceDir:    config.SourceDir,
+		TargetDir:    config.TargetDir,
+		TraceChanges: config.TraceChanges,
+		WatchIgnore:  config.WatchIgnore,
+		Watcher:      watcher,
+		Websocket:    config.Websocket,
 	})
 }
 
+// Loads the build cache from the given path if one was configured. Errors are
+// logged rather than fatal because the worst case is that everything is
+// rebuilt.
+func loadBuildCache(c *Context, path string) {
+	if path == "" {
+		return
+	}
+
+	if err := c.BuildCache.Load(path); err != nil {
+		c.Log.Errorf("Error loading build cache: %v", err)
+	}
+}
+
+// Loads the file modification time cache from the given path if one was
+// configured. Errors are logged rather than fatal because the worst case is
+// that everything is rebuilt.
+func loadModTimeCache(c *Context, path string) {
+	if path == "" {
+		return
+	}
+
+	if err := c.fileModTimeCache.load(path); err != nil {
+		c.Log.Errorf("Error loading mod time cache: %v", err)
+	}
+}
+
 // Extract the names of keys out of a map and return them as a slice.
 func mapKeys(m map[string]struct{}) []string {
 	keys := make([]string, 0, len(m))
@@ -305,18 +817,49 @@ func mapKeys(m map[string]struct{}) []string {
 	return keys
 }
 
+// Saves the build cache to the given path if one was configured.
+func saveBuildCache(c *Context, path string) {
+	if path == "" {
+		return
+	}
+
+	if err := c.BuildCache.Save(path); err != nil {
+		c.Log.Errorf("Error saving build cache: %v", err)
+	}
+}
+
+// Saves the file modification time cache to the given path if one was
+// configured.
+func saveModTimeCache(c *Context, path string) {
+	if path == "" {
+		return
+	}
+
+	if err := c.fileModTimeCache.save(path); err != nil {
+		c.Log.Errorf("Error saving mod time cache: %v", err)
+	}
+}
+
 // Replaces the current process with a fresh one by invoking the same
 // executable with the operating system's exec syscall. This is prompted by the
 // USR2 signal and is intended to allow the process to refresh itself in the
 // case where it's source files changed and it was recompiled.
 //
 // The fsnotify watcher and HTTP server are shut down as gracefully as possible
-// before the replacement occurs.
-func shutdownAndExec(c *Context, finish chan struct{},
-	watcher *fsnotify.Watcher, server *http.Server,
+// before the replacement occurs. Any build in progress is canceled, and caches
+// are saved only after the build loop has exited (signaled by buildDone
+// closing) so that they don't include the work of jobs that didn't finish.
+func shutdownAndExec(c *Context, config *Config, finish chan struct{},
+	buildDone <-chan struct{}, watcher *fsnotify.Watcher, server *http.Server,
 ) {
-	// Tell the build loop to finish up
+	// Cancel the current round so that its jobs return early, then tell the
+	// build loop to finish up and wait for it to do so.
+	c.round.cancelAll()
 	finish <- struct{}{}
+	<-buildDone
+
+	saveBuildCache(c, config.BuildCachePath)
+	saveModTimeCache(c, config.ModTimeCachePath)
 
 	// DANGER: Defers don't seem to get called on the re-exec, so even though
 	// we have a defer which closes our watcher, it won't close, leading to
@@ -349,3 +892,51 @@ func shutdownAndExec(c *Context, finish chan struct{},
 		exitWithError(err)
 	}
 }
+
+// Writes a JSON report of the build that just finished to the given path,
+// replacing any report that was there before. Only the slowest jobs (up to the
+// same limit used when logging them) are included.
+func writeReport(c *Context, path string, buildDuration time.Duration) error {
+	report := buildReport{
+		DurationSeconds: buildDuration.Seconds(),
+		Errors:          make([]*buildReportError, 0, len(c.Stats.JobsErrored)),
+		NumJobs:         c.Stats.NumJobs,
+		NumJobsErrored:  len(c.Stats.JobsErrored),
+		NumJobsExecuted: len(c.Stats.JobsExecuted),
+		NumRounds:       c.Stats.NumRounds,
+		SlowestJobs:     make([]*buildReportJob, 0, maxMessages),
+	}
+
+	for _, job := range c.Stats.JobsErrored {
+		report.Errors = append(report.Errors, &buildReportError{
+			Message: job.Err.Error(),
+			Name:    job.Name,
+		})
+	}
+
+	jobs := make([]*Job, len(c.Stats.JobsExecuted))
+	copy(jobs, c.Stats.JobsExecuted)
+	sortJobsBySlowest(jobs)
+
+	for i, job := range jobs {
+		if i >= maxMessages {
+			break
+		}
+
+		report.SlowestJobs = append(report.SlowestJobs, &buildReportJob{
+			DurationSeconds: job.Duration.Seconds(),
+			Name:            job.Name,
+		})
+	}
+
+	data, err := json.MarshalIndent(&report, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("error encoding build report: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return xerrors.Errorf("error writing build report: %w", err)
+	}
+
+	return nil
+}
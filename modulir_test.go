@@ -1,5 +1,118 @@
 package modulir
 
-//"testing"
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
 
-// assert "github.com/stretchr/testify/require"
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestBuildErrors(t *testing.T) {
+	assert.Nil(t, NewBuildErrors(nil))
+
+	errNotFound := errors.New("not found")
+
+	job := &Job{Name: "render", Err: errors.New("error rendering")}
+	errs := NewBuildErrors([]error{
+		xerrors.Errorf("wrapped: %w", job),
+		xerrors.Errorf("error fetching: %w", errNotFound),
+		errors.New("duplicate"),
+		errors.New("duplicate"),
+	})
+
+	// Identical messages are deduplicated.
+	assert.Len(t, errs.Errors(), 3)
+	assert.Equal(t,
+		"3 build errors: wrapped: error rendering; error fetching: not found; duplicate",
+		errs.Error(),
+	)
+	assert.Equal(t,
+		"Job errors:\n  render: error rendering\n"+
+			"Build errors:\n  error fetching: not found\n  duplicate (x2)\n",
+		errs.Summary(),
+	)
+
+	var err error = errs
+
+	var foundJob *Job
+	assert.True(t, errors.As(err, &foundJob))
+	assert.Equal(t, job, foundJob)
+
+	assert.ErrorIs(t, err, errNotFound)
+	assert.False(t, errors.Is(err, errors.New("other")))
+
+	// A single error's message is used as is.
+	assert.Equal(t, "duplicate", NewBuildErrors([]error{errors.New("duplicate")}).Error())
+}
+
+func TestWriteReport(t *testing.T) {
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+
+	c.Stats.NumJobs = 3
+	c.Stats.NumRounds = 1
+	c.Stats.JobsErrored = []*Job{
+		{Name: "errored", Err: xerrors.Errorf("error")},
+	}
+	c.Stats.JobsExecuted = []*Job{
+		{Name: "fast", Duration: 1 * time.Second},
+		{Name: "slow", Duration: 2 * time.Second},
+	}
+
+	path := filepath.Join(t.TempDir(), "report.json")
+
+	err := writeReport(c, path, 3*time.Second)
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	var report buildReport
+	err = json.Unmarshal(data, &report)
+	assert.NoError(t, err)
+
+	assert.Equal(t, buildReport{
+		DurationSeconds: 3,
+		Errors:          []*buildReportError{{Message: "error", Name: "errored"}},
+		NumJobs:         3,
+		NumJobsErrored:  1,
+		NumJobsExecuted: 2,
+		NumRounds:       1,
+		SlowestJobs: []*buildReportJob{
+			{DurationSeconds: 2, Name: "slow"},
+			{DurationSeconds: 1, Name: "fast"},
+		},
+	}, report)
+
+	// Reports are overwritten on subsequent builds.
+	c.Stats.Reset()
+	err = writeReport(c, path, 1*time.Second)
+	assert.NoError(t, err)
+
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+
+	report = buildReport{}
+	err = json.Unmarshal(data, &report)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, report.NumJobs)
+	assert.Empty(t, report.Errors)
+	assert.Empty(t, report.SlowestJobs)
+}
+
+func TestOnlyStylesheetsChanged(t *testing.T) {
+	assert.False(t, onlyStylesheetsChanged(nil))
+	assert.False(t, onlyStylesheetsChanged(map[string]struct{}{}))
+	assert.True(t, onlyStylesheetsChanged(map[string]struct{}{
+		"content/stylesheets/main.css":   {},
+		"content/stylesheets/_vars.SCSS": {},
+	}))
+	assert.False(t, onlyStylesheetsChanged(map[string]struct{}{
+		"content/stylesheets/main.css": {},
+		"layouts/main.ace":             {},
+	}))
+}
@@ -1,9 +1,13 @@
 package modulir
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"io"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/xerrors"
@@ -24,6 +28,21 @@ import (
 //
 //nolint:errname
 type Job struct {
+	// Dependencies are jobs that must finish successfully before this job is
+	// run. If any of them errors or is skipped, this job is skipped as well
+	// with an error that wraps the reason.
+	//
+	// Dependencies must be enqueued to the same pool during the same round as
+	// the job (or have finished in a previous round). A job whose dependency
+	// is never enqueued, or which is part of a dependency cycle, is errored
+	// without running.
+	Dependencies []*Job
+
+	// Category is an optional category for the job like "images" or
+	// "templates". Jobs are grouped by category by Pool.StatsByCategory to
+	// provide a breakdown of where build time is going.
+	Category string
+
 	// Duration is the time it took the job to run. It's set regardless of
 	// whether the job's finished state was executed, not executed, or errored.
 	Duration time.Duration
@@ -37,9 +56,49 @@ type Job struct {
 	// F is the function which makes up the job's workload.
 	F func() (bool, error)
 
+	// FWithContext is an alternative to F for jobs that support cancellation.
+	// It's passed the context of the round in which it runs, which is
+	// canceled if the parent context given to StartRoundWithContext is
+	// canceled. If set, it's run instead of F.
+	FWithContext func(context.Context) (bool, error)
+
+	// MaxRetries is the number of times that the job is retried if it returns
+	// an error, which is useful for jobs that are prone to intermittent
+	// failure like ones that fetch from the network. Panics aren't retried.
+	//
+	// Defaults to zero, which means no retries.
+	MaxRetries int
+
 	// Name is a name for the job which is helpful for informational and
 	// debugging purposes.
 	Name string
+
+	// RetryBackoff returns how long to sleep before the given retry attempt
+	// (starting from 1) when MaxRetries is set.
+	//
+	// Defaults to nil, which retries immediately.
+	RetryBackoff func(attempt int) time.Duration
+
+	// StartedAt is the time at which the job started running. It's zero if
+	// the job was never run.
+	StartedAt time.Time
+
+	// ctx is the context of the round in which the job was dispatched.
+	ctx context.Context
+
+	// fed is whether the job has been received by a pool's feeder.
+	fed bool
+
+	// finished is whether the job has finished running, or was skipped or
+	// errored without running. Guarded by the pool's depsMu.
+	finished bool
+
+	// skipped is whether the job was skipped without running. Guarded by the
+	// pool's depsMu.
+	skipped bool
+
+	// workerNum is the number of the worker that ran the job.
+	workerNum int
 }
 
 // Error returns the error message of the error wrapped in the job if this was
@@ -62,11 +121,79 @@ func NewJob(name string, f func() (bool, error)) *Job {
 	return &Job{Name: name, F: f}
 }
 
+// NewJobWithContext initializes and returns a new Job whose function is passed
+// a context that's canceled along with the round in which it runs. Jobs that
+// may run for a long time (e.g. ones that make HTTP requests) should prefer
+// this so they can exit early.
+func NewJobWithContext(name string, f func(context.Context) (bool, error)) *Job {
+	return &Job{Name: name, FWithContext: f}
+}
+
+// Result is a handle to the value computed by a job submitted with
+// SubmitFunc. Value is set only if the job succeeded, and shouldn't be read
+// until after the pool's Wait has returned.
+type Result[T any] struct {
+	// Job is the job that computes the value.
+	Job *Job
+
+	// Value is the value returned by the job.
+	Value T
+}
+
+// SubmitFunc enqueues a job to the given pool that computes a value, and
+// returns a handle from which the value can be read after Wait. This avoids
+// having to collect the results of jobs in external structures guarded by
+// mutexes.
+//
+// The pool must have a round started.
+func SubmitFunc[T any](p *Pool, name string, f func() (bool, T, error)) *Result[T] {
+	result := &Result[T]{}
+
+	result.Job = NewJob(name, func() (bool, error) {
+		executed, value, err := f()
+		if err != nil {
+			return executed, err
+		}
+
+		result.Value = value
+		return executed, nil
+	})
+
+	p.Jobs <- result.Job
+	return result
+}
+
 // Pool is a worker group that runs a number of jobs at a configured
 // concurrency.
 type Pool struct {
+	// FailFast causes the pool to stop running jobs after the first job in a
+	// round errors. Jobs already running are allowed to finish, but any that
+	// haven't started yet are skipped so that Wait returns as soon as
+	// possible. This is useful in development where knowing that anything is
+	// broken is more important than a complete list of errors.
+	//
+	// Defaults to false.
+	FailFast bool
+
 	Jobs chan *Job
 
+	// JobSoftTimeout is how long a job can run before the pool logs an error
+	// identifying it as probably stuck. It's a "soft" timeout because jobs
+	// aren't killed. Set to zero to disable it, which also saves a timer and
+	// Goroutine per job.
+	//
+	// Defaults to 15 seconds (set by NewPool).
+	JobSoftTimeout time.Duration
+
+	// JobsBufferSize is the buffer size of the Jobs channel (and of the
+	// internal channel that feeds jobs to workers). A larger buffer uses more
+	// memory, but lets builds that enqueue a large number of jobs in a tight
+	// loop do so without blocking on workers to catch up, which would
+	// otherwise serialize enqueuing with processing.
+	//
+	// Takes effect when the next round is started. Defaults to 500.
+	JobsBufferSize int
+
 	// JobsAll is a slice of all the jobs that were fed into the pool on the
 	// last run.
 	JobsAll []*Job
@@ -80,15 +207,44 @@ type Pool struct {
 	// JobsExecuted is a slice of jobs that were executed on the last run.
 	JobsExecuted []*Job
 
+	// SlowJobThreshold is a duration beyond which executed jobs are logged as
+	// slow at the end of each round (i.e. in Wait). It's a much gentler
+	// version of JobSoftTimeout that's useful for surfacing creeping
+	// performance regressions in jobs that are slow, but not stuck.
+	//
+	// Defaults to zero, which disables it.
+	SlowJobThreshold time.Duration
+
+	// WaitSoftTimeout is how long Wait can wait on a round before the pool
+	// logs debugging information about the state of each worker. Like
+	// JobSoftTimeout, nothing is killed. Set to zero to disable it.
+	//
+	// Defaults to 60 seconds (set by NewPool).
+	WaitSoftTimeout time.Duration
+
+	// JobsSkipped is a slice of jobs that were never run on the last run
+	// because a job failed in FailFast mode, the round was canceled, or one of
+	// their dependencies failed. Their Executed is false, and they have an Err
+	// only if they were skipped because of a dependency.
+	JobsSkipped []*Job
+
 	colorizer      *colorizer
 	concurrency    int
+	depsMu         sync.Mutex
+	failed         int32 // accessed atomically; set when a job errors under FailFast
 	jobsInternal   chan *Job
+	jobsPending    []*Job // jobs waiting on dependencies; guarded by depsMu
 	jobsErroredMu  sync.Mutex
 	jobsExecutedMu sync.Mutex
+	jobsSkippedMu  sync.Mutex
 	jobsFeederDone chan struct{}
 	log            LoggerInterface
+	roundCancel    context.CancelFunc
+	roundCtx       context.Context
 	roundNum       int
 	roundStarted   bool
+	roundStartedAt time.Time
+	waitHooks      []func(*Pool)
 	wg             sync.WaitGroup
 	workerInfos    []workerInfo
 }
@@ -100,6 +256,9 @@ func NewPool(log LoggerInterface, concurrency int) *Pool {
 	// By default a pool gets a no-op colorizer. NewContext may set one
 	// separately for pools created within the package.
 	pool := &Pool{
+		JobSoftTimeout:  defaultJobSoftTimeout,
+		WaitSoftTimeout: defaultWaitSoftTimeout,
+
 		colorizer:   &colorizer{LogColor: false},
 		concurrency: concurrency,
 		log:         log,
@@ -108,6 +267,20 @@ func NewPool(log LoggerInterface, concurrency int) *Pool {
 	return pool
 }
 
+// CategoryStats are statistics for the jobs in a single category. See
+// Pool.StatsByCategory.
+type CategoryStats struct {
+	// Duration is the total time taken by jobs in the category that ran.
+	Duration time.Duration
+
+	// NumJobs is the number of jobs in the category.
+	NumJobs int
+
+	// NumJobsExecuted is the number of jobs in the category that executed
+	// (i.e. did work).
+	NumJobsExecuted int
+}
+
 // JobErrors is a shortcut from extracting all the errors out of JobsErrored,
 // the set of jobs that errored on the last round.
 func (p *Pool) JobErrors() []error {
@@ -186,9 +359,125 @@ func (p *Pool) LogSlowestSlice(jobs []*Job) {
 	}
 }
 
+// LogStatsByCategory logs job counts and durations for each job category from
+// the last round.
+func (p *Pool) LogStatsByCategory() {
+	p.LogStatsByCategorySlice(p.JobsAll)
+}
+
+// LogStatsByCategorySlice logs job counts and durations for each job category
+// in the given slice. Nothing is logged if no jobs were given a category.
+func (p *Pool) LogStatsByCategorySlice(jobs []*Job) {
+	stats := statsByCategory(jobs)
+
+	if len(stats) < 1 {
+		return
+	}
+	if _, ok := stats[""]; ok && len(stats) == 1 {
+		return
+	}
+
+	categories := make([]string, 0, len(stats))
+	for category := range stats {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	p.log.Infof("Jobs by category:")
+	for _, category := range categories {
+		categoryStats := stats[category]
+
+		name := category
+		if name == "" {
+			name = "<uncategorized>"
+		}
+
+		p.log.Infof(
+			p.colorizer.Bold(p.colorizer.Cyan("    %s:")).String()+
+				" %v job(s), %v executed (time: %v)",
+			name, categoryStats.NumJobs, categoryStats.NumJobsExecuted,
+			categoryStats.Duration.Truncate(100*time.Microsecond))
+	}
+}
+
+// StatsByCategory aggregates the jobs from the last round by their Category,
+// returning job counts and total durations for each. Jobs without a category
+// are aggregated under an empty string.
+func (p *Pool) StatsByCategory() map[string]CategoryStats {
+	return statsByCategory(p.JobsAll)
+}
+
+// WriteTrace writes a trace of the last round like WriteTraceJSON.
+//
+// Deprecated: Use WriteTraceJSON instead.
+func (p *Pool) WriteTrace(w io.Writer) error {
+	return p.WriteTraceJSON(w)
+}
+
+// WriteTraceJSON writes a trace of the last round in Chrome's trace event
+// format, which can be loaded into chrome://tracing or Perfetto to visualize
+// how jobs were parallelized across workers and where gaps occurred.
+//
+// Every job that ran is emitted as a complete event with timestamps relative
+// to the start of the round, and grouped into a thread by the worker that ran
+// it.
+func (p *Pool) WriteTraceJSON(w io.Writer) error {
+	trace := traceFile{
+		DisplayTimeUnit: "ms",
+		TraceEvents:     make([]*traceEvent, 0, len(p.JobsAll)),
+	}
+
+	for _, job := range p.JobsAll {
+		if job.StartedAt.IsZero() {
+			continue
+		}
+
+		trace.TraceEvents = append(trace.TraceEvents, &traceEvent{
+			Args: map[string]interface{}{
+				"errored":  job.Err != nil,
+				"executed": job.Executed,
+			},
+			Category:  "job",
+			Duration:  job.Duration.Microseconds(),
+			Name:      job.Name,
+			Phase:     "X",
+			ProcessID: 1,
+			ThreadID:  job.workerNum,
+			Timestamp: job.StartedAt.Sub(p.roundStartedAt).Microseconds(),
+		})
+	}
+
+	// Jobs are appended to JobsAll as they're fed rather than as they start,
+	// so sort by start time to make the output easier to read.
+	sort.SliceStable(trace.TraceEvents, func(i, j int) bool {
+		return trace.TraceEvents[i].Timestamp < trace.TraceEvents[j].Timestamp
+	})
+
+	if err := json.NewEncoder(w).Encode(&trace); err != nil {
+		return xerrors.Errorf("error encoding trace: %w", err)
+	}
+
+	return nil
+}
+
+// OnWait registers a function that's called at the end of every Wait, once
+// all jobs in the round have finished. It's useful for collecting statistics
+// about each round. Hooks should be registered before a round is started.
+func (p *Pool) OnWait(f func(p *Pool)) {
+	p.waitHooks = append(p.waitHooks, f)
+}
+
 // StartRound begins an execution round. Internal statistics and other tracking
 // are all reset.
 func (p *Pool) StartRound(roundNum int) {
+	p.StartRoundWithContext(context.Background(), roundNum)
+}
+
+// StartRoundWithContext begins an execution round like StartRound, but with a
+// parent context. Jobs created with NewJobWithContext receive a context
+// derived from it, and if it's canceled, jobs that haven't started yet are
+// skipped so that Wait returns as soon as in-flight jobs finish.
+func (p *Pool) StartRoundWithContext(ctx context.Context, roundNum int) {
 	if p.roundStarted {
 		panic("StartRound already called (call Wait before calling it again)")
 	}
@@ -196,13 +485,23 @@ func (p *Pool) StartRound(roundNum int) {
 	p.roundNum = roundNum
 	p.log.Debugf("pool: Starting round %v at concurrency %v", p.roundNum, p.concurrency)
 
-	p.Jobs = make(chan *Job, 500)
+	bufferSize := p.JobsBufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultJobsBufferSize
+	}
+
+	p.Jobs = make(chan *Job, bufferSize)
 	p.JobsAll = nil
 	p.JobsErrored = nil
 	p.JobsExecuted = nil
+	p.JobsSkipped = nil
+	p.jobsPending = nil
 	p.jobsFeederDone = make(chan struct{}, 1)
-	p.jobsInternal = make(chan *Job, 500)
+	p.jobsInternal = make(chan *Job, bufferSize)
+	atomic.StoreInt32(&p.failed, 0)
+	p.roundCtx, p.roundCancel = context.WithCancel(ctx)
 	p.roundStarted = true
+	p.roundStartedAt = time.Now()
 
 	for i := range p.workerInfos {
 		p.workerInfos[i].reset()
@@ -213,9 +512,28 @@ func (p *Pool) StartRound(roundNum int) {
 		p.log.Debugf("pool: Job feeder: Starting")
 
 		for job := range p.Jobs {
+			p.JobsAll = append(p.JobsAll, job)
+			job.fed = true
+
+			// Keep draining Jobs so that senders don't block, but stop
+			// dispatching once a job has failed in fail fast mode or the
+			// round was canceled.
+			if p.shouldSkip() {
+				p.skipJob(job, nil)
+				continue
+			}
+
+			job.ctx = p.roundCtx
+
+			// Jobs with dependencies are held until their dependencies are
+			// finished, and dispatched from there.
+			if len(job.Dependencies) > 0 {
+				p.feedJobWithDependencies(job)
+				continue
+			}
+
 			p.wg.Add(1)
 			p.jobsInternal <- job
-			p.JobsAll = append(p.JobsAll, job)
 		}
 
 		p.log.Debugf("pool: Job feeder: Finished feeding")
@@ -257,16 +575,26 @@ func (p *Pool) Wait() bool {
 	// been enqueued in jobsInternal.
 	<-p.jobsFeederDone
 
+	// Any jobs still waiting on dependencies that were never enqueued would
+	// wait forever, so error them.
+	p.errorJobsWithUnfedDependencies()
+
 	// Prints some debug information to help us in case we run into stalling
 	// problems in the main job loop.
-	done := make(chan struct{}, 1)
-	go func() {
-		select {
-		case <-time.After(waitSoftTimeout):
-			p.logWaitTimeoutInfo()
-		case <-done:
-		}
-	}()
+	var done chan struct{}
+	if p.WaitSoftTimeout > 0 {
+		done = make(chan struct{}, 1)
+		go func() {
+			timer := time.NewTimer(p.WaitSoftTimeout)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C:
+				p.logWaitTimeoutInfo()
+			case <-done:
+			}
+		}()
+	}
 
 	p.log.Debugf("pool: Waiting for %v job(s) to be done", len(p.JobsAll))
 
@@ -274,15 +602,33 @@ func (p *Pool) Wait() bool {
 	p.wg.Wait()
 
 	// Kill the timeout Goroutine.
-	done <- struct{}{}
+	if done != nil {
+		done <- struct{}{}
+	}
 
 	// Drops workers out of their run loop. Their Goroutines return.
 	// wait on the run gate.
 	close(p.jobsInternal)
 
+	// Releases resources associated with the round's context.
+	p.roundCancel()
+
 	// Occasionally useful for debugging.
 	// p.logWaitTimeoutInfo()
 
+	if len(p.JobsSkipped) > 0 {
+		p.log.Infof("pool: Skipped %v job(s) after the first error or cancellation",
+			len(p.JobsSkipped))
+	}
+
+	if p.SlowJobThreshold > 0 {
+		p.logSlowJobs()
+	}
+
+	for _, hook := range p.waitHooks {
+		hook(p)
+	}
+
 	return p.JobsErrored == nil
 }
 
@@ -297,19 +643,41 @@ func (p *Pool) Wait() bool {
 //////////////////////////////////////////////////////////////////////////////
 
 const (
-	// When to report that a job is probably timed out. We call it a "soft"
-	// timeout because we can't actually kill jobs.
-	jobSoftTimeout = 15 * time.Second
+	// Default buffer size of the Jobs channel when Pool.JobsBufferSize isn't
+	// set.
+	defaultJobsBufferSize = 500
+
+	// Default for when to report that a job is probably timed out. We call it
+	// a "soft" timeout because we can't actually kill jobs.
+	defaultJobSoftTimeout = 15 * time.Second
 
 	// Maximum number of errors or jobs to print on screen after a build loop.
 	maxMessages = 10
 
-	// When to report that a wait round is probably timed out. We call it a
-	// "soft" timeout because no jobs are killed -- it's just for reporting and
-	// debugging purposes.
-	waitSoftTimeout = 60 * time.Second
+	// Default for when to report that a wait round is probably timed out. We
+	// call it a "soft" timeout because no jobs are killed -- it's just for
+	// reporting and debugging purposes.
+	defaultWaitSoftTimeout = 60 * time.Second
 )
 
+// The top level of a trace in Chrome's trace event format.
+type traceFile struct {
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+	TraceEvents     []*traceEvent `json:"traceEvents"`
+}
+
+// A single event in Chrome's trace event format. Times are in microseconds.
+type traceEvent struct {
+	Args      map[string]interface{} `json:"args,omitempty"`
+	Category  string                 `json:"cat"`
+	Duration  int64                  `json:"dur"`
+	Name      string                 `json:"name"`
+	Phase     string                 `json:"ph"`
+	ProcessID int                    `json:"pid"`
+	ThreadID  int                    `json:"tid"`
+	Timestamp int64                  `json:"ts"`
+}
+
 // Keeps track of the information on a worker. Used for debugging purposes
 // only.
 type workerInfo struct {
@@ -324,6 +692,10 @@ type workerInfo struct {
 	numJobsErrored  int
 	numJobsExecuted int
 	numJobsFinished int
+
+	// Number of times a job was retried after an error. A job retried
+	// multiple times is counted once for each retry.
+	numJobsRetried int
 }
 
 // Resets statistics for the worker info.
@@ -332,6 +704,7 @@ func (wi *workerInfo) reset() {
 	wi.numJobsErrored = 0
 	wi.numJobsExecuted = 0
 	wi.numJobsFinished = 0
+	wi.numJobsRetried = 0
 }
 
 // Keeps track of the state of a worker. Used for debugging purposes only.
@@ -347,6 +720,13 @@ const (
 	workerStateWaitingOnRunOrStop workerState = "waiting_on_run_or_stop"
 )
 
+// Returns true if jobs that haven't started yet should be skipped, either
+// because a job has failed during the current round and the pool is in fail
+// fast mode, or because the round's context was canceled.
+func (p *Pool) shouldSkip() bool {
+	return atomic.LoadInt32(&p.failed) == 1 || p.roundCtx.Err() != nil
+}
+
 func (p *Pool) logWaitTimeoutInfo() {
 	// We don't have an easy channel to count on for this number, so sum the
 	// numbers across all workers.
@@ -370,8 +750,9 @@ func (p *Pool) logWaitTimeoutInfo() {
 			jobName = info.activeJob.Name
 		}
 
-		p.log.Errorf("    Worker %v state: %v, jobs finished: %v, errored: %v, executed: %v, job: %v",
-			i, info.state, info.numJobsFinished, info.numJobsErrored, info.numJobsExecuted, jobName)
+		p.log.Errorf("    Worker %v state: %v, jobs finished: %v, errored: %v, executed: %v, retried: %v, job: %v",
+			i, info.state, info.numJobsFinished, info.numJobsErrored, info.numJobsExecuted,
+			info.numJobsRetried, jobName)
 	}
 }
 
@@ -383,6 +764,10 @@ func (p *Pool) setWorkerJobFinished(workerNum int, job *Job, executed bool, err
 	if err != nil {
 		job.Err = err
 
+		if p.FailFast {
+			atomic.StoreInt32(&p.failed, 1)
+		}
+
 		p.jobsErroredMu.Lock()
 		p.JobsErrored = append(p.JobsErrored, job)
 		p.jobsErroredMu.Unlock()
@@ -400,17 +785,227 @@ func (p *Pool) setWorkerJobFinished(workerNum int, job *Job, executed bool, err
 		p.workerInfos[workerNum].numJobsExecuted++
 	}
 
+	// Dispatch any jobs that were waiting on this one before marking it done
+	// so that Wait can't return while they're still pending.
+	p.depsMu.Lock()
+	job.finished = true
+	p.dispatchReadyLocked()
+	p.depsMu.Unlock()
+
 	p.wg.Done()
 
 	p.workerInfos[workerNum].activeJob = nil
 	p.workerInfos[workerNum].state = workerStateJobFinished
 }
 
+// Records a job that was skipped without being run, optionally with an error
+// describing why. Jobs waiting on it are skipped in turn.
+func (p *Pool) skipJob(job *Job, err error) {
+	p.depsMu.Lock()
+	defer p.depsMu.Unlock()
+
+	p.skipJobLocked(job, err)
+	p.dispatchReadyLocked()
+}
+
+// Same as skipJob, but must be called with depsMu held.
+func (p *Pool) skipJobLocked(job *Job, err error) {
+	job.Err = err
+	job.finished = true
+	job.skipped = true
+
+	p.jobsSkippedMu.Lock()
+	p.JobsSkipped = append(p.JobsSkipped, job)
+	p.jobsSkippedMu.Unlock()
+}
+
+// Records a job that errored without being run. Must be called with depsMu
+// held.
+func (p *Pool) errorJobLocked(job *Job, err error) {
+	job.Err = err
+	job.finished = true
+
+	p.jobsErroredMu.Lock()
+	p.JobsErrored = append(p.JobsErrored, job)
+	p.jobsErroredMu.Unlock()
+}
+
+// Dispatches any pending jobs whose dependencies have all finished
+// successfully, and skips any for which a dependency failed. Must be called
+// with depsMu held.
+func (p *Pool) dispatchReadyLocked() {
+	// Skipping a job may make others that depend on it skippable, so loop
+	// until no more progress is made.
+	for progressed := true; progressed; {
+		progressed = false
+
+		var remaining []*Job
+		for _, j := range p.jobsPending {
+			job := j
+
+			ready, err := dependenciesReady(job)
+			switch {
+			case err != nil:
+				p.skipJobLocked(job, err)
+				p.wg.Done()
+				progressed = true
+
+			case ready:
+				// Sent from a separate Goroutine because this may be called
+				// from a worker, which would deadlock on a full channel.
+				// jobsInternal isn't closed until the WaitGroup is done,
+				// which can't happen before this job is worked.
+				go func() {
+					p.jobsInternal <- job
+				}()
+				progressed = true
+
+			default:
+				remaining = append(remaining, job)
+			}
+		}
+		p.jobsPending = remaining
+	}
+}
+
+// Errors any pending jobs that depend on a job that was never fed into the
+// pool. Called after the feeder finishes when no more jobs can be enqueued.
+func (p *Pool) errorJobsWithUnfedDependencies() {
+	p.depsMu.Lock()
+	defer p.depsMu.Unlock()
+
+	var remaining []*Job
+	for _, job := range p.jobsPending {
+		var unfed *Job
+		for _, dep := range job.Dependencies {
+			if !dep.fed && !dep.finished {
+				unfed = dep
+				break
+			}
+		}
+
+		if unfed == nil {
+			remaining = append(remaining, job)
+			continue
+		}
+
+		p.errorJobLocked(job, xerrors.Errorf("dependency '%s' was never enqueued", unfed.Name))
+		p.wg.Done()
+	}
+	p.jobsPending = remaining
+
+	p.dispatchReadyLocked()
+}
+
+// Feeds a job with dependencies by holding it as pending until its
+// dependencies are finished. Jobs in a dependency cycle can never run, so
+// they're errored immediately.
+func (p *Pool) feedJobWithDependencies(job *Job) {
+	p.depsMu.Lock()
+	defer p.depsMu.Unlock()
+
+	if hasDependencyCycle(job) {
+		p.errorJobLocked(job, xerrors.Errorf("job '%s' has a dependency cycle", job.Name))
+	} else {
+		p.wg.Add(1)
+		p.jobsPending = append(p.jobsPending, job)
+	}
+
+	p.dispatchReadyLocked()
+}
+
 func (p *Pool) setWorkerJobExecuting(workerNum int, job *Job) {
 	p.workerInfos[workerNum].activeJob = job
 	p.workerInfos[workerNum].state = workerStateJobExecuting
 }
 
+// Returns true if all of a job's dependencies have finished successfully, or
+// an error if any of them failed or were skipped, meaning that the job should
+// never run. Must be called with depsMu held.
+func dependenciesReady(job *Job) (bool, error) {
+	for _, dep := range job.Dependencies {
+		if !dep.finished {
+			return false, nil
+		}
+
+		if dep.skipped {
+			if dep.Err != nil {
+				return false, xerrors.Errorf("dependency '%s' was skipped: %w", dep.Name, dep.Err)
+			}
+			return false, xerrors.Errorf("dependency '%s' was skipped", dep.Name)
+		}
+
+		if dep.Err != nil {
+			return false, xerrors.Errorf("dependency '%s' errored: %w", dep.Name, dep.Err)
+		}
+	}
+
+	return true, nil
+}
+
+// Returns true if the job depends on itself through any chain of
+// dependencies.
+func hasDependencyCycle(job *Job) bool {
+	visited := make(map[*Job]struct{})
+
+	var visit func(*Job) bool
+	visit = func(j *Job) bool {
+		for _, dep := range j.Dependencies {
+			if dep == job {
+				return true
+			}
+
+			if _, ok := visited[dep]; ok {
+				continue
+			}
+			visited[dep] = struct{}{}
+
+			if visit(dep) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return visit(job)
+}
+
+// Aggregates statistics for the given jobs by category.
+func statsByCategory(jobs []*Job) map[string]CategoryStats {
+	stats := make(map[string]CategoryStats)
+
+	for _, job := range jobs {
+		categoryStats := stats[job.Category]
+		categoryStats.Duration += job.Duration
+		categoryStats.NumJobs++
+		if job.Executed {
+			categoryStats.NumJobsExecuted++
+		}
+		stats[job.Category] = categoryStats
+	}
+
+	return stats
+}
+
+// Logs a warning for every executed job from the last round whose duration
+// exceeded SlowJobThreshold, starting with the slowest. Note that this sorts
+// JobsExecuted in place.
+func (p *Pool) logSlowJobs() {
+	sortJobsBySlowest(p.JobsExecuted)
+
+	for _, job := range p.JobsExecuted {
+		// Jobs are sorted, so everything after this is faster.
+		if job.Duration <= p.SlowJobThreshold {
+			break
+		}
+
+		p.log.Warnf(
+			p.colorizer.Bold(p.colorizer.Yellow("Slow job:")).String()+
+				" %s (time: %v; threshold: %v)",
+			job.Name, job.Duration.Truncate(100*time.Microsecond), p.SlowJobThreshold)
+	}
+}
+
 // Sorts a slice of jobs with the slowest on top.
 func sortJobsBySlowest(jobs []*Job) {
 	sort.Slice(jobs, func(i, j int) bool {
@@ -425,6 +1020,14 @@ func (p *Pool) workForRound(workerNum int) {
 		// lifetime of the loop. Don't change this.
 		job := j
 
+		// Jobs that were already dispatched when another job failed in fail
+		// fast mode or when the round was canceled are skipped.
+		if p.shouldSkip() {
+			p.skipJob(job, nil)
+			p.wg.Done()
+			continue
+		}
+
 		p.workJob(workerNum, job)
 	}
 
@@ -441,24 +1044,33 @@ func (p *Pool) workJob(workerNum int, job *Job) {
 	// Go (and we rely on the user to make sure these get fixed instead),
 	// but we can at least raise on the interface which job is problematic
 	// to help identify what needs to be fixed.
-	done := make(chan struct{}, 1)
-	go func() {
-		select {
-		case <-time.After(jobSoftTimeout):
-			p.log.Errorf("Job soft timeout (job: '%s')", job.Name)
-		case <-done:
-		}
-	}()
+	var done chan struct{}
+	if p.JobSoftTimeout > 0 {
+		done = make(chan struct{}, 1)
+		go func() {
+			timer := time.NewTimer(p.JobSoftTimeout)
+			defer timer.Stop()
+
+			select {
+			case <-timer.C:
+				p.log.Errorf("Job soft timeout (job: '%s')", job.Name)
+			case <-done:
+			}
+		}()
+	}
 
 	var executed bool
 	var jobErr error
-	start := time.Now()
+	job.StartedAt = time.Now()
+	job.workerNum = workerNum
 
 	defer func() {
-		job.Duration = time.Since(start)
+		job.Duration = time.Since(job.StartedAt)
 
 		// Kill the timeout Goroutine.
-		done <- struct{}{}
+		if done != nil {
+			done <- struct{}{}
+		}
 
 		var panicked bool
 		if r := recover(); r != nil {
@@ -474,17 +1086,47 @@ func (p *Pool) workJob(workerNum int, job *Job) {
 
 		p.setWorkerJobFinished(workerNum, job, executed, jobErr)
 
-		// And set the special panicked worker status if we panicked
-		// because it means that this worker is down and no longer
-		// available.
+		// And set the special panicked worker status if we panicked so that
+		// it shows up in debugging information.
 		//
-		// TODO: It is possible to hit a deadlock if all workers have
-		// panicked and there's still work left to do. The framework should
-		// detect this condition and exit.
+		// Because the panic was recovered above, the worker isn't actually
+		// down. It returns normally to its work loop and picks up the next
+		// job, so even a round in which every job panics can't leave
+		// queued work without workers and deadlock Wait.
 		if panicked {
 			p.workerInfos[workerNum].state = workerStatePanicked
 		}
 	}()
 
-	executed, jobErr = job.F()
+	ctx := job.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for attempt := 1; ; attempt++ {
+		if job.FWithContext != nil {
+			executed, jobErr = job.FWithContext(ctx)
+		} else {
+			executed, jobErr = job.F()
+		}
+
+		if jobErr == nil || attempt > job.MaxRetries {
+			break
+		}
+
+		p.workerInfos[workerNum].numJobsRetried++
+		p.log.Infof("Retrying job '%s' after error (retry %v of %v): %v",
+			job.Name, attempt, job.MaxRetries, jobErr)
+
+		if job.RetryBackoff != nil {
+			select {
+			case <-time.After(job.RetryBackoff(attempt)):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// Only the final attempt is reflected in the job's duration.
+		job.StartedAt = time.Now()
+	}
 }
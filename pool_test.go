@@ -1,7 +1,15 @@
 package modulir
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/require"
 	"golang.org/x/xerrors"
@@ -69,6 +77,178 @@ func TestWithLargeNonWork(t *testing.T) {
 	}
 }
 
+func TestStatsByCategory(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+	newJob := func(category string, executed bool) *Job {
+		job := NewJob("job", func() (bool, error) { return executed, nil })
+		job.Category = category
+		return job
+	}
+
+	p.StartRound(0)
+	p.Jobs <- newJob("images", true)
+	p.Jobs <- newJob("images", true)
+	p.Jobs <- newJob("images", false)
+	p.Jobs <- newJob("templates", true)
+	p.Jobs <- newJob("", false)
+	p.Wait()
+
+	stats := p.StatsByCategory()
+	assert.Equal(t, 3, len(stats))
+
+	assert.Equal(t, 3, stats["images"].NumJobs)
+	assert.Equal(t, 2, stats["images"].NumJobsExecuted)
+	assert.Equal(t, 1, stats["templates"].NumJobs)
+	assert.Equal(t, 1, stats["templates"].NumJobsExecuted)
+	assert.Equal(t, 1, stats[""].NumJobs)
+	assert.Equal(t, 0, stats[""].NumJobsExecuted)
+
+	var imagesDuration time.Duration
+	for _, job := range p.JobsAll {
+		if job.Category == "images" {
+			imagesDuration += job.Duration
+		}
+	}
+	assert.Equal(t, imagesDuration, stats["images"].Duration)
+
+	p.LogStatsByCategory()
+}
+
+func TestSubmitFunc(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+	p.StartRound(0)
+	r0 := SubmitFunc(p, "job 0", func() (bool, string, error) { return true, "value", nil })
+	r1 := SubmitFunc(p, "job 1", func() (bool, int, error) { return true, 1, xerrors.Errorf("error") })
+	assert.False(t, p.Wait())
+
+	assert.Equal(t, "value", r0.Value)
+	assert.True(t, r0.Job.Executed)
+	assert.Nil(t, r0.Job.Err)
+
+	// Values from errored jobs aren't captured.
+	assert.Equal(t, 0, r1.Value)
+	assert.Equal(t, []*Job{r1.Job}, p.JobsErrored)
+}
+
+func TestWithDependencies(t *testing.T) {
+	t.Run("RunsAfterDependencies", func(t *testing.T) {
+		p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+		var mu sync.Mutex
+		var order []string
+		newJob := func(name string, deps ...*Job) *Job {
+			job := NewJob(name, func() (bool, error) {
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				return true, nil
+			})
+			job.Dependencies = deps
+			return job
+		}
+
+		articles := []*Job{newJob("article 0"), newJob("article 1"), newJob("article 2")}
+		index := newJob("index", articles...)
+		tag := newJob("tag", index)
+
+		p.StartRound(0)
+
+		// Enqueued in reverse to make sure order comes from dependencies.
+		p.Jobs <- tag
+		p.Jobs <- index
+		for _, article := range articles {
+			p.Jobs <- article
+		}
+		assert.True(t, p.Wait())
+
+		assert.Equal(t, 5, len(p.JobsExecuted))
+		assert.Equal(t, []string{"index", "tag"}, order[3:])
+	})
+
+	t.Run("DependencyErrored", func(t *testing.T) {
+		p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+		dep := NewJob("dep", func() (bool, error) { return true, xerrors.Errorf("error") })
+		job := NewJob("job", func() (bool, error) { return true, nil })
+		job.Dependencies = []*Job{dep}
+		dependent := NewJob("dependent", func() (bool, error) { return true, nil })
+		dependent.Dependencies = []*Job{job}
+
+		p.StartRound(0)
+		p.Jobs <- dependent
+		p.Jobs <- job
+		p.Jobs <- dep
+		assert.False(t, p.Wait())
+
+		assert.Equal(t, []*Job{dep}, p.JobsErrored)
+		assert.ElementsMatch(t, []*Job{job, dependent}, p.JobsSkipped)
+		assert.False(t, job.Executed)
+		assert.Equal(t, "dependency 'dep' errored: error", job.Err.Error())
+		assert.ErrorIs(t, dependent.Err, dep.Err)
+	})
+
+	t.Run("Cycle", func(t *testing.T) {
+		p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+		j0 := NewJob("job 0", func() (bool, error) { return true, nil })
+		j1 := NewJob("job 1", func() (bool, error) { return true, nil })
+		j0.Dependencies = []*Job{j1}
+		j1.Dependencies = []*Job{j0}
+
+		p.StartRound(0)
+		p.Jobs <- j0
+		p.Jobs <- j1
+		assert.False(t, p.Wait())
+
+		assert.ElementsMatch(t, []*Job{j0, j1}, p.JobsErrored)
+		assert.Equal(t, "job 'job 0' has a dependency cycle", j0.Err.Error())
+		assert.Equal(t, 0, len(p.JobsExecuted))
+	})
+
+	t.Run("DependencyNeverEnqueued", func(t *testing.T) {
+		p := NewPool(&Logger{Level: LevelDebug}, 10)
+
+		dep := NewJob("dep", func() (bool, error) { return true, nil })
+		job := NewJob("job", func() (bool, error) { return true, nil })
+		job.Dependencies = []*Job{dep}
+
+		p.StartRound(0)
+		p.Jobs <- job
+		assert.False(t, p.Wait())
+
+		assert.Equal(t, []*Job{job}, p.JobsErrored)
+		assert.Equal(t, "dependency 'dep' was never enqueued", job.Err.Error())
+	})
+}
+
+func TestWithJobsBufferSize(t *testing.T) {
+	for _, bufferSize := range []int{1, 5000} {
+		p := NewPool(&Logger{Level: LevelDebug}, 10)
+		p.JobsBufferSize = bufferSize
+
+		numJobs := 2000
+
+		p.StartRound(0)
+		assert.Equal(t, bufferSize, cap(p.Jobs))
+		for i := 0; i < numJobs; i++ {
+			p.Jobs <- NewJob("job", func() (bool, error) { return true, nil })
+		}
+		p.Wait()
+
+		assert.Equal(t, numJobs, len(p.JobsAll))
+		assert.Equal(t, numJobs, len(p.JobsExecuted))
+	}
+
+	// Falls back to a default when unset.
+	p := NewPool(&Logger{Level: LevelDebug}, 10)
+	p.StartRound(0)
+	assert.Equal(t, defaultJobsBufferSize, cap(p.Jobs))
+	p.Wait()
+}
+
 func TestWithError(t *testing.T) {
 	p := NewPool(&Logger{Level: LevelDebug}, 10)
 
@@ -96,6 +276,134 @@ func TestWithError(t *testing.T) {
 	assert.Equal(t, "error", j2.Err.Error())
 }
 
+func TestWithErrorFailFast(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+	p.FailFast = true
+
+	for i := 0; i < 2; i++ {
+		p.StartRound(i)
+		j0 := NewJob("job 0", func() (bool, error) { return true, xerrors.Errorf("error") })
+		p.Jobs <- j0
+
+		var numRun int32
+		for j := 0; j < 10; j++ {
+			p.Jobs <- NewJob("job", func() (bool, error) {
+				atomic.AddInt32(&numRun, 1)
+				return true, nil
+			})
+		}
+		assert.False(t, p.Wait())
+
+		// Jobs after the error didn't run, but the round after starts fresh.
+		assert.Equal(t, int32(0), atomic.LoadInt32(&numRun))
+		assert.Equal(t, 11, len(p.JobsAll))
+		assert.Equal(t, []*Job{j0}, p.JobsErrored)
+		assert.Equal(t, []*Job{j0}, p.JobsExecuted)
+		assert.Equal(t, 10, len(p.JobsSkipped))
+		for _, job := range p.JobsSkipped {
+			assert.False(t, job.Executed)
+			assert.Nil(t, job.Err)
+		}
+	}
+}
+
+func TestWithContextCanceled(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p.StartRoundWithContext(ctx, 0)
+
+	started := make(chan struct{})
+	j0 := NewJobWithContext("job 0", func(ctx context.Context) (bool, error) {
+		close(started)
+		<-ctx.Done()
+		return false, ctx.Err()
+	})
+	p.Jobs <- j0
+
+	var numRun int32
+	for i := 0; i < 10; i++ {
+		p.Jobs <- NewJob("job", func() (bool, error) {
+			atomic.AddInt32(&numRun, 1)
+			return true, nil
+		})
+	}
+
+	<-started
+	cancel()
+
+	assert.False(t, p.Wait())
+
+	// The in-flight job saw the cancellation, and queued jobs were skipped.
+	assert.Equal(t, []*Job{j0}, p.JobsErrored)
+	assert.ErrorIs(t, j0.Err, context.Canceled)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&numRun))
+	assert.Equal(t, 10, len(p.JobsSkipped))
+
+	// A new round with a fresh context runs jobs normally.
+	p.StartRound(1)
+	j1 := NewJobWithContext("job 1", func(ctx context.Context) (bool, error) {
+		return true, ctx.Err()
+	})
+	p.Jobs <- j1
+	assert.True(t, p.Wait())
+	assert.Equal(t, []*Job{j1}, p.JobsExecuted)
+}
+
+func TestWithSlowJobThreshold(t *testing.T) {
+	var b bytes.Buffer
+	p := NewPool(&Logger{Level: LevelWarn, stderrOverride: &b}, 2)
+	p.SlowJobThreshold = 50 * time.Millisecond
+
+	p.StartRound(0)
+	p.Jobs <- NewJob("fast job", func() (bool, error) { return true, nil })
+	p.Jobs <- NewJob("slow job", func() (bool, error) {
+		time.Sleep(100 * time.Millisecond)
+		return true, nil
+	})
+	assert.True(t, p.Wait())
+
+	assert.Contains(t, b.String(), "Slow job: slow job")
+	assert.NotContains(t, b.String(), "fast job")
+}
+
+func TestWriteTraceJSON(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 2)
+
+	p.StartRound(0)
+	p.Jobs <- NewJob("job 0", func() (bool, error) { return true, nil })
+	p.Jobs <- NewJob("job 1", func() (bool, error) { return true, nil })
+	p.Jobs <- NewJob("job 2", func() (bool, error) { return false, xerrors.Errorf("error") })
+	p.Wait()
+
+	var b bytes.Buffer
+	err := p.WriteTraceJSON(&b)
+	assert.NoError(t, err)
+
+	var trace traceFile
+	err = json.Unmarshal(b.Bytes(), &trace)
+	assert.NoError(t, err)
+
+	names := make([]string, len(trace.TraceEvents))
+	for i, event := range trace.TraceEvents {
+		names[i] = event.Name
+
+		assert.Equal(t, "X", event.Phase)
+		assert.GreaterOrEqual(t, event.Timestamp, int64(0))
+		assert.Contains(t, []int{0, 1}, event.ThreadID)
+	}
+	sort.Strings(names)
+
+	assert.Equal(t, []string{"job 0", "job 1", "job 2"}, names)
+
+	// WriteTrace is an alias kept for compatibility.
+	var legacy bytes.Buffer
+	assert.NoError(t, p.WriteTrace(&legacy))
+	assert.Equal(t, b.String(), legacy.String())
+}
+
 func TestWorkJob(t *testing.T) {
 	p := NewPool(&Logger{Level: LevelDebug}, 1)
 
@@ -145,6 +453,82 @@ func TestWorkJob_Error(t *testing.T) {
 	assert.Equal(t, "error", j.Err.Error())
 }
 
+func TestWorkJob_SoftTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Millisecond} {
+		log := &errorRecordingLogger{Logger: Logger{Level: LevelDebug}}
+		p := NewPool(log, 1)
+		p.JobSoftTimeout = timeout
+
+		j := NewJob("slow job", func() (bool, error) {
+			time.Sleep(20 * time.Millisecond)
+			return true, nil
+		})
+
+		p.wg.Add(1)
+		p.workJob(0, j)
+
+		if timeout == 0 {
+			assert.Equal(t, []string(nil), log.errors())
+		} else {
+			assert.Equal(t, []string{"Job soft timeout (job: 'slow job')"}, log.errors())
+		}
+	}
+}
+
+func TestWorkJob_Retry(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	var attempts []int
+	var backoffs []int
+	j := &Job{
+		F: func() (bool, error) {
+			attempts = append(attempts, len(attempts)+1)
+			if len(attempts) < 3 {
+				return false, xerrors.Errorf("error %v", len(attempts))
+			}
+			return true, nil
+		},
+		MaxRetries: 3,
+		Name:       "TestJob",
+		RetryBackoff: func(attempt int) time.Duration {
+			backoffs = append(backoffs, attempt)
+			return time.Millisecond
+		},
+	}
+
+	p.wg.Add(1)
+	p.workJob(0, j)
+
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+	assert.Equal(t, []int{1, 2}, backoffs)
+	assert.Equal(t, 2, p.workerInfos[0].numJobsRetried)
+	assert.Equal(t, 0, len(p.JobsErrored))
+	assert.Equal(t, true, j.Executed)
+	assert.Equal(t, nil, j.Err)
+}
+
+func TestWorkJob_RetryExhausted(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 1)
+
+	numAttempts := 0
+	j := &Job{
+		F: func() (bool, error) {
+			numAttempts++
+			return true, xerrors.Errorf("error %v", numAttempts)
+		},
+		MaxRetries: 2,
+		Name:       "TestJob",
+	}
+
+	p.wg.Add(1)
+	p.workJob(0, j)
+
+	// The error from the final attempt is the one recorded.
+	assert.Equal(t, 3, numAttempts)
+	assert.Equal(t, 1, len(p.JobsErrored))
+	assert.Equal(t, "error 3", j.Err.Error())
+}
+
 func TestWorkJob_Panic(t *testing.T) {
 	p := NewPool(&Logger{Level: LevelDebug}, 1)
 
@@ -172,6 +556,36 @@ func TestWorkJob_Panic(t *testing.T) {
 	assert.Equal(t, "job panicked: error", j.Err.Error())
 }
 
+// Makes sure that a round where every job panics doesn't leave work queued
+// with no workers left to do it.
+func TestWithAllJobsPanicking(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 2)
+
+	numJobs := 10
+
+	p.StartRound(0)
+	for i := 0; i < numJobs; i++ {
+		p.Jobs <- NewJob("job", func() (bool, error) { panic("panicked") })
+	}
+
+	waitDone := make(chan bool)
+	go func() {
+		waitDone <- p.Wait()
+	}()
+
+	select {
+	case success := <-waitDone:
+		assert.False(t, success)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "Wait didn't return after all jobs panicked")
+	}
+
+	assert.Equal(t, numJobs, len(p.JobsErrored))
+	for _, job := range p.JobsErrored {
+		assert.Equal(t, "job panicked: panicked", job.Err.Error())
+	}
+}
+
 func TestWorkJob_PanicString(t *testing.T) {
 	p := NewPool(&Logger{Level: LevelDebug}, 1)
 
@@ -204,3 +618,26 @@ func errorStrings(errs []error) []string {
 	}
 	return strs
 }
+
+// A logger that records error messages so that tests can make assertions
+// against them.
+type errorRecordingLogger struct {
+	Logger
+
+	messages []string
+	mu       sync.Mutex
+}
+
+func (l *errorRecordingLogger) Errorf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *errorRecordingLogger) errors() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.messages
+}
@@ -0,0 +1,174 @@
+package modulir
+
+import (
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Public
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Stream delivers items produced by jobs (like rendered articles) to
+// subscribers as each one finishes. It's intended for aggregate outputs like
+// feeds, sitemaps, and search indexes, which depend on a full list of content
+// and would otherwise have to wait for all of it to render before starting.
+// Instead, they can be built incrementally alongside rendering, leaving only
+// a quick finalization step after the pool's Wait.
+//
+// Each subscriber receives items on its own Goroutine, so different
+// subscribers run concurrently with each other, but calls to any one
+// subscriber are serialized and it doesn't need its own synchronization.
+// Items arrive in the order that jobs finish, which isn't deterministic, so
+// subscribers whose output is ordered should sort it when finalizing.
+//
+// A stream is used for a single round: subscribers are added with Subscribe,
+// items are sent with Send (or SubmitToStream) from jobs, and Close is called
+// after the pool's Wait to finalize subscribers.
+type Stream[T any] struct {
+	closed      bool
+	mu          sync.RWMutex
+	subscribers []*streamSubscriber[T]
+}
+
+// NewStream initializes and returns a new Stream.
+func NewStream[T any]() *Stream[T] {
+	return &Stream[T]{}
+}
+
+// Close signals that no more items will be sent, waits for subscribers to
+// receive all the items sent so far, and then finalizes them. It returns the
+// error of the first subscriber that failed, if any.
+func (s *Stream[T]) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		panic("Close called on a closed Stream")
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	for _, sub := range s.subscribers {
+		close(sub.items)
+	}
+
+	var firstErr error
+	for _, sub := range s.subscribers {
+		<-sub.done
+
+		if sub.err != nil && firstErr == nil {
+			firstErr = xerrors.Errorf("error in stream subscriber '%s': %w", sub.name, sub.err)
+		}
+	}
+
+	return firstErr
+}
+
+// Send delivers an item to every subscriber. It's safe to call from multiple
+// jobs concurrently. It only blocks if a subscriber has fallen far behind.
+func (s *Stream[T]) Send(item T) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		panic("Send called on a closed Stream")
+	}
+
+	for _, sub := range s.subscribers {
+		sub.items <- item
+	}
+}
+
+// Subscribe adds a subscriber with the given name, which is used in errors.
+// add is called with each item sent to the stream and finalize is called once
+// after the last item during Close, either of which may be nil.
+//
+// If add returns an error, the subscriber stops receiving items and its
+// finalize isn't called. The error is returned from Close.
+//
+// Subscribers should be added before any items are sent.
+func (s *Stream[T]) Subscribe(name string, add func(item T) error, finalize func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		panic("Subscribe called on a closed Stream")
+	}
+
+	sub := &streamSubscriber[T]{
+		add:      add,
+		done:     make(chan struct{}),
+		finalize: finalize,
+		items:    make(chan T, defaultStreamBufferSize),
+		name:     name,
+	}
+	s.subscribers = append(s.subscribers, sub)
+
+	go sub.run()
+}
+
+// SubmitToStream enqueues a job to the given pool that computes a value like
+// SubmitFunc, and sends the value to the given stream if the job succeeds.
+//
+// The pool must have a round started.
+func SubmitToStream[T any](p *Pool, s *Stream[T], name string, f func() (bool, T, error)) *Result[T] {
+	return SubmitFunc(p, name, func() (bool, T, error) {
+		executed, value, err := f()
+		if err != nil {
+			return executed, value, err
+		}
+
+		s.Send(value)
+		return executed, value, nil
+	})
+}
+
+//////////////////////////////////////////////////////////////////////////////
+//
+//
+//
+// Private
+//
+//
+//
+//////////////////////////////////////////////////////////////////////////////
+
+// Buffer size of each stream subscriber's channel, which lets senders keep
+// going while a subscriber is busy with a previous item.
+const defaultStreamBufferSize = 100
+
+// A single subscriber to a Stream along with the channel over which it
+// receives items.
+type streamSubscriber[T any] struct {
+	add      func(item T) error
+	done     chan struct{}
+	err      error
+	finalize func() error
+	items    chan T
+	name     string
+}
+
+// Receives items until the subscriber's channel is closed, then finalizes.
+// Items received after an error are drained so that senders don't block.
+func (sub *streamSubscriber[T]) run() {
+	defer close(sub.done)
+
+	for item := range sub.items {
+		if sub.err != nil || sub.add == nil {
+			continue
+		}
+
+		sub.err = sub.add(item)
+	}
+
+	if sub.err == nil && sub.finalize != nil {
+		sub.err = sub.finalize()
+	}
+}
@@ -0,0 +1,99 @@
+package modulir
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestStream(t *testing.T) {
+	p := NewPool(&Logger{Level: LevelDebug}, 10)
+	s := NewStream[string]()
+
+	// A feed that's built as articles are rendered, and sorted at the end.
+	var feed []string
+	var feedFinal string
+	firstReceived := make(chan struct{})
+	s.Subscribe("feed", func(item string) error {
+		if len(feed) == 0 {
+			close(firstReceived)
+		}
+		feed = append(feed, item)
+		return nil
+	}, func() error {
+		sort.Strings(feed)
+		feedFinal = strings.Join(feed, ",")
+		return nil
+	})
+
+	// Subscribers run independently of each other.
+	var sitemapCount int
+	s.Subscribe("sitemap", func(item string) error {
+		sitemapCount++
+		return nil
+	}, nil)
+
+	p.StartRound(0)
+
+	r0 := SubmitToStream(p, s, "article 0", func() (bool, string, error) {
+		return true, "article 0", nil
+	})
+
+	// This job doesn't finish until the feed has received the first article,
+	// which shows that aggregation happens while other jobs are still running.
+	SubmitToStream(p, s, "article 1", func() (bool, string, error) {
+		select {
+		case <-firstReceived:
+		case <-time.After(5 * time.Second):
+			return true, "", xerrors.Errorf("timed out waiting for feed")
+		}
+		return true, "article 1", nil
+	})
+
+	// Values from errored jobs aren't sent.
+	SubmitToStream(p, s, "article 2", func() (bool, string, error) {
+		return true, "article 2", xerrors.Errorf("error")
+	})
+
+	assert.False(t, p.Wait())
+	assert.Equal(t, 1, len(p.JobsErrored))
+	assert.Equal(t, "article 0", r0.Value)
+
+	assert.NoError(t, s.Close())
+	assert.Equal(t, "article 0,article 1", feedFinal)
+	assert.Equal(t, 2, sitemapCount)
+
+	assert.PanicsWithValue(t, "Send called on a closed Stream", func() { s.Send("article 3") })
+}
+
+func TestStream_Error(t *testing.T) {
+	s := NewStream[int]()
+
+	var finalized bool
+	var received []int
+	s.Subscribe("search index", func(item int) error {
+		received = append(received, item)
+		if item == 1 {
+			return xerrors.Errorf("bad item")
+		}
+		return nil
+	}, func() error {
+		finalized = true
+		return nil
+	})
+
+	for i := 0; i < 3; i++ {
+		s.Send(i)
+	}
+
+	assert.EqualError(t, s.Close(), "error in stream subscriber 'search index': bad item")
+
+	// The subscriber stops receiving items after an error, and isn't
+	// finalized.
+	assert.Equal(t, []int{0, 1}, received)
+	assert.False(t, finalized)
+}
@@ -1,11 +1,18 @@
 package modulir
 
 import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"golang.org/x/sys/unix"
+	"golang.org/x/xerrors"
 )
 
 //////////////////////////////////////////////////////////////////////////////
@@ -18,18 +25,37 @@ import (
 //
 //////////////////////////////////////////////////////////////////////////////
 
+// WatchEvent is a change to a file detected by the watcher. See
+// Context.WatchEvents.
+type WatchEvent struct {
+	// Op is the operation that triggered the event (e.g. fsnotify.Write).
+	Op fsnotify.Op
+
+	// Path is the path of the file that changed.
+	Path string
+}
+
 // Listens for file system changes from fsnotify and pushes relevant ones back
 // out over the rebuild channel.
 //
 // It doesn't start listening to fsnotify again until the main loop has
 // signaled rebuildDone, so there is a possibility that in the case of very
 // fast consecutive changes the build might not be perfectly up to date.
+//
+// While rebuilds are paused (see the context's rebuildPauser), changes are
+// accumulated instead of being pushed out, and are all sent as a single
+// rebuild once rebuilds are resumed.
 func watchChanges(c *Context, watchEvents chan fsnotify.Event, watchErrors chan error,
 	rebuild chan map[string]struct{}, rebuildDone chan struct{},
 ) {
 	var changedSources, lastChangedSources map[string]struct{}
 	var lastRebuild time.Time
 
+	ignorer, err := newWatchIgnorer(c)
+	if err != nil {
+		c.Log.Errorf("Error reading watch ignore patterns: %v", err)
+	}
+
 	for {
 		select {
 		case event, ok := <-watchEvents:
@@ -42,104 +68,136 @@ func watchChanges(c *Context, watchEvents chan fsnotify.Event, watchErrors chan
 			lastChangedSources = changedSources
 			changedSources = map[string]struct{}{event.Name: {}}
 
-			if !shouldRebuild(event.Name, event.Op) {
+			if !shouldRebuild(event.Name, event.Op, ignorer) {
 				continue
 			}
 
-			// The central purpose of this loop is to make sure we do as few
-			// build loops given incoming changes as possible.
-			//
-			// On the first receipt of a rebuild-eligible event we start
-			// rebuilding immediately, and during the rebuild we accumulate any
-			// other rebuild-eligible changes that stream in. When the initial
-			// build finishes, we loop and start a new one if there were
-			// changes since. If not, we return to the outer loop and continue
-			// watching for fsnotify events.
-			//
-			// If changes did come in, the inner for loop continues to work --
-			// triggering builds and accumulating changes while they're running
-			// -- until we're able to successfully execute a build loop without
-			// seeing a new change.
-			//
-			// The overwhelmingly common case will be few files being changed,
-			// and therefore the inner for almost never needs to loop.
-			for {
-				if len(changedSources) < 1 {
-					break
-				}
+			c.watchEventSubscribers.publish(WatchEvent{Op: event.Op, Path: event.Name})
 
-				// If the detect changes are identical to the last set of
-				// changes we just processed and we're within a certain quiesce
-				// time, *don't* trigger another rebuild and just go back to
-				// steady state.
-				//
-				// This is to protect against a problem where for a single save
-				// operation, the watcher occasionally picks up a number of
-				// events on the same file in quick succession, but not *so*
-				// quick that the build can't finish before the next one comes
-				// in. The faster the build, the more often this is a problem.
-				//
-				// I'm not sure why this occurs, but protect against it.
-				if buildWithinSameFileQuiesce(lastRebuild, time.Now(), changedSources, lastChangedSources) {
-					c.Log.Infof("Identical file(s) %v changed within quiesce time; not rebuilding",
-						mapKeys(changedSources))
-					break
-				}
+			if event.Op&fsnotify.Create != 0 {
+				c.watchCreatedDir(event.Name)
+			}
 
-				lastRebuild = time.Now()
-
-				// Start rebuild
-				rebuild <- changedSources
-
-				// Zero out the set of changes and start accumulating.
-				//
-				// Keep a pointer to it so that we can compare it to any new
-				// set of changes.
-				lastChangedSources = changedSources
-				changedSources = nil
-
-				// Wait until rebuild is finished. In the meantime, accumulate
-				// new events that come in on the watcher's channel and prepare
-				// for the next loop.
-			innerLoop:
-				for {
-					select {
-					case <-rebuildDone:
-						// Break and start next outer loop
-						break innerLoop
-
-					case event, ok := <-watchEvents:
-						if !ok {
-							c.Log.Infof("Watcher detected closed channel; stopping")
-							return
-						}
-
-						if !shouldRebuild(event.Name, event.Op) {
-							continue
-						}
-
-						if changedSources == nil {
-							changedSources = make(map[string]struct{})
-						}
-
-						changedSources[event.Name] = struct{}{}
-
-					case err, ok := <-watchErrors:
-						if !ok {
-							c.Log.Infof("Watcher detected closed channel; stopping")
-							return
-						}
-						c.Log.Errorf("Error from watcher:", err)
-					}
-				}
+			if c.rebuildPauser.addIfPaused(event.Name) {
+				c.Log.Infof("Rebuilds paused; deferring change on %v", event.Name)
+				continue
+			}
+
+		case <-c.rebuildPauser.resumed:
+			pausedSources := c.rebuildPauser.takePending()
+			if len(pausedSources) < 1 {
+				continue
 			}
 
+			c.Log.Infof("Rebuilding for %v change(s) made while paused", len(pausedSources))
+			lastChangedSources = changedSources
+			changedSources = pausedSources
+
 		case err, ok := <-watchErrors:
 			if !ok {
 				c.Log.Infof("Watcher detected closed channel; stopping")
 				return
 			}
 			c.Log.Errorf("Error from watcher:", err)
+			continue
+		}
+
+		// The central purpose of this loop is to make sure we do as few
+		// build loops given incoming changes as possible.
+		//
+		// On the first receipt of a rebuild-eligible event we start
+		// rebuilding immediately, and during the rebuild we accumulate any
+		// other rebuild-eligible changes that stream in. When the initial
+		// build finishes, we loop and start a new one if there were
+		// changes since. If not, we return to the outer loop and continue
+		// watching for fsnotify events.
+		//
+		// If changes did come in, the inner for loop continues to work --
+		// triggering builds and accumulating changes while they're running
+		// -- until we're able to successfully execute a build loop without
+		// seeing a new change.
+		//
+		// The overwhelmingly common case will be few files being changed,
+		// and therefore the inner for almost never needs to loop.
+		for {
+			if len(changedSources) < 1 {
+				break
+			}
+
+			// If the detect changes are identical to the last set of
+			// changes we just processed and we're within a certain quiesce
+			// time, *don't* trigger another rebuild and just go back to
+			// steady state.
+			//
+			// This is to protect against a problem where for a single save
+			// operation, the watcher occasionally picks up a number of
+			// events on the same file in quick succession, but not *so*
+			// quick that the build can't finish before the next one comes
+			// in. The faster the build, the more often this is a problem.
+			//
+			// I'm not sure why this occurs, but protect against it.
+			if buildWithinSameFileQuiesce(lastRebuild, time.Now(), changedSources, lastChangedSources) {
+				c.Log.Infof("Identical file(s) %v changed within quiesce time; not rebuilding",
+					mapKeys(changedSources))
+				break
+			}
+
+			lastRebuild = time.Now()
+
+			// Start rebuild
+			rebuild <- changedSources
+
+			// Zero out the set of changes and start accumulating.
+			//
+			// Keep a pointer to it so that we can compare it to any new
+			// set of changes.
+			lastChangedSources = changedSources
+			changedSources = nil
+
+			// Wait until rebuild is finished. In the meantime, accumulate
+			// new events that come in on the watcher's channel and prepare
+			// for the next loop.
+		innerLoop:
+			for {
+				select {
+				case <-rebuildDone:
+					// Break and start next outer loop
+					break innerLoop
+
+				case event, ok := <-watchEvents:
+					if !ok {
+						c.Log.Infof("Watcher detected closed channel; stopping")
+						return
+					}
+
+					if !shouldRebuild(event.Name, event.Op, ignorer) {
+						continue
+					}
+
+					c.watchEventSubscribers.publish(WatchEvent{Op: event.Op, Path: event.Name})
+
+					if event.Op&fsnotify.Create != 0 {
+						c.watchCreatedDir(event.Name)
+					}
+
+					if c.rebuildPauser.addIfPaused(event.Name) {
+						continue
+					}
+
+					if changedSources == nil {
+						changedSources = make(map[string]struct{})
+					}
+
+					changedSources[event.Name] = struct{}{}
+
+				case err, ok := <-watchErrors:
+					if !ok {
+						c.Log.Infof("Watcher detected closed channel; stopping")
+						return
+					}
+					c.Log.Errorf("Error from watcher:", err)
+				}
+			}
 		}
 	}
 }
@@ -199,8 +257,8 @@ func compareKeys(m1, m2 map[string]struct{}) bool {
 }
 
 // Decides whether a rebuild should be triggered given some input event
-// properties from fsnotify.
-func shouldRebuild(path string, op fsnotify.Op) bool {
+// properties from fsnotify. The ignorer may be nil.
+func shouldRebuild(path string, op fsnotify.Op, ignorer *watchIgnorer) bool {
 	base := filepath.Base(path)
 
 	// Mac OS' worst mistake.
@@ -219,6 +277,10 @@ func shouldRebuild(path string, op fsnotify.Op) bool {
 		return false
 	}
 
+	if ignorer.ignored(path) {
+		return false
+	}
+
 	if op&fsnotify.Create != 0 {
 		return true
 	}
@@ -242,3 +304,349 @@ func shouldRebuild(path string, op fsnotify.Op) bool {
 	//
 	return false
 }
+
+// Tracks whether rebuilds are paused, and while they are, accumulates the
+// paths of changes so that they can all be rebuilt at once when resumed.
+type rebuildPauser struct {
+	// Receives a value when rebuilds are resumed. Buffered so that resuming
+	// never blocks on the watch loop.
+	resumed chan struct{}
+
+	mu      sync.Mutex
+	paused  bool
+	pending map[string]struct{}
+}
+
+func newRebuildPauser() *rebuildPauser {
+	return &rebuildPauser{resumed: make(chan struct{}, 1)}
+}
+
+// Records the given path as changed if rebuilds are paused. Returns true if
+// they were and the path was recorded.
+func (p *rebuildPauser) addIfPaused(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		return false
+	}
+
+	if p.pending == nil {
+		p.pending = make(map[string]struct{})
+	}
+	p.pending[path] = struct{}{}
+
+	return true
+}
+
+// Pauses rebuilds. Returns false if they were already paused.
+func (p *rebuildPauser) pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		return false
+	}
+
+	p.paused = true
+	return true
+}
+
+// Resumes rebuilds, signaling the watch loop over the resumed channel. Returns
+// false if they weren't paused.
+func (p *rebuildPauser) resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		return false
+	}
+
+	p.paused = false
+
+	// Non-blocking because a pending signal that hasn't been picked up yet
+	// will pick up these changes as well.
+	select {
+	case p.resumed <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// Returns and clears the set of paths that changed while rebuilds were paused.
+// Returns nil if rebuilds have been paused again in the meantime, in which
+// case the changes are left to be picked up on the next resume.
+func (p *rebuildPauser) takePending() map[string]struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		return nil
+	}
+
+	pending := p.pending
+	p.pending = nil
+	return pending
+}
+
+// Decides whether changes to paths should be ignored based on the context's
+// WatchIgnore patterns, a `.gitignore` in its SourceDir, and its TargetDir.
+type watchIgnorer struct {
+	patterns  []string
+	sourceDir string // absolute
+	targetDir string // absolute
+}
+
+// Produces a watchIgnorer for the given context. An ignorer is returned even
+// if there's an error reading `.gitignore` so that other patterns still
+// apply.
+func newWatchIgnorer(c *Context) (*watchIgnorer, error) {
+	ignorer := &watchIgnorer{
+		patterns:  append([]string(nil), c.WatchIgnore...),
+		sourceDir: absPath(c.SourceDir),
+		targetDir: absPath(c.TargetDir),
+	}
+
+	patterns, err := readGitignore(filepath.Join(c.SourceDir, ".gitignore"))
+	if err != nil {
+		return ignorer, err
+	}
+
+	ignorer.patterns = append(ignorer.patterns, patterns...)
+	return ignorer, nil
+}
+
+// Returns whether changes to the given path should be ignored.
+func (w *watchIgnorer) ignored(path string) bool {
+	if w == nil {
+		return false
+	}
+
+	path = absPath(path)
+
+	if w.targetDir != "" && (path == w.targetDir ||
+		strings.HasPrefix(path, w.targetDir+string(filepath.Separator))) {
+		return true
+	}
+
+	relPath, err := filepath.Rel(w.sourceDir, path)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		// Outside of the source directory, so only the base name is
+		// considered.
+		relPath = filepath.Base(path)
+	}
+
+	elems := strings.Split(filepath.ToSlash(relPath), "/")
+
+	for _, pattern := range w.patterns {
+		if strings.Contains(pattern, "/") {
+			pattern = strings.TrimPrefix(pattern, "/")
+
+			// Also match against parent directories so that everything
+			// beneath an ignored directory is ignored too.
+			for i := len(elems); i > 0; i-- {
+				if ok, _ := filepath.Match(pattern, strings.Join(elems[:i], "/")); ok {
+					return true
+				}
+			}
+
+			continue
+		}
+
+		for _, elem := range elems {
+			if ok, _ := filepath.Match(pattern, elem); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the absolute version of the given path, or the cleaned path if it
+// can't be made absolute.
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
+
+// Reads glob patterns from a `.gitignore` file. A file that doesn't exist is
+// not an error. Only a subset of the format is supported: comments and blank
+// lines are skipped, negated patterns (`!`) are unsupported and skipped, and
+// trailing slashes (directory-only patterns) are dropped so that the pattern
+// matches any path element.
+func readGitignore(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("error opening gitignore: %w", err)
+	}
+	defer file.Close()
+
+	var patterns []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		line = strings.TrimSuffix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("error reading gitignore: %w", err)
+	}
+
+	return patterns, nil
+}
+
+// The time to wait after the last change to a self-restart path before
+// triggering a restart. Compilers and linkers may write executables over
+// multiple operations, so this gives them a chance to finish.
+const selfRestartQuiesceTime = 500 * time.Millisecond
+
+// Watches the running executable along with any additional paths, and sends
+// a USR2 over the given channel when any of them change, which prompts the
+// build loop to re-exec the process. See Config.SelfRestart.
+//
+// Directories are watched instead of files themselves because executables are
+// often replaced by renaming a new file over the old one, which would drop a
+// watch on the file.
+func watchSelfRestart(c *Context, paths []string, signals chan<- os.Signal) error {
+	execPath, err := os.Executable()
+	if err != nil {
+		return xerrors.Errorf("error getting executable path: %w", err)
+	}
+
+	// Paths that are watched for changes directly, and directories within
+	// which any change triggers a restart.
+	files := map[string]struct{}{absPath(execPath): {}}
+	dirs := make(map[string]struct{})
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return xerrors.Errorf("error checking self-restart path: %w", err)
+		}
+
+		if info.IsDir() {
+			dirs[absPath(path)] = struct{}{}
+		} else {
+			files[absPath(path)] = struct{}{}
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return xerrors.Errorf("error starting watcher: %w", err)
+	}
+
+	watchDirs := make(map[string]struct{})
+	for path := range files {
+		watchDirs[filepath.Dir(path)] = struct{}{}
+	}
+	for path := range dirs {
+		watchDirs[path] = struct{}{}
+	}
+
+	for dir := range watchDirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return xerrors.Errorf("error watching self-restart path '%s': %w", dir, err)
+		}
+	}
+
+	go func() {
+		// Closed here rather than by the caller because the restart replaces
+		// the process without running defers, which would otherwise leak the
+		// watcher's file descriptor.
+		defer watcher.Close()
+
+		// Nil (i.e. blocks forever) until a change is seen.
+		var quiesce <-chan time.Time
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				path := absPath(event.Name)
+				_, isFile := files[path]
+				_, inDir := dirs[filepath.Dir(path)]
+				if !isFile && !(inDir && shouldRebuild(path, event.Op, nil)) {
+					continue
+				}
+
+				c.Log.Debugf("Self-restart path changed: %s", path)
+				quiesce = time.After(selfRestartQuiesceTime)
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				c.Log.Errorf("Error from self-restart watcher: %v", err)
+
+			case <-quiesce:
+				c.Log.Infof("Detected change to executable or self-restart paths; restarting")
+				signals <- unix.SIGUSR2
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// The buffer size of each channel returned by Context.WatchEvents.
+const watchEventsBufferSize = 100
+
+// Channels subscribed to watch events with Context.WatchEvents.
+type watchEventSubscribers struct {
+	mu    sync.RWMutex
+	chans []chan WatchEvent
+}
+
+// Sends an event to every subscriber without blocking. Events are dropped for
+// subscribers whose buffers are full.
+func (s *watchEventSubscribers) publish(event WatchEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, ch := range s.chans {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Adds and returns a new subscriber channel.
+func (s *watchEventSubscribers) subscribe() chan WatchEvent {
+	ch := make(chan WatchEvent, watchEventsBufferSize)
+
+	s.mu.Lock()
+	s.chans = append(s.chans, ch)
+	s.mu.Unlock()
+
+	return ch
+}
@@ -1,11 +1,14 @@
 package modulir
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	assert "github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 func TestBuildWithinSameFileQuiesce(t *testing.T) {
@@ -68,18 +71,53 @@ func TestCompareKeys(t *testing.T) {
 	))
 }
 
+func TestWatchChangesPaused(t *testing.T) {
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+
+	watchEvents := make(chan fsnotify.Event)
+	watchErrors := make(chan error)
+	rebuild := make(chan map[string]struct{})
+	rebuildDone := make(chan struct{})
+
+	go watchChanges(c, watchEvents, watchErrors, rebuild, rebuildDone)
+	defer close(watchEvents)
+
+	assert.True(t, c.rebuildPauser.pause())
+	assert.False(t, c.rebuildPauser.pause())
+
+	watchEvents <- fsnotify.Event{Name: "a/path", Op: fsnotify.Write}
+	watchEvents <- fsnotify.Event{Name: "b/path", Op: fsnotify.Write}
+	watchEvents <- fsnotify.Event{Name: "a/path", Op: fsnotify.Write}
+
+	select {
+	case changed := <-rebuild:
+		assert.FailNow(t, "Unexpected rebuild while paused", "%v", changed)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// All changes made while paused are rebuilt together.
+	assert.True(t, c.rebuildPauser.resume())
+	assert.Equal(t, map[string]struct{}{"a/path": {}, "b/path": {}}, <-rebuild)
+	rebuildDone <- struct{}{}
+
+	// Changes trigger rebuilds right away again after resuming.
+	watchEvents <- fsnotify.Event{Name: "c/path", Op: fsnotify.Write}
+	assert.Equal(t, map[string]struct{}{"c/path": {}}, <-rebuild)
+	rebuildDone <- struct{}{}
+}
+
 func TestShouldRebuild(t *testing.T) {
 	// Most things signal a rebuild
-	assert.Equal(t, true, shouldRebuild("a/path", fsnotify.Create))
-	assert.Equal(t, true, shouldRebuild("a/path", fsnotify.Remove))
-	assert.Equal(t, true, shouldRebuild("a/path", fsnotify.Write))
+	assert.Equal(t, true, shouldRebuild("a/path", fsnotify.Create, nil))
+	assert.Equal(t, true, shouldRebuild("a/path", fsnotify.Remove, nil))
+	assert.Equal(t, true, shouldRebuild("a/path", fsnotify.Write, nil))
 
 	// With just a few special cases that don't
-	assert.Equal(t, false, shouldRebuild("a/path", fsnotify.Chmod))
-	assert.Equal(t, false, shouldRebuild("a/path", fsnotify.Rename))
-	assert.Equal(t, false, shouldRebuild("a/.DS_Store", fsnotify.Create))
-	assert.Equal(t, false, shouldRebuild("a/4913", fsnotify.Create))
-	assert.Equal(t, false, shouldRebuild("a/path~", fsnotify.Create))
+	assert.Equal(t, false, shouldRebuild("a/path", fsnotify.Chmod, nil))
+	assert.Equal(t, false, shouldRebuild("a/path", fsnotify.Rename, nil))
+	assert.Equal(t, false, shouldRebuild("a/.DS_Store", fsnotify.Create, nil))
+	assert.Equal(t, false, shouldRebuild("a/4913", fsnotify.Create, nil))
+	assert.Equal(t, false, shouldRebuild("a/path~", fsnotify.Create, nil))
 }
 
 func TestWatchChanges(t *testing.T) {
@@ -145,3 +183,105 @@ func TestWatchChanges(t *testing.T) {
 func newContext() *Context {
 	return NewContext(&Args{Log: &Logger{Level: LevelInfo}})
 }
+
+func TestWatchEvents(t *testing.T) {
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+	events := c.WatchEvents()
+
+	// Sub-contexts share subscriptions.
+	subEvents := c.Sub("", "").WatchEvents()
+
+	watchEvents := make(chan fsnotify.Event)
+	watchErrors := make(chan error)
+	rebuild := make(chan map[string]struct{})
+	rebuildDone := make(chan struct{})
+
+	go watchChanges(c, watchEvents, watchErrors, rebuild, rebuildDone)
+	defer close(watchEvents)
+
+	// Ignored events aren't sent.
+	watchEvents <- fsnotify.Event{Name: "a/.DS_Store", Op: fsnotify.Write}
+	watchEvents <- fsnotify.Event{Name: "a/path", Op: fsnotify.Write}
+	<-rebuild
+
+	// Events are sent while a rebuild is running too.
+	watchEvents <- fsnotify.Event{Name: "b/path", Op: fsnotify.Create}
+	rebuildDone <- struct{}{}
+	<-rebuild
+	rebuildDone <- struct{}{}
+
+	assert.Equal(t, WatchEvent{Op: fsnotify.Write, Path: "a/path"}, <-events)
+	assert.Equal(t, WatchEvent{Op: fsnotify.Create, Path: "b/path"}, <-events)
+	assert.Equal(t, WatchEvent{Op: fsnotify.Write, Path: "a/path"}, <-subEvents)
+}
+
+func TestWatchIgnorer(t *testing.T) {
+	dir := t.TempDir()
+	sourceDir := filepath.Join(dir, "content")
+	targetDir := filepath.Join(dir, "public")
+
+	assert.NoError(t, os.MkdirAll(sourceDir, 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(sourceDir, ".gitignore"), []byte(`
+# Dependencies
+node_modules/
+!important.log
+/drafts/*.md
+`), 0o600))
+
+	c := NewContext(&Args{
+		Log:         &Logger{Level: LevelInfo},
+		SourceDir:   sourceDir,
+		TargetDir:   targetDir,
+		WatchIgnore: []string{"*.log", ".git"},
+	})
+
+	ignorer, err := newWatchIgnorer(c)
+	assert.NoError(t, err)
+
+	// Matches against the base name.
+	assert.True(t, ignorer.ignored(filepath.Join(sourceDir, "debug.log")))
+	assert.True(t, ignorer.ignored(filepath.Join(sourceDir, "posts", "debug.log")))
+
+	// Matches against any directory in the path relative to the source
+	// directory.
+	assert.True(t, ignorer.ignored(filepath.Join(sourceDir, ".git", "HEAD")))
+	assert.True(t, ignorer.ignored(filepath.Join(sourceDir, "node_modules", "pkg", "index.js")))
+
+	// Matches patterns with slashes against the relative path.
+	assert.True(t, ignorer.ignored(filepath.Join(sourceDir, "drafts", "post.md")))
+	assert.False(t, ignorer.ignored(filepath.Join(sourceDir, "posts", "drafts", "post.md")))
+
+	// Always ignores the target directory.
+	assert.True(t, ignorer.ignored(targetDir))
+	assert.True(t, ignorer.ignored(filepath.Join(targetDir, "index.html")))
+
+	assert.False(t, ignorer.ignored(filepath.Join(sourceDir, "posts", "post.md")))
+	assert.False(t, ignorer.ignored(filepath.Join(dir, "public-other", "index.html")))
+
+	// And is consulted by shouldRebuild.
+	assert.False(t, shouldRebuild(filepath.Join(sourceDir, "debug.log"), fsnotify.Write, ignorer))
+	assert.True(t, shouldRebuild(filepath.Join(sourceDir, "post.md"), fsnotify.Write, ignorer))
+}
+
+func TestWatchSelfRestart(t *testing.T) {
+	c := NewContext(&Args{Log: &Logger{Level: LevelInfo}})
+
+	dir := t.TempDir()
+	signals := make(chan os.Signal, 1)
+
+	err := watchSelfRestart(c, []string{dir}, signals)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "build.go"), []byte("package main"), 0o600))
+
+	select {
+	case s := <-signals:
+		assert.Equal(t, unix.SIGUSR2, s)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "Timed out waiting for restart signal")
+	}
+
+	// Missing paths error.
+	err = watchSelfRestart(c, []string{filepath.Join(dir, "missing")}, signals)
+	assert.Error(t, err)
+}